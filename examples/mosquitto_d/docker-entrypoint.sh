@@ -18,14 +18,15 @@ CKPT_DIR="${DMTCP_CHECKPOINT_DIR:-/dmtcp/checkpoints}"
 # --- MyceDrive Execution Agent handshake -----------------------------------
 # go-agent registers this container with the Migration Coordinator. On a
 # migration target it blocks while receiving the source pod's checkpoints,
-# then execs dmtcp_restart in place: in that case the line below only
-# returns once the RESTORED application exits, and go-agent leaves a
-# ".restored" marker so we must NOT launch a fresh instance afterwards.
+# then supervises dmtcp_restart: in that case the line below only returns
+# once the RESTORED application exits, with its exit code, and go-agent
+# leaves a ".restored" marker so we must NOT launch a fresh instance.
 if [ -x /dmtcp/bin/go-agent ]; then
-	/dmtcp/bin/go-agent "${VOLUME_ROOT_DIR:-}" "${CHECKPOINT_ROUNDS:-1}" || true
+	rc=0
+	/dmtcp/bin/go-agent "${VOLUME_ROOT_DIR:-}" "${CHECKPOINT_ROUNDS:-1}" || rc=$?
 	if [ -f "$CKPT_DIR/.restored" ]; then
-		echo "restored application finished; exiting without fresh launch"
-		exit 0
+		echo "restored application finished (exit $rc); exiting without fresh launch"
+		exit "$rc"
 	fi
 fi
 
@@ -410,16 +410,18 @@ fi
 # go-agent registers this container with the Migration Coordinator. On a
 # migration target it blocks while receiving the source pod's checkpoints
 # (overlay volume layers and/or DMTCP process checkpoints, depending on the
-# ENABLE_VOLUME_MIGRATION / ENABLE_PROCESS_MIGRATION flags) and then execs
-# dmtcp_restart in place: in that case the go-agent call below only returns
-# once the RESTORED application exits, and a ".restored" marker is left in
-# the checkpoint directory so we must NOT launch a fresh instance.
+# ENABLE_VOLUME_MIGRATION / ENABLE_PROCESS_MIGRATION flags) and then
+# supervises dmtcp_restart: in that case the go-agent call below only returns
+# once the RESTORED application exits, with its exit code, and a ".restored"
+# marker is left in the checkpoint directory so we must NOT launch a fresh
+# instance.
 CKPT_DIR="${DMTCP_CHECKPOINT_DIR:-/dmtcp/checkpoints}"
 if [ -x /dmtcp/bin/go-agent ]; then
-	/dmtcp/bin/go-agent "${VOLUME_ROOT_DIR:-$RABBITMQ_DATA_DIR}" "${CHECKPOINT_ROUNDS:-1}" || true
+	rc=0
+	/dmtcp/bin/go-agent "${VOLUME_ROOT_DIR:-$RABBITMQ_DATA_DIR}" "${CHECKPOINT_ROUNDS:-1}" || rc=$?
 	if [ -f "$CKPT_DIR/.restored" ]; then
-		echo "MyceDrive: restored application finished; exiting without fresh launch"
-		exit 0
+		echo "MyceDrive: restored application finished (exit $rc); exiting without fresh launch"
+		exit "$rc"
 	fi
 fi
 
@@ -0,0 +1,177 @@
+package main
+
+// Destination-side handling of an aborted migration.
+//
+// The transfer into a migration target can end without anything to restore:
+// the source aborts it (a KindAbort frame), the MC gives up on the
+// migration (GET /poll names it as abortedMigration, checked every
+// ABORT_POLL_INTERVAL_MS), RECEIVE_TIMEOUT_SECONDS elapses, or the transfer
+// fails otherwise. Instead of exiting into a crash loop the agent applies
+// the abort policy the MC handed out with the workload (ABORT_POLICY when
+// it did not; see utils/abort.go) and reports what it did with
+// POST /aborted:
+//
+//	Fresh       received layers and images are discarded; the volume
+//	            mounts empty and the entrypoint launches the application
+//	KeepVolume  the images are discarded but the volume mounts the layers
+//	            received so far
+//	Fail        the agent exits non-zero, leaving .aborted in the
+//	            checkpoint dir; every restart exits again until someone
+//	            removes it
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-agent/dmtcp"
+	"go-agent/utils"
+)
+
+// defaultAbortPollMS is how often the destination asks the MC whether its
+// migration was aborted (ABORT_POLL_INTERVAL_MS).
+const defaultAbortPollMS = 5000
+
+// abortedMarker is left in the checkpoint directory by the Fail policy; it
+// holds why the migration was aborted.
+func abortedMarker(checkpointDir string) string {
+	return filepath.Join(checkpointDir, ".aborted")
+}
+
+// checkAborted exits when an aborted migration left the Fail policy's
+// marker behind.
+func checkAborted(checkpointDir string) {
+	marker := abortedMarker(checkpointDir)
+	reason, err := os.ReadFile(marker)
+	if err != nil {
+		return
+	}
+	log.Fatalf("the migration into this pod was aborted (%s) and its abort policy is Fail; remove %s to start the application", strings.TrimSpace(string(reason)), marker)
+}
+
+// abortPolicy resolves the destination's abort policy: the MC's, else
+// ABORT_POLICY.
+func abortPolicy(fromMC string) utils.AbortPolicy {
+	policy, err := utils.AbortPolicyFromEnv()
+	if err != nil {
+		log.Printf("%v; using %s", err, policy)
+	}
+	if fromMC == "" {
+		return policy
+	}
+	p, err := utils.ParseAbortPolicy(fromMC)
+	if err != nil {
+		log.Printf("ignoring the abort policy from the MC: %v", err)
+		return policy
+	}
+	return p
+}
+
+// watchAbort polls the MC at coordAddr until it reports migration of
+// podName aborted, then sends the reason on the returned channel. stop ends
+// the polling.
+func watchAbort(coordAddr, podName, migration string) (abort <-chan string, stop func()) {
+	every := time.Duration(utils.EnvInt("ABORT_POLL_INTERVAL_MS", defaultAbortPollMS)) * time.Millisecond
+	pollURL := coordAddr + "/poll?podName=" + url.QueryEscape(podName)
+	ch := make(chan string, 1)
+	quit := make(chan struct{})
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+			}
+			body, err := utils.GetJSON(pollURL)
+			if err != nil {
+				continue // the MC may be restarting; the receive timeout still applies
+			}
+			var resp utils.PollResponse
+			if json.Unmarshal(body, &resp) != nil || resp.AbortedMigration != migration {
+				continue
+			}
+			reason := resp.AbortReason
+			if reason == "" {
+				reason = "the MC aborted the migration"
+			}
+			ch <- reason
+			return
+		}
+	}()
+	return ch, func() { close(quit) }
+}
+
+// abandon applies policy after the transfer of migration into t failed
+// with cause and reports the outcome to the MC. It returns unless the
+// policy is Fail or it could not be applied.
+func (t *target) abandon(coordAddr, podName, migration string, policy utils.AbortPolicy, volMig bool, cause error) {
+	log.Printf("migration %s abandoned: %v; abort policy %s", migration, cause, policy)
+	outcome, err := t.applyAbortPolicy(policy, volMig, cause)
+	if err != nil {
+		outcome = fmt.Sprintf("abort policy %s failed: %v", policy, err)
+	}
+	if _, perr := utils.PostJSONAuth(coordAddr+"/aborted", utils.AbortNotification{
+		PodName:     podName,
+		MigrationID: migration,
+		Reason:      cause.Error(),
+		Policy:      string(policy),
+		Outcome:     outcome,
+	}, t.agentKey); perr != nil {
+		log.Printf("abort not reported to the MC: %v", perr)
+	}
+	if err != nil || policy == utils.AbortFail {
+		log.Fatalf("migration aborted: %v (%s)", cause, outcome)
+	}
+	log.Printf("migration aborted: %s", outcome)
+}
+
+// applyAbortPolicy does what policy says with the state received so far
+// and describes the result.
+func (t *target) applyAbortPolicy(policy utils.AbortPolicy, volMig bool, cause error) (string, error) {
+	if policy == utils.AbortFail {
+		marker := abortedMarker(t.checkpointDir)
+		if err := os.WriteFile(marker, []byte(cause.Error()+"\n"), 0o644); err != nil {
+			return "", fmt.Errorf("write %s: %w", marker, err)
+		}
+		return "the destination keeps failing until " + marker + " is removed", nil
+	}
+
+	// Half a process set cannot be restored: the application starts over.
+	h := dmtcp.NewHandlerFromEnv(t.checkpointDir)
+	images, _ := h.ListCheckpoints()
+	for _, f := range images {
+		if err := os.Remove(f); err != nil {
+			return "", fmt.Errorf("discard checkpoint image: %w", err)
+		}
+	}
+	if err := utils.CleanStaging(t.lm.DataDir, t.checkpointDir); err != nil {
+		return "", err
+	}
+	if !volMig {
+		return "the application started without migrated state", nil
+	}
+	if policy == utils.AbortFresh {
+		if err := t.lm.DropReceivedLayers(); err != nil {
+			return "", err
+		}
+	}
+	layers, err := t.lm.ReceivedLayers()
+	if err != nil {
+		return "", err
+	}
+	if err := mountVolume(t.lm); err != nil {
+		return "", fmt.Errorf("overlay init: %w", err)
+	}
+	startSyncDaemon(t.lm.RootDir, t.agentKey)
+	if len(layers) == 0 {
+		return "the application started without migrated state", nil
+	}
+	return fmt.Sprintf("the application started on %d received volume layer(s) without its process state", len(layers)), nil
+}
@@ -78,8 +78,20 @@ func (h *Handler) coordAddr() string {
 // for completion. It sets State to StateCheckpoint during the operation and
 // StateCheckpointed on success, or StateError on failure.
 func (h *Handler) Checkpoint() error {
+	wait, err := h.StartCheckpoint()
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// StartCheckpoint sends a checkpoint command to the DMTCP coordinator and
+// returns without waiting for the checkpoint; wait blocks until it
+// completed and sets State like Checkpoint does. wait must be called
+// exactly once.
+func (h *Handler) StartCheckpoint() (wait func() error, err error) {
 	if h.State != StateRunning {
-		return fmt.Errorf("cannot checkpoint: handler is in state %d (expected StateRunning)", h.State)
+		return nil, fmt.Errorf("cannot checkpoint: handler is in state %d (expected StateRunning)", h.State)
 	}
 
 	log.Printf("[dmtcp] Requesting checkpoint via coordinator at %s", h.coordAddr())
@@ -93,14 +105,39 @@ func (h *Handler) Checkpoint() error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := cmd.Start(); err != nil {
 		h.State = StateError
-		return fmt.Errorf("dmtcp_command checkpoint failed: %w", err)
+		return nil, fmt.Errorf("dmtcp_command checkpoint failed: %w", err)
 	}
+	return func() error {
+		if err := cmd.Wait(); err != nil {
+			h.State = StateError
+			return fmt.Errorf("dmtcp_command checkpoint failed: %w", err)
+		}
+		h.State = StateCheckpointed
+		log.Printf("[dmtcp] Checkpoint completed, files in %s", h.CheckpointDir)
+		return nil
+	}, nil
+}
 
-	h.State = StateCheckpointed
-	log.Printf("[dmtcp] Checkpoint completed, files in %s", h.CheckpointDir)
-	return nil
+// WritingSince reports whether DMTCP has started writing a checkpoint image
+// in CheckpointDir since t. DMTCP only writes images once every process
+// of the computation is suspended, so from then on the application no
+// longer changes its files.
+func (h *Handler) WritingSince(t time.Time) bool {
+	entries, err := os.ReadDir(h.CheckpointDir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if _, ok := ImageName(e.Name()); !ok {
+			continue
+		}
+		if info, err := e.Info(); err == nil && !info.ModTime().Before(t) {
+			return true
+		}
+	}
+	return false
 }
 
 // Restart launches the application from the latest checkpoint in CheckpointDir.
@@ -178,6 +215,97 @@ func (h *Handler) ExecRestart() error {
 	return nil // unreachable
 }
 
+// StartRestart starts dmtcp_restart for all checkpoints in CheckpointDir as
+// a child of the calling process and returns the running command. Unlike
+// ExecRestart the caller stays alive and can supervise the restored
+// computation; it owns the returned command and must Wait on it.
+func (h *Handler) StartRestart() (*exec.Cmd, error) {
+	argv, err := h.RestartCommand()
+	if err != nil {
+		h.State = StateError
+		return nil, err
+	}
+	log.Printf("[dmtcp] Starting restore: %s", strings.Join(argv, " "))
+	h.State = StateRestoring
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		h.State = StateError
+		return nil, fmt.Errorf("dmtcp_restart failed: %w", err)
+	}
+	return cmd, nil
+}
+
+// CoordinatorStatus queries the coordinator (dmtcp_command -s) and returns
+// the number of connected peers and whether the computation is running.
+func (h *Handler) CoordinatorStatus() (peers int, running bool, err error) {
+	out, err := exec.Command("dmtcp_command",
+		"--coord-host", h.CoordHost,
+		"--coord-port", fmt.Sprintf("%d", h.CoordPort),
+		"-s",
+	).Output()
+	if err != nil {
+		return 0, false, fmt.Errorf("dmtcp_command status failed: %w", err)
+	}
+	return parseCoordinatorStatus(string(out))
+}
+
+// parseCoordinatorStatus extracts NUM_PEERS and RUNNING from dmtcp_command
+// -s output. Other lines (coordinator host/port, checkpoint interval) are
+// ignored.
+func parseCoordinatorStatus(out string) (peers int, running bool, err error) {
+	seen := false
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "NUM_PEERS":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid NUM_PEERS %q: %w", value, err)
+			}
+			peers, seen = n, true
+		case "RUNNING":
+			running = strings.EqualFold(strings.TrimSpace(value), "yes")
+		}
+	}
+	if !seen {
+		return 0, false, fmt.Errorf("no NUM_PEERS in coordinator status")
+	}
+	return peers, running, nil
+}
+
+// WaitForPeers polls the coordinator until at least want peers are
+// connected and the computation is running, or the timeout is exceeded.
+// It returns the last observed peer count. On success State becomes
+// StateRunning.
+func (h *Handler) WaitForPeers(want int, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	peers := 0
+	var lastErr error
+	for time.Now().Before(deadline) {
+		n, running, err := h.CoordinatorStatus()
+		if err == nil {
+			peers = n
+			if running && n >= want {
+				h.State = StateRunning
+				return n, nil
+			}
+		}
+		lastErr = err
+		time.Sleep(500 * time.Millisecond)
+	}
+	if lastErr != nil {
+		return peers, fmt.Errorf("timed out waiting for %d peer(s) at %s: %w", want, h.coordAddr(), lastErr)
+	}
+	return peers, fmt.Errorf("timed out waiting for %d peer(s) at %s (%d connected)", want, h.coordAddr(), peers)
+}
+
 // Launch wraps a command with dmtcp_launch so it is managed by the coordinator.
 // It sets State to StateRunning on success.
 func (h *Handler) Launch(applicationCmd string) error {
@@ -255,6 +383,17 @@ func (h *Handler) latestCheckpointFile() (string, error) {
 	return latest, nil
 }
 
+// ImageName maps the name of a file DMTCP creates in CheckpointDir to the
+// checkpoint image it becomes. Images are written as <image>.temp and
+// renamed into place once complete.
+func ImageName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".temp")
+	if !strings.HasSuffix(name, ".dmtcp") {
+		return "", false
+	}
+	return name, true
+}
+
 // ListCheckpoints returns all checkpoint files in CheckpointDir.
 func (h *Handler) ListCheckpoints() ([]string, error) {
 	pattern := filepath.Join(h.CheckpointDir, "*.dmtcp")
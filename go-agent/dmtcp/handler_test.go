@@ -191,6 +191,26 @@ func TestListCheckpoints_MultipleFiles(t *testing.T) {
 	}
 }
 
+// --- ImageName ---
+
+func TestImageName(t *testing.T) {
+	tests := []struct {
+		name, image string
+		ok          bool
+	}{
+		{"ckpt_app_1a2b.dmtcp", "ckpt_app_1a2b.dmtcp", true},
+		{"ckpt_app_1a2b.dmtcp.temp", "ckpt_app_1a2b.dmtcp", true},
+		{"dmtcp_restart_script.sh", "", false},
+		{"notes.temp", "", false},
+	}
+	for _, tt := range tests {
+		image, ok := ImageName(tt.name)
+		if image != tt.image || ok != tt.ok {
+			t.Errorf("ImageName(%q) = %q, %v; want %q, %v", tt.name, image, ok, tt.image, tt.ok)
+		}
+	}
+}
+
 // --- WaitForCheckpointFile ---
 
 func TestWaitForCheckpointFile_Timeout(t *testing.T) {
@@ -317,3 +337,125 @@ func TestRestart_FailsWhenNoCheckpointFile(t *testing.T) {
 	}
 	_ = expectedErr
 }
+
+// --- Restore supervision ---
+
+// fakeTool installs an executable shell script named name on PATH for the
+// duration of the test.
+func fakeTool(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestParseCoordinatorStatus(t *testing.T) {
+	cases := []struct {
+		name    string
+		out     string
+		peers   int
+		running bool
+		wantErr bool
+	}{
+		{"dmtcp3", "Coordinator:\n  Host: 127.0.0.1\n  Port: 7779\nStatus...\n  NUM_PEERS=2\n  RUNNING=yes\n", 2, true, false},
+		{"dmtcp2", "Status...\nNUM_PEERS=1\nRUNNING=no\nCKPT_INTERVAL=0\n", 1, false, false},
+		{"no peers", "NUM_PEERS=0\nRUNNING=yes\n", 0, true, false},
+		{"missing", "Coordinator:\n  Host: 127.0.0.1\n", 0, false, true},
+		{"garbled", "NUM_PEERS=many\n", 0, false, true},
+	}
+	for _, tc := range cases {
+		peers, running, err := parseCoordinatorStatus(tc.out)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if peers != tc.peers || running != tc.running {
+			t.Errorf("%s: got (%d, %v), want (%d, %v)", tc.name, peers, running, tc.peers, tc.running)
+		}
+	}
+}
+
+func TestStartRestart_FailsWithoutCheckpoints(t *testing.T) {
+	h := NewHandler(t.TempDir())
+	if _, err := h.StartRestart(); err == nil {
+		t.Fatal("StartRestart() should fail when CheckpointDir has no .dmtcp files")
+	}
+	if h.State != StateError {
+		t.Errorf("expected StateError, got %d", h.State)
+	}
+}
+
+func TestStartRestart_RunsChild(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ckpt_a.dmtcp"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fakeTool(t, "dmtcp_restart", `exit 3`)
+
+	h := NewHandler(dir)
+	cmd, err := h.StartRestart()
+	if err != nil {
+		t.Fatalf("StartRestart: %v", err)
+	}
+	if h.State != StateRestoring {
+		t.Errorf("expected StateRestoring, got %d", h.State)
+	}
+	err = cmd.Wait()
+	if cmd.ProcessState == nil || cmd.ProcessState.ExitCode() != 3 {
+		t.Fatalf("child exit = %v, want code 3", err)
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	fakeTool(t, "dmtcp_command", `printf 'Status...\nNUM_PEERS=2\nRUNNING=yes\n'`)
+	h := NewHandler(t.TempDir())
+	n, err := h.WaitForPeers(2, 5*time.Second)
+	if err != nil || n != 2 {
+		t.Fatalf("WaitForPeers = %d, %v; want 2, nil", n, err)
+	}
+	if h.State != StateRunning {
+		t.Errorf("expected StateRunning, got %d", h.State)
+	}
+}
+
+func TestWaitForPeers_Timeout(t *testing.T) {
+	fakeTool(t, "dmtcp_command", `printf 'NUM_PEERS=1\nRUNNING=yes\n'`)
+	h := NewHandler(t.TempDir())
+	n, err := h.WaitForPeers(2, time.Second)
+	if err == nil {
+		t.Fatal("WaitForPeers should time out when too few peers connect")
+	}
+	if n != 1 {
+		t.Errorf("last observed peers = %d, want 1", n)
+	}
+}
+
+// --- WritingSince ---
+
+func TestWritingSince(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := &Handler{CheckpointDir: tmpDir}
+	old := filepath.Join(tmpDir, "ckpt_old.dmtcp")
+	if err := os.WriteFile(old, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(old, past, past)
+
+	since := time.Now().Add(-time.Minute)
+	if h.WritingSince(since) {
+		t.Error("an image from an earlier checkpoint counted as being written")
+	}
+	_ = os.WriteFile(filepath.Join(tmpDir, "notes.txt"), []byte("x"), 0644)
+	if h.WritingSince(since) {
+		t.Error("a file that is no image counted as being written")
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "ckpt_app.dmtcp.temp"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !h.WritingSince(since) {
+		t.Error("an image being written was not noticed")
+	}
+}
@@ -8,17 +8,39 @@ package main
 // has been transferred to the destination Execution Agent, so the kubelet
 // cannot kill the pod before its state is safe:
 //
-//  1. iterative volume pre-transfer rounds (CreateCheckpoint+CopyCheckpoint,
-//     CloudCom 2020 §IV) while the application is still running;
-//  2. DMTCP process checkpoint, then transfer of the *.dmtcp files;
+//  1. ship any frozen volume layers the sync daemon (syncdaemon.go) could
+//     not deliver during its pre-downtime rounds, e.g. because the
+//     destination only registered after the source pod was deleted;
+//  2. DMTCP process checkpoint, then transfer of the *.dmtcp files. With
+//     CHECKPOINT_STREAM=true the images are sent while DMTCP writes them
+//     and only their tails wait for the checkpoint to return;
 //  3. EndVolume: unmount and transfer of the final upper layer;
 //  4. DONE frame to the destination, /copy notification to the MC.
+//
+// Steps 1-4 run as a dependency graph (utils.Pipeline), so the final layer
+// is sent while DMTCP writes the images and the images are sent side by
+// side; each step's duration is logged. When a step fails, the destination
+// is sent an ABORT frame so it applies its abort policy right away (see
+// abort.go).
+//
+// Everything travels over a single transfer session to the destination, so
+// a distant target costs one handshake and the frames are pipelined. A
+// dropped connection is re-dialed for up to TRANSFER_RETRY_SECONDS and the
+// transfer resumes where the destination's journal left off. Its progress
+// is posted to the MC (POST /progress) while it runs.
+//
+// When the destination has not registered yet and CHECKPOINT_STORE is set,
+// the same frames are uploaded to the checkpoint store instead, as the set
+// of the migration, for the destination to download when it registers.
+// Otherwise the MC's transfer relay takes the stream.
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"go-agent/dmtcp"
@@ -57,9 +79,93 @@ func runEndContainer() {
 	}
 }
 
+// applyCodec switches s to the payload codec the MC asked for. An empty or
+// unknown name (a newer MC) keeps the sender's TRANSFER_CODEC default.
+func applyCodec(s interface{ SetCodec(utils.Codec) }, name string) {
+	if name == "" {
+		return
+	}
+	c, err := utils.ParseCodec(name)
+	if err != nil {
+		log.Printf("ignoring compression from the MC: %v", err)
+		return
+	}
+	s.SetCodec(c)
+}
+
+// dialDestination opens the transfer session to dest with the codec, the
+// transfer certificate, the token, the striping connections and the
+// bandwidth cap the MC handed out, deduplicating against the destination's
+// chunk cache when it has one. progress, when set, counts what it sends.
+func dialDestination(dest string, g utils.TransferGrant, progress *utils.Progress) (*utils.Session, error) {
+	cfg, err := utils.ClientTLS(g.TLS)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := utils.ChunkCacheFromEnv(utils.EnvOr("DATA_DIR", "/data"))
+	if err != nil {
+		log.Printf("transfer deduplication off: %v", err)
+	}
+	s, err := utils.DialSessionWith(dest, utils.DialOptions{
+		TLS:        cfg,
+		Token:      g.TransferToken,
+		ChunkCache: cache,
+		Streams:    g.TransferStreams,
+		Limit:      utils.NewRateLimiter(g.MaxTransferBytesPerSecond),
+		Emulate:    utils.WANEmulationFromEnv(),
+		Progress:   progress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	applyCodec(s, g.Compression)
+	return s, nil
+}
+
+// abortTransfer tells the destination at dest that the transfer failed
+// with cause, so it applies its abort policy instead of waiting out its
+// receive timeout. The pipeline closed the session that failed, so the
+// abort travels over a new one. Failing to send it is only logged.
+func abortTransfer(dest string, g utils.TransferGrant, cause error) {
+	g.TransferStreams = 0
+	s, err := dialDestination(dest, g, nil)
+	if err != nil {
+		log.Printf("transfer abort not sent to %s: %v", dest, err)
+		return
+	}
+	defer s.Close()
+	if err := s.Abort(cause.Error()); err != nil {
+		log.Printf("transfer abort not sent to %s: %v", dest, err)
+		return
+	}
+	log.Printf("transfer to %s aborted", dest)
+}
+
+// openUpload starts the upload of the migration's checkpoint set. MCs that
+// name no migration get the pod's name, as the MC itself does.
+func openUpload(store utils.CheckpointStore, podName, checkpointDir string, resp utils.RemoveResponse) (*utils.Upload, string, error) {
+	migration := resp.MigrationID
+	if migration == "" {
+		migration = podName
+	}
+	set := utils.MigrationSet(podName, migration)
+	u, err := utils.OpenUpload(store, set, utils.UploadOptions{SpoolDir: checkpointDir})
+	if err != nil {
+		return nil, "", err
+	}
+	applyCodec(u, resp.Compression)
+	return u, set, nil
+}
+
 // endContainer drives the source-side checkpoint and transfer sequence.
 func endContainer(coordAddr, podName, checkpointDir string) error {
-	body, err := utils.PostJSON(fmt.Sprintf("http://%s/remove", coordAddr), utils.RemoveRequest{PodName: podName})
+	// The agent key proves this is the source, which alone is handed the
+	// migration's transfer credentials.
+	key, err := os.ReadFile(agentKeyFile(checkpointDir))
+	if err != nil {
+		log.Printf("no agent key to present on /remove: %v", err)
+	}
+	body, err := utils.PostJSONAuth(fmt.Sprintf("http://%s/remove", coordAddr), utils.RemoveRequest{PodName: podName}, string(key))
 	if err != nil {
 		return fmt.Errorf("POST /remove: %w", err)
 	}
@@ -74,9 +180,19 @@ func endContainer(coordAddr, podName, checkpointDir string) error {
 
 	procMig := utils.ProcessMigrationEnabled()
 	volMig := utils.VolumeMigrationEnabled()
+	store, err := utils.CheckpointStoreFromEnv()
+	if err != nil {
+		return err
+	}
 	dest := resp.DestAddress
-	if dest == "" {
-		log.Println("warning: MC did not provide destAddress; checkpoints stay local for MC-driven copy")
+	switch {
+	case dest == "" && store != nil:
+		log.Println("destination not registered yet; uploading to the checkpoint store")
+	case dest == "" && resp.RelayAddress != "":
+		dest = resp.RelayAddress
+		log.Printf("destination not registered yet; streaming to the MC's transfer relay at %s", dest)
+	case dest == "":
+		log.Println("warning: MC provided neither destAddress nor relayAddress and CHECKPOINT_STORE is unset; checkpoints stay local")
 	}
 	log.Printf("migration termination: processMigration=%v volumeMigration=%v dest=%q", procMig, volMig, dest)
 
@@ -88,78 +204,241 @@ func endContainer(coordAddr, podName, checkpointDir string) error {
 	}
 	layersSent := 0
 
-	// 1. Iterative volume pre-transfer rounds while the app still runs.
+	// sess is the session to dest or the upload to the store; target
+	// names it in logs. A session reports its progress to the MC.
+	var sess utils.Sender
+	var stopProgress func()
+	target := dest
+	switch {
+	case dest != "":
+		grant := resp.TransferGrant
+		if dest != resp.DestAddress {
+			// The relay forwards a single connection.
+			grant.TransferStreams = 0
+		}
+		progress := utils.NewProgress()
+		s, err := dialDestination(dest, grant, progress)
+		if err != nil {
+			return fmt.Errorf("open transfer session: %w", err)
+		}
+		sess = s
+		stopProgress = utils.ReportProgress(coordAddr, podName, progress)
+		defer stopProgress()
+	case store != nil:
+		u, set, err := openUpload(store, podName, checkpointDir, resp)
+		if err != nil {
+			return fmt.Errorf("open checkpoint upload: %w", err)
+		}
+		sess, target = u, "checkpoint set "+set
+	}
+	if sess != nil {
+		defer sess.Close()
+	}
+
+	// The lock waits out a sync round that is still in flight.
 	if volMig {
 		lm = overlay.NewLayerManager(utils.EnvOr("DATA_DIR", "/data"), rootDir)
+		unlock, err := lm.Lock()
+		if err != nil {
+			return fmt.Errorf("lock overlay state: %w", err)
+		}
+		defer unlock()
 		if err := lm.Discover(); err != nil {
 			return fmt.Errorf("discover overlay state: %w", err)
 		}
-		if lm.Level() > 0 && dest != "" {
-			rounds := utils.EnvInt("CHECKPOINT_ROUNDS", 1)
-			for i := 0; i < rounds; i++ {
-				frozen, err := lm.CreateCheckpoint()
-				if err != nil {
-					return fmt.Errorf("volume checkpoint round %d: %w", i+1, err)
-				}
-				if err := lm.CopyCheckpoint(dest); err != nil {
-					return fmt.Errorf("copy volume checkpoint %d: %w", frozen, err)
+	}
+
+	// The steps, run on up to PRESTOP_WORKERS workers at once:
+	//
+	//	layers                         frozen pre-sync layers
+	//	suspend                        start the checkpoint, return once it writes
+	//	images   after suspend         wait for the checkpoint; "send <file>" each image
+	//	volume   after layers, suspend final upper layer
+	//	done     after all others      DONE frame
+	//
+	// The first failure cancels the rest.
+	p := utils.NewPipeline(utils.EnvInt("PRESTOP_WORKERS", 4))
+	if sess != nil {
+		p.OnCancel = func() { sess.Close() }
+	}
+	var added []string
+	add := func(name string, run utils.StepFunc, after ...string) {
+		var deps []string
+		for _, dep := range after {
+			for _, a := range added {
+				if a == dep {
+					deps = append(deps, dep)
 				}
-				layersSent++
-				log.Printf("volume pre-transfer round %d/%d: layer %d sent", i+1, rounds, frozen)
 			}
 		}
+		p.Add(name, run, deps...)
+		added = append(added, name)
 	}
 
-	// 2. DMTCP process checkpoint, then transfer the checkpoint files.
+	// Frozen layers left over from the pre-downtime rounds.
+	if volMig && lm.Level() > 0 && sess != nil {
+		add("layers", func(context.Context, func(string, utils.StepFunc)) error {
+			pending, err := lm.UnsentLayers()
+			if err != nil {
+				return err
+			}
+			if err := lm.CopyCheckpoint(sess); err != nil {
+				return fmt.Errorf("copy pre-synced volume layers: %w", err)
+			}
+			if len(pending) > 0 {
+				log.Printf("%d frozen volume layer(s) from pre-downtime rounds sent: %v", len(pending), pending)
+			}
+			return nil
+		})
+	}
+
+	// DMTCP process checkpoint. suspend returns once the processes are
+	// suspended and DMTCP writes their images; images waits for the
+	// checkpoint and sends the images that were not streamed.
+	var stream *utils.FileStream
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
 	if procMig {
 		h := dmtcp.NewHandlerFromEnv(checkpointDir)
 		h.AttachRunning()
-		if err := h.Checkpoint(); err != nil {
-			return fmt.Errorf("dmtcp checkpoint: %w", err)
-		}
-		if _, err := h.WaitForCheckpointFile(60 * time.Second); err != nil {
-			return fmt.Errorf("wait for checkpoint files: %w", err)
-		}
-		files, err := h.ListCheckpoints()
-		if err != nil {
-			return fmt.Errorf("list checkpoints: %w", err)
-		}
-		log.Printf("checkpoint ready: %v", files)
-		if dest != "" {
+		ckptDone := make(chan struct{})
+		var ckptErr error
+		add("suspend", func(ctx context.Context, _ func(string, utils.StepFunc)) error {
+			if sess != nil && utils.EnvBool("CHECKPOINT_STREAM", false) {
+				var err error
+				if stream, err = utils.StreamFiles(sess, checkpointDir, utils.StreamOptions{Image: dmtcp.ImageName}); err != nil {
+					log.Printf("checkpoint images sent after the checkpoint: %v", err)
+				}
+			}
+			since := time.Now()
+			wait, err := h.StartCheckpoint()
+			if err != nil {
+				close(ckptDone)
+				return fmt.Errorf("dmtcp checkpoint: %w", err)
+			}
+			go func() {
+				ckptErr = wait()
+				close(ckptDone)
+			}()
+			for !h.WritingSince(since) {
+				select {
+				case <-ckptDone:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+			return nil
+		})
+		add("images", func(ctx context.Context, spawn func(string, utils.StepFunc)) error {
+			select {
+			case <-ckptDone:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if ckptErr != nil {
+				return fmt.Errorf("dmtcp checkpoint: %w", ckptErr)
+			}
+			streamed := make(map[string]bool)
+			if stream != nil {
+				names, err := stream.Finish()
+				if err != nil {
+					return fmt.Errorf("stream checkpoint images: %w", err)
+				}
+				for _, name := range names {
+					streamed[name] = true
+				}
+			}
+			if _, err := h.WaitForCheckpointFile(60 * time.Second); err != nil {
+				return fmt.Errorf("wait for checkpoint files: %w", err)
+			}
+			files, err := h.ListCheckpoints()
+			if err != nil {
+				return fmt.Errorf("list checkpoints: %w", err)
+			}
+			log.Printf("checkpoint ready: %v", files)
+			if sess == nil {
+				return nil
+			}
 			for _, f := range files {
-				if err := utils.SendCheckpointFile(dest, f); err != nil {
-					return fmt.Errorf("send checkpoint file %s: %w", f, err)
+				if streamed[filepath.Base(f)] {
+					continue
 				}
+				f := f
+				spawn("send "+filepath.Base(f), func(context.Context, func(string, utils.StepFunc)) error {
+					if err := sess.SendCheckpointFile(f); err != nil {
+						return fmt.Errorf("send checkpoint file %s: %w", f, err)
+					}
+					return nil
+				})
 			}
-			log.Printf("%d checkpoint file(s) transferred to %s", len(files), dest)
-		}
+			log.Printf("%d checkpoint file(s) queued for %s (%d sent while being written)", len(files), target, len(streamed))
+			return nil
+		}, "suspend")
 	}
 
-	// 3. Unmount the volume and transfer the final upper layer.
+	// Unmount the volume and transfer the final upper layer, once the
+	// processes no longer write to it.
 	if volMig {
-		if lm.Level() > 0 {
-			if err := lm.EndVolume(dest); err != nil {
+		add("volume", func(context.Context, func(string, utils.StepFunc)) error {
+			if lm.Level() == 0 {
+				if sess == nil {
+					return nil
+				}
+				// Volume was never overlay-mounted: ship the whole root
+				// dir as layer 1 (the bash prototype's tar_main_flow path).
+				if err := sess.SendDir(1, "u1", rootDir); err != nil {
+					return fmt.Errorf("send volume root: %w", err)
+				}
+				layersSent++
+				return nil
+			}
+			if err := lm.EndVolume(sess); err != nil {
 				return fmt.Errorf("end volume: %w", err)
 			}
-			if dest != "" {
-				layersSent++
+			n, err := lm.SentLayers()
+			layersSent = n
+			return err
+		}, "layers", "suspend")
+	}
+
+	// Tell the destination the stream is complete. The DONE manifest also
+	// lists the layers the sync daemon shipped, so the destination refuses
+	// to restore if any of them went missing.
+	if sess != nil {
+		add("done", func(context.Context, func(string, utils.StepFunc)) error {
+			if volMig {
+				sent, err := lm.SentManifest()
+				if err != nil {
+					return err
+				}
+				sess.Expect(sent...)
 			}
-		} else if dest != "" {
-			// Volume was never overlay-mounted: ship the whole root dir
-			// as layer 1 (the bash prototype's tar_main_flow path).
-			if err := utils.SendDir(dest, 1, "u1", rootDir); err != nil {
-				return fmt.Errorf("send volume root: %w", err)
+			if err := sess.Done(); err != nil {
+				return fmt.Errorf("send done frame: %w", err)
 			}
-			layersSent++
-		}
+			log.Printf("transfer to %s complete", target)
+			return nil
+		}, added...)
 	}
 
-	// 4. Tell the destination the stream is complete, then notify the MC.
-	if dest != "" {
-		if err := utils.SendDone(dest); err != nil {
-			return fmt.Errorf("send done frame: %w", err)
+	timings, err := p.Run(context.Background())
+	log.Printf("preStop steps: %s", utils.FormatTimings(timings))
+	if err != nil {
+		if sess != nil && dest != "" && dest == resp.DestAddress {
+			abortTransfer(dest, resp.TransferGrant, err)
 		}
+		return err
 	}
+	if stopProgress != nil {
+		stopProgress() // the last report lands before /copy
+	}
+
+	// Notify the MC.
 	if _, err := utils.PostJSON(fmt.Sprintf("http://%s/copy", coordAddr), utils.CopyNotification{
 		PodName:       podName,
 		CheckpointDir: checkpointDir,
@@ -1,3 +1,13 @@
 module go-agent
 
 go 1.18
+
+require (
+	github.com/klauspost/compress v1.15.15
+	github.com/klauspost/pgzip v1.2.6
+	github.com/paulosouzajr/mycedrive-k8s/wire v0.0.0
+	github.com/pierrec/lz4/v4 v4.1.17
+	golang.org/x/sys v0.21.0
+)
+
+replace github.com/paulosouzajr/mycedrive-k8s/wire => ../wire
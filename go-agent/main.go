@@ -3,9 +3,16 @@
 // The agent runs inside every application container. At container start it
 // registers with the Migration Coordinator (MC). On a migration target it
 // receives the source pod's checkpoints (overlay volume layers and/or DMTCP
-// process checkpoints), mounts the overlay volume and execs dmtcp_restart.
-// As the "end_container" preStop hook it checkpoints and streams state to
-// the destination before letting the source pod terminate.
+// process checkpoints), mounts the overlay volume and restores the processes
+// under a supervisor that reports POST /restored and outlives the restored
+// application (RESTORE_SUPERVISOR=false execs dmtcp_restart instead); a
+// transfer that is aborted is settled by the abort policy (abort.go).
+// With volume migration enabled it leaves a detached "sync_daemon" child
+// behind that performs the MC's pre-downtime layer rounds. As the
+// "end_container" preStop hook it checkpoints and streams state to the
+// destination before letting the source pod terminate. The "snapshot"
+// sub-command stores a point-in-time snapshot in the checkpoint store, and
+// RESTORE_SNAPSHOT restores a fresh pod from one (snapshot.go).
 //
 // Feature flags (each independently toggleable, both default to true):
 //
@@ -15,6 +22,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -30,24 +38,56 @@ import (
 )
 
 // Message mirrors the server-side struct for JSON serialisation.
-// ProcessMigration / VolumeMigration are additive fields that advertise the
-// agent's enabled mechanisms to the MC (older MCs ignore them).
 type Message struct {
-	PodName          string `json:"podName"`
-	PodAddress       string `json:"podAddress"`
-	ContainerPort    int    `json:"containerPort,omitempty"`
-	IsNew            bool   `json:"isNew"`
-	IsMig            bool   `json:"isMig"`
-	ProcessMigration bool   `json:"processMigration,omitempty"`
-	VolumeMigration  bool   `json:"volumeMigration,omitempty"`
+	PodName       string `json:"podName"`
+	PodAddress    string `json:"podAddress"`
+	ContainerPort int    `json:"containerPort,omitempty"`
+	IsNew         bool   `json:"isNew"`
+	IsMig         bool   `json:"isMig"`
+
+	// ProcessMigration and VolumeMigration are additive fields that
+	// advertise the agent's enabled mechanisms to the MC (older MCs ignore
+	// them).
+	ProcessMigration bool `json:"processMigration,omitempty"`
+	VolumeMigration  bool `json:"volumeMigration,omitempty"`
+
+	// TLS is the destination's transfer certificate, on an isMig=true
+	// response.
+	TLS *utils.TLSBundle `json:"tls,omitempty"`
+
+	// TransferToken is the key the source signs its frames with, on an
+	// isMig=true response.
+	TransferToken string `json:"transferToken,omitempty"`
+
+	// MigrationID names the checkpoint set a source may have left in the
+	// store, on an isMig=true response.
+	MigrationID string `json:"migrationID,omitempty"`
+
+	// MaxTransferBytesPerSecond is the workload's cap on transfer
+	// bandwidth, on an isMig=true response.
+	MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond,omitempty"`
+
+	// AbortPolicy is what to do should the migration be aborted (see
+	// abort.go), on an isMig=true response.
+	AbortPolicy string `json:"abortPolicy,omitempty"`
+
+	// VolumeMountMode is how to mount the overlay volume (Privileged,
+	// UserNamespace or FUSE; see overlay.MountMode), on both responses once
+	// the MC knows the pod's workload. Empty keeps VOLUME_MOUNT_MODE.
+	VolumeMountMode string `json:"volumeMountMode,omitempty"`
+
+	// AgentKey is the secret of this registration; the sync daemon
+	// presents it on /poll to be handed the source's transfer grant.
+	AgentKey string `json:"agentKey,omitempty"`
 }
 
 const defaultCoordAddr = "localhost:80"
 
 // restoredMarker is created in the checkpoint directory just before the
-// agent execs dmtcp_restart. The container entrypoint consults it after the
+// agent starts dmtcp_restart. The container entrypoint consults it after the
 // agent returns: marker present means the restored application already ran
-// (and exited), so the entrypoint must NOT dmtcp_launch a fresh instance.
+// (and exited), so the entrypoint must NOT dmtcp_launch a fresh instance and
+// should exit with the agent's status, which is the restored application's.
 func restoredMarker(checkpointDir string) string {
 	return filepath.Join(checkpointDir, ".restored")
 }
@@ -59,6 +99,14 @@ func main() {
 		runEndContainer()
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == syncDaemonCmd {
+		runSyncDaemon(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == snapshotCmd {
+		runSnapshot(os.Args[2:])
+		return
+	}
 	runAgent()
 }
 
@@ -76,7 +124,7 @@ func runAgent() {
 		log.Println("ENABLE_VOLUME_MIGRATION is true but no volume root dir (arg or VOLUME_ROOT_DIR); disabling volume migration")
 		volMig = false
 	}
-	if len(os.Args) > 2 { // legacy layerCount argument, now governed by CHECKPOINT_ROUNDS
+	if len(os.Args) > 2 { // legacy layerCount argument, now governed by the MC's preSyncRounds
 		if _, err := strconv.Atoi(os.Args[2]); err != nil {
 			log.Fatalf("Invalid layerCount argument: %v", err)
 		}
@@ -85,6 +133,12 @@ func runAgent() {
 	transferPort := utils.TransferPort()
 	checkpointDir := utils.EnvOr("DMTCP_CHECKPOINT_DIR", "/dmtcp/checkpoints")
 	dataDir := utils.EnvOr("DATA_DIR", "/data")
+	checkAborted(checkpointDir)
+	// Whatever an earlier run of this container was receiving when it died
+	// cannot be resumed by this one.
+	if err := utils.CleanStaging(dataDir, checkpointDir); err != nil {
+		log.Printf("stale staging entries not removed: %v", err)
+	}
 
 	registerMsg := Message{
 		PodAddress:       net.JoinHostPort(os.Getenv("POD_IP"), strconv.Itoa(transferPort)),
@@ -104,28 +158,130 @@ func runAgent() {
 	if err := json.Unmarshal(reply, &response); err != nil {
 		log.Fatalf("Failed to parse register response: %v", err)
 	}
-	log.Printf("Register response from MC: %+v", response)
+	log.Printf("Register response from MC: isNew=%v isMig=%v tls=%v token=%v", response.IsNew, response.IsMig, response.TLS != nil, response.TransferToken != "")
+	saveAgentKey(checkpointDir, response.AgentKey)
 
 	lm := overlay.NewLayerManager(dataDir, rootDir)
+	if response.VolumeMountMode != "" {
+		mode, err := overlay.ParseMountMode(response.VolumeMountMode)
+		if err != nil {
+			log.Printf("ignoring the volume mount mode from the MC: %v", err)
+		} else {
+			lm.SetMountMode(mode)
+		}
+	}
 
 	if response.IsMig {
-		runMigrationTarget(lm, transferPort, checkpointDir, procMig, volMig)
+		runMigrationTarget(coordAddr, lm, transferPort, checkpointDir, procMig, volMig, response)
+		return
+	}
+	if set := os.Getenv("RESTORE_SNAPSHOT"); set != "" && restoreSnapshot(lm, checkpointDir, set, procMig, volMig) {
 		return
 	}
 
 	// Fresh start or non-migration duplicate registration.
 	if volMig {
-		if err := lm.InitVolume(); err != nil {
+		if err := mountVolume(lm); err != nil {
 			log.Fatalf("overlay init failed: %v", err)
 		}
 		log.Printf("overlay volume initialised at level %d over %s", lm.Level(), rootDir)
+		startSyncDaemon(rootDir, response.AgentKey)
 	}
 	// The entrypoint dmtcp_launches the application after we return.
 }
 
+// mountVolume mounts the overlay volume over RootDir. Discover first
+// finishes an operation an earlier run of the container left half-done and
+// picks up the layers it froze; a stack that is still mounted is kept.
+func mountVolume(lm *overlay.LayerManager) error {
+	unlock, err := lm.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := lm.Discover(); err != nil {
+		return fmt.Errorf("discover overlay stack: %w", err)
+	}
+	mounted, err := lm.Mounted()
+	if err != nil || mounted {
+		return err
+	}
+	return lm.InitVolume()
+}
+
+// agentKeyFile is where the agent leaves the agent key of its registration
+// for end_container, which presents it on /remove.
+func agentKeyFile(checkpointDir string) string {
+	return filepath.Join(checkpointDir, ".agent-key")
+}
+
+// saveAgentKey writes key to agentKeyFile. Without it the source is not
+// handed its transfer credentials at termination, so a failure is logged.
+func saveAgentKey(checkpointDir, key string) {
+	if key == "" {
+		return
+	}
+	if err := os.MkdirAll(checkpointDir, 0o755); err != nil {
+		log.Printf("agent key not saved: %v", err)
+		return
+	}
+	if err := os.WriteFile(agentKeyFile(checkpointDir), []byte(key), 0o600); err != nil {
+		log.Printf("agent key not saved: %v", err)
+	}
+}
+
+// startSyncDaemon spawns the pre-downtime sync loop unless disabled with
+// ENABLE_SYNC_DAEMON=false, handing it agentKey to poll with. A failure
+// only costs the pre-copy rounds, so it is logged rather than fatal.
+func startSyncDaemon(rootDir, agentKey string) {
+	if !utils.EnvBool("ENABLE_SYNC_DAEMON", true) {
+		return
+	}
+	if os.Getenv("POD_NAME") == "" {
+		log.Println("POD_NAME is unset; not starting the sync daemon")
+		return
+	}
+	if err := spawnSyncDaemon(rootDir, agentKey); err != nil {
+		log.Printf("sync daemon not started: %v", err)
+	}
+}
+
 // runMigrationTarget receives the source pod's checkpoints and restores.
-func runMigrationTarget(lm *overlay.LayerManager, transferPort int, checkpointDir string, procMig, volMig bool) {
-	log.Printf("Pod is migration target: listening on :%d for checkpoint transfer", transferPort)
+// A set the source left in the checkpoint store is downloaded; otherwise
+// the agent listens for the source's (or the MC relay's) transfer session.
+// A transfer that does not complete is handled by the abort policy.
+func runMigrationTarget(coordAddr string, lm *overlay.LayerManager, transferPort int, checkpointDir string, procMig, volMig bool, resp Message) {
+	t := &target{lm: lm, checkpointDir: checkpointDir, agentKey: resp.AgentKey}
+	migration := resp.MigrationID
+	if migration == "" {
+		migration = resp.PodName
+	}
+	store, err := utils.CheckpointStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if store != nil {
+		set := utils.MigrationSet(resp.PodName, migration)
+		found, err := t.download(store, set)
+		if err != nil {
+			t.abandon(coordAddr, resp.PodName, migration, abortPolicy(resp.AbortPolicy), volMig, err)
+			return
+		}
+		if found {
+			if err := utils.DeleteSet(store, set); err != nil {
+				log.Printf("checkpoint set %s restored but not deleted: %v", set, err)
+			}
+			t.restore(procMig, volMig)
+			return
+		}
+		log.Printf("no checkpoint set %s in the store yet; waiting for the source's transfer", set)
+	}
+
+	tlsCfg, err := utils.ServerTLS(resp.TLS)
+	if err != nil {
+		log.Fatalf("transfer TLS: %v", err)
+	}
+	log.Printf("Pod is migration target: listening on :%d for checkpoint transfer (TLS: %v, token: %v)", transferPort, tlsCfg != nil, resp.TransferToken != "")
 
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", transferPort))
 	if err != nil {
@@ -133,45 +289,141 @@ func runMigrationTarget(lm *overlay.LayerManager, transferPort int, checkpointDi
 	}
 	defer ln.Close()
 
-	timeout := time.Duration(utils.EnvInt("RECEIVE_TIMEOUT_SECONDS", 600)) * time.Second
-	layers, ckptFiles := 0, 0
-
-	frames, err := utils.ReceiveAll(ln, timeout, func(h utils.FrameHeader, payload io.Reader) error {
-		switch h.Kind {
-		case utils.KindLayer:
-			layers++
-			log.Printf("receiving volume layer %d (%s)", h.Ordinal, h.Name)
-			return lm.ReceiveCheckpoint(h.Ordinal, payload)
-		case utils.KindCheckpointFile:
-			ckptFiles++
-			log.Printf("receiving checkpoint file %s", h.Name)
-			return utils.ExtractTarGz(payload, checkpointDir)
-		default:
-			return fmt.Errorf("unexpected frame kind %d", h.Kind)
+	// Stripe ranges and chunk queries are spooled next to where they end
+	// up, so they do not need room on another filesystem.
+	cache, err := utils.ChunkCacheFromEnv(lm.DataDir)
+	if err != nil {
+		log.Printf("transfer deduplication off: %v", err)
+	}
+	opts := utils.ReceiveOptions{
+		Timeout:     time.Duration(utils.EnvInt("RECEIVE_TIMEOUT_SECONDS", 600)) * time.Second,
+		IdleTimeout: time.Duration(utils.EnvInt("RECEIVE_IDLE_SECONDS", 60)) * time.Second,
+		TLS:         tlsCfg,
+		Token:       resp.TransferToken,
+		SpoolDir:    t.spoolDir,
+		ChunkCache:  cache,
+		Limit:       utils.NewRateLimiter(resp.MaxTransferBytesPerSecond),
+		Emulate:     utils.WANEmulationFromEnv(),
+	}
+	abort, stopWatch := watchAbort(coordAddr, resp.PodName, migration)
+	opts.Abort = abort
+	frames, err := utils.ReceiveAllWith(ln, opts, t.handle)
+	stopWatch()
+	ln.Close()
+	if err != nil {
+		// This includes a DONE manifest naming items that never arrived
+		// intact: restoring from a partial set would only crash later.
+		t.abandon(coordAddr, resp.PodName, migration, abortPolicy(resp.AbortPolicy), volMig,
+			fmt.Errorf("checkpoint transfer failed after %d frame(s): %w", len(frames), err))
+		return
+	}
+	if cache != nil {
+		go pruneChunkCache(cache)
+	}
+	t.restore(procMig, volMig)
+}
+
+// pruneChunkCache trims the node's chunk cache to its size limit.
+func pruneChunkCache(cache *utils.ChunkCache) {
+	n, err := cache.Prune()
+	if err != nil {
+		log.Printf("chunk cache: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("chunk cache: pruned %d chunk(s)", n)
+	}
+}
+
+// target receives a transfer into the overlay layers and the checkpoint
+// directory, then restores from them.
+type target struct {
+	lm            *overlay.LayerManager
+	checkpointDir string
+	agentKey      string // of the destination's registration, for the sync daemon and /aborted
+
+	layers, ckptFiles int
+	firstFrame        time.Time
+}
+
+// handle is the FrameHandler of the transfer.
+func (t *target) handle(h utils.FrameHeader, payload io.Reader) error {
+	if t.firstFrame.IsZero() {
+		t.firstFrame = time.Now()
+	}
+	switch h.Kind {
+	case utils.KindLayer:
+		t.layers++
+		log.Printf("receiving volume layer %d (%s)", h.Ordinal, h.Name)
+		return t.lm.ReceiveCheckpoint(h.Ordinal, h.Codec, payload)
+	case utils.KindCheckpointFile:
+		t.ckptFiles++
+		log.Printf("receiving checkpoint file %s", h.Name)
+		return utils.ExtractPayload(h, payload, t.checkpointDir)
+	case utils.KindCheckpointPart:
+		if h.Ordinal == 1 {
+			t.ckptFiles++
+			log.Printf("receiving checkpoint file %s while it is written", h.Name)
 		}
-	})
+		return utils.ExtractPayload(h, payload, t.checkpointDir)
+	case utils.KindFileRange:
+		return utils.ExtractPayload(h, payload, t.checkpointDir)
+	case utils.KindStripedFile:
+		t.ckptFiles++
+		log.Printf("received striped checkpoint file %s", h.Name)
+		return utils.ExtractPayload(h, payload, t.checkpointDir)
+	default:
+		return fmt.Errorf("unexpected frame kind %d", h.Kind)
+	}
+}
+
+// spoolDir keeps a frame's payload on the filesystem it is extracted to.
+func (t *target) spoolDir(h utils.FrameHeader) string {
+	if h.Kind == utils.KindLayer {
+		return t.lm.DataDir
+	}
+	return t.checkpointDir
+}
+
+// download restores the checkpoint set from store. It returns false when
+// the set does not exist (yet).
+func (t *target) download(store utils.CheckpointStore, set string) (bool, error) {
+	log.Printf("downloading checkpoint set %s", set)
+	frames, err := utils.Download(store, set, utils.DownloadOptions{SpoolDir: t.spoolDir}, t.handle)
+	if errors.Is(err, os.ErrNotExist) && len(frames) == 0 {
+		return false, nil
+	}
 	if err != nil {
-		log.Fatalf("checkpoint transfer failed after %d frame(s): %v", len(frames), err)
+		return false, fmt.Errorf("download of checkpoint set %s failed after %d frame(s): %w", set, len(frames), err)
+	}
+	return true, nil
+}
+
+// restore mounts the received layers and restores the processes.
+func (t *target) restore(procMig, volMig bool) {
+	var transfer time.Duration
+	if !t.firstFrame.IsZero() {
+		transfer = time.Since(t.firstFrame)
 	}
-	log.Printf("transfer complete: %d volume layer(s), %d checkpoint file(s)", layers, ckptFiles)
+	log.Printf("transfer complete in %s: %d volume layer(s), %d checkpoint file(s)", transfer, t.layers, t.ckptFiles)
 
 	if volMig {
-		if err := lm.InitVolume(); err != nil {
+		if err := mountVolume(t.lm); err != nil {
 			log.Fatalf("overlay init with received layers failed: %v", err)
 		}
-		log.Printf("overlay volume mounted at level %d with %d received layer(s)", lm.Level(), layers)
+		log.Printf("overlay volume mounted at level %d with %d received layer(s)", t.lm.Level(), t.layers)
+		// The restored pod is a migration source from now on.
+		startSyncDaemon(t.lm.RootDir, t.agentKey)
 	}
 
 	if procMig {
-		h := dmtcp.NewHandlerFromEnv(checkpointDir)
+		h := dmtcp.NewHandlerFromEnv(t.checkpointDir)
 		if ckpts, _ := h.ListCheckpoints(); len(ckpts) > 0 {
-			marker := restoredMarker(checkpointDir)
+			marker := restoredMarker(t.checkpointDir)
 			if err := os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644); err != nil {
 				log.Fatalf("write restore marker: %v", err)
 			}
-			// ExecRestart replaces this process with dmtcp_restart; the
-			// entrypoint's agent invocation becomes the restored app.
-			if err := h.ExecRestart(); err != nil {
+			if err := restoreProcesses(h, ckpts, transfer); err != nil {
 				os.Remove(marker)
 				log.Fatalf("dmtcp restore failed: %v", err)
 			}
@@ -0,0 +1,352 @@
+package overlay
+
+// Layer compaction.
+//
+// Every pre-sync round and every migration into the pod adds a received
+// lower layer, and each one costs the kernel a lowerdir on every lookup; the
+// kernel also caps their number and the length of the mount options. So
+// once more than CompactDepth layers were received, InitVolume squashes the
+// oldest ones into one, leaving CompactDepth; Compact squashes them all,
+// remounting a mounted volume on the fly.
+//
+// The squashed layer is built in a staging dir by applying the layers
+// oldest first: a non-directory replaces whatever was at its path, a
+// whiteout removes it, and an opaque directory first empties it. Files are
+// hardlinked rather than copied, so squashing costs metadata only and the
+// layers stay untouched until the squashed one is published. It keeps the
+// whiteouts and marks a directory opaque wherever one of the layers hid what
+// lies below, so it is a faithful layer on its own: a crash between
+// publishing it as l<N>, N the newest ordinal squashed, and removing the
+// older layers leaves them beneath it with nothing showing through. Once
+// they are gone nothing is left for the markers to hide (the oldest layers
+// are squashed), and they are dropped; the kernel would list a whiteout in
+// a directory no other layer has.
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"go-agent/utils"
+)
+
+// defaultCompactDepth is how many received lower layers InitVolume mounts
+// before it squashes the oldest ones (LAYER_COMPACT_DEPTH).
+const defaultCompactDepth = 16
+
+// opaqueXattrs mark an overlay directory opaque in any MountMode.
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque", "user.fuseoverlayfs.opaque"}
+
+// Compact squashes every received lower layer into one. A mounted volume is
+// remounted on the new stack.
+func (lm *LayerManager) Compact() error {
+	lowers, err := lm.ReceivedLayers()
+	if err != nil {
+		return err
+	}
+	if len(lowers) < 2 {
+		return nil
+	}
+	staged, err := lm.squash(lowers)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staged)
+	if lm.level == 0 {
+		return lm.publishSquashed(staged, lowers)
+	}
+	if err := lm.unmountLevel(); err != nil {
+		return err
+	}
+	if err := lm.publishSquashed(staged, lowers); err != nil {
+		return err
+	}
+	return lm.InitVolume()
+}
+
+// compactLowers squashes the oldest of the received lower layers when
+// there are more than CompactDepth, and returns the layers left.
+func (lm *LayerManager) compactLowers(lowers []int) ([]int, error) {
+	if lm.CompactDepth <= 0 || len(lowers) <= lm.CompactDepth {
+		return lowers, nil
+	}
+	squashed := lowers[:len(lowers)-lm.CompactDepth+1]
+	staged, err := lm.squash(squashed)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staged)
+	if err := lm.publishSquashed(staged, squashed); err != nil {
+		return nil, err
+	}
+	return lowers[len(squashed)-1:], nil
+}
+
+// squash builds the squashed layer of the given lower layers, oldest
+// first, in a staging dir and returns it.
+func (lm *LayerManager) squash(ordinals []int) (string, error) {
+	last := ordinals[len(ordinals)-1]
+	staged, err := utils.StagingDir(lm.DataDir, fmt.Sprintf("l%d", last))
+	if err != nil {
+		return "", err
+	}
+	mtimes := make(map[string]time.Time)
+	for _, n := range ordinals {
+		if err := mergeLayer(staged, lm.dir("l", n), lm.opaqueXattr(), mtimes); err != nil {
+			os.RemoveAll(staged)
+			return "", fmt.Errorf("squash layer %d: %w", n, err)
+		}
+	}
+	// Adding entries touched the directories; they get the mtime of the
+	// newest layer that had them.
+	for rel, mtime := range mtimes {
+		target := filepath.Join(staged, rel)
+		if err := os.Chtimes(target, mtime, mtime); err != nil && !os.IsNotExist(err) {
+			os.RemoveAll(staged)
+			return "", fmt.Errorf("set mtime of %s: %w", rel, err)
+		}
+	}
+	return staged, nil
+}
+
+// publishSquashed renames the squashed layer staged over the newest of the
+// layers it squashed, removes the others and then its whiteouts and opaque
+// markers.
+func (lm *LayerManager) publishSquashed(staged string, ordinals []int) error {
+	last := ordinals[len(ordinals)-1]
+	if err := utils.PublishDir(staged, lm.dir("l", last)); err != nil {
+		return fmt.Errorf("layer %d: %w", last, err)
+	}
+	for _, n := range ordinals[:len(ordinals)-1] {
+		if err := os.RemoveAll(lm.dir("l", n)); err != nil {
+			return fmt.Errorf("remove squashed layer %d: %w", n, err)
+		}
+	}
+	if err := dropMarkers(lm.dir("l", last)); err != nil {
+		return fmt.Errorf("layer %d: %w", last, err)
+	}
+	return nil
+}
+
+// dropMarkers removes the whiteouts and opaque markers of the bottom layer
+// at dir.
+func dropMarkers(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			for _, name := range opaqueXattrs {
+				if err := unix.Lremovexattr(path, name); err != nil && err != unix.ENODATA && err != unix.ENOTSUP {
+					return fmt.Errorf("unmark %s opaque: %w", path, err)
+				}
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if isWhiteout(info) {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("remove whiteout: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// isWhiteout reports whether info describes an overlay whiteout, a 0/0
+// character device.
+func isWhiteout(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// baseLayerDir returns the directory holding received lower layer n as a
+// delta base: l<n>, or the layer it was squashed into, the oldest one
+// received after it.
+func (lm *LayerManager) baseLayerDir(n int) string {
+	if _, err := os.Stat(lm.dir("l", n)); err == nil {
+		return lm.dir("l", n)
+	}
+	lowers, err := lm.numberedDirs("l")
+	if err == nil {
+		for _, m := range lowers {
+			if m > n {
+				return lm.dir("l", m)
+			}
+		}
+	}
+	return lm.dir("l", n)
+}
+
+// mergeLayer applies the layer at src to the squashed layer at dst, marking
+// directories opaque with the attribute opaque where src has none. mtimes
+// collects the mtime of every directory applied.
+func mergeLayer(dst, src, opaque string, mtimes map[string]time.Time) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			mtimes[rel] = info.ModTime()
+			return mergeDir(path, target, opaque, info)
+		}
+		// A whiteout, too, replaces what was there: it hides it from the
+		// layers below the squashed one.
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.Link(path, target); err != nil {
+			return fmt.Errorf("link %s: %w", rel, err)
+		}
+		return nil
+	})
+}
+
+// mergeDir applies the directory at src to target.
+func mergeDir(src, target, opaque string, info os.FileInfo) error {
+	srcOpaque := opaqueXattr(src)
+	var dstOpaque string
+	existing, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case existing.IsDir() && srcOpaque == "":
+		dstOpaque = opaqueXattr(target)
+	default:
+		// An opaque directory hides the one below, and a directory that
+		// replaces a file or a whiteout hides whatever that hid.
+		if !existing.IsDir() {
+			dstOpaque = opaque
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		existing = nil
+	}
+	if existing == nil {
+		if err := os.Mkdir(target, 0o700); err != nil {
+			return err
+		}
+	}
+	if err := copyDirMetadata(src, target, info); err != nil {
+		return err
+	}
+	if mark := firstNonEmpty(srcOpaque, dstOpaque); mark != "" {
+		if err := unix.Lsetxattr(target, mark, []byte("y"), 0); err != nil {
+			return fmt.Errorf("mark %s opaque: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// copyDirMetadata gives the directory target the ownership, permissions and
+// extended attributes of src, except overlay's own attributes.
+func copyDirMetadata(src, target string, info os.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return fmt.Errorf("chown %s: %w", target, err)
+		}
+	}
+	if err := os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return fmt.Errorf("chmod %s: %w", target, err)
+	}
+	old, err := listXattrs(target)
+	if err != nil {
+		return err
+	}
+	for _, name := range old {
+		unix.Lremovexattr(target, name)
+	}
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") || strings.HasPrefix(name, "user.fuseoverlayfs.") {
+			continue
+		}
+		val, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(target, name, val, 0); err != nil && !strings.HasPrefix(name, "security.") {
+			return fmt.Errorf("set xattr %s on %s: %w", name, target, err)
+		}
+	}
+	return nil
+}
+
+// opaqueXattr returns the attribute marking the directory at path opaque,
+// or "".
+func opaqueXattr(path string) string {
+	for _, name := range opaqueXattrs {
+		if val, err := getXattr(path, name); err == nil && string(val) == "y" {
+			return name
+		}
+	}
+	return ""
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, name, val); err != nil {
+		return nil, fmt.Errorf("get xattr %s of %s: %w", name, path, err)
+	}
+	return val[:size], nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
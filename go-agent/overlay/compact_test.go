@@ -0,0 +1,184 @@
+package overlay
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func writeLayerFile(t *testing.T, lm *LayerManager, n int, name, content string) {
+	t.Helper()
+	path := filepath.Join(lm.LayerDir(n), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitVolume_CompactsBeyondDepth(t *testing.T) {
+	lm, fr := newTestManager(t)
+	lm.CompactDepth = 3
+	for n := 1; n <= 5; n++ {
+		writeLayerFile(t, lm, n, "state.db", fmt.Sprintf("v%d", n))
+		writeLayerFile(t, lm, n, fmt.Sprintf("only%d", n), "x")
+	}
+	if err := lm.InitVolume(); err != nil {
+		t.Fatalf("InitVolume: %v", err)
+	}
+	lowers, _ := lm.ReceivedLayers()
+	if fmt.Sprint(lowers) != "[3 4 5]" {
+		t.Fatalf("lower layers after compaction = %v, want [3 4 5]", lowers)
+	}
+	want := fmt.Sprintf("lowerdir=%s:%s:%s,", lm.LayerDir(5), lm.LayerDir(4), lm.LayerDir(3))
+	if !strings.Contains(fr.calls[0], want) {
+		t.Errorf("mount = %s, want %s", fr.calls[0], want)
+	}
+	for name, content := range map[string]string{"state.db": "v3", "only1": "x", "only2": "x", "only3": "x"} {
+		if got, err := os.ReadFile(filepath.Join(lm.LayerDir(3), name)); err != nil || string(got) != content {
+			t.Errorf("squashed %s = %q, %v; want %q", name, got, err, content)
+		}
+	}
+	// A delta against a squashed layer finds its base in the layer it
+	// was squashed into.
+	if got := lm.baseLayerDir(2); got != lm.LayerDir(3) {
+		t.Errorf("base of layer 2 = %s, want %s", got, lm.LayerDir(3))
+	}
+	if got := lm.baseLayerDir(4); got != lm.LayerDir(4) {
+		t.Errorf("base of layer 4 = %s", got)
+	}
+}
+
+func TestCompact_RemountsMountedVolume(t *testing.T) {
+	lm, fr := newTestManager(t)
+	lm.CompactDepth = 0
+	for n := 1; n <= 3; n++ {
+		writeLayerFile(t, lm, n, "state.db", fmt.Sprintf("v%d", n))
+	}
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	fr.calls = nil
+	if err := lm.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if lm.Level() != 1 || len(fr.calls) != 4 {
+		t.Fatalf("level %d after %v, want level 1 remounted", lm.Level(), fr.calls)
+	}
+	if !strings.Contains(fr.calls[2], "lowerdir="+lm.LayerDir(3)+",") {
+		t.Errorf("remount = %s, want the squashed layer alone", fr.calls[2])
+	}
+	if got, _ := os.ReadFile(filepath.Join(lm.LayerDir(3), "state.db")); string(got) != "v3" {
+		t.Errorf("squashed state.db = %q", got)
+	}
+}
+
+// TestSquash_MatchesOverlayView mounts a stack with whiteouts and opaque
+// directories before and after squashing it and compares what the
+// application sees.
+func TestSquash_MatchesOverlayView(t *testing.T) {
+	lm := newNativeManager(t)
+	// Layer 1: the oldest.
+	writeLayerFile(t, lm, 1, "a.txt", "a1")
+	writeLayerFile(t, lm, 1, "gone.txt", "deleted later")
+	writeLayerFile(t, lm, 1, "dir/x", "x1")
+	writeLayerFile(t, lm, 1, "dir/y", "y1")
+	writeLayerFile(t, lm, 1, "merged/keep", "k1")
+	writeLayerFile(t, lm, 1, "became-dir", "file")
+	// Layer 2 deletes gone.txt, replaces dir and turns a file into a dir.
+	writeLayerFile(t, lm, 2, "a.txt", "a2")
+	writeLayerFile(t, lm, 2, "dir/z", "z2")
+	writeLayerFile(t, lm, 2, "merged/add", "m2")
+	writeLayerFile(t, lm, 2, "became-dir/inner", "i2")
+	if err := unix.Mknod(filepath.Join(lm.LayerDir(2), "gone.txt"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create a whiteout: %v", err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(lm.LayerDir(2), "dir"), opaqueXattrs[0], []byte("y"), 0); err != nil {
+		t.Skipf("cannot mark a directory opaque: %v", err)
+	}
+	// Layer 3 deletes a file layer 2 added.
+	writeLayerFile(t, lm, 3, "b.txt", "b3")
+	os.MkdirAll(filepath.Join(lm.LayerDir(3), "merged"), 0o755)
+	if err := unix.Mknod(filepath.Join(lm.LayerDir(3), "merged", "add"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	before := overlayView(t, lm, lm.LayerDir(3), lm.LayerDir(2), lm.LayerDir(1))
+	want := map[string]string{
+		"a.txt": "a2", "b.txt": "b3", "dir/": "", "dir/z": "z2",
+		"merged/": "", "merged/keep": "k1", "became-dir/": "", "became-dir/inner": "i2",
+	}
+	if fmt.Sprint(before) != fmt.Sprint(want) {
+		t.Fatalf("overlay view = %v, want %v", before, want)
+	}
+
+	staged, err := lm.squash([]int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("squash: %v", err)
+	}
+	defer os.RemoveAll(staged)
+	// Squashed layers left beneath it by a crash must not show through.
+	if got := overlayView(t, lm, staged, lm.LayerDir(1)); fmt.Sprint(got) != fmt.Sprint(before) {
+		t.Errorf("view over layer 1 = %v, want %v", got, before)
+	}
+	if err := lm.publishSquashed(staged, []int{1, 2, 3}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if got := overlayView(t, lm, lm.LayerDir(3)); fmt.Sprint(got) != fmt.Sprint(before) {
+		t.Errorf("squashed view = %v, want %v", got, before)
+	}
+	if lowers, _ := lm.ReceivedLayers(); fmt.Sprint(lowers) != "[3]" {
+		t.Errorf("layers after publishing = %v, want [3]", lowers)
+	}
+	filepath.WalkDir(lm.LayerDir(3), func(path string, d fs.DirEntry, err error) error {
+		if info, _ := d.Info(); err == nil && isWhiteout(info) {
+			t.Errorf("whiteout left at the bottom: %s", path)
+		}
+		return err
+	})
+}
+
+// overlayView mounts lowers, topmost first, read-only and returns what it
+// shows: file contents by path, directories with a trailing slash.
+func overlayView(t *testing.T, lm *LayerManager, lowers ...string) map[string]string {
+	t.Helper()
+	escaped := make([]string, len(lowers))
+	for i, dir := range lowers {
+		escaped[i] = escapeOptionPath(dir)
+	}
+	if len(lowers) == 1 {
+		// A read-only overlay needs two lower layers.
+		empty := t.TempDir()
+		escaped = append(escaped, escapeOptionPath(empty))
+	}
+	target := t.TempDir()
+	if err := NativeRunner("mount", "-t", "overlay", "overlay", "-o", "lowerdir="+strings.Join(escaped, ":"), target); err != nil {
+		t.Fatalf("mount view: %v", err)
+	}
+	defer NativeRunner("umount", "-l", target)
+
+	view := make(map[string]string)
+	err := filepath.WalkDir(target, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == target {
+			return err
+		}
+		rel, _ := filepath.Rel(target, path)
+		if d.IsDir() {
+			view[rel+"/"] = ""
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		view[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return view
+}
@@ -0,0 +1,446 @@
+package overlay
+
+// Crash-consistent overlay operations.
+//
+// CreateCheckpoint, InitVolume, the remount of ReceiveCheckpoint and
+// Compact, and the unmount of EndVolume each take several mount steps. An
+// agent, a preStop hook or a node dying between two of them leaves a stack
+// the directories in DataDir no longer describe: a u<N> that was never
+// bound over RootDir, or RootDir unbound under the running application. So
+// each of them keeps a write-ahead journal in DataDir/.journal: a begin
+// record naming the operation and the level it brings up, written before
+// its first step, then a record after each step; the journal is removed
+// once the operation completed. The begin record of a remount's mount
+// replaces the remount's, so the journal never lapses in between; any
+// other operation fails while a journal is pending, until Discover has
+// recovered it.
+//
+// Discover finishes what the journal describes before it derives the
+// level:
+//
+//	checkpoint  rolled back (the new level unmounted and removed) unless
+//	            RootDir already shows the new level; the application never
+//	            wrote to its upper dir
+//	mount       replayed: the level is mounted on the current lower layers
+//	remount     and bound over RootDir
+//	unmount     replayed: every level is unmounted
+//
+// /proc/self/mountinfo tells which steps took effect; the step records
+// stand in when the stack is not mounted in this mount namespace. Discover
+// then checks the mount table against DataDir: when any level is mounted,
+// RootDir must show the current one.
+//
+// Squashing layers needs no journal: a crash there leaves either staging
+// dirs, which CleanStaging removes, or older layers beneath a faithful
+// squashed one (see compact.go).
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrStackMismatch is the error of a Discover that finds RootDir showing
+// another level than the one DataDir describes.
+var ErrStackMismatch = errors.New("mounted overlay stack does not match the layer directories")
+
+// ErrOpPending is the error of an overlay operation started while the
+// journal still holds an interrupted one.
+var ErrOpPending = errors.New("an interrupted overlay operation is pending")
+
+// mountinfoPath is the mount table Discover checks the stack against.
+var mountinfoPath = "/proc/self/mountinfo"
+
+// Journaled operations.
+const (
+	opCheckpoint = "checkpoint"
+	opMount      = "mount"
+	opRemount    = "remount"
+	opUnmount    = "unmount"
+)
+
+// Journaled steps.
+const (
+	stepMounted   = "mounted"   // o<level> mounted
+	stepUnbound   = "unbound"   // RootDir unbound
+	stepUnmounted = "unmounted" // o<level> (every level for unmount) unmounted
+)
+
+// journalRecord is one line of the journal: the begin record names the
+// operation and its level, the others a step it completed.
+type journalRecord struct {
+	Op    string `json:"op,omitempty"`
+	Level int    `json:"level,omitempty"`
+	Step  string `json:"step,omitempty"`
+}
+
+// journalOp is the operation a journal describes.
+type journalOp struct {
+	Op    string
+	Level int
+	Steps []string
+}
+
+// done reports whether the operation completed step.
+func (op *journalOp) done(step string) bool {
+	for _, s := range op.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// lastStep returns the last step the operation completed, or "begin".
+func (op *journalOp) lastStep() string {
+	if len(op.Steps) == 0 {
+		return "begin"
+	}
+	return op.Steps[len(op.Steps)-1]
+}
+
+func (lm *LayerManager) journalPath() string {
+	return filepath.Join(lm.DataDir, ".journal")
+}
+
+// beginOp starts the journal of operation op bringing up level. It fails
+// with ErrOpPending when the journal holds another operation, unless op is
+// the mount of the level a remount unmounted.
+func (lm *LayerManager) beginOp(op string, level int) error {
+	if err := os.MkdirAll(lm.DataDir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", lm.DataDir, err)
+	}
+	pending, err := lm.pendingOp()
+	if err != nil {
+		return err
+	}
+	if pending != nil && !(pending.Op == opRemount && op == opMount && pending.Level == level) {
+		return fmt.Errorf("%s of level %d: %s of level %d stopped after %s: %w",
+			op, level, pending.Op, pending.Level, pending.lastStep(), ErrOpPending)
+	}
+	line, err := json.Marshal(journalRecord{Op: op, Level: level})
+	if err != nil {
+		return fmt.Errorf("journal %s: %w", op, err)
+	}
+	tmp := lm.journalPath() + ".tmp"
+	if err := writeSynced(tmp, append(line, '\n'), os.O_CREATE|os.O_TRUNC|os.O_WRONLY); err != nil {
+		return fmt.Errorf("journal %s: %w", op, err)
+	}
+	if err := os.Rename(tmp, lm.journalPath()); err != nil {
+		return fmt.Errorf("journal %s: %w", op, err)
+	}
+	return syncDir(lm.DataDir)
+}
+
+// logStep records that the operation in the journal completed step.
+func (lm *LayerManager) logStep(step string) error {
+	line, err := json.Marshal(journalRecord{Step: step})
+	if err != nil {
+		return fmt.Errorf("journal step %s: %w", step, err)
+	}
+	if err := writeSynced(lm.journalPath(), append(line, '\n'), os.O_APPEND|os.O_WRONLY); err != nil {
+		return fmt.Errorf("journal step %s: %w", step, err)
+	}
+	return nil
+}
+
+// endOp removes the journal of a completed operation.
+func (lm *LayerManager) endOp() error {
+	if err := os.Remove(lm.journalPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("close journal: %w", err)
+	}
+	return syncDir(lm.DataDir)
+}
+
+// pendingOp returns the operation the journal describes, or nil when no
+// operation was interrupted. A step record torn by a crash is ignored.
+func (lm *LayerManager) pendingOp() (*journalOp, error) {
+	data, err := os.ReadFile(lm.journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	var begin journalRecord
+	if err := json.Unmarshal([]byte(lines[0]), &begin); err != nil || begin.Op == "" {
+		return nil, fmt.Errorf("parse journal %s: bad begin record %q", lm.journalPath(), lines[0])
+	}
+	op := &journalOp{Op: begin.Op, Level: begin.Level}
+	for _, line := range lines[1:] {
+		var r journalRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			break
+		}
+		op.Steps = append(op.Steps, r.Step)
+	}
+	return op, nil
+}
+
+// recoverJournal finishes or rolls back the operation the journal
+// describes, if any.
+func (lm *LayerManager) recoverJournal() error {
+	op, err := lm.pendingOp()
+	if err != nil || op == nil {
+		return err
+	}
+	st, err := lm.stackState()
+	if err != nil {
+		return err
+	}
+	log.Printf("overlay: recovering a %s of level %d interrupted after %s", op.Op, op.Level, op.lastStep())
+	switch op.Op {
+	case opCheckpoint:
+		err = lm.recoverCheckpoint(op, st)
+	case opMount, opRemount:
+		err = lm.recoverMount(op, st)
+	case opUnmount:
+		err = lm.recoverUnmount(st)
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Op)
+	}
+	if err != nil {
+		return fmt.Errorf("recover %s of level %d: %w", op.Op, op.Level, err)
+	}
+	return lm.endOp()
+}
+
+// recoverCheckpoint keeps a checkpoint whose new level RootDir shows, and
+// otherwise rebinds the frozen level and removes the new one.
+func (lm *LayerManager) recoverCheckpoint(op *journalOp, st stackState) error {
+	level, frozen := op.Level, op.Level-1
+	if st.bound == level || (!st.live() && op.done(stepUnbound)) {
+		return nil
+	}
+	if st.live() && st.bound != frozen {
+		if st.bound != 0 {
+			if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
+				return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+			}
+		}
+		if st.mounted[frozen] {
+			if err := lm.Run("mount", "--bind", lm.dir("o", frozen), lm.RootDir); err != nil {
+				return fmt.Errorf("bind %s over %s: %w", lm.dir("o", frozen), lm.RootDir, err)
+			}
+		}
+	}
+	if st.mounted[level] {
+		if err := lm.Run("umount", "-l", lm.dir("o", level)); err != nil {
+			return fmt.Errorf("unmount level %d: %w", level, err)
+		}
+	}
+	for _, p := range []string{"u", "w", "o"} {
+		if err := os.RemoveAll(lm.dir(p, level)); err != nil {
+			return fmt.Errorf("remove %s: %w", lm.dir(p, level), err)
+		}
+	}
+	return nil
+}
+
+// recoverMount mounts the level of a mount or remount on the current lower
+// layers and binds it over RootDir, unless a mount already did.
+func (lm *LayerManager) recoverMount(op *journalOp, st stackState) error {
+	if op.Op == opMount && st.bound == op.Level {
+		return lm.recordMountMode()
+	}
+	if st.bound != 0 {
+		if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
+			return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+		}
+	}
+	if st.mounted[op.Level] {
+		if err := lm.Run("umount", "-l", lm.dir("o", op.Level)); err != nil {
+			return fmt.Errorf("unmount level %d: %w", op.Level, err)
+		}
+	}
+	lowers, err := lm.numberedDirs("l")
+	if err != nil {
+		return fmt.Errorf("list lower layers: %w", err)
+	}
+	if err := lm.mountStack(op.Level, lowers); err != nil {
+		return err
+	}
+	return lm.recordMountMode()
+}
+
+// recoverUnmount unmounts whatever an unmount left mounted.
+func (lm *LayerManager) recoverUnmount(st stackState) error {
+	if st.bound != 0 {
+		if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
+			return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+		}
+	}
+	merged, err := lm.numberedDirs("o")
+	if err != nil {
+		return fmt.Errorf("list merged dirs: %w", err)
+	}
+	for i := len(merged) - 1; i >= 0; i-- {
+		if !st.mounted[merged[i]] {
+			continue
+		}
+		if err := lm.Run("umount", "-l", lm.dir("o", merged[i])); err != nil {
+			return fmt.Errorf("unmount level %d: %w", merged[i], err)
+		}
+	}
+	return nil
+}
+
+// checkMounts fails with ErrStackMismatch when a level is mounted but
+// RootDir does not show the current one.
+func (lm *LayerManager) checkMounts() error {
+	st, err := lm.stackState()
+	if err != nil {
+		return err
+	}
+	if st.live() && st.bound != lm.level {
+		return fmt.Errorf("%s shows level %d, the layer directories level %d: %w", lm.RootDir, st.bound, lm.level, ErrStackMismatch)
+	}
+	return nil
+}
+
+// stackState is what the mount table says about the stack in DataDir.
+type stackState struct {
+	mounted map[int]bool // levels whose o<N> is mounted
+	bound   int          // level whose merged view RootDir shows; 0 if none
+}
+
+// live reports whether any level is mounted in this mount namespace.
+func (st stackState) live() bool { return len(st.mounted) > 0 }
+
+// stackState reads the mount table. A bind mount has the device of its
+// source, so RootDir shows the level mounted with the same device.
+func (lm *LayerManager) stackState() (stackState, error) {
+	st := stackState{mounted: make(map[int]bool)}
+	mounts, err := readMounts(mountinfoPath)
+	if err != nil {
+		return st, err
+	}
+	merged, err := lm.numberedDirs("o")
+	if err != nil {
+		return st, fmt.Errorf("list merged dirs: %w", err)
+	}
+	root, rootMounted := mounts[canonicalPath(lm.RootDir)]
+	for _, n := range merged {
+		m, ok := mounts[canonicalPath(lm.dir("o", n))]
+		if !ok {
+			continue
+		}
+		st.mounted[n] = true
+		if rootMounted && m.Dev == root.Dev && n > st.bound {
+			st.bound = n
+		}
+	}
+	return st, nil
+}
+
+// canonicalPath returns path as the mount table shows it.
+func canonicalPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	return filepath.Clean(path)
+}
+
+// mountEntry is a mount in the mount table.
+type mountEntry struct {
+	Dev string // major:minor
+}
+
+// readMounts returns the topmost mount on each mount point of the mount
+// table at path.
+func readMounts(path string) (map[string]mountEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read mount table: %w", err)
+	}
+	defer f.Close()
+	mounts, err := parseMountinfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("read mount table %s: %w", path, err)
+	}
+	return mounts, nil
+}
+
+// parseMountinfo parses a mount table in the format of
+// /proc/self/mountinfo. A mount listed later covers one listed earlier on
+// the same mount point.
+func parseMountinfo(r io.Reader) (map[string]mountEntry, error) {
+	mounts := make(map[string]mountEntry)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("malformed line %q", sc.Text())
+		}
+		mounts[unescapeMountinfo(fields[4])] = mountEntry{Dev: fields[2]}
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMountinfo undoes the octal escapes (\040 for a space) of a path
+// in the mount table.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// writeSynced writes data to the file at path, opened with flag, and
+// flushes it to disk.
+func writeSynced(path string, data []byte, flag int) error {
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of dir to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("sync %s: %w", dir, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", dir, err)
+	}
+	return nil
+}
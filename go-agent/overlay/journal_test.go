@@ -0,0 +1,199 @@
+package overlay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountinfo_TopmostMountWins(t *testing.T) {
+	table := strings.Join([]string{
+		`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+		`90 22 0:50 / /data/o1 rw,relatime - overlay overlay rw,lowerdir=/app`,
+		`91 22 8:1 /app /mnt/app\040root rw,relatime - ext4 /dev/sda1 rw`,
+		`92 91 0:50 / /mnt/app\040root rw,relatime - overlay overlay rw,lowerdir=/app`,
+	}, "\n")
+	mounts, err := parseMountinfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("parseMountinfo: %v", err)
+	}
+	if got := mounts["/mnt/app root"]; got.Dev != "0:50" {
+		t.Errorf("/mnt/app root = %+v, want the bind of /data/o1 on top", got)
+	}
+	if _, err := parseMountinfo(strings.NewReader("22 1 8:1 / /")); err == nil {
+		t.Error("a truncated line must not parse")
+	}
+}
+
+func TestDiscover_RollsBackInterruptedCheckpoint(t *testing.T) {
+	lm, fr := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	// The agent died after mounting level 2, before touching RootDir.
+	fr.fail = map[string]error{"umount -l " + lm.RootDir: errors.New("killed")}
+	if _, err := lm.CreateCheckpoint(); err == nil {
+		t.Fatal("CreateCheckpoint must fail")
+	}
+	fr.fail = nil
+
+	other := NewLayerManager(lm.DataDir, lm.RootDir)
+	other.Run = fr.run
+	if err := other.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if other.Level() != 1 {
+		t.Errorf("level = %d, want the checkpoint rolled back to 1", other.Level())
+	}
+	if _, err := os.Stat(lm.dir("u", 2)); !os.IsNotExist(err) {
+		t.Errorf("u2 survived the rollback: %v", err)
+	}
+	if _, err := os.Stat(lm.journalPath()); !os.IsNotExist(err) {
+		t.Errorf("journal survived the recovery: %v", err)
+	}
+}
+
+func TestDiscover_ReplaysInterruptedRemount(t *testing.T) {
+	lm, fr := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	// ReceiveCheckpoint's remount died after unbinding RootDir.
+	fr.fail = map[string]error{"umount -l " + lm.dir("o", 1): errors.New("killed")}
+	if err := lm.unmountLevel(); err == nil {
+		t.Fatal("unmountLevel must fail")
+	}
+	fr.fail, fr.calls = nil, nil
+
+	other := NewLayerManager(lm.DataDir, lm.RootDir)
+	other.Run = fr.run
+	if err := other.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if other.Level() != 1 || len(fr.calls) != 2 || !strings.HasPrefix(fr.calls[0], "mount -t overlay") ||
+		fr.calls[1] != "mount --bind "+lm.dir("o", 1)+" "+lm.RootDir {
+		t.Fatalf("level %d after %v, want level 1 mounted and bound again", other.Level(), fr.calls)
+	}
+}
+
+// TestDiscover_RepairsRealStack interrupts a checkpoint with RootDir
+// unbound under the application, and checks that Discover rebinds the
+// frozen level.
+func TestDiscover_RepairsRealStack(t *testing.T) {
+	lm := newNativeManager(t)
+	os.WriteFile(filepath.Join(lm.RootDir, "base.txt"), []byte("base"), 0o644)
+	if err := lm.InitVolume(); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skipf("mounting not permitted: %v", err)
+		}
+		t.Fatalf("InitVolume: %v", err)
+	}
+	defer lm.unmountStack()
+	os.WriteFile(filepath.Join(lm.RootDir, "app.txt"), []byte("v1"), 0o644)
+
+	// CreateCheckpoint up to the unbind, then the agent dies.
+	if err := lm.beginOp(opCheckpoint, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.mkLevelDirs(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.mountLevel(2, []string{lm.dir("o", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	lm.logStep(stepMounted)
+	if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
+		t.Fatal(err)
+	}
+	lm.logStep(stepUnbound)
+
+	if err := lm.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if lm.Level() != 1 {
+		t.Errorf("level = %d, want 1", lm.Level())
+	}
+	if got, _ := os.ReadFile(filepath.Join(lm.RootDir, "app.txt")); string(got) != "v1" {
+		t.Errorf("app.txt through RootDir = %q, want level 1 bound again", got)
+	}
+	st, err := lm.stackState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.bound != 1 || st.mounted[2] {
+		t.Errorf("stack = %+v, want level 1 bound and level 2 gone", st)
+	}
+
+	// A level bound without a journal is reported, not guessed at.
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		t.Fatalf("CreateCheckpoint: %v", err)
+	}
+	lm.Run("umount", "-l", lm.RootDir)
+	lm.Run("mount", "--bind", lm.dir("o", 1), lm.RootDir)
+	if err := lm.Discover(); !errors.Is(err, ErrStackMismatch) {
+		t.Fatalf("Discover = %v, want ErrStackMismatch", err)
+	}
+}
+
+func TestBeginOp_RefusesPendingJournal(t *testing.T) {
+	lm, fr := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	fr.fail = map[string]error{"umount -l " + lm.RootDir: errors.New("killed")}
+	if _, err := lm.CreateCheckpoint(); err == nil {
+		t.Fatal("CreateCheckpoint must fail")
+	}
+	fr.fail = nil
+
+	if _, err := lm.CreateCheckpoint(); !errors.Is(err, ErrOpPending) {
+		t.Fatalf("CreateCheckpoint = %v, want ErrOpPending", err)
+	}
+	if _, err := lm.unmountStack(); !errors.Is(err, ErrOpPending) {
+		t.Fatalf("unmountStack = %v, want ErrOpPending", err)
+	}
+	if op, err := lm.pendingOp(); err != nil || op == nil || op.Op != opCheckpoint || op.Level != 2 {
+		t.Fatalf("journal = %+v, %v; want the interrupted checkpoint of level 2 kept", op, err)
+	}
+	if err := lm.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		t.Fatalf("CreateCheckpoint after Discover: %v", err)
+	}
+}
+
+func TestInitVolume_StacksLayersFrozenBeforeRestart(t *testing.T) {
+	lm, fr := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The container restarts in a new mount namespace: nothing is mounted.
+	fr.calls = nil
+	other := NewLayerManager(lm.DataDir, lm.RootDir)
+	other.Run = fr.run
+	if err := other.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if mounted, err := other.Mounted(); err != nil || mounted {
+		t.Fatalf("Mounted = %v, %v; want an unmounted stack", mounted, err)
+	}
+	if err := other.InitVolume(); err != nil {
+		t.Fatalf("InitVolume: %v", err)
+	}
+	if other.Level() != 3 {
+		t.Errorf("level = %d, want 3", other.Level())
+	}
+	want := "lowerdir=" + lm.dir("u", 2) + ":" + lm.dir("u", 1) + ":" + lm.RootDir + ","
+	if len(fr.calls) == 0 || !strings.Contains(fr.calls[0], want) {
+		t.Errorf("mount = %v, want %s", fr.calls, want)
+	}
+}
@@ -70,7 +70,7 @@ func (l *Layer) Finish() bool {
 	if lm.Level() == 0 {
 		return true // nothing mounted
 	}
-	if err := lm.EndVolume(""); err != nil {
+	if err := lm.EndVolume(nil); err != nil {
 		log.Printf("overlay: finish failed: %v", err)
 		return false
 	}
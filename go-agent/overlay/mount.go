@@ -0,0 +1,233 @@
+package overlay
+
+// Mount backends.
+//
+// LayerManager issues three commands through its Runner:
+//
+//	mount -t overlay overlay -o <options> <target>
+//	mount --bind <source> <target>
+//	umount -l <target>
+//
+// ExecRunner hands them to the mount(8) and umount(8) binaries. NativeRunner
+// carries them out with mount(2) and umount2(2), so the image needs no
+// util-linux and a failure is a *MountError holding the errno. Paths in the
+// overlay options are escaped (escapeOptionPath), which both backends pass
+// to the kernel unchanged; any other path is a single argument and may
+// contain spaces. An option string longer than mount(2) accepts (one page)
+// is applied with fsopen(2)/fsconfig(2) instead, one lowerdir+ per layer
+// (Linux 6.8+). MOUNT_BACKEND selects the backend.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"go-agent/utils"
+)
+
+// ErrOptionsTooLong is the error of an overlay mount whose options exceed
+// what mount(2) accepts on a kernel without the lowerdir+ parameter of the
+// new mount API.
+var ErrOptionsTooLong = errors.New("overlay options exceed one page and the kernel cannot append lower layers one by one")
+
+// MountError is the error of a mount or unmount carried out by NativeRunner.
+// Err is the errno, so errors.Is(err, unix.EBUSY) and the like work.
+type MountError struct {
+	Op     string // "mount", "bind" or "umount"
+	Source string
+	Target string
+	FSType string
+	// Detail is what the kernel logged about the failure, when the new
+	// mount API was used.
+	Detail string
+	Err    error
+}
+
+func (e *MountError) Error() string {
+	var msg string
+	switch e.Op {
+	case "mount":
+		msg = fmt.Sprintf("mount %s on %s", e.FSType, e.Target)
+	case "bind":
+		msg = fmt.Sprintf("bind %s on %s", e.Source, e.Target)
+	default:
+		msg = fmt.Sprintf("%s %s", e.Op, e.Target)
+	}
+	msg += ": " + e.Err.Error()
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	return msg
+}
+
+func (e *MountError) Unwrap() error { return e.Err }
+
+// RunnerFromEnv returns the Runner MOUNT_BACKEND names: "native" (the
+// default) or "exec".
+func RunnerFromEnv() (Runner, error) {
+	switch backend := strings.ToLower(utils.EnvOr("MOUNT_BACKEND", "native")); backend {
+	case "native":
+		return NativeRunner, nil
+	case "exec":
+		return ExecRunner, nil
+	default:
+		return NativeRunner, fmt.Errorf("MOUNT_BACKEND: unknown backend %q (want native or exec)", backend)
+	}
+}
+
+// ExecRunner runs the command for real via os/exec.
+func ExecRunner(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w (stderr: %s)", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// NativeRunner carries out the mount and umount commands LayerManager
+// issues with system calls.
+func NativeRunner(name string, args ...string) error {
+	switch {
+	case name == "mount" && len(args) == 6 && args[0] == "-t" && args[2] == args[1] && args[3] == "-o":
+		return mountFS(args[1], args[4], args[5])
+	case name == "mount" && len(args) == 3 && args[0] == "--bind":
+		if err := unix.Mount(args[1], args[2], "", unix.MS_BIND, ""); err != nil {
+			return &MountError{Op: "bind", Source: args[1], Target: args[2], Err: err}
+		}
+		return nil
+	case name == "umount" && len(args) == 2 && args[0] == "-l":
+		if err := unix.Unmount(args[1], unix.MNT_DETACH); err != nil {
+			return &MountError{Op: "umount", Target: args[1], Err: err}
+		}
+		return nil
+	}
+	return fmt.Errorf("native mount backend: unsupported command %q", name+" "+strings.Join(args, " "))
+}
+
+// mountFS mounts a filesystem of type fstype on target with options, the
+// -o string of mount(8).
+func mountFS(fstype, options, target string) error {
+	if len(options) < os.Getpagesize() {
+		if err := unix.Mount(fstype, target, fstype, 0, options); err != nil {
+			return &MountError{Op: "mount", Source: fstype, Target: target, FSType: fstype, Err: err}
+		}
+		return nil
+	}
+	return mountFSConfig(fstype, options, target)
+}
+
+// mountFSConfig mounts like mountFS through the new mount API, which takes
+// the options one by one and so has no limit on their total length.
+func mountFSConfig(fstype, options, target string) error {
+	fail := func(err error, detail string) error {
+		if errors.Is(err, unix.ENOSYS) {
+			err = ErrOptionsTooLong
+		}
+		return &MountError{Op: "mount", Source: fstype, Target: target, FSType: fstype, Detail: detail, Err: err}
+	}
+	fd, err := unix.Fsopen(fstype, unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return fail(err, "")
+	}
+	defer unix.Close(fd)
+
+	for _, opt := range splitEscaped(options, ',') {
+		key, value, hasValue := strings.Cut(opt, "=")
+		if key == "lowerdir" {
+			for _, dir := range splitEscaped(value, ':') {
+				if err := unix.FsconfigSetString(fd, "lowerdir+", unescapeOption(dir)); err != nil {
+					if errors.Is(err, unix.EINVAL) {
+						// Kernels before 6.8 know no lowerdir+.
+						return fail(ErrOptionsTooLong, fsLog(fd))
+					}
+					return fail(err, fsLog(fd))
+				}
+			}
+			continue
+		}
+		if !hasValue {
+			err = unix.FsconfigSetFlag(fd, key)
+		} else {
+			err = unix.FsconfigSetString(fd, key, unescapeOption(value))
+		}
+		if err != nil {
+			return fail(err, fsLog(fd))
+		}
+	}
+	if err := unix.FsconfigCreate(fd); err != nil {
+		return fail(err, fsLog(fd))
+	}
+	mfd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, 0)
+	if err != nil {
+		return fail(err, fsLog(fd))
+	}
+	defer unix.Close(mfd)
+	if err := unix.MoveMount(mfd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fail(err, "")
+	}
+	return nil
+}
+
+// fsLog drains the messages the kernel logged on a filesystem context.
+func fsLog(fd int) string {
+	var msgs []string
+	buf := make([]byte, 1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil || n <= 0 {
+			break
+		}
+		// Each message is "e ", "w " or "i " followed by the text.
+		msgs = append(msgs, strings.TrimSpace(string(buf[:n])))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// escapeOptionPath escapes a path for an overlay option value: a comma
+// separates options, a colon lower layers, and a backslash escapes either.
+func escapeOptionPath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if r == '\\' || r == ',' || r == ':' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unescapeOption undoes escapeOptionPath.
+func unescapeOption(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// splitEscaped splits s at every sep not escaped with a backslash, keeping
+// the escapes.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
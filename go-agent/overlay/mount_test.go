@@ -0,0 +1,120 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestEscapeOptionPath_RoundTrip(t *testing.T) {
+	dirs := []string{`/data/a b`, `/data/c,d`, `/data/e:f`, `/data/g\h`}
+	escaped := make([]string, len(dirs))
+	for i, d := range dirs {
+		escaped[i] = escapeOptionPath(d)
+	}
+	opts := "lowerdir=" + strings.Join(escaped, ":") + ",upperdir=" + escapeOptionPath("/data/u,1")
+
+	parts := splitEscaped(opts, ',')
+	if len(parts) != 2 {
+		t.Fatalf("options split into %q", parts)
+	}
+	var got []string
+	for _, d := range splitEscaped(strings.TrimPrefix(parts[0], "lowerdir="), ':') {
+		got = append(got, unescapeOption(d))
+	}
+	if strings.Join(got, "|") != strings.Join(dirs, "|") {
+		t.Errorf("lower dirs = %q, want %q", got, dirs)
+	}
+	if u := unescapeOption(strings.TrimPrefix(parts[1], "upperdir=")); u != "/data/u,1" {
+		t.Errorf("upperdir = %q", u)
+	}
+}
+
+func TestNativeRunner_RejectsUnknownCommands(t *testing.T) {
+	if err := NativeRunner("mount", "-t", "tmpfs", "none", "/mnt"); err == nil {
+		t.Fatal("a command LayerManager never issues was run")
+	}
+}
+
+// newNativeManager returns a LayerManager that really mounts, in a data
+// dir whose name needs escaping, or skips the test where mounting is not
+// permitted.
+func newNativeManager(t *testing.T) *LayerManager {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	base := t.TempDir()
+	lm := &LayerManager{
+		DataDir: filepath.Join(base, "layers, with: punctuation"),
+		RootDir: filepath.Join(base, "app root"),
+		Run:     NativeRunner,
+	}
+	if err := os.MkdirAll(lm.RootDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return lm
+}
+
+func TestNativeRunner_MountsLayerStack(t *testing.T) {
+	lm := newNativeManager(t)
+	os.WriteFile(filepath.Join(lm.RootDir, "base.txt"), []byte("base"), 0o644)
+	if err := lm.InitVolume(); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skipf("mounting not permitted: %v", err)
+		}
+		t.Fatalf("InitVolume: %v", err)
+	}
+	os.WriteFile(filepath.Join(lm.RootDir, "app.txt"), []byte("v1"), 0o644)
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		t.Fatalf("CreateCheckpoint: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(lm.RootDir, "base.txt")); string(got) != "base" {
+		t.Errorf("base.txt through the stack = %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(lm.dir("u", 1), "app.txt")); string(got) != "v1" {
+		t.Errorf("frozen layer holds %q", got)
+	}
+	if _, err := lm.unmountStack(); err != nil {
+		t.Fatalf("unmount: %v", err)
+	}
+
+	err := NativeRunner("umount", "-l", lm.RootDir)
+	var merr *MountError
+	if !errors.As(err, &merr) || merr.Op != "umount" || !errors.Is(err, unix.EINVAL) {
+		t.Fatalf("unmounting what is not mounted = %v, want a *MountError with EINVAL", err)
+	}
+}
+
+func TestNativeRunner_LongLowerdirUsesNewMountAPI(t *testing.T) {
+	lm := newNativeManager(t)
+	const layers = 48
+	for n := 1; n <= layers; n++ {
+		dir := lm.LayerDir(n)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, "layer"), []byte(fmt.Sprint(n)), 0o644)
+	}
+	if len(lm.DataDir)*layers < os.Getpagesize() {
+		t.Fatalf("%d layers fit mount(2)'s options", layers)
+	}
+	if err := lm.InitVolume(); err != nil {
+		switch {
+		case errors.Is(err, unix.EPERM):
+			t.Skipf("mounting not permitted: %v", err)
+		case errors.Is(err, ErrOptionsTooLong):
+			t.Skipf("kernel without lowerdir+: %v", err)
+		}
+		t.Fatalf("InitVolume: %v", err)
+	}
+	defer lm.unmountStack()
+	if got, _ := os.ReadFile(filepath.Join(lm.RootDir, "layer")); string(got) != fmt.Sprint(layers) {
+		t.Errorf("topmost layer = %q, want %d", got, layers)
+	}
+}
@@ -0,0 +1,195 @@
+package overlay
+
+// Rootless volume checkpointing.
+//
+// By default (Privileged) the overlay stack is mounted with the kernel's
+// overlayfs, which needs CAP_SYS_ADMIN in the initial user namespace, i.e. a
+// privileged container. Two modes do without it; both run the pod in a user
+// namespace of its own (hostUsers: false), whose CAP_SYS_ADMIN only covers
+// the pod's own mounts, so the bind mount over RootDir keeps working:
+//
+//	UserNamespace  the kernel's overlayfs, mounted with userxattr so it
+//	               keeps its metadata in user.overlay.* attributes (Linux
+//	               5.11+)
+//	FUSE           fuse-overlayfs (FUSE_OVERLAYFS names the binary), for
+//	               kernels or policies that do not allow the former; needs
+//	               /dev/fuse
+//
+// The layout, the transfer and the VolumeManager methods are the same in
+// every mode. The mode is the MC's, from the workload spec, else
+// VOLUME_MOUNT_MODE; InitVolume records it in DataDir/.mount_mode, so the
+// sync daemon and the preStop hook manage the stack with it too. Both pods
+// of a migration mount with the workload's mode, so the layers' metadata
+// means the same on either side.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go-agent/utils"
+)
+
+// MountMode is how LayerManager mounts the overlay stack.
+type MountMode string
+
+const (
+	MountPrivileged    MountMode = "Privileged"
+	MountUserNamespace MountMode = "UserNamespace"
+	MountFUSE          MountMode = "FUSE"
+)
+
+// ParseMountMode parses a mount mode, case-insensitively; "" is
+// Privileged.
+func ParseMountMode(s string) (MountMode, error) {
+	for _, m := range []MountMode{MountPrivileged, MountUserNamespace, MountFUSE} {
+		if strings.EqualFold(s, string(m)) {
+			return m, nil
+		}
+	}
+	if s == "" {
+		return MountPrivileged, nil
+	}
+	return MountPrivileged, fmt.Errorf("unknown volume mount mode %q (want Privileged, UserNamespace or FUSE)", s)
+}
+
+// MountModeFromEnv returns the mount mode VOLUME_MOUNT_MODE names.
+func MountModeFromEnv() (MountMode, error) {
+	mode, err := ParseMountMode(os.Getenv("VOLUME_MOUNT_MODE"))
+	if err != nil {
+		return mode, fmt.Errorf("VOLUME_MOUNT_MODE: %w", err)
+	}
+	return mode, nil
+}
+
+// SetMountMode makes lm mount in mode from now on.
+func (lm *LayerManager) SetMountMode(mode MountMode) {
+	lm.Mode = mode
+	if mode == MountFUSE {
+		if !fuseAvailable() {
+			log.Printf("volume mount mode FUSE: %s not found", utils.EnvOr("FUSE_OVERLAYFS", "fuse-overlayfs"))
+		}
+		lm.Run = FUSERunner
+		return
+	}
+	run, err := RunnerFromEnv()
+	if err != nil {
+		log.Printf("%v; using the native backend", err)
+	}
+	lm.Run = run
+}
+
+// mountModeMarker records the mode the stack in DataDir was mounted with.
+func (lm *LayerManager) mountModeMarker() string {
+	return filepath.Join(lm.DataDir, ".mount_mode")
+}
+
+// recordedMountMode returns the mode recorded in DataDir, if any.
+func (lm *LayerManager) recordedMountMode() (MountMode, bool) {
+	data, err := os.ReadFile(lm.mountModeMarker())
+	if err != nil {
+		return "", false
+	}
+	mode, err := ParseMountMode(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Printf("%s: %v", lm.mountModeMarker(), err)
+		return "", false
+	}
+	return mode, true
+}
+
+// recordMountMode records lm.Mode in DataDir.
+func (lm *LayerManager) recordMountMode() error {
+	mode := lm.Mode
+	if mode == "" {
+		mode = MountPrivileged
+	}
+	if err := os.WriteFile(lm.mountModeMarker(), []byte(string(mode)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("record mount mode: %w", err)
+	}
+	return nil
+}
+
+// overlayOptions returns the mount options specific to lm.Mode.
+func (lm *LayerManager) overlayOptions() string {
+	if lm.Mode == MountUserNamespace {
+		return ",userxattr"
+	}
+	return ""
+}
+
+// opaqueXattr returns the attribute marking a directory opaque in lm.Mode.
+func (lm *LayerManager) opaqueXattr() string {
+	switch lm.Mode {
+	case MountUserNamespace:
+		return "user.overlay.opaque"
+	case MountFUSE:
+		return "user.fuseoverlayfs.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// FUSERunner carries out the commands LayerManager issues like
+// NativeRunner, except that it mounts an overlay with fuse-overlayfs.
+func FUSERunner(name string, args ...string) error {
+	if name == "mount" && len(args) == 6 && args[0] == "-t" && args[1] == "overlay" && args[3] == "-o" {
+		return mountFUSE(args[4], args[5])
+	}
+	return NativeRunner(name, args...)
+}
+
+// mountFUSE mounts fuse-overlayfs on target with options, the -o string of
+// an overlay mount. fuse-overlayfs unmounts when it is unmounted.
+func mountFUSE(options, target string) error {
+	opts, err := fuseOptions(options)
+	if err != nil {
+		return &MountError{Op: "mount", Source: "fuse-overlayfs", Target: target, FSType: "fuse-overlayfs", Err: err}
+	}
+	bin := utils.EnvOr("FUSE_OVERLAYFS", "fuse-overlayfs")
+	// fuse-overlayfs returns once the mount is up, leaving its daemon
+	// serving it.
+	if err := ExecRunner(bin, "-o", opts, target); err != nil {
+		return &MountError{Op: "mount", Source: "fuse-overlayfs", Target: target, FSType: "fuse-overlayfs", Err: err}
+	}
+	return nil
+}
+
+// errFUSEColon is the error of a layer path fuse-overlayfs cannot take.
+var errFUSEColon = errors.New("fuse-overlayfs cannot take a layer path containing a colon")
+
+// fuseOptions rewrites overlay options for fuse-overlayfs, whose option
+// parser escapes commas and backslashes but knows no escaped colon.
+func fuseOptions(options string) (string, error) {
+	escape := strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+	var out []string
+	for _, opt := range splitEscaped(options, ',') {
+		key, value, hasValue := strings.Cut(opt, "=")
+		switch {
+		case key == "userxattr":
+			continue // fuse-overlayfs keeps its own attributes
+		case !hasValue:
+			out = append(out, key)
+			continue
+		}
+		var dirs []string
+		for _, dir := range splitEscaped(value, ':') {
+			dir = unescapeOption(dir)
+			if strings.Contains(dir, ":") {
+				return "", fmt.Errorf("%w: %s", errFUSEColon, dir)
+			}
+			dirs = append(dirs, escape.Replace(dir))
+		}
+		out = append(out, key+"="+strings.Join(dirs, ":"))
+	}
+	return strings.Join(out, ","), nil
+}
+
+// fuseAvailable reports whether the fuse-overlayfs binary can be found.
+func fuseAvailable() bool {
+	_, err := exec.LookPath(utils.EnvOr("FUSE_OVERLAYFS", "fuse-overlayfs"))
+	return err == nil
+}
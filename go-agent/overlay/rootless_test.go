@@ -0,0 +1,72 @@
+package overlay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMountMode(t *testing.T) {
+	for in, want := range map[string]MountMode{"": MountPrivileged, "fuse": MountFUSE, "UserNamespace": MountUserNamespace} {
+		if got, err := ParseMountMode(in); err != nil || got != want {
+			t.Errorf("ParseMountMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMountMode("rootless"); err == nil {
+		t.Error("an unknown mode was accepted")
+	}
+}
+
+func TestUserNamespaceMode_RecordedForOtherProcesses(t *testing.T) {
+	lm, fr := newTestManager(t)
+	lm.Mode = MountUserNamespace
+	if err := lm.InitVolume(); err != nil {
+		t.Fatalf("InitVolume: %v", err)
+	}
+	if !strings.HasSuffix(fr.calls[0], ",userxattr "+lm.dir("o", 1)) {
+		t.Errorf("mount = %s, want the userxattr option", fr.calls[0])
+	}
+	// The preStop hook manages the stack with the mode it was mounted with.
+	t.Setenv("VOLUME_MOUNT_MODE", "Privileged")
+	if hook := NewLayerManager(lm.DataDir, lm.RootDir); hook.Mode != MountUserNamespace {
+		t.Errorf("mode of a new manager = %q, want %q", hook.Mode, MountUserNamespace)
+	}
+	if fresh := NewLayerManager(t.TempDir(), lm.RootDir); fresh.Mode != MountPrivileged {
+		t.Errorf("mode without a recorded one = %q, want VOLUME_MOUNT_MODE's", fresh.Mode)
+	}
+}
+
+func TestFuseOptions(t *testing.T) {
+	opts := "lowerdir=" + escapeOptionPath("/data/l2") + ":" + escapeOptionPath("/data/a,b") +
+		",upperdir=" + escapeOptionPath(`/data/u\1`) + ",workdir=/data/w1,userxattr"
+	got, err := fuseOptions(opts)
+	if want := `lowerdir=/data/l2:/data/a\,b,upperdir=/data/u\\1,workdir=/data/w1`; err != nil || got != want {
+		t.Errorf("fuseOptions = %q, %v; want %q", got, err, want)
+	}
+	if _, err := fuseOptions("lowerdir=" + escapeOptionPath("/data/a:b")); !errors.Is(err, errFUSEColon) {
+		t.Errorf("a colon in a layer path = %v, want errFUSEColon", err)
+	}
+}
+
+func TestFUSERunner_RunsFuseOverlayfs(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "fuse-overlayfs")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > "+argsFile+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FUSE_OVERLAYFS", script)
+
+	lm := NewLayerManager(t.TempDir(), "/mnt/approot")
+	lm.SetMountMode(MountFUSE)
+	if err := lm.mountLevel(1, []string{lm.RootDir}); err != nil {
+		t.Fatalf("mountLevel: %v", err)
+	}
+	got, _ := os.ReadFile(argsFile)
+	want := "-o\nlowerdir=/mnt/approot,upperdir=" + lm.dir("u", 1) + ",workdir=" + lm.dir("w", 1) + "\n" + lm.dir("o", 1) + "\n"
+	if string(got) != want {
+		t.Errorf("fuse-overlayfs args = %q, want %q", got, want)
+	}
+}
@@ -9,25 +9,22 @@ package overlay
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"go-agent/utils"
 )
 
 // Runner executes a privileged system command (mount/umount). It is
-// injectable so unit tests can run without real mounts.
+// injectable so unit tests can run without real mounts; see mount.go for
+// the real backends.
 type Runner func(name string, args ...string) error
 
-// ExecRunner runs the command for real via os/exec.
-func ExecRunner(name string, args ...string) error {
-	_, err := utils.Run(name, strings.Join(args, " "))
-	return err
-}
-
 // VolumeManager is the five-method volume migration API from the paper.
 type VolumeManager interface {
 	// InitVolume ensures the lowerdir/upperdir structure exists and
@@ -38,40 +35,69 @@ type VolumeManager interface {
 	// the ordinal of the frozen layer.
 	CreateCheckpoint() (int, error)
 	// CopyCheckpoint streams every frozen, not-yet-transferred layer to the
-	// destination agent at destAddr (tar+gzip over TCP).
-	CopyCheckpoint(destAddr string) error
-	// ReceiveCheckpoint extracts one incoming layer payload (gzip+tar
-	// stream) into lower layer <ordinal> on the destination node.
-	ReceiveCheckpoint(ordinal int, payload io.Reader) error
+	// destination agent over s, a transfer session opened with the MC's
+	// grant (compressed tar over TCP).
+	CopyCheckpoint(s utils.Sender) error
+	// ReceiveCheckpoint extracts one incoming layer payload (tar stream
+	// compressed with codec) into lower layer <ordinal> on the destination
+	// node.
+	ReceiveCheckpoint(ordinal int, codec utils.Codec, payload io.Reader) error
 	// EndVolume unmounts the overlay stack and transfers the final,
-	// un-transferred upper layer to destAddr (empty destAddr skips the
-	// transfer, e.g. on normal termination).
-	EndVolume(destAddr string) error
+	// un-transferred upper layer over s (a nil s skips the transfer, e.g.
+	// on normal termination).
+	EndVolume(s utils.Sender) error
 }
 
 // LayerManager implements VolumeManager.
 //
 // On-disk layout inside DataDir:
 //
-//	u<N>      upper (writable) dir of level N; frozen once level N+1 exists
-//	w<N>      OverlayFS workdir of level N
-//	o<N>      merged mountpoint of level N
-//	l<N>      received lower layer N (destination side)
-//	.sent_<N> marker: layer u<N> was successfully transferred
+//	u<N>        upper (writable) dir of level N; frozen once level N+1 exists
+//	w<N>        OverlayFS workdir of level N
+//	o<N>        merged mountpoint of level N
+//	l<N>        received lower layer N (destination side), or the layers
+//	            up to N squashed into one (see compact.go)
+//	.staging-*  a layer still being received (see utils/staging.go)
+//	.sent_<N>   marker: layer u<N> was successfully transferred; holds the
+//	            SHA-256 of the payload the destination verified
+//	.lock       flock serialising overlay operations across agent processes
+//	.mount_mode the MountMode the stack was mounted with (see rootless.go)
+//	.journal    write-ahead journal of the overlay operation in progress
+//	            (see journal.go)
 type LayerManager struct {
-	DataDir string // layer storage root (default /data)
-	RootDir string // application volume mountpoint
-	Run     Runner // mount/umount executor
+	DataDir string    // layer storage root (default /data)
+	RootDir string    // application volume mountpoint
+	Run     Runner    // mount/umount executor
+	Mode    MountMode // how the stack is mounted; set with SetMountMode
+
+	// CompactDepth is how many received lower layers InitVolume mounts
+	// before it squashes the oldest ones; 0 never squashes.
+	CompactDepth int
 
 	level int // current writable level (0 = not mounted yet)
 }
 
-// NewLayerManager returns a LayerManager using the real ExecRunner.
+// NewLayerManager returns a LayerManager using the mount mode the stack in
+// dataDir was mounted with, else VOLUME_MOUNT_MODE, and the mount backend
+// MOUNT_BACKEND selects.
 func NewLayerManager(dataDir, rootDir string) *LayerManager {
 	if dataDir == "" {
 		dataDir = "/data"
 	}
-	return &LayerManager{DataDir: dataDir, RootDir: rootDir, Run: ExecRunner}
+	lm := &LayerManager{
+		DataDir:      dataDir,
+		RootDir:      rootDir,
+		CompactDepth: utils.EnvInt("LAYER_COMPACT_DEPTH", defaultCompactDepth),
+	}
+	mode, ok := lm.recordedMountMode()
+	if !ok {
+		var err error
+		if mode, err = MountModeFromEnv(); err != nil {
+			log.Printf("%v; using %s", err, mode)
+		}
+	}
+	lm.SetMountMode(mode)
+	return lm
 }
 
 // Level returns the current writable layer level (0 when unmounted).
@@ -79,54 +105,123 @@ func (lm *LayerManager) Level() int { return lm.level }
 
 // Discover derives the current level from the directories present in
 // DataDir, so a separate process (the preStop hook) can resume management of
-// an overlay stack created by the agent at container start.
+// an overlay stack created by the agent at container start. It first
+// finishes or rolls back an operation that was interrupted, and fails with
+// ErrStackMismatch when the mounted stack is not the one DataDir describes
+// (see journal.go).
 func (lm *LayerManager) Discover() error {
+	if err := lm.recoverJournal(); err != nil {
+		return err
+	}
 	uppers, err := lm.numberedDirs("u")
 	if err != nil {
 		return err
 	}
-	if len(uppers) == 0 {
-		lm.level = 0
-		return nil
+	lm.level = 0
+	if len(uppers) > 0 {
+		lm.level = uppers[len(uppers)-1]
 	}
-	lm.level = uppers[len(uppers)-1]
-	return nil
+	return lm.checkMounts()
+}
+
+// Mounted reports whether RootDir shows the current level, as it does
+// after Discover when the stack outlived the process that mounted it.
+func (lm *LayerManager) Mounted() (bool, error) {
+	if lm.level == 0 {
+		return false, nil
+	}
+	st, err := lm.stackState()
+	if err != nil {
+		return false, err
+	}
+	return st.bound == lm.level, nil
+}
+
+// Lock takes an exclusive flock on DataDir/.lock, blocking until it is
+// available. The sync daemon and the preStop hook run as separate processes
+// over the same stack; holding the lock keeps a pre-sync round from
+// remounting while end_container is freezing the final layer. The returned
+// function releases the lock.
+func (lm *LayerManager) Lock() (func(), error) {
+	if err := os.MkdirAll(lm.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", lm.DataDir, err)
+	}
+	path := filepath.Join(lm.DataDir, ".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %w", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
 }
 
 // InitVolume implements the paper's Init Volume method: it creates the
 // upperdir/workdir/merged structure for a fresh writable layer, mounts the
 // overlay using any received lower layers (or the original volume content)
-// as lowerdir, and bind-mounts the merged view over RootDir.
+// as lowerdir, and bind-mounts the merged view over RootDir. Lower layers
+// beyond CompactDepth are squashed first. Upper layers frozen below the new
+// level, which Discover finds after a restart, stay in the stack above the
+// received ones.
 func (lm *LayerManager) InitVolume() error {
 	lowers, err := lm.numberedDirs("l")
 	if err != nil {
 		return fmt.Errorf("list lower layers: %w", err)
 	}
+	if lowers, err = lm.compactLowers(lowers); err != nil {
+		return fmt.Errorf("compact lower layers: %w", err)
+	}
 
 	level := lm.level + 1
+	if err := lm.beginOp(opMount, level); err != nil {
+		return err
+	}
+	if err := lm.mountStack(level, lowers); err != nil {
+		return err
+	}
+	lm.level = level
+	if err := lm.recordMountMode(); err != nil {
+		return err
+	}
+	return lm.endOp()
+}
+
+// mountStack mounts level on the upper layers below it and the given lower
+// layers, or on RootDir when there are none, and binds it over RootDir.
+func (lm *LayerManager) mountStack(level int, lowers []int) error {
 	if err := lm.mkLevelDirs(level); err != nil {
 		return err
 	}
+	uppers, err := lm.numberedDirs("u")
+	if err != nil {
+		return fmt.Errorf("list upper layers: %w", err)
+	}
 
 	// Newest layer must be the leftmost (topmost) lowerdir entry.
-	var lowerdir string
-	if len(lowers) == 0 {
-		lowerdir = lm.RootDir
-	} else {
-		parts := make([]string, 0, len(lowers))
-		for i := len(lowers) - 1; i >= 0; i-- {
-			parts = append(parts, lm.dir("l", lowers[i]))
+	var lowerdirs []string
+	for i := len(uppers) - 1; i >= 0; i-- {
+		if uppers[i] < level {
+			lowerdirs = append(lowerdirs, lm.dir("u", uppers[i]))
 		}
-		lowerdir = strings.Join(parts, ":")
+	}
+	for i := len(lowers) - 1; i >= 0; i-- {
+		lowerdirs = append(lowerdirs, lm.dir("l", lowers[i]))
+	}
+	if len(lowers) == 0 {
+		lowerdirs = append(lowerdirs, lm.RootDir)
 	}
 
-	if err := lm.mountLevel(level, lowerdir); err != nil {
+	if err := lm.mountLevel(level, lowerdirs); err != nil {
 		return err
 	}
 	if err := lm.Run("mount", "--bind", lm.dir("o", level), lm.RootDir); err != nil {
 		return fmt.Errorf("bind %s over %s: %w", lm.dir("o", level), lm.RootDir, err)
 	}
-	lm.level = level
 	return nil
 }
 
@@ -137,40 +232,65 @@ func (lm *LayerManager) CreateCheckpoint() (int, error) {
 	}
 	frozen := lm.level
 	level := frozen + 1
+	if err := lm.beginOp(opCheckpoint, level); err != nil {
+		return 0, err
+	}
 	if err := lm.mkLevelDirs(level); err != nil {
 		return 0, err
 	}
 	// The previous merged view becomes the (frozen, read-only) lowerdir.
-	if err := lm.mountLevel(level, lm.dir("o", frozen)); err != nil {
+	if err := lm.mountLevel(level, []string{lm.dir("o", frozen)}); err != nil {
+		return 0, err
+	}
+	if err := lm.logStep(stepMounted); err != nil {
 		return 0, err
 	}
 	if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
 		return 0, fmt.Errorf("unbind %s: %w", lm.RootDir, err)
 	}
+	if err := lm.logStep(stepUnbound); err != nil {
+		return 0, err
+	}
 	if err := lm.Run("mount", "--bind", lm.dir("o", level), lm.RootDir); err != nil {
 		return 0, fmt.Errorf("bind %s over %s: %w", lm.dir("o", level), lm.RootDir, err)
 	}
 	lm.level = level
+	if err := lm.endOp(); err != nil {
+		return 0, err
+	}
 	return frozen, nil
 }
 
-// CopyCheckpoint implements the paper's Copy Checkpoint method.
-func (lm *LayerManager) CopyCheckpoint(destAddr string) error {
-	if destAddr == "" {
-		return fmt.Errorf("no destination address")
-	}
-	uppers, err := lm.numberedDirs("u")
+// CopyCheckpoint implements the paper's Copy Checkpoint method over s, so
+// the layers share one connection with the rest of the transfer.
+func (lm *LayerManager) CopyCheckpoint(s utils.Sender) error {
+	pending, err := lm.UnsentLayers()
 	if err != nil {
-		return fmt.Errorf("list upper layers: %w", err)
+		return err
 	}
-	for _, n := range uppers {
-		if n >= lm.level || lm.isSent(n) {
-			continue // still writable, or already transferred
-		}
-		if err := utils.SendDir(destAddr, n, fmt.Sprintf("u%d", n), lm.dir("u", n)); err != nil {
+	return lm.sendLayersTo(s, pending)
+}
+
+// sendLayersTo queues the given upper layers on s and marks them sent once
+// the destination has acknowledged all of them. Large files changed since a
+// layer the destination already holds are sent as block-level deltas.
+func (lm *LayerManager) sendLayersTo(s utils.Sender, layers []int) error {
+	for i, n := range layers {
+		if err := s.SendLayer(n, fmt.Sprintf("u%d", n), lm.dir("u", n), lm.deltaBase(n, layers[:i])); err != nil {
 			return fmt.Errorf("send layer %d: %w", n, err)
 		}
-		if err := lm.markSent(n); err != nil {
+	}
+	if err := s.Flush(); err != nil {
+		return fmt.Errorf("send layers %v: %w", layers, err)
+	}
+	digests := make(map[int]string)
+	for _, e := range s.Sent() {
+		if e.Kind == utils.KindLayer {
+			digests[e.Ordinal] = e.SHA256
+		}
+	}
+	for _, n := range layers {
+		if err := lm.markSent(n, digests[n]); err != nil {
 			return err
 		}
 	}
@@ -178,63 +298,256 @@ func (lm *LayerManager) CopyCheckpoint(destAddr string) error {
 }
 
 // ReceiveCheckpoint implements the paper's Receive Checkpoint method. The
-// payload is a gzip-compressed tar stream of one layer. When the volume is
-// already mounted the overlay is remounted to include the new layer.
-func (lm *LayerManager) ReceiveCheckpoint(ordinal int, payload io.Reader) error {
+// payload is a compressed tar stream of one layer; delta-encoded files are
+// rebuilt from the lower layers received before it. The layer is extracted
+// into a staging dir and renamed to l<ordinal> only once all of it is there,
+// so a failed transfer never leaves a partial layer for InitVolume to
+// mount. When the volume is already mounted the overlay is remounted to
+// include the new layer.
+func (lm *LayerManager) ReceiveCheckpoint(ordinal int, codec utils.Codec, payload io.Reader) error {
 	dest := lm.dir("l", ordinal)
-	if err := utils.ExtractTarGz(payload, dest); err != nil {
+	staged, err := utils.StagingDir(lm.DataDir, filepath.Base(dest))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staged)
+	if err := utils.ExtractTarWith(payload, codec, staged, utils.ExtractOptions{LayerDir: lm.baseLayerDir}); err != nil {
 		return fmt.Errorf("extract layer %d: %w", ordinal, err)
 	}
+	if err := utils.PublishDir(staged, dest); err != nil {
+		return fmt.Errorf("layer %d: %w", ordinal, err)
+	}
 	if lm.level > 0 {
 		// Remount on the fly so the running container sees the new layer.
-		if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
-			return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
-		}
-		if err := lm.Run("umount", "-l", lm.dir("o", lm.level)); err != nil {
-			return fmt.Errorf("unmount level %d: %w", lm.level, err)
+		if err := lm.unmountLevel(); err != nil {
+			return err
 		}
-		lm.level--
 		return lm.InitVolume()
 	}
 	return nil
 }
 
+// unmountLevel unbinds RootDir and unmounts the writable level, so that
+// InitVolume mounts it again on the current lower layers. The journal
+// holds a remount until InitVolume starts.
+func (lm *LayerManager) unmountLevel() error {
+	if err := lm.beginOp(opRemount, lm.level); err != nil {
+		return err
+	}
+	if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
+		return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+	}
+	if err := lm.logStep(stepUnbound); err != nil {
+		return err
+	}
+	if err := lm.Run("umount", "-l", lm.dir("o", lm.level)); err != nil {
+		return fmt.Errorf("unmount level %d: %w", lm.level, err)
+	}
+	if err := lm.logStep(stepUnmounted); err != nil {
+		return err
+	}
+	lm.level--
+	return nil
+}
+
 // EndVolume implements the paper's End Volume method: unmount the stack and
-// transfer the final upper layer that was never frozen/copied.
-func (lm *LayerManager) EndVolume(destAddr string) error {
+// transfer the final upper layer that was never frozen/copied over s.
+func (lm *LayerManager) EndVolume(s utils.Sender) error {
+	final, err := lm.unmountStack()
+	if err != nil {
+		return err
+	}
+	if s == nil || lm.isSent(final) {
+		return nil
+	}
+	if err := lm.sendLayersTo(s, []int{final}); err != nil {
+		return fmt.Errorf("send final layer %d: %w", final, err)
+	}
+	return nil
+}
+
+// SnapshotTo freezes the current upper layer and sends the whole volume to
+// s as a point-in-time snapshot: the received lower layers, then every
+// frozen upper layer, numbered 1, 2, ... from the bottom so a restore can
+// receive them as lower layers. Layers are not marked sent; a snapshot does
+// not count towards a migration. It returns the number of layers sent.
+func (lm *LayerManager) SnapshotTo(s utils.Sender) (int, error) {
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		return 0, fmt.Errorf("freeze layer: %w", err)
+	}
+	lowers, err := lm.numberedDirs("l")
+	if err != nil {
+		return 0, fmt.Errorf("list lower layers: %w", err)
+	}
+	uppers, err := lm.numberedDirs("u")
+	if err != nil {
+		return 0, fmt.Errorf("list upper layers: %w", err)
+	}
+	var dirs []string
+	for _, n := range lowers {
+		dirs = append(dirs, lm.dir("l", n))
+	}
+	for _, n := range uppers {
+		if n < lm.level {
+			dirs = append(dirs, lm.dir("u", n))
+		}
+	}
+	for i, dir := range dirs {
+		if err := s.SendDir(i+1, filepath.Base(dir), dir); err != nil {
+			return 0, fmt.Errorf("send %s: %w", filepath.Base(dir), err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		return 0, err
+	}
+	return len(dirs), nil
+}
+
+// unmountStack unmounts the bind mount and every merged level, and returns
+// the ordinal of the last writable upper layer.
+func (lm *LayerManager) unmountStack() (int, error) {
 	if lm.level == 0 {
-		return fmt.Errorf("volume not initialised")
+		return 0, fmt.Errorf("volume not initialised")
 	}
 	final := lm.level
 
+	if err := lm.beginOp(opUnmount, final); err != nil {
+		return 0, err
+	}
 	if err := lm.Run("umount", "-l", lm.RootDir); err != nil {
-		return fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+		return 0, fmt.Errorf("unbind %s: %w", lm.RootDir, err)
+	}
+	if err := lm.logStep(stepUnbound); err != nil {
+		return 0, err
 	}
 	merged, err := lm.numberedDirs("o")
 	if err != nil {
-		return fmt.Errorf("list merged dirs: %w", err)
+		return 0, fmt.Errorf("list merged dirs: %w", err)
 	}
 	for i := len(merged) - 1; i >= 0; i-- {
 		if err := lm.Run("umount", "-l", lm.dir("o", merged[i])); err != nil {
-			return fmt.Errorf("unmount level %d: %w", merged[i], err)
+			return 0, fmt.Errorf("unmount level %d: %w", merged[i], err)
 		}
 	}
 	lm.level = 0
+	if err := lm.endOp(); err != nil {
+		return 0, err
+	}
+	return final, nil
+}
 
-	if destAddr != "" && !lm.isSent(final) {
-		if err := utils.SendDir(destAddr, final, fmt.Sprintf("u%d", final), lm.dir("u", final)); err != nil {
-			return fmt.Errorf("send final layer %d: %w", final, err)
+// UnsentLayers returns the ordinals of frozen upper layers that have not
+// been transferred yet, oldest first. The writable level is never included.
+func (lm *LayerManager) UnsentLayers() ([]int, error) {
+	uppers, err := lm.numberedDirs("u")
+	if err != nil {
+		return nil, fmt.Errorf("list upper layers: %w", err)
+	}
+	var pending []int
+	for _, n := range uppers {
+		if n >= lm.level || lm.isSent(n) {
+			continue // still writable, or already transferred
 		}
-		if err := lm.markSent(final); err != nil {
-			return err
+		pending = append(pending, n)
+	}
+	return pending, nil
+}
+
+// SentLayers returns how many upper layers carry a .sent marker, i.e. the
+// number of layers this source has transferred so far.
+func (lm *LayerManager) SentLayers() (int, error) {
+	markers, err := filepath.Glob(filepath.Join(lm.DataDir, ".sent_*"))
+	if err != nil {
+		return 0, fmt.Errorf("list sent markers: %w", err)
+	}
+	return len(markers), nil
+}
+
+// SentManifest returns a manifest entry for every layer marked sent, oldest
+// first, so a final session can vouch for layers shipped by earlier ones.
+func (lm *LayerManager) SentManifest() ([]utils.ManifestEntry, error) {
+	uppers, err := lm.numberedDirs("u")
+	if err != nil {
+		return nil, fmt.Errorf("list upper layers: %w", err)
+	}
+	var items []utils.ManifestEntry
+	for _, n := range uppers {
+		digest, err := os.ReadFile(lm.sentMarker(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read sent marker %d: %w", n, err)
 		}
+		items = append(items, utils.ManifestEntry{
+			Kind:    utils.KindLayer,
+			Ordinal: n,
+			Name:    fmt.Sprintf("u%d", n),
+			SHA256:  strings.TrimSpace(string(digest)),
+		})
 	}
-	return nil
+	return items, nil
 }
 
+// UpperDir returns the upper dir of level n, frozen layer n once level n+1
+// exists.
+func (lm *LayerManager) UpperDir(n int) string { return lm.dir("u", n) }
+
 // LayerDir returns the destination directory for received lower layer n.
 func (lm *LayerManager) LayerDir(n int) string { return lm.dir("l", n) }
 
+// ReceivedLayers returns the ordinals of the lower layers received so far,
+// oldest first.
+func (lm *LayerManager) ReceivedLayers() ([]int, error) {
+	lowers, err := lm.numberedDirs("l")
+	if err != nil {
+		return nil, fmt.Errorf("list lower layers: %w", err)
+	}
+	return lowers, nil
+}
+
+// DropReceivedLayers removes every received lower layer, so the volume
+// mounts without migrated state. The volume must not be mounted.
+func (lm *LayerManager) DropReceivedLayers() error {
+	lowers, err := lm.ReceivedLayers()
+	if err != nil {
+		return err
+	}
+	for _, n := range lowers {
+		if err := os.RemoveAll(lm.LayerDir(n)); err != nil {
+			return fmt.Errorf("remove layer %d: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// deltaBase returns the DeltaBase of upper layer n: a file's newest
+// earlier version in a frozen layer that was sent before, or is queued
+// ahead of n in batch, is at the destination as lower layer m.
+func (lm *LayerManager) deltaBase(n int, batch []int) utils.DeltaBase {
+	var held []int // newest first
+	for m := n - 1; m >= 1; m-- {
+		if lm.isSent(m) || containsInt(batch, m) {
+			held = append(held, m)
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	return func(name string) (int, string, bool) {
+		for _, m := range held {
+			path := filepath.Join(lm.dir("u", m), filepath.FromSlash(name))
+			info, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+			// A whiteout or a directory hides any older version.
+			return m, path, info.Mode().IsRegular()
+		}
+		return 0, "", false
+	}
+}
+
 // --- helpers ---
 
 func (lm *LayerManager) dir(prefix string, n int) string {
@@ -250,8 +563,15 @@ func (lm *LayerManager) mkLevelDirs(level int) error {
 	return nil
 }
 
-func (lm *LayerManager) mountLevel(level int, lowerdir string) error {
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, lm.dir("u", level), lm.dir("w", level))
+// mountLevel mounts the overlay of level on o<level>, lowerdirs topmost
+// first.
+func (lm *LayerManager) mountLevel(level int, lowerdirs []string) error {
+	escaped := make([]string, len(lowerdirs))
+	for i, dir := range lowerdirs {
+		escaped[i] = escapeOptionPath(dir)
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s%s", strings.Join(escaped, ":"),
+		escapeOptionPath(lm.dir("u", level)), escapeOptionPath(lm.dir("w", level)), lm.overlayOptions())
 	if err := lm.Run("mount", "-t", "overlay", "overlay", "-o", opts, lm.dir("o", level)); err != nil {
 		return fmt.Errorf("mount overlay level %d: %w", level, err)
 	}
@@ -267,8 +587,17 @@ func (lm *LayerManager) isSent(n int) bool {
 	return err == nil
 }
 
-func (lm *LayerManager) markSent(n int) error {
-	if err := os.WriteFile(lm.sentMarker(n), nil, 0o644); err != nil {
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (lm *LayerManager) markSent(n int, digest string) error {
+	if err := os.WriteFile(lm.sentMarker(n), []byte(digest), 0o644); err != nil {
 		return fmt.Errorf("mark layer %d sent: %w", n, err)
 	}
 	return nil
@@ -1,6 +1,8 @@
 package overlay
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -189,14 +191,19 @@ func TestCopyAndReceiveCheckpoint_EndToEnd(t *testing.T) {
 	done := make(chan error, 1)
 	go func() {
 		_, err := utils.ReceiveAll(ln, 5*time.Second, func(h utils.FrameHeader, payload io.Reader) error {
-			return dst.ReceiveCheckpoint(h.Ordinal, payload)
+			return dst.ReceiveCheckpoint(h.Ordinal, h.Codec, payload)
 		})
 		done <- err
 	}()
 
-	if err := src.CopyCheckpoint(ln.Addr().String()); err != nil {
+	s, err := utils.DialSession(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CopyCheckpoint(s); err != nil {
 		t.Fatalf("CopyCheckpoint: %v", err)
 	}
+	s.Close()
 	if err := utils.SendDone(ln.Addr().String()); err != nil {
 		t.Fatalf("SendDone: %v", err)
 	}
@@ -213,8 +220,111 @@ func TestCopyAndReceiveCheckpoint_EndToEnd(t *testing.T) {
 	}
 
 	// A second CopyCheckpoint must not resend the already-sent layer.
-	if err := src.CopyCheckpoint("127.0.0.1:1"); err != nil { // unreachable addr
-		t.Errorf("CopyCheckpoint with nothing to send should succeed, got %v", err)
+	if pending, err := src.UnsentLayers(); err != nil || len(pending) != 0 {
+		t.Errorf("UnsentLayers after the copy = %v, %v; want none", pending, err)
+	}
+}
+
+func TestReceiveCheckpoint_PublishesWholeLayersOnly(t *testing.T) {
+	lm, _ := newTestManager(t)
+	layer := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, data := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+			tw.Write([]byte(data))
+		}
+		tw.Close()
+		return &buf
+	}
+	if err := lm.ReceiveCheckpoint(1, utils.CodecNone, layer(map[string]string{"old.db": "v1"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resend of layer 1 that breaks off half-way keeps the first one.
+	broken := layer(map[string]string{"new.db": strings.Repeat("x", 4096)})
+	broken.Truncate(1024)
+	if err := lm.ReceiveCheckpoint(1, utils.CodecNone, broken); err == nil {
+		t.Fatal("a truncated layer was received")
+	}
+	if got, _ := os.ReadFile(filepath.Join(lm.LayerDir(1), "old.db")); string(got) != "v1" {
+		t.Fatalf("layer 1 after a failed resend: old.db = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(lm.LayerDir(1), "new.db")); !os.IsNotExist(err) {
+		t.Errorf("part of the failed resend was published: %v", err)
+	}
+
+	// A complete resend replaces the layer rather than merging into it.
+	if err := lm.ReceiveCheckpoint(1, utils.CodecNone, layer(map[string]string{"new.db": "v2"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(lm.LayerDir(1), "old.db")); !os.IsNotExist(err) {
+		t.Errorf("old.db survived the replacement: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(lm.DataDir, ".staging-*")); len(left) != 0 {
+		t.Errorf("staging left behind: %v", left)
+	}
+}
+
+// --- UnsentLayers / SentLayers / Lock ---
+
+func TestUnsentLayers_SkipsWritableAndSent(t *testing.T) {
+	lm, _ := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ { // freeze u1, u2, u3; u4 stays writable
+		if _, err := lm.CreateCheckpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lm.markSent(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := lm.UnsentLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("UnsentLayers = %v, want [2 3]", got)
+	}
+	if n, err := lm.SentLayers(); err != nil || n != 1 {
+		t.Errorf("SentLayers = %d, %v; want 1", n, err)
+	}
+}
+
+func TestLock_SerialisesProcesses(t *testing.T) {
+	lm, _ := newTestManager(t)
+	unlock, err := lm.Lock()
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	// A second manager over the same DataDir stands in for the other agent
+	// process: its flock must block until the first is released.
+	other := NewLayerManager(lm.DataDir, lm.RootDir)
+	acquired := make(chan func(), 1)
+	go func() {
+		u, err := other.Lock()
+		if err != nil {
+			t.Errorf("second Lock: %v", err)
+			close(acquired)
+			return
+		}
+		acquired <- u
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second Lock acquired while the first was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case u := <-acquired:
+		if u != nil {
+			u()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second Lock not acquired after release")
 	}
 }
 
@@ -246,10 +356,15 @@ func TestEndVolume_UnmountsAndSendsFinalLayer(t *testing.T) {
 		done <- err
 	}()
 
+	s, err := utils.DialSession(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
 	fr.calls = nil
-	if err := lm.EndVolume(ln.Addr().String()); err != nil {
+	if err := lm.EndVolume(s); err != nil {
 		t.Fatalf("EndVolume: %v", err)
 	}
+	s.Close()
 	if err := utils.SendDone(ln.Addr().String()); err != nil {
 		t.Fatal(err)
 	}
@@ -278,7 +393,7 @@ func TestEndVolume_NoTransferWithoutDest(t *testing.T) {
 	if err := lm.InitVolume(); err != nil {
 		t.Fatal(err)
 	}
-	if err := lm.EndVolume(""); err != nil {
+	if err := lm.EndVolume(nil); err != nil {
 		t.Fatalf("EndVolume without dest: %v", err)
 	}
 	if lm.Level() != 0 {
@@ -309,3 +424,253 @@ func TestNumberedDirs_NumericSort(t *testing.T) {
 		}
 	}
 }
+
+func TestCopyCheckpoint_EndVolume_OneSession(t *testing.T) {
+	lm, _ := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // freeze u1, u2; u3 is the final layer
+		if _, err := lm.CreateCheckpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dstDir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := 0
+	done := make(chan error, 1)
+	go func() {
+		counting := &countingListener{Listener: ln, n: &accepted}
+		_, err := utils.ReceiveAll(counting, 5*time.Second, func(h utils.FrameHeader, payload io.Reader) error {
+			return utils.ExtractTarGz(payload, filepath.Join(dstDir, h.Name))
+		})
+		done <- err
+	}()
+
+	s, err := utils.DialSession(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := lm.CopyCheckpoint(s); err != nil {
+		t.Fatalf("CopyCheckpoint: %v", err)
+	}
+	if err := lm.EndVolume(s); err != nil {
+		t.Fatalf("EndVolume: %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("receive side: %v", err)
+	}
+	if accepted != 1 {
+		t.Errorf("receiver accepted %d connections, want 1", accepted)
+	}
+	for _, name := range []string{"u1", "u2", "u3"} {
+		if _, err := os.Stat(filepath.Join(dstDir, name)); err != nil {
+			t.Errorf("layer %s not received: %v", name, err)
+		}
+	}
+	if n, err := lm.SentLayers(); err != nil || n != 3 {
+		t.Errorf("SentLayers = %d, %v; want 3", n, err)
+	}
+}
+
+// startLayerReceiver runs ReceiveAll discarding payloads and returns the
+// listener address and the receive result.
+func startLayerReceiver(t *testing.T) (string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan error, 1)
+	go func() {
+		_, err := utils.ReceiveAll(ln, 5*time.Second, func(h utils.FrameHeader, payload io.Reader) error {
+			_, err := io.Copy(io.Discard, payload)
+			return err
+		})
+		done <- err
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestSentManifest_VouchesForEarlierSessions(t *testing.T) {
+	lm, _ := newTestManager(t)
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.CreateCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	addr, done := startLayerReceiver(t)
+
+	// A pre-downtime round ships u1 in a session of its own.
+	round, err := utils.DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.CopyCheckpoint(round); err != nil {
+		t.Fatalf("CopyCheckpoint: %v", err)
+	}
+	round.Close()
+	if digest, err := os.ReadFile(lm.sentMarker(1)); err != nil || len(digest) != 64 {
+		t.Fatalf("sent marker = %q, %v; want the payload digest", digest, err)
+	}
+
+	s, err := utils.DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := lm.EndVolume(s); err != nil {
+		t.Fatalf("EndVolume: %v", err)
+	}
+	sent, err := lm.SentManifest()
+	if err != nil || len(sent) != 2 || sent[0].Name != "u1" || sent[1].Name != "u2" {
+		t.Fatalf("SentManifest = %+v, %v", sent, err)
+	}
+	s.Expect(sent...)
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("receive side: %v", err)
+	}
+
+	// A destination that never got u1 refuses the transfer.
+	addr, done = startLayerReceiver(t)
+	s2, err := utils.DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s2.Expect(sent[0])
+	if err := s2.Done(); err == nil || !strings.Contains(err.Error(), "layer 1 (u1) missing") {
+		t.Errorf("Done = %v, want layer 1 reported missing", err)
+	}
+	if err := <-done; err == nil {
+		t.Error("receiver must refuse an incomplete transfer")
+	}
+}
+
+// countingListener counts accepted connections.
+type countingListener struct {
+	net.Listener
+	n *int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		*l.n++
+	}
+	return c, err
+}
+
+func TestSnapshotTo_RestoresAsLowerLayers(t *testing.T) {
+	lm, _ := newTestManager(t)
+	// A restored pod: one received lower layer, then its own uppers.
+	if err := os.MkdirAll(lm.LayerDir(1), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.CreateCheckpoint(); err != nil { // freeze u1
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(lm.DataDir, "l1", "base.txt"), []byte("base"), 0o644)
+	os.WriteFile(filepath.Join(lm.DataDir, "u1", "one.txt"), []byte("one"), 0o644)
+	os.WriteFile(filepath.Join(lm.DataDir, "u2", "two.txt"), []byte("two"), 0o644)
+
+	store := &utils.FSStore{Root: t.TempDir()}
+	set := utils.SnapshotSet("web-0", time.Now())
+	up, err := utils.OpenUpload(store, set, utils.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := lm.SnapshotTo(up)
+	if err != nil || n != 3 {
+		t.Fatalf("SnapshotTo = %d, %v; want 3 layers (l1, u1, u2)", n, err)
+	}
+	if err := up.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := lm.SentLayers(); sent != 0 {
+		t.Errorf("a snapshot must not mark layers sent, %d marked", sent)
+	}
+
+	target, _ := newTestManager(t)
+	if _, err := utils.Download(store, set, utils.DownloadOptions{}, func(h utils.FrameHeader, payload io.Reader) error {
+		return target.ReceiveCheckpoint(h.Ordinal, h.Codec, payload)
+	}); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	for i, name := range []string{"base.txt", "one.txt", "two.txt"} {
+		if _, err := os.Stat(filepath.Join(target.LayerDir(i+1), name)); err != nil {
+			t.Errorf("snapshot layer %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestCopyCheckpoint_SendsChangedFilesAsDeltas(t *testing.T) {
+	t.Setenv("VOLUME_DELTA_MIN_KB", "64")
+	src, _ := newTestManager(t)
+	if err := src.InitVolume(); err != nil {
+		t.Fatal(err)
+	}
+	db := make([]byte, 1<<20)
+	for i := range db {
+		db[i] = byte(i * 7 / 3)
+	}
+	os.WriteFile(filepath.Join(src.DataDir, "u1", "state.db"), db, 0o644)
+
+	store := &utils.FSStore{Root: t.TempDir()}
+	set := utils.MigrationSet("web-0", "uid-1")
+	up, err := utils.OpenUpload(store, set, utils.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.SetCodec(utils.CodecNone)
+	// Two pre-sync rounds; the copy-up puts the whole file into u2.
+	for round := 0; round < 2; round++ {
+		if _, err := src.CreateCheckpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.CopyCheckpoint(up); err != nil {
+			t.Fatalf("round %d: %v", round+1, err)
+		}
+		copy(db[300<<10:], "one changed page")
+		os.WriteFile(filepath.Join(src.DataDir, fmt.Sprintf("u%d", round+2), "state.db"), db, 0o644)
+	}
+	if err := up.Done(); err != nil {
+		t.Fatal(err)
+	}
+	index, err := utils.ReadSet(store, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full, delta := index.Frames[0].Size, index.Frames[1].Size; delta > full/10 {
+		t.Errorf("layer 2 payload is %d bytes, layer 1 %d; want a delta", delta, full)
+	}
+
+	dst, _ := newTestManager(t)
+	if _, err := utils.Download(store, set, utils.DownloadOptions{}, func(h utils.FrameHeader, payload io.Reader) error {
+		return dst.ReceiveCheckpoint(h.Ordinal, h.Codec, payload)
+	}); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dst.LayerDir(2), "state.db"))
+	want, _ := os.ReadFile(filepath.Join(src.DataDir, "u2", "state.db"))
+	if !bytes.Equal(got, want) {
+		t.Fatal("layer 2 state.db differs after rebuilding it on the destination")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+// Point-in-time snapshots for disaster recovery.
+//
+// "go-agent snapshot" (e.g. from a CronJob running kubectl exec) checkpoints
+// the running application without stopping it and uploads the checkpoint
+// images and the whole overlay volume to the checkpoint store as the set
+// snapshots/<pod>/<UTC time>. SNAPSHOT_KEEP, when positive, bounds how many
+// snapshots of the pod are kept; older ones are deleted.
+//
+// A pod started with RESTORE_SNAPSHOT=<set or "latest"> restores from a
+// snapshot instead of starting fresh, exactly like a migration target
+// restores a transfer. The restore happens once per pod: a marker in the
+// checkpoint directory keeps a container restart from rolling back to the
+// snapshot again.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-agent/dmtcp"
+	"go-agent/overlay"
+	"go-agent/utils"
+)
+
+// snapshotCmd is the sub-command that takes a snapshot.
+const snapshotCmd = "snapshot"
+
+// snapshotMarker records which snapshot the pod was restored from.
+func snapshotMarker(checkpointDir string) string {
+	return filepath.Join(checkpointDir, ".snapshot")
+}
+
+// runSnapshot is the snapshot entry point.
+//
+//	Usage: go-agent snapshot [<checkpointDir>]
+func runSnapshot(args []string) {
+	checkpointDir := utils.EnvOr("DMTCP_CHECKPOINT_DIR", "/dmtcp/checkpoints")
+	if len(args) > 0 && args[0] != "" {
+		checkpointDir = args[0]
+	}
+	podName := os.Getenv("POD_NAME")
+	store, err := utils.CheckpointStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if store == nil || podName == "" {
+		log.Fatal("snapshot needs CHECKPOINT_STORE and POD_NAME")
+	}
+	set, err := takeSnapshot(store, podName, checkpointDir, time.Now())
+	if err != nil {
+		log.Fatalf("snapshot failed: %v", err)
+	}
+	log.Printf("snapshot stored as %s", set)
+	if keep := utils.EnvInt("SNAPSHOT_KEEP", 0); keep > 0 {
+		if err := pruneSnapshots(store, podName, keep); err != nil {
+			log.Printf("pruning old snapshots: %v", err)
+		}
+	}
+}
+
+// takeSnapshot uploads the pod's current state as the snapshot taken at
+// now and returns its set.
+func takeSnapshot(store utils.CheckpointStore, podName, checkpointDir string, now time.Time) (string, error) {
+	set := utils.SnapshotSet(podName, now)
+	up, err := utils.OpenUpload(store, set, utils.UploadOptions{SpoolDir: checkpointDir})
+	if err != nil {
+		return "", err
+	}
+
+	if utils.ProcessMigrationEnabled() {
+		h := dmtcp.NewHandlerFromEnv(checkpointDir)
+		h.AttachRunning()
+		if err := h.Checkpoint(); err != nil {
+			return "", fmt.Errorf("dmtcp checkpoint: %w", err)
+		}
+		files, err := h.ListCheckpoints()
+		if err != nil {
+			return "", fmt.Errorf("list checkpoints: %w", err)
+		}
+		for _, f := range files {
+			if err := up.SendCheckpointFile(f); err != nil {
+				return "", err
+			}
+		}
+		log.Printf("%d checkpoint file(s) uploaded", len(files))
+	}
+
+	rootDir := utils.EnvOr("VOLUME_ROOT_DIR", "")
+	if utils.VolumeMigrationEnabled() && rootDir != "" {
+		lm := overlay.NewLayerManager(utils.EnvOr("DATA_DIR", "/data"), rootDir)
+		unlock, err := lm.Lock()
+		if err != nil {
+			return "", fmt.Errorf("lock overlay state: %w", err)
+		}
+		defer unlock()
+		if err := lm.Discover(); err != nil {
+			return "", fmt.Errorf("discover overlay state: %w", err)
+		}
+		if lm.Level() > 0 {
+			n, err := lm.SnapshotTo(up)
+			if err != nil {
+				return "", fmt.Errorf("snapshot volume: %w", err)
+			}
+			log.Printf("%d volume layer(s) uploaded", n)
+		} else if err := up.SendDir(1, "u1", rootDir); err != nil {
+			return "", fmt.Errorf("snapshot volume root: %w", err)
+		}
+	}
+	if err := up.Done(); err != nil {
+		return "", err
+	}
+	return set, nil
+}
+
+// pruneSnapshots deletes all but the keep newest snapshots of podName.
+func pruneSnapshots(store utils.CheckpointStore, podName string, keep int) error {
+	sets, err := utils.ListSets(store, "snapshots/"+podName)
+	if err != nil {
+		return err
+	}
+	for len(sets) > keep {
+		if err := utils.DeleteSet(store, sets[0]); err != nil {
+			return err
+		}
+		log.Printf("deleted old snapshot %s", sets[0])
+		sets = sets[1:]
+	}
+	return nil
+}
+
+// restoreSnapshot restores the pod from the snapshot named by set (a set
+// name, a time stamp of this pod's snapshots or "latest"). It returns false,
+// and the pod starts fresh, when it was already restored from that set.
+func restoreSnapshot(lm *overlay.LayerManager, checkpointDir, set string, procMig, volMig bool) bool {
+	podName := os.Getenv("POD_NAME")
+	store, err := utils.CheckpointStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if store == nil {
+		log.Fatal("RESTORE_SNAPSHOT needs CHECKPOINT_STORE")
+	}
+	if set, err = resolveSnapshot(store, podName, set); err != nil {
+		log.Fatalf("RESTORE_SNAPSHOT: %v", err)
+	}
+	marker := snapshotMarker(checkpointDir)
+	if prev, err := os.ReadFile(marker); err == nil && strings.TrimSpace(string(prev)) == set {
+		log.Printf("already restored from snapshot %s; starting normally", set)
+		return false
+	}
+	t := &target{lm: lm, checkpointDir: checkpointDir}
+	found, err := t.download(store, set)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !found {
+		log.Fatalf("snapshot %s not found in the checkpoint store", set)
+	}
+	if err := os.WriteFile(marker, []byte(set+"\n"), 0o644); err != nil {
+		log.Fatalf("write snapshot marker: %v", err)
+	}
+	log.Printf("restoring from snapshot %s", set)
+	t.restore(procMig, volMig)
+	return true
+}
+
+// resolveSnapshot expands "latest" and bare time stamps to a set name.
+func resolveSnapshot(store utils.CheckpointStore, podName, set string) (string, error) {
+	switch {
+	case set == "latest":
+		sets, err := utils.ListSets(store, "snapshots/"+podName)
+		if err != nil {
+			return "", err
+		}
+		if len(sets) == 0 {
+			return "", fmt.Errorf("no snapshots of %s in the checkpoint store", podName)
+		}
+		return sets[len(sets)-1], nil
+	case !strings.Contains(set, "/"):
+		return "snapshots/" + podName + "/" + set, nil
+	default:
+		return set, nil
+	}
+}
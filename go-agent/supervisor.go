@@ -0,0 +1,143 @@
+package main
+
+// Target-side restore supervisor.
+//
+// ExecRestart replaces the agent with dmtcp_restart, after which nothing is
+// left to tell the MC that the restore actually worked and reconcileRestoring
+// can only finish through pod readiness. In supervisor mode
+// (RESTORE_SUPERVISOR, default true) the agent instead starts dmtcp_restart
+// as its child, waits until every restored process has rejoined the DMTCP
+// coordinator and reports POST /restored with timing data. It then stays in
+// the foreground for the lifetime of the restored application: signals are
+// forwarded to the child and the agent exits with the child's exit code, so
+// the entrypoint observes the same lifetime as with the exec'ing restore.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go-agent/dmtcp"
+	"go-agent/utils"
+)
+
+// forwardedSignals are relayed from the agent to the restored application.
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP,
+	syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// restoreSupervisor holds what superviseRestore needs to report to the MC.
+type restoreSupervisor struct {
+	coordAddr string
+	podName   string
+	h         *dmtcp.Handler
+
+	// peers is the number of processes expected to rejoin the coordinator:
+	// one per received checkpoint image.
+	peers int
+	// transfer is how long the checkpoint transfer took; reported as-is.
+	transfer time.Duration
+	// confirmTimeout bounds the wait for the peers to rejoin.
+	confirmTimeout time.Duration
+}
+
+// superviseRestore starts dmtcp_restart, confirms and reports the restore,
+// and returns the restored application's exit code once it terminates.
+func (s *restoreSupervisor) superviseRestore() (int, error) {
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	start := time.Now()
+	cmd, err := s.h.StartRestart()
+	if err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	go s.confirm(start)
+
+	for {
+		select {
+		case sig := <-sigs:
+			log.Printf("forwarding %s to restored application (pid %d)", sig, cmd.Process.Pid)
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Printf("forward %s: %v", sig, err)
+			}
+		case err := <-exited:
+			code := childExitCode(cmd)
+			log.Printf("restored application exited with code %d (%v)", code, err)
+			return code, nil
+		}
+	}
+}
+
+// confirm waits for the restored peers to rejoin the coordinator and posts
+// /restored. A failed confirmation is only logged: the MC then falls back to
+// the destination pod's readiness.
+func (s *restoreSupervisor) confirm(start time.Time) {
+	peers, err := s.h.WaitForPeers(s.peers, s.confirmTimeout)
+	if err != nil {
+		log.Printf("restore not confirmed: %v", err)
+		return
+	}
+	elapsed := time.Since(start)
+	log.Printf("restore confirmed: %d peer(s) running after %s", peers, elapsed)
+	if s.podName == "" {
+		log.Println("POD_NAME is unset; not reporting /restored")
+		return
+	}
+	notif := utils.RestoredNotification{
+		PodName:    s.podName,
+		TransferMs: s.transfer.Milliseconds(),
+		RestoreMs:  elapsed.Milliseconds(),
+		Peers:      peers,
+	}
+	if _, err := utils.PostJSON(s.coordAddr+"/restored", notif); err != nil {
+		log.Printf("POST /restored: %v", err)
+	}
+}
+
+// childExitCode maps a reaped child to a shell-style exit code: the exit
+// status, or 128+signal when the child was killed by a signal.
+func childExitCode(cmd *exec.Cmd) int {
+	st := cmd.ProcessState
+	if st == nil {
+		return 1
+	}
+	if ws, ok := st.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return st.ExitCode()
+}
+
+// restoreProcesses restores the received DMTCP checkpoints, either under the
+// supervisor or, with RESTORE_SUPERVISOR=false, by exec'ing dmtcp_restart.
+// In supervisor mode it does not return: the agent exits with the restored
+// application's exit code.
+func restoreProcesses(h *dmtcp.Handler, ckpts []string, transfer time.Duration) error {
+	if !utils.EnvBool("RESTORE_SUPERVISOR", true) {
+		// ExecRestart replaces this process with dmtcp_restart; the
+		// entrypoint's agent invocation becomes the restored app.
+		return h.ExecRestart()
+	}
+	s := &restoreSupervisor{
+		coordAddr:      "http://" + utils.EnvOr("MIGR_COOR", defaultCoordAddr),
+		podName:        os.Getenv("POD_NAME"),
+		h:              h,
+		peers:          len(ckpts),
+		transfer:       transfer,
+		confirmTimeout: time.Duration(utils.EnvInt("RESTORE_CONFIRM_SECONDS", 120)) * time.Second,
+	}
+	code, err := s.superviseRestore()
+	if err != nil {
+		return fmt.Errorf("supervised restore: %w", err)
+	}
+	os.Exit(code)
+	return nil // unreachable
+}
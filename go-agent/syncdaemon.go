@@ -0,0 +1,222 @@
+package main
+
+// Source-side pre-downtime volume sync.
+//
+// Per the CloudCom 2020 flow (§IV) the overlay layers are frozen and shipped
+// while the application still serves traffic, so only the last small upper
+// layer moves inside the downtime window. The MC asks for preSyncRounds
+// rounds by moving the Migration to Syncing and waits for the source EA to
+// report each one via POST /sync before it deletes the source pod.
+//
+// runAgent therefore leaves this loop running in a detached child process
+// ("sync_daemon" sub-command) after registration. The loop polls GET /poll
+// and, while a migration is armed and rounds are outstanding, freezes the
+// current upper layer (CreateCheckpoint), streams every unsent frozen layer
+// to the destination (CopyCheckpoint) and reports the round. When the
+// destination has not registered yet (StatefulSet: it only appears once
+// the source pod is deleted) the round still freezes the layer; the preStop
+// hook ships those leftovers before the final layer.
+//
+// Every report carries the round's measurements. When the MC hands out a
+// target downtime the number of rounds is adaptive: the daemon stops once
+// utils.PreSyncPolicy says so and reports why with the last round.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"go-agent/overlay"
+	"go-agent/utils"
+)
+
+// syncDaemonCmd is the sub-command runAgent re-executes itself with.
+const syncDaemonCmd = "sync_daemon"
+
+// agentKeyEnv passes the agent key of the pod's registration to the sync
+// daemon, which presents it on /poll.
+const agentKeyEnv = "MIGR_AGENT_KEY"
+
+// defaultPreSyncLagMS is about how long after the last pre-downtime round
+// the preStop hook freezes the final layer: the MC reacts to the report on
+// its next reconcile and then deletes the pod (PRESYNC_LAG_MS).
+const defaultPreSyncLagMS = 3000
+
+// spawnSyncDaemon starts the sync loop as a detached child of the agent. The
+// child gets its own session so it outlives the entrypoint's exec into
+// dmtcp_launch and is not part of the checkpointed process tree.
+func spawnSyncDaemon(rootDir, agentKey string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("resolve agent binary: %w", err)
+	}
+	cmd := exec.Command(exe, syncDaemonCmd, rootDir)
+	cmd.Env = append(os.Environ(), agentKeyEnv+"="+agentKey)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", syncDaemonCmd, err)
+	}
+	log.Printf("sync daemon started (pid %d)", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// syncDaemon holds the state of the pre-downtime sync loop.
+type syncDaemon struct {
+	coordAddr string
+	podName   string
+	agentKey  string
+	lm        *overlay.LayerManager
+	interval  time.Duration
+
+	// round is the last round this daemon reported for the armed
+	// migration, stats what it measured in the rounds so far and
+	// lastFreeze when it froze the latest layer; reset when the migration
+	// is disarmed.
+	round      int
+	stats      []utils.SyncRoundStats
+	lastFreeze time.Time
+}
+
+// runSyncDaemon is the sync_daemon entry point.
+//
+//	Usage: go-agent sync_daemon [<rootDir>]
+func runSyncDaemon(args []string) {
+	rootDir := utils.EnvOr("VOLUME_ROOT_DIR", "")
+	if len(args) > 0 && args[0] != "" {
+		rootDir = args[0]
+	}
+	coordAddr := utils.EnvOr("MIGR_COOR", defaultCoordAddr)
+	podName := os.Getenv("POD_NAME")
+	if rootDir == "" || podName == "" {
+		log.Fatal("sync_daemon needs a volume root dir (arg or VOLUME_ROOT_DIR) and POD_NAME")
+	}
+	d := &syncDaemon{
+		coordAddr: "http://" + coordAddr,
+		podName:   podName,
+		agentKey:  os.Getenv(agentKeyEnv),
+		lm:        overlay.NewLayerManager(utils.EnvOr("DATA_DIR", "/data"), rootDir),
+		interval:  time.Duration(utils.EnvInt("SYNC_POLL_SECONDS", 2)) * time.Second,
+	}
+	log.Printf("sync daemon polling %s every %s for %s", coordAddr, d.interval, podName)
+	for {
+		if err := d.step(); err != nil {
+			log.Printf("sync daemon: %v", err)
+		}
+		time.Sleep(d.interval)
+	}
+}
+
+// step polls the MC once and runs at most one sync round.
+func (d *syncDaemon) step() error {
+	body, err := utils.GetJSONAuth(fmt.Sprintf("%s/poll?podName=%s", d.coordAddr, url.QueryEscape(d.podName)), d.agentKey)
+	if err != nil {
+		return fmt.Errorf("GET /poll: %w", err)
+	}
+	var p utils.PollResponse
+	if err := json.Unmarshal(body, &p); err != nil {
+		return fmt.Errorf("parse /poll response: %w", err)
+	}
+	if !p.Migrating {
+		d.round = 0
+		d.stats = nil
+		d.lastFreeze = time.Time{}
+		return nil
+	}
+	if !p.VolumeMigration || p.SyncRound >= p.SyncRounds || p.SyncStopReason != "" {
+		return nil
+	}
+	// After a daemon restart, continue from what the MC already recorded.
+	if d.round < p.SyncRound {
+		d.round = p.SyncRound
+	}
+	round := d.round + 1
+
+	stats, err := d.syncRound(p)
+	if err != nil {
+		return fmt.Errorf("round %d/%d: %w", round, p.SyncRounds, err)
+	}
+	stats.Round = round
+	policy := utils.PreSyncPolicy{
+		TargetDowntime: time.Duration(p.TargetDowntimeMs) * time.Millisecond,
+		MinRounds:      p.MinSyncRounds,
+		MaxRounds:      p.SyncRounds,
+		Lag:            d.interval + time.Duration(utils.EnvInt("PRESYNC_LAG_MS", defaultPreSyncLagMS))*time.Millisecond,
+	}
+	policy.Project(&stats)
+	history := append(d.stats, stats)
+	notif := utils.SyncNotification{PodName: d.podName, Round: round, Stats: &stats}
+	if policy.TargetDowntime > 0 {
+		notif.StopReason = policy.Stop(history)
+	}
+	if _, err := utils.PostJSON(d.coordAddr+"/sync", notif); err != nil {
+		return fmt.Errorf("POST /sync round %d: %w", round, err)
+	}
+	d.round = round
+	d.stats = history
+	log.Printf("pre-downtime round %d/%d reported: %d bytes written in %dms, %d sent in %dms, projected downtime %dms",
+		round, p.SyncRounds, stats.LayerBytes, stats.FillMs, stats.SentBytes, stats.SendMs, stats.ProjectedDowntimeMs)
+	if notif.StopReason != "" {
+		log.Printf("pre-downtime rounds stop after round %d: %s", round, notif.StopReason)
+	}
+	return nil
+}
+
+// syncRound freezes the current upper layer and, when the destination is
+// known, ships every frozen layer it has not received yet with the codec and
+// transfer certificate from the poll response p. It returns what it
+// measured.
+func (d *syncDaemon) syncRound(p utils.PollResponse) (utils.SyncRoundStats, error) {
+	var stats utils.SyncRoundStats
+	dest := p.DestAddress
+	unlock, err := d.lm.Lock()
+	if err != nil {
+		return stats, err
+	}
+	defer unlock()
+
+	if err := d.lm.Discover(); err != nil {
+		return stats, fmt.Errorf("discover overlay state: %w", err)
+	}
+	// The upper layer filled since it was created, by the previous freeze.
+	filling := utils.DirBirth(d.lm.UpperDir(d.lm.Level()))
+	if filling.IsZero() {
+		filling = d.lastFreeze
+	}
+	frozen, err := d.lm.CreateCheckpoint()
+	if err != nil {
+		return stats, fmt.Errorf("freeze layer: %w", err)
+	}
+	d.lastFreeze = time.Now()
+	stats.LayerBytes = utils.DirSize(d.lm.UpperDir(frozen))
+	if !filling.IsZero() {
+		stats.FillMs = d.lastFreeze.Sub(filling).Milliseconds()
+	}
+	if dest == "" {
+		log.Printf("layer %d frozen; destination not registered yet, end_container will ship it", frozen)
+		return stats, nil
+	}
+	progress := utils.NewProgress()
+	s, err := dialDestination(dest, p.TransferGrant, progress)
+	if err != nil {
+		return stats, fmt.Errorf("open transfer session: %w", err)
+	}
+	defer s.Close()
+	start := time.Now()
+	if err := d.lm.CopyCheckpoint(s); err != nil {
+		return stats, fmt.Errorf("copy layers to %s: %w", dest, err)
+	}
+	stats.SendMs = time.Since(start).Milliseconds()
+	stats.SentBytes = progress.Snapshot().BytesDone
+	// The round added what it sent to the node's chunk cache.
+	if cache, _ := utils.ChunkCacheFromEnv(d.lm.DataDir); cache != nil {
+		pruneChunkCache(cache)
+	}
+	return stats, nil
+}
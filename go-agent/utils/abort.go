@@ -0,0 +1,142 @@
+package utils
+
+// Aborted transfers.
+//
+// A source that cannot complete its transfer, e.g. because the checkpoint
+// failed, tells the destination with a KindAbort frame whose payload is the
+// reason. Its session may be what broke, so Abort is usually sent over a
+// session of its own. The receiver acknowledges the frame and
+// ReceiveAllWith returns an *AbortError.
+//
+// The destination may also give up on its own: a reason sent on
+// ReceiveOptions.Abort, typically once the MC reports the migration aborted
+// (GET /poll), closes the listener and every connection being served, and
+// ReceiveAllWith returns an *AbortError as well. Either way, the layers and
+// files delivered so far stay where the handler put them; what arrived
+// half-way is only staged (see staging.go).
+//
+// What the destination does after an abort is its AbortPolicy, which the MC
+// hands out from the workload spec (ABORT_POLICY when it does not):
+//
+//	Fresh       start the application without migrated state
+//	KeepVolume  start it on the volume layers received so far
+//	Fail        exit, and keep failing on restart until someone intervenes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// maxAbortReasonSize bounds the KindAbort payload.
+const maxAbortReasonSize = 4 << 10
+
+// AbortPolicy is what a destination does after its transfer was aborted.
+type AbortPolicy string
+
+const (
+	AbortFresh      AbortPolicy = "Fresh"
+	AbortKeepVolume AbortPolicy = "KeepVolume"
+	AbortFail       AbortPolicy = "Fail"
+)
+
+// ParseAbortPolicy parses a policy name, ignoring case.
+func ParseAbortPolicy(name string) (AbortPolicy, error) {
+	for _, p := range []AbortPolicy{AbortFresh, AbortKeepVolume, AbortFail} {
+		if strings.EqualFold(name, string(p)) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown abort policy %q (want Fresh, KeepVolume or Fail)", name)
+}
+
+// AbortPolicyFromEnv reads ABORT_POLICY (default Fail). An unknown name
+// falls back to the default.
+func AbortPolicyFromEnv() (AbortPolicy, error) {
+	name := EnvOr("ABORT_POLICY", "")
+	if name == "" {
+		return AbortFail, nil
+	}
+	p, err := ParseAbortPolicy(name)
+	if err != nil {
+		return AbortFail, fmt.Errorf("ABORT_POLICY: %w", err)
+	}
+	return p, nil
+}
+
+// AbortError is the error of an aborted transfer.
+type AbortError struct {
+	Reason string
+	// BySource is set when the sender aborted with a KindAbort frame,
+	// unset when ReceiveOptions.Abort did.
+	BySource bool
+}
+
+func (e *AbortError) Error() string {
+	if e.BySource {
+		return "transfer aborted by the source: " + e.Reason
+	}
+	return "transfer aborted: " + e.Reason
+}
+
+// Abort tells the destination that the transfer will not complete, and
+// why, and waits until it acknowledged that. Frames still unacknowledged
+// are abandoned; the session is unusable afterwards.
+func (s *Session) Abort(reason string) error {
+	if len(reason) > maxAbortReasonSize {
+		reason = reason[:maxAbortReasonSize]
+	}
+	err := s.send(&outFrame{h: FrameHeader{Kind: KindAbort}, payload: func(w io.Writer) error {
+		_, err := io.WriteString(w, reason)
+		return err
+	}})
+	if err != nil {
+		return err
+	}
+	return s.Flush()
+}
+
+// abort ends the transfer for reason: nothing more is accepted and the
+// connections being served are closed.
+func (rs *receiverState) abort(reason string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.abortReason != nil {
+		return
+	}
+	rs.abortReason = &reason
+	rs.ln.Close()
+	for c := range rs.conns {
+		c.Close()
+	}
+}
+
+// aborted returns the error of a transfer aborted through
+// ReceiveOptions.Abort, or nil.
+func (rs *receiverState) aborted() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.abortReason == nil {
+		return nil
+	}
+	return &AbortError{Reason: *rs.abortReason}
+}
+
+// track adds conn to the connections an abort closes; a transfer already
+// aborted closes it right away.
+func (rs *receiverState) track(conn net.Conn) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.abortReason != nil {
+		conn.Close()
+	}
+	rs.conns[conn] = true
+}
+
+// untrack removes conn from the connections an abort closes.
+func (rs *receiverState) untrack(conn net.Conn) {
+	rs.mu.Lock()
+	delete(rs.conns, conn)
+	rs.mu.Unlock()
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSession_Abort(t *testing.T) {
+	dst := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, filepath.Join(dst, h.Name))
+	})
+	layer := t.TempDir()
+	os.WriteFile(filepath.Join(layer, "state.db"), []byte("v1"), 0o600)
+
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(1, "u1", layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Abort("dmtcp checkpoint failed"); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	res := <-resCh
+	var aerr *AbortError
+	if !errors.As(res.err, &aerr) || !aerr.BySource || aerr.Reason != "dmtcp checkpoint failed" {
+		t.Fatalf("ReceiveAll = %v, want the source's abort", res.err)
+	}
+	if len(res.frames) != 1 || res.frames[0].Name != "u1" {
+		t.Errorf("frames before the abort = %+v", res.frames)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "u1", "state.db")); string(got) != "v1" {
+		t.Errorf("layer received before the abort: %q", got)
+	}
+}
+
+func TestReceive_AbortedWhileWaiting(t *testing.T) {
+	abort := make(chan string, 1)
+	addr, resCh := startReceiverWith(t, ReceiveOptions{Timeout: 10 * time.Second, Abort: abort}, func(FrameHeader, io.Reader) error { return nil })
+	// A sender that connected and went quiet must not hold the abort up.
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	abort <- "migration deleted"
+	res := <-resCh
+	var aerr *AbortError
+	if !errors.As(res.err, &aerr) || aerr.BySource || aerr.Reason != "migration deleted" {
+		t.Fatalf("ReceiveAllWith = %v, want the requested abort", res.err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("abort took %s", d)
+	}
+}
+
+func TestParseAbortPolicy(t *testing.T) {
+	for name, want := range map[string]AbortPolicy{"Fresh": AbortFresh, "keepvolume": AbortKeepVolume, "FAIL": AbortFail} {
+		if got, err := ParseAbortPolicy(name); err != nil || got != want {
+			t.Errorf("ParseAbortPolicy(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseAbortPolicy("restart"); err == nil {
+		t.Error("an unknown policy parsed")
+	}
+	t.Setenv("ABORT_POLICY", "")
+	if p, err := AbortPolicyFromEnv(); err != nil || p != AbortFail {
+		t.Errorf("default policy = %q, %v; want Fail", p, err)
+	}
+}
@@ -0,0 +1,272 @@
+package utils
+
+// Layer archive fidelity.
+//
+// A frozen overlay upper layer is more than regular files. A deleted lower
+// file is a whiteout (a 0/0 character device), a directory replacing a lower
+// one is marked opaque with the trusted.overlay.opaque xattr
+// (user.overlay.opaque with the userxattr mount option), and the
+// application's files carry ownership, mtimes and hardlinks it may depend
+// on. tarDir records all of it in the tar stream:
+//
+//   - device nodes and FIFOs with their device numbers,
+//   - extended attributes as PAX SCHILY.xattr.* records,
+//   - numeric uid/gid and nanosecond mtimes (PAX format),
+//   - second and later links to an inode as hardlink entries.
+//
+// ExtractTarGz recreates them, and writes runs of zero blocks as holes so
+// sparse files (and mostly-empty DMTCP images) stay sparse. Ownership is
+// only restored when running as root. security.* xattrs are host policy
+// and are skipped when the destination refuses them.
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+
+	// sparseBlock is the granularity at which extracted zero runs become
+	// holes.
+	sparseBlock = 4096
+)
+
+// inode identifies a file across hardlinks.
+type inode struct{ dev, ino uint64 }
+
+// fileHeader returns the tar header for the file at path, stored as name.
+// links maps inodes already archived to their names; a later link to one of
+// them becomes a hardlink entry.
+func fileHeader(path, name string, info os.FileInfo, links map[inode]string) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	// Only what the destination restores, so the stream is reproducible
+	// for a resumed transfer: no atime/ctime, numeric ids only.
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.Uname, hdr.Gname = "", ""
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && links != nil && info.Mode().IsRegular() && st.Nlink > 1 {
+		key := inode{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return hdr, nil
+		}
+		links[key] = name
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+k] = v
+	}
+	return hdr, nil
+}
+
+// readXattrs returns the extended attributes of path, not following
+// symlinks. A filesystem without xattr support has none.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		n, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("get xattr %s of %s: %w", name, path, err)
+		}
+		val := make([]byte, n)
+		if n, err = unix.Lgetxattr(path, name, val); err != nil {
+			return nil, fmt.Errorf("get xattr %s of %s: %w", name, path, err)
+		}
+		attrs[name] = string(val[:n])
+	}
+	return attrs, nil
+}
+
+// mknod creates the device node or FIFO described by hdr at target.
+func mknod(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode) & 0o7777
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	if err := unix.Mknod(target, mode, int(dev)); err != nil {
+		return fmt.Errorf("mknod %s: %w", target, err)
+	}
+	return nil
+}
+
+// writeSparse writes r to a new file at target, leaving zero blocks as
+// holes.
+func writeSparse(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", target, err)
+	}
+	buf := make([]byte, 64<<10)
+	var off int64
+	var writeErr error
+	for writeErr == nil {
+		n, err := io.ReadFull(r, buf)
+		writeErr = writeNonZero(f, buf[:n], off)
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			writeErr = err
+		}
+	}
+	if writeErr == nil {
+		// Extends the file over a trailing hole.
+		writeErr = f.Truncate(off)
+	}
+	closeErr := f.Close()
+	if writeErr != nil {
+		return fmt.Errorf("write %s: %w", target, writeErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("close %s: %w", target, closeErr)
+	}
+	return nil
+}
+
+// writeNonZero writes the blocks of b that are not all zero at offset off.
+func writeNonZero(f *os.File, b []byte, off int64) error {
+	start := -1 // first block of the pending non-zero run
+	for i := 0; i < len(b); i += sparseBlock {
+		end := i + sparseBlock
+		if end > len(b) {
+			end = len(b)
+		}
+		zero := isZero(b[i:end])
+		if !zero && start < 0 {
+			start = i
+		}
+		if zero && start >= 0 {
+			if _, err := f.WriteAt(b[start:i], off+int64(start)); err != nil {
+				return err
+			}
+			start = -1
+		}
+	}
+	if start >= 0 {
+		if _, err := f.WriteAt(b[start:], off+int64(start)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMetadata restores ownership, xattrs, permission bits and mtimes of
+// an extracted entry. Directories only get ownership and xattrs here; see
+// finishDir.
+func applyMetadata(target string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("chown %s: %w", target, err)
+		}
+	}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, name, []byte(v), 0); err != nil {
+			if strings.HasPrefix(name, "security.") {
+				continue
+			}
+			return fmt.Errorf("set xattr %s on %s: %w", name, target, err)
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return nil
+	case tar.TypeSymlink:
+		return setMtime(target, hdr.ModTime)
+	}
+	// After chown, which clears setuid/setgid.
+	if err := chmod(target, hdr); err != nil {
+		return err
+	}
+	return setMtime(target, hdr.ModTime)
+}
+
+// finishDir sets an extracted directory's mode and mtime once its contents
+// are in place.
+func finishDir(target string, hdr *tar.Header) error {
+	if err := chmod(target, hdr); err != nil {
+		return err
+	}
+	return setMtime(target, hdr.ModTime)
+}
+
+func chmod(target string, hdr *tar.Header) error {
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(target, mode); err != nil {
+		return fmt.Errorf("chmod %s: %w", target, err)
+	}
+	return nil
+}
+
+// setMtime sets the access and modification times of target, not following
+// symlinks, to mtime.
+func setMtime(target string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("set mtime of %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package utils
+
+// Transfer authorization.
+//
+// When the MC arms a migration it mints a random transfer token and hands
+// it to the source (/remove, and /poll when it presents its agent key) and
+// the destination (/register). The source then signs its session: the
+// HELLO header sets the signed flag and is followed by a MAC, and every
+// later frame carries one after its digest trailer:
+//
+//	HELLO: [64-byte header][32-byte MAC]
+//	frame: [64-byte header][chunks][terminator][digest][32-byte MAC]
+//	MAC   = HMAC-SHA256(token, transfer ID || header || hex digest)
+//
+// The digest covers the payload, so the MAC authenticates the whole frame,
+// and the transfer ID and sequence number in the header pin it to its place
+// in the session. A destination holding a token refuses unsigned sessions,
+// version-1 frames (which have nowhere to carry a MAC) and any frame whose
+// MAC does not verify before its handler sees the payload; the connection is
+// dropped and the destination keeps waiting for the real source. Without a
+// token MACs are read and ignored, so a source may sign before every
+// destination checks.
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"io"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// readMAC reads the MAC trailer of a signed frame, or returns nil for an
+// unsigned one.
+func readMAC(r io.Reader, h FrameHeader) ([]byte, error) {
+	if !h.Signed {
+		return nil, nil
+	}
+	return wire.ReadMAC(r)
+}
+
+// authError is a connection refused for want of a valid transfer token. It
+// ends the connection but not the transfer.
+type authError struct{ err error }
+
+func (e authError) Error() string { return e.err.Error() }
+func (e authError) Unwrap() error { return e.err }
+
+// authenticate checks the MAC of frame h in transfer id against the
+// receiver's token. It accepts anything when the receiver has no token.
+func (rs *receiverState) authenticate(id string, h FrameHeader, digest string, mac []byte) error {
+	token := rs.opts.Token
+	if token == "" {
+		return nil
+	}
+	what := fmt.Sprintf("frame %d (%q)", h.Seq, h.Name)
+	if h.Kind == KindHello {
+		what = "session " + id
+	}
+	if mac == nil {
+		return authError{fmt.Errorf("%s is not signed; this destination requires the migration's transfer token", what)}
+	}
+	header, err := encodeFrameHeader(h, wire.SessionVersion)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, wire.MAC(token, id, header, digest)) {
+		return authError{fmt.Errorf("%s: bad transfer token MAC", what)}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// startTokenReceiver is startReceiver requiring the transfer token; handled
+// counts the frames the handler extracted.
+func startTokenReceiver(t *testing.T, token, dst string, handled *int) (string, <-chan receiveResult) {
+	t.Helper()
+	return startReceiverWith(t, ReceiveOptions{Timeout: 10 * time.Second, Token: token}, func(h FrameHeader, payload io.Reader) error {
+		if err := ExtractPayload(h, payload, filepath.Join(dst, h.Name)); err != nil {
+			return err
+		}
+		*handled++
+		return nil
+	})
+}
+
+// sendSigned sends one layer in a session signed with token and finishes it.
+func sendSigned(t *testing.T, addr, token, src string) {
+	t.Helper()
+	s, err := DialSessionWith(addr, DialOptions{Token: token})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer s.Close()
+	if err := s.SendDir(1, "u1", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+}
+
+func TestSession_SignedWithToken(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "state.db"), []byte("signed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	var handled int
+	addr, resCh := startTokenReceiver(t, "s3cret", dst, &handled)
+
+	sendSigned(t, addr, "s3cret", src)
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 || !res.frames[0].Signed {
+		t.Fatalf("receive = %+v, %v", res.frames, res.err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "u1", "state.db")); err != nil || string(got) != "signed" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+
+	// A destination without a token still takes a signed session.
+	addr, resCh = startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, filepath.Join(t.TempDir(), h.Name))
+	})
+	sendSigned(t, addr, "s3cret", src)
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("tokenless receive = %+v, %v", res.frames, res.err)
+	}
+}
+
+// TestSession_TokenRefusesStrangers checks that senders without the token
+// fail fast and deliver nothing, while the destination keeps waiting for
+// the real source.
+func TestSession_TokenRefusesStrangers(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var handled int
+	addr, resCh := startTokenReceiver(t, "s3cret", t.TempDir(), &handled)
+
+	if _, err := DialSession(addr); err == nil || !strings.Contains(err.Error(), "requires the migration's transfer token") {
+		t.Errorf("unsigned session: dial error = %v", err)
+	}
+	start := time.Now()
+	if _, err := DialSessionWith(addr, DialOptions{Token: "guess"}); err == nil || !strings.Contains(err.Error(), "bad transfer token MAC") {
+		t.Errorf("wrong token: dial error = %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("a refused token must not be retried")
+	}
+	if err := SendDir(addr, 1, "u1", src); err == nil {
+		t.Error("a version-1 frame must be refused")
+	}
+
+	// A signed HELLO followed by a frame whose MAC was not made with the
+	// token: its payload verifies, but the handler must never extract it.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, _ := encodeFrameHeader(FrameHeader{Kind: KindHello, Name: "forged", Signed: true}, wire.SessionVersion)
+	conn.Write(append(hello, wire.MAC("s3cret", "forged", hello, "")...))
+	h := FrameHeader{Kind: KindCheckpointFile, Name: "ckpt.dmtcp", Seq: 1, Codec: CodecNone, Signed: true}
+	header, _ := encodeFrameHeader(h, wire.SessionVersion)
+	var payload bytes.Buffer
+	if err := writeFilePayload(&payload, filepath.Join(src, "f"), CodecNone); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(header)
+	conn.Write(chunkStream(payload.Bytes(), 0, 4096))
+	conn.Write(bytes.Repeat([]byte{0xAB}, wire.MACSize))
+	br := bufio.NewReader(conn)
+	if code, _, _, err := wire.ReadReply(br); err != nil || code != wire.Ack {
+		t.Fatalf("signed HELLO reply = 0x%02X, %v", code, err)
+	}
+	if code, _, msg, err := wire.ReadReply(br); err != nil || code != wire.Err || !strings.Contains(msg, "bad transfer token MAC") {
+		t.Fatalf("forged frame reply = 0x%02X %q, %v", code, msg, err)
+	}
+	conn.Close()
+
+	sendSigned(t, addr, "s3cret", src)
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 || handled != 1 {
+		t.Fatalf("receive after refused connections = %d frame(s), %d handled, %v", len(res.frames), handled, res.err)
+	}
+}
+
+func TestSession_SilentStrangersDoNotBlockSignedSession(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var handled int
+	addr, resCh := startTokenReceiver(t, "s3cret", t.TempDir(), &handled)
+
+	// One stranger sends nothing, another half a HELLO header.
+	hello, _ := encodeFrameHeader(FrameHeader{Kind: KindHello, Name: "stranger", Signed: true}, wire.SessionVersion)
+	for _, b := range [][]byte{nil, hello[:len(hello)/2]} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(b)
+	}
+	start := time.Now()
+	sendSigned(t, addr, "s3cret", src)
+	if res := <-resCh; res.err != nil || handled != 1 {
+		t.Fatalf("receive next to silent connections = %d handled, %v", handled, res.err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("signed session took %s next to silent connections", d)
+	}
+}
+
+func TestOpen_DropsSilentConnection(t *testing.T) {
+	rs := newReceiverState(ReceiveOptions{Token: "s3cret"})
+	rs.deadline = time.Now().Add(time.Minute)
+	rs.helloTimeout = 200 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rs.open(server)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("a connection that sent nothing was admitted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection that sent nothing is still being admitted")
+	}
+}
+
+func TestFrameHeader_SignedFlag(t *testing.T) {
+	h := FrameHeader{Kind: KindLayer, Ordinal: 1, Name: "u1", Seq: 2, Codec: CodecGzip, Signed: true}
+	buf, err := encodeFrameHeader(h, wire.SessionVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := readFrameHeader(bytes.NewReader(buf))
+	if err != nil || got != h {
+		t.Fatalf("round trip = %+v, %v, want %+v", got, err, h)
+	}
+	if _, err := encodeFrameHeader(h, wire.Version); err == nil {
+		t.Fatal("a version-1 header must not be signed")
+	}
+}
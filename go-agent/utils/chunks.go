@@ -0,0 +1,441 @@
+package utils
+
+// Content-addressed deduplication of session frames.
+//
+// Repeated pre-sync rounds and the DMTCP images of similar processes carry
+// much of the same content. When both agents keep a chunk cache, a Session
+// cuts the uncompressed tar stream of each layer and checkpoint file into
+// content-defined chunks (a gear rolling hash, so an insertion only changes
+// the chunks around it) and asks the receiver which of them it lacks before
+// sending the frame:
+//
+//	query  = frame of kind KindChunkQuery, payload the 32-byte SHA-256 of
+//	         every chunk in order; the ACK message is a bitmap with bit i
+//	         (byte i/8, bit i%8) set when chunk i is missing
+//	frame  = the item's frame with wire.FlagChunked set; its payload, compressed
+//	         with the frame codec, is a recipe of
+//	         ['R'][32-byte SHA-256]                       chunk from the cache
+//	         ['D'][32-byte SHA-256][4-byte length][data]  chunk sent now
+//
+// The receiver stores every chunk it is sent, rebuilds the tar stream and
+// hands it to the FrameHandler as an uncompressed payload. The sender adds
+// the chunks it sends to its own cache as well, so a pod migrating back to
+// a node it left only sends what changed since.
+//
+// A session offers deduplication with wire.FlagChunked on HELLO; a receiver
+// with a cache accepts it with a 13-byte HELLO ACK. Older receivers answer
+// with 12 bytes and get ordinary frames.
+//
+// The cache lives in CHUNK_CACHE_DIR (default <DATA_DIR>/.chunks; mount a
+// hostPath there to keep it across pods on the node) as one file per chunk,
+// and is pruned to CHUNK_CACHE_MB (default 2048), least recently used
+// first. TRANSFER_DEDUP=false turns deduplication off.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+const (
+	// helloDedupReplySize is the HELLO ACK of a receiver that accepts
+	// deduplication: the resume point and one capability byte.
+	helloDedupReplySize = wire.HelloReplySize + 1
+
+	chunkMin  = 16 << 10
+	chunkMask = 1<<16 - 1 // 64 KiB average
+	chunkMax  = 256 << 10
+
+	recipeRef  = 'R'
+	recipeData = 'D'
+
+	// chunkKeepRecent protects recently used chunks from pruning: a
+	// receiver may have promised them to a sender.
+	chunkKeepRecent = time.Hour
+)
+
+// gear is the table of the content-defined chunker's rolling hash.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x6d796365647269) // splitmix64
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// chunker is an io.Writer that cuts what is written to it into
+// content-defined chunks and passes each to emit.
+type chunker struct {
+	emit func(chunk []byte) error
+	buf  []byte
+	hash uint64
+}
+
+func newChunker(emit func(chunk []byte) error) *chunker {
+	return &chunker{emit: emit, buf: make([]byte, 0, chunkMax)}
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		cut := -1
+		for i, b := range p {
+			c.hash = c.hash<<1 + gear[b]
+			if n := len(c.buf) + i + 1; n >= chunkMax || n >= chunkMin && c.hash&chunkMask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+		if cut < 0 {
+			c.buf = append(c.buf, p...)
+			return written + len(p), nil
+		}
+		c.buf = append(c.buf, p[:cut]...)
+		if err := c.cut(); err != nil {
+			return written + cut, err
+		}
+		written += cut
+		p = p[cut:]
+	}
+	return written, nil
+}
+
+func (c *chunker) cut() error {
+	err := c.emit(c.buf)
+	c.buf = c.buf[:0]
+	c.hash = 0
+	return err
+}
+
+// Close emits the last, short chunk.
+func (c *chunker) Close() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	return c.cut()
+}
+
+// chunkSums returns the SHA-256 of every chunk of what write produces.
+func chunkSums(write func(w io.Writer) error) ([][sha256.Size]byte, error) {
+	var sums [][sha256.Size]byte
+	c := newChunker(func(chunk []byte) error {
+		sums = append(sums, sha256.Sum256(chunk))
+		return nil
+	})
+	if err := write(c); err != nil {
+		return nil, err
+	}
+	return sums, c.Close()
+}
+
+// ChunkCache is a node's content-addressed chunk store.
+type ChunkCache struct {
+	Dir      string
+	MaxBytes int64
+}
+
+// ChunkCacheFromEnv returns the node's chunk cache below dataDir, or nil
+// when TRANSFER_DEDUP is false.
+func ChunkCacheFromEnv(dataDir string) (*ChunkCache, error) {
+	if !EnvBool("TRANSFER_DEDUP", true) {
+		return nil, nil
+	}
+	c := &ChunkCache{
+		Dir:      EnvOr("CHUNK_CACHE_DIR", filepath.Join(dataDir, ".chunks")),
+		MaxBytes: EnvSize("CHUNK_CACHE_MB", 2048, 1<<20),
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("chunk cache: %w", err)
+	}
+	return c, nil
+}
+
+func (c *ChunkCache) path(sum [sha256.Size]byte) string {
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, h[:2], h[2:])
+}
+
+// Has reports whether the chunk sum is cached and marks it used.
+func (c *ChunkCache) Has(sum [sha256.Size]byte) bool {
+	now := time.Now()
+	return os.Chtimes(c.path(sum), now, now) == nil
+}
+
+// Get returns the cached chunk sum. A chunk whose content no longer
+// matches its name is removed and reported as an error.
+func (c *ChunkCache) Get(sum [sha256.Size]byte) ([]byte, error) {
+	data, err := os.ReadFile(c.path(sum))
+	if err != nil {
+		return nil, fmt.Errorf("cached chunk %x: %w", sum[:8], err)
+	}
+	if sha256.Sum256(data) != sum {
+		os.Remove(c.path(sum))
+		return nil, fmt.Errorf("cached chunk %x is corrupt", sum[:8])
+	}
+	return data, nil
+}
+
+// Put stores chunk data under its SHA-256 sum, unless it is cached.
+func (c *ChunkCache) Put(sum [sha256.Size]byte, data []byte) error {
+	path := c.path(sum)
+	if c.Has(sum) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("chunk cache: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return fmt.Errorf("chunk cache: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("chunk cache: %w", err)
+	}
+	return nil
+}
+
+// Prune removes least recently used chunks until the cache fits MaxBytes,
+// sparing those used within the last hour. It returns how many it removed.
+func (c *ChunkCache) Prune() (int, error) {
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if strings.HasPrefix(info.Name(), ".put-") && time.Since(info.ModTime()) > chunkKeepRecent {
+				os.Remove(path) // left by a crashed writer
+				return nil
+			}
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("prune chunk cache: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	removed := 0
+	for _, e := range entries {
+		if total <= c.MaxBytes || time.Since(e.used) < chunkKeepRecent {
+			break
+		}
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("prune chunk cache: %w", err)
+		}
+		total -= e.size
+		removed++
+	}
+	return removed, nil
+}
+
+// answerQuery returns the bitmap of the chunks named by a query payload
+// that the cache lacks.
+func (c *ChunkCache) answerQuery(r io.Reader) (string, error) {
+	var sums [][sha256.Size]byte
+	br := bufio.NewReader(r)
+	for {
+		var sum [sha256.Size]byte
+		if _, err := io.ReadFull(br, sum[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("read chunk query: %w", err)
+		}
+		sums = append(sums, sum)
+	}
+	bitmap := make([]byte, (len(sums)+7)/8)
+	for i, sum := range sums {
+		if !c.Has(sum) {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return string(bitmap), nil
+}
+
+// writeQuery is the payload of a chunk query for sums.
+func writeQuery(w io.Writer, sums [][sha256.Size]byte) error {
+	for _, sum := range sums {
+		if _, err := w.Write(sum[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecipe writes the recipe of what write produces, compressed with
+// codec, to w: chunk i is sent when the receiver's bitmap missing says it
+// lacks it (and it was not sent earlier in this frame), referenced
+// otherwise. sums are the chunks the receiver was asked about; content
+// that no longer cuts into them fails. Every chunk is also added to cache.
+func writeRecipe(w io.Writer, codec Codec, sums [][sha256.Size]byte, missing string, cache *ChunkCache, write func(w io.Writer) error) error {
+	cw, err := compressor(w, codec)
+	if err != nil {
+		return err
+	}
+	if len(missing) != (len(sums)+7)/8 {
+		return fmt.Errorf("chunk query answer of %d bytes for %d chunks", len(missing), len(sums))
+	}
+	sent := make(map[[sha256.Size]byte]bool)
+	i := 0
+	c := newChunker(func(chunk []byte) error {
+		sum := sha256.Sum256(chunk)
+		if i >= len(sums) || sums[i] != sum {
+			return errors.New("content changed since its chunks were queried")
+		}
+		lacks := missing[i/8]&(1<<(i%8)) != 0
+		i++
+		var rec [1 + sha256.Size + 4]byte
+		copy(rec[1:], sum[:])
+		if !lacks || sent[sum] {
+			rec[0] = recipeRef
+			_, err := cw.Write(rec[:1+sha256.Size])
+			return err
+		}
+		sent[sum] = true
+		rec[0] = recipeData
+		binary.BigEndian.PutUint32(rec[1+sha256.Size:], uint32(len(chunk)))
+		if _, err := cw.Write(rec[:]); err != nil {
+			return err
+		}
+		if _, err := cw.Write(chunk); err != nil {
+			return err
+		}
+		if cache != nil {
+			// Best effort: the local copy only helps a later migration back.
+			cache.Put(sum, chunk)
+		}
+		return nil
+	})
+	if err := write(c); err != nil {
+		return err
+	}
+	if err := c.Close(); err != nil {
+		return err
+	}
+	if i != len(sums) {
+		return errors.New("content changed since its chunks were queried")
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", codec, err)
+	}
+	return nil
+}
+
+// recipeReader rebuilds the content of a recipe, storing the chunks it
+// carries in cache.
+type recipeReader struct {
+	r     *bufio.Reader
+	cache *ChunkCache
+	cur   bytes.Reader
+}
+
+func newRecipeReader(r io.Reader, cache *ChunkCache) *recipeReader {
+	return &recipeReader{r: bufio.NewReader(r), cache: cache}
+}
+
+func (rr *recipeReader) Read(p []byte) (int, error) {
+	for rr.cur.Len() == 0 {
+		if err := rr.next(); err != nil {
+			return 0, err
+		}
+	}
+	return rr.cur.Read(p)
+}
+
+// next loads the next chunk of the recipe.
+func (rr *recipeReader) next() error {
+	op, err := rr.r.ReadByte()
+	if err != nil {
+		return err // io.EOF ends the content
+	}
+	var sum [sha256.Size]byte
+	if _, err := io.ReadFull(rr.r, sum[:]); err != nil {
+		return fmt.Errorf("truncated chunk recipe: %w", err)
+	}
+	switch op {
+	case recipeRef:
+		data, err := rr.cache.Get(sum)
+		if err != nil {
+			return err
+		}
+		rr.cur.Reset(data)
+	case recipeData:
+		var n [4]byte
+		if _, err := io.ReadFull(rr.r, n[:]); err != nil {
+			return fmt.Errorf("truncated chunk recipe: %w", err)
+		}
+		size := binary.BigEndian.Uint32(n[:])
+		if size > chunkMax {
+			return fmt.Errorf("chunk of %d bytes exceeds %d", size, chunkMax)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(rr.r, data); err != nil {
+			return fmt.Errorf("truncated chunk recipe: %w", err)
+		}
+		if sha256.Sum256(data) != sum {
+			return fmt.Errorf("chunk %x does not match its hash", sum[:8])
+		}
+		if err := rr.cache.Put(sum, data); err != nil {
+			return err
+		}
+		rr.cur.Reset(data)
+	default:
+		return fmt.Errorf("unknown chunk recipe operation %#x", op)
+	}
+	return nil
+}
+
+// unchunk wraps handle so frames with a chunk recipe reach it as their
+// rebuilt, uncompressed payload.
+func unchunk(cache *ChunkCache, handle FrameHandler) FrameHandler {
+	return func(h FrameHeader, payload io.Reader) error {
+		if !h.Chunked {
+			return handle(h, payload)
+		}
+		if cache == nil {
+			return errors.New("chunked frame without a chunk cache")
+		}
+		dr, err := decompressor(payload, h.Codec)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		h.Chunked, h.Codec = false, CodecNone
+		var content io.Reader = newRecipeReader(dr, cache)
+		if sp, ok := payload.(*sessionPayload); ok {
+			content = &sessionPayload{Reader: content, raw: sp.raw}
+		}
+		return handle(h, content)
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChunker_InsertionKeepsOtherChunks(t *testing.T) {
+	data := randomData(2 << 20)
+	edited := append(append(append([]byte{}, data[:1<<20]...), "inserted"...), data[1<<20:]...)
+	sums := func(b []byte) [][sha256.Size]byte {
+		s, err := chunkSums(func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	before, after := sums(data), sums(edited)
+	if n := len(before); n < 2<<20/chunkMax || n > 2<<20/chunkMin {
+		t.Fatalf("%d chunks for 2 MiB", n)
+	}
+	known := make(map[[sha256.Size]byte]bool)
+	for _, s := range before {
+		known[s] = true
+	}
+	changed := 0
+	for _, s := range after {
+		if !known[s] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("an insertion changed %d of %d chunks", changed, len(after))
+	}
+}
+
+// startDedupReceiver runs one transfer into dst with the chunk cache in
+// cacheDir, behind a proxy that counts the bytes sent to it.
+func startDedupReceiver(t *testing.T, dst, cacheDir string) (*flakyProxy, <-chan receiveResult) {
+	t.Helper()
+	var cache *ChunkCache
+	if cacheDir != "" {
+		cache = &ChunkCache{Dir: cacheDir, MaxBytes: 1 << 30}
+	}
+	addr, resCh := startReceiverWith(t, ReceiveOptions{Timeout: 10 * time.Second, ChunkCache: cache}, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+	return startFlakyProxy(t, addr, 1<<40, false), resCh
+}
+
+// sendFile sends the file at path over a deduplicating session to addr.
+func sendFile(t *testing.T, addr, path, cacheDir string) *Session {
+	t.Helper()
+	s, err := DialSessionWith(addr, DialOptions{ChunkCache: &ChunkCache{Dir: cacheDir, MaxBytes: 1 << 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.SetCodec(CodecNone)
+	if err := s.SendCheckpointFile(path); err != nil {
+		t.Fatalf("SendCheckpointFile: %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	return s
+}
+
+func TestSession_DedupSendsOnlyMissingChunks(t *testing.T) {
+	data := randomData(2 << 20)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_app.dmtcp")
+	os.WriteFile(ckpt, data, 0o600)
+	dst, recvCache, sendCache := t.TempDir(), t.TempDir(), t.TempDir()
+
+	for round, edit := range []string{"", "one changed page"} {
+		copy(data[1<<20:], edit)
+		os.WriteFile(ckpt, data, 0o600)
+		proxy, resCh := startDedupReceiver(t, dst, recvCache)
+		sendFile(t, proxy.ln.Addr().String(), ckpt, sendCache)
+		if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+			t.Fatalf("round %d: ReceiveAll = %d frame(s), %v", round, len(res.frames), res.err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_app.dmtcp")); !bytes.Equal(got, data) {
+			t.Fatalf("round %d: file differs after the transfer", round)
+		}
+		_, up := proxy.stats()
+		switch {
+		case round == 0 && up < int64(len(data)):
+			t.Errorf("first transfer sent %d bytes of %d", up, len(data))
+		case round == 1 && up > int64(len(data))/8:
+			t.Errorf("second transfer sent %d bytes for one changed page of %d", up, len(data))
+		}
+	}
+	// The sender keeps what it sent, for a migration back.
+	if chunks, _ := filepath.Glob(filepath.Join(sendCache, "*", "*")); len(chunks) < 2<<20/chunkMax {
+		t.Errorf("sender cached %d chunk(s)", len(chunks))
+	}
+}
+
+func TestSession_DedupFallsBackWithoutReceiverCache(t *testing.T) {
+	data := textData(512 << 10)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_app.dmtcp")
+	os.WriteFile(ckpt, data, 0o600)
+	dst := t.TempDir()
+	proxy, resCh := startDedupReceiver(t, dst, "")
+	s := sendFile(t, proxy.ln.Addr().String(), ckpt, t.TempDir())
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	if s.dedup {
+		t.Error("a receiver without a chunk cache must not be sent chunk recipes")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_app.dmtcp")); !bytes.Equal(got, data) {
+		t.Fatal("file differs after the transfer")
+	}
+}
+
+func TestSession_DedupResumesChunkedFrame(t *testing.T) {
+	data := randomData(1536 << 10)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_big.dmtcp")
+	os.WriteFile(ckpt, data, 0o600)
+	dst := t.TempDir()
+
+	spool := t.TempDir()
+	addr, resCh := startReceiverWith(t, ReceiveOptions{
+		Timeout:    10 * time.Second,
+		SpoolDir:   func(FrameHeader) string { return spool },
+		ChunkCache: &ChunkCache{Dir: t.TempDir(), MaxBytes: 1 << 30},
+	}, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+	// Cut inside the chunked frame, after the query was answered.
+	proxy := startFlakyProxy(t, addr, 600<<10, false)
+	s := sendFile(t, proxy.ln.Addr().String(), ckpt, t.TempDir())
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_big.dmtcp")); !bytes.Equal(got, data) {
+		t.Fatal("file differs after the resumed transfer")
+	}
+	if n := s.Reconnects(); n != 1 {
+		t.Errorf("Reconnects = %d, want 1", n)
+	}
+}
+
+func TestChunkCache_PruneOldestFirst(t *testing.T) {
+	c := &ChunkCache{Dir: t.TempDir(), MaxBytes: 3000}
+	var sums [][sha256.Size]byte
+	for i := 0; i < 4; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 1000)
+		sum := sha256.Sum256(chunk)
+		if err := c.Put(sum, chunk); err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+	}
+	// Chunks 0 and 1 were last used two hours ago, 0 before 1.
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour} {
+		old := time.Now().Add(-age)
+		os.Chtimes(c.path(sums[i]), old, old)
+	}
+	n, err := c.Prune()
+	if err != nil || n != 1 {
+		t.Fatalf("Prune = %d, %v; want 1 chunk removed", n, err)
+	}
+	if c.Has(sums[0]) || !c.Has(sums[1]) {
+		t.Error("Prune must remove the least recently used chunk")
+	}
+	if _, err := c.Get(sums[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks used within the hour stay even over the limit.
+	c.MaxBytes = 0
+	if n, _ := c.Prune(); n != 0 {
+		t.Errorf("Prune removed %d recently used chunk(s)", n)
+	}
+
+	os.WriteFile(c.path(sums[2]), []byte("bit rot"), 0o644)
+	if _, err := c.Get(sums[2]); err == nil || c.Has(sums[2]) {
+		t.Error("a corrupt chunk must be refused and dropped")
+	}
+}
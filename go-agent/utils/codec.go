@@ -0,0 +1,202 @@
+package utils
+
+// Payload compression.
+//
+// A version-2 frame header names the codec of its payload (bytes [52:56));
+// version-1 frames are always gzip. The sender picks the codec per session
+// (TRANSFER_CODEC, or the MC's /remove and /poll responses):
+//
+//	gzip   compress/gzip, the version-1 format (default)
+//	pgzip  gzip format, compressed on all cores
+//	zstd   Zstandard, much faster than gzip at a similar ratio
+//	lz4    LZ4, fastest, for links faster than zstd can feed
+//	none   tar stream as-is
+//	auto   per frame: none when a sample of the content does not compress
+//	       (DMTCP gzip images, compressed databases), zstd otherwise
+//
+// Every codec produces the same bytes for the same input, which a resumed
+// transfer relies on (see session.go).
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec identifies the compression of a frame payload.
+type Codec uint32
+
+const (
+	CodecGzip  Codec = 0
+	CodecNone  Codec = 1
+	CodecZstd  Codec = 2
+	CodecLZ4   Codec = 3
+	CodecPgzip Codec = 4
+
+	// CodecAuto is a sender policy, never sent: each frame gets CodecNone
+	// or CodecZstd depending on how well its content compresses.
+	CodecAuto Codec = 0xFF
+)
+
+const (
+	// autoSampleSize is how much content CodecAuto compresses to decide.
+	autoSampleSize = 256 << 10
+	// autoSamplePerFile caps one file's share of a directory sample.
+	autoSamplePerFile = 64 << 10
+	// autoMinSaving is the fraction of the sample compression must save.
+	autoMinSaving = 0.1
+)
+
+var codecNames = map[Codec]string{
+	CodecGzip:  "gzip",
+	CodecNone:  "none",
+	CodecZstd:  "zstd",
+	CodecLZ4:   "lz4",
+	CodecPgzip: "pgzip",
+	CodecAuto:  "auto",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", uint32(c))
+}
+
+// ParseCodec returns the codec called name; empty means gzip.
+func ParseCodec(name string) (Codec, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return CodecGzip, nil
+	}
+	for c, n := range codecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q (want none, gzip, pgzip, zstd, lz4 or auto)", name)
+}
+
+// compressor returns a writer that compresses into w with codec c. Closing
+// it flushes the codec's trailer but does not close w.
+func compressor(w io.Writer, c Codec) (io.WriteCloser, error) {
+	switch c {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecPgzip:
+		pw := pgzip.NewWriter(w)
+		if err := pw.SetConcurrency(1<<20, runtime.NumCPU()); err != nil {
+			return nil, fmt.Errorf("pgzip: %w", err)
+		}
+		return pw, nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecLZ4:
+		return lz4.NewWriter(w), nil
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("cannot compress with %s", c)
+}
+
+// decompressor returns a reader of the data r holds compressed with codec c.
+func decompressor(r io.Reader, c Codec) (io.ReadCloser, error) {
+	switch c {
+	case CodecGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip reader: %w", err)
+		}
+		// The payload is a single gzip member; a version-1 connection is
+		// then used for the ACK exchange. Multistream mode would block
+		// probing the connection for a second member that never arrives.
+		gr.Multistream(false)
+		return gr, nil
+	case CodecPgzip:
+		pr, err := pgzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("pgzip reader: %w", err)
+		}
+		pr.Multistream(false)
+		return pr, nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case CodecLZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case CodecNone:
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported payload codec %s", c)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// resolveCodec returns c, or for CodecAuto the codec suited to the content
+// of paths (files or directories).
+func resolveCodec(c Codec, paths ...string) Codec {
+	if c != CodecAuto {
+		return c
+	}
+	var sample bytes.Buffer
+	for _, p := range paths {
+		sampleContent(&sample, p)
+	}
+	if compressible(sample.Bytes()) {
+		return CodecZstd
+	}
+	return CodecNone
+}
+
+// sampleContent appends up to autoSamplePerFile bytes of every regular file
+// under path to sample, in walk order, until it holds autoSampleSize.
+func sampleContent(sample *bytes.Buffer, path string) {
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if sample.Len() >= autoSampleSize {
+			return filepath.SkipDir
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		n := int64(autoSampleSize - sample.Len())
+		if n > autoSamplePerFile {
+			n = autoSamplePerFile
+		}
+		io.CopyN(sample, f, n)
+		return nil
+	})
+}
+
+// compressible reports whether zstd saves at least autoMinSaving of b. An
+// empty sample counts as compressible: the tar headers still are.
+func compressible(b []byte) bool {
+	if len(b) == 0 {
+		return true
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return true
+	}
+	defer enc.Close()
+	out := enc.EncodeAll(b, nil)
+	return float64(len(out)) <= float64(len(b))*(1-autoMinSaving)
+}
@@ -0,0 +1,428 @@
+package utils
+
+// Block-level delta encoding of layer files.
+//
+// OverlayFS copies a whole file up into the writable layer on its first
+// write, so one changed page of a large database puts the full file into
+// every later layer. When the sender knows that the destination already
+// holds an earlier version of such a file in a lower layer (see DeltaBase),
+// tarDir archives only the differences, rsync-style: the earlier version is
+// cut into deltaBlockSize blocks indexed by a rolling checksum and a
+// SHA-256, the new version is scanned for blocks that match at any offset,
+// and the entry's content becomes a list of operations:
+//
+//	copy    = ['C'][8-byte offset in the earlier version][8-byte length]
+//	literal = ['L'][8-byte length][length bytes]
+//
+// The tar entry stays a regular file whose PAX records name the base layer
+// and the rebuilt file's size and SHA-256. ExtractTarWith rebuilds the file
+// from the base in that layer and refuses the archive when the result does
+// not match. A delta is only used when it is smaller than the file, and
+// only for files of at least VOLUME_DELTA_MIN_KB (default 1024);
+// VOLUME_DELTA=false turns it off.
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	deltaBlockSize = 16 << 10
+
+	paxDeltaLayer  = "MYCEDRIVE.delta.layer"
+	paxDeltaSize   = "MYCEDRIVE.delta.size"
+	paxDeltaSHA256 = "MYCEDRIVE.delta.sha256"
+
+	deltaCopy    = 'C'
+	deltaLiteral = 'L'
+)
+
+// DeltaBase locates an earlier version of the layer file name (a slash
+// separated path relative to the layer) that the destination already
+// holds: the ordinal of the lower layer it is in there and its path on
+// this node. ok is false when there is none.
+type DeltaBase func(name string) (layer int, path string, ok bool)
+
+// ExtractOptions configures ExtractTarWith.
+type ExtractOptions struct {
+	// LayerDir returns the directory of received lower layer n; delta
+	// entries are rebuilt from their base in it. Archives with delta
+	// entries cannot be extracted without it.
+	LayerDir func(n int) string
+}
+
+// deltaMinSize returns the smallest file size that is delta encoded, or 0
+// when delta encoding is off.
+func deltaMinSize() int64 {
+	if !EnvBool("VOLUME_DELTA", true) {
+		return 0
+	}
+	return EnvSize("VOLUME_DELTA_MIN_KB", 1024, 1<<10)
+}
+
+// deltaOp is one operation of a delta. off is an offset in the base for a
+// copy and in the new file for a literal.
+type deltaOp struct {
+	copy   bool
+	off, n int64
+}
+
+// fileDelta is the delta of a file against its base.
+type fileDelta struct {
+	ops      []deltaOp
+	encoded  int64  // size of the encoded operations
+	size     int64  // size of the new file
+	checksum string // hex SHA-256 of the new file
+}
+
+func (d *fileDelta) add(op deltaOp) {
+	if !op.copy {
+		d.encoded += op.n
+	}
+	if k := len(d.ops) - 1; k >= 0 && d.ops[k].copy == op.copy && d.ops[k].off+d.ops[k].n == op.off {
+		d.ops[k].n += op.n
+		return
+	}
+	d.ops = append(d.ops, op)
+	d.encoded += 9
+	if op.copy {
+		d.encoded += 8
+	}
+}
+
+// write encodes d to w, reading literals from f, the new file.
+func (d *fileDelta) write(w io.Writer, f *os.File) error {
+	var rec [17]byte
+	for _, op := range d.ops {
+		if op.copy {
+			rec[0] = deltaCopy
+			binary.BigEndian.PutUint64(rec[1:9], uint64(op.off))
+			binary.BigEndian.PutUint64(rec[9:17], uint64(op.n))
+			if _, err := w.Write(rec[:17]); err != nil {
+				return err
+			}
+			continue
+		}
+		rec[0] = deltaLiteral
+		binary.BigEndian.PutUint64(rec[1:9], uint64(op.n))
+		if _, err := w.Write(rec[:9]); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, op.off, op.n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollsum is the rsync rolling checksum of a deltaBlockSize window.
+type rollsum struct{ a, b uint32 }
+
+func (r *rollsum) init(p []byte) {
+	r.a, r.b = 0, 0
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+}
+
+// roll slides the window by one byte: out leaves it, in enters it.
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - deltaBlockSize*uint32(out)
+}
+
+func (r *rollsum) sum() uint32 { return r.a&0xffff | r.b<<16 }
+
+// baseBlock is one full block of a delta base.
+type baseBlock struct {
+	index  int64
+	strong [sha256.Size]byte
+}
+
+// blockSignature indexes the full blocks of the file at path by their
+// rolling checksum.
+func blockSignature(path string) (map[uint32][]baseBlock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sig := make(map[uint32][]baseBlock)
+	br := bufio.NewReaderSize(f, 4*deltaBlockSize)
+	buf := make([]byte, deltaBlockSize)
+	var rs rollsum
+	for i := int64(0); ; i++ {
+		if _, err := io.ReadFull(br, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rs.init(buf)
+		sig[rs.sum()] = append(sig[rs.sum()], baseBlock{i, sha256.Sum256(buf)})
+	}
+}
+
+// computeDelta returns the delta of the file at path against its earlier
+// version at basePath.
+func computeDelta(basePath, path string) (*fileDelta, error) {
+	sig, err := blockSignature(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("index delta base %s: %w", basePath, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &fileDelta{}
+	h := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(f, h), 4*deltaBlockSize)
+	var (
+		pos     int64
+		literal int64 = -1 // start of the pending literal
+		next    int64      // base block that would continue the last copy
+		rs      rollsum
+		valid   bool // rs holds the checksum of the window at pos
+	)
+	flush := func() {
+		if literal >= 0 {
+			d.add(deltaOp{off: literal, n: pos - literal})
+			literal = -1
+		}
+	}
+	for {
+		win, err := br.Peek(deltaBlockSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(win) < deltaBlockSize {
+			break
+		}
+		if !valid {
+			rs.init(win)
+			valid = true
+		}
+		if idx, ok := matchBlock(sig[rs.sum()], win, next); ok {
+			flush()
+			d.add(deltaOp{copy: true, off: idx * deltaBlockSize, n: deltaBlockSize})
+			next = idx + 1
+			br.Discard(deltaBlockSize)
+			pos += deltaBlockSize
+			valid = false
+			continue
+		}
+		if literal < 0 {
+			literal = pos
+		}
+		out := win[0]
+		if ahead, _ := br.Peek(deltaBlockSize + 1); len(ahead) > deltaBlockSize {
+			rs.roll(out, ahead[deltaBlockSize])
+		} else {
+			valid = false
+		}
+		br.Discard(1)
+		pos++
+	}
+	rest, err := io.Copy(io.Discard, br)
+	if err != nil {
+		return nil, err
+	}
+	if rest > 0 && literal < 0 {
+		literal = pos
+	}
+	pos += rest
+	flush()
+	d.size = pos
+	d.checksum = hex.EncodeToString(h.Sum(nil))
+	return d, nil
+}
+
+// matchBlock returns the base block among candidates holding win,
+// preferring next so consecutive copies merge.
+func matchBlock(candidates []baseBlock, win []byte, next int64) (int64, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := sha256.Sum256(win)
+	found := int64(-1)
+	for _, c := range candidates {
+		if c.strong != strong {
+			continue
+		}
+		if c.index == next {
+			return c.index, true
+		}
+		if found < 0 {
+			found = c.index
+		}
+	}
+	return found, found >= 0
+}
+
+// writeDeltaEntry archives the regular file at path (header hdr) as a
+// delta against its base when base has one and the delta is smaller than
+// the file. It reports whether it wrote the entry.
+func writeDeltaEntry(tw *tar.Writer, hdr *tar.Header, path string, base DeltaBase) (bool, error) {
+	layer, basePath, ok := base(hdr.Name)
+	if !ok {
+		return false, nil
+	}
+	d, err := computeDelta(basePath, path)
+	if err != nil {
+		return false, err
+	}
+	if d.size != hdr.Size {
+		return false, fmt.Errorf("%s changed while it was archived", path)
+	}
+	if d.encoded >= hdr.Size {
+		return false, nil
+	}
+	dh := *hdr
+	dh.Size = d.encoded
+	dh.PAXRecords = make(map[string]string, len(hdr.PAXRecords)+3)
+	for k, v := range hdr.PAXRecords {
+		dh.PAXRecords[k] = v
+	}
+	dh.PAXRecords[paxDeltaLayer] = strconv.Itoa(layer)
+	dh.PAXRecords[paxDeltaSize] = strconv.FormatInt(d.size, 10)
+	dh.PAXRecords[paxDeltaSHA256] = d.checksum
+	if err := tw.WriteHeader(&dh); err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return true, d.write(tw, f)
+}
+
+// isDelta reports whether hdr is a delta entry.
+func isDelta(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[paxDeltaLayer]
+	return ok
+}
+
+// applyDelta rebuilds the delta entry hdr, whose operations r yields, at
+// target from its base in the lower layer named by the entry.
+func applyDelta(target string, hdr *tar.Header, r io.Reader, opts ExtractOptions) error {
+	layer, err := strconv.Atoi(hdr.PAXRecords[paxDeltaLayer])
+	if err != nil {
+		return fmt.Errorf("tar entry %q: bad delta layer: %w", hdr.Name, err)
+	}
+	size, err := strconv.ParseInt(hdr.PAXRecords[paxDeltaSize], 10, 64)
+	if err != nil {
+		return fmt.Errorf("tar entry %q: bad delta size: %w", hdr.Name, err)
+	}
+	if opts.LayerDir == nil {
+		return fmt.Errorf("tar entry %q is a delta against layer %d, which is not available here", hdr.Name, layer)
+	}
+	basePath, err := safeJoin(opts.LayerDir(layer), hdr.Name)
+	if err != nil {
+		return err
+	}
+	base, err := os.Open(basePath)
+	if err != nil {
+		return fmt.Errorf("open delta base of %s: %w", hdr.Name, err)
+	}
+	defer base.Close()
+
+	dr := &deltaReader{ops: r, base: base, h: sha256.New()}
+	if err := writeSparse(target, dr); err != nil {
+		return fmt.Errorf("rebuild %s from layer %d: %w", hdr.Name, layer, err)
+	}
+	if dr.n != size || hex.EncodeToString(dr.h.Sum(nil)) != hdr.PAXRecords[paxDeltaSHA256] {
+		return fmt.Errorf("rebuild %s from layer %d: result does not match the source file", hdr.Name, layer)
+	}
+	return nil
+}
+
+// deltaReader yields the file a delta's operations describe, reading
+// copies from base.
+type deltaReader struct {
+	ops  io.Reader
+	base *os.File
+	h    hash.Hash
+	n    int64     // bytes yielded so far
+	cur  io.Reader // data of the current operation
+}
+
+func (d *deltaReader) Read(p []byte) (int, error) {
+	for {
+		if d.cur != nil {
+			n, err := d.cur.Read(p)
+			d.h.Write(p[:n])
+			d.n += int64(n)
+			if err == io.EOF {
+				d.cur = nil
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		var rec [17]byte
+		if _, err := io.ReadFull(d.ops, rec[:1]); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		switch rec[0] {
+		case deltaCopy:
+			if _, err := io.ReadFull(d.ops, rec[1:17]); err != nil {
+				return 0, fmt.Errorf("truncated delta copy: %w", err)
+			}
+			off := int64(binary.BigEndian.Uint64(rec[1:9]))
+			n := int64(binary.BigEndian.Uint64(rec[9:17]))
+			d.cur = &exactReader{r: io.NewSectionReader(d.base, off, n), n: n}
+		case deltaLiteral:
+			if _, err := io.ReadFull(d.ops, rec[1:9]); err != nil {
+				return 0, fmt.Errorf("truncated delta literal: %w", err)
+			}
+			n := int64(binary.BigEndian.Uint64(rec[1:9]))
+			d.cur = &exactReader{r: io.LimitReader(d.ops, n), n: n}
+		default:
+			return 0, fmt.Errorf("unknown delta operation %#x", rec[0])
+		}
+	}
+}
+
+// errShortDelta reports a copy or literal that ended early: a base shorter
+// than the source's, or a truncated archive.
+var errShortDelta = errors.New("delta data ends early")
+
+// exactReader reads exactly n bytes from r; running short is errShortDelta.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = errShortDelta
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
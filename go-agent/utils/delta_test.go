@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// deltaLayers writes base as db.bin in lower layer 1 of a destination and
+// returns that destination's LayerDir together with a source layer holding
+// next as db.bin and a DeltaBase pointing at the source's copy of base.
+func deltaLayers(t *testing.T, base, next []byte) (func(int) string, string, DeltaBase) {
+	t.Helper()
+	srcBase, srcNext, dst := t.TempDir(), t.TempDir(), t.TempDir()
+	layerDir := func(n int) string { return filepath.Join(dst, fmt.Sprintf("l%d", n)) }
+	for dir, data := range map[string][]byte{srcBase: base, srcNext: next, layerDir(1): base} {
+		os.MkdirAll(dir, 0o755)
+		if err := os.WriteFile(filepath.Join(dir, "db.bin"), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return layerDir, srcNext, func(name string) (int, string, bool) {
+		return 1, filepath.Join(srcBase, filepath.FromSlash(name)), name == "db.bin"
+	}
+}
+
+func TestDelta_SendsOnlyChangedBlocks(t *testing.T) {
+	t.Setenv("VOLUME_DELTA_MIN_KB", "64")
+	base := randomData(2 << 20)
+	next := append([]byte("inserted header "), base...) // shifts every block
+	copy(next[1<<20:], "rewritten page")
+	next = append(next, textData(5000)...)
+
+	layerDir, src, deltaBase := deltaLayers(t, base, next)
+	var buf bytes.Buffer
+	if err := writeDirPayload(&buf, src, CodecNone, deltaBase); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 64<<10 {
+		t.Errorf("delta payload is %d bytes for a few changed blocks of a %d byte file", buf.Len(), len(next))
+	}
+	if err := ExtractTarWith(bytes.NewReader(buf.Bytes()), CodecNone, layerDir(2), ExtractOptions{LayerDir: layerDir}); err != nil {
+		t.Fatalf("ExtractTarWith: %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(layerDir(2), "db.bin"))
+	if !bytes.Equal(got, next) {
+		t.Fatalf("rebuilt file differs (%d bytes, want %d)", len(got), len(next))
+	}
+
+	// Without the lower layers the archive cannot be extracted.
+	if err := ExtractTar(bytes.NewReader(buf.Bytes()), CodecNone, t.TempDir()); err == nil || !strings.Contains(err.Error(), "delta against layer 1") {
+		t.Fatalf("ExtractTar of a delta = %v", err)
+	}
+}
+
+func TestDelta_RefusesWrongBase(t *testing.T) {
+	t.Setenv("VOLUME_DELTA_MIN_KB", "64")
+	base := randomData(256 << 10)
+	next := append(append([]byte{}, base...), "appended"...)
+	layerDir, src, deltaBase := deltaLayers(t, base, next)
+	var buf bytes.Buffer
+	if err := writeDirPayload(&buf, src, CodecNone, deltaBase); err != nil {
+		t.Fatal(err)
+	}
+	// The destination's copy of the base is not what the source diffed.
+	os.WriteFile(filepath.Join(layerDir(1), "db.bin"), textData(256<<10), 0o644)
+	err := ExtractTarWith(&buf, CodecNone, layerDir(2), ExtractOptions{LayerDir: layerDir})
+	if err == nil || !strings.Contains(err.Error(), "does not match the source file") {
+		t.Fatalf("ExtractTarWith over a wrong base = %v", err)
+	}
+}
+
+func TestDelta_FallsBackToWholeFile(t *testing.T) {
+	t.Setenv("VOLUME_DELTA_MIN_KB", "64")
+	for name, env := range map[string]string{"unrelated content": "true", "disabled": "false"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("VOLUME_DELTA", env)
+			next := randomData(256 << 10)
+			base := textData(256 << 10)
+			if env == "false" {
+				base = next
+			}
+			_, src, deltaBase := deltaLayers(t, base, next)
+			var buf bytes.Buffer
+			if err := writeDirPayload(&buf, src, CodecNone, deltaBase); err != nil {
+				t.Fatal(err)
+			}
+			// A plain archive extracts without any lower layers.
+			dst := t.TempDir()
+			if err := ExtractTar(&buf, CodecNone, dst); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dst, "db.bin")); !bytes.Equal(got, next) {
+				t.Fatal("file differs after round trip")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+// Transfer integrity.
+//
+// Every version-2 frame ends with the SHA-256 of its payload (see
+// transfer.go). The receiver compares it with the bytes it spooled before
+// the handler runs and answers a mismatch with a NAK, which makes the sender
+// reconnect and send the frame again from the start. The DONE frame carries
+// a Manifest of every item the destination must hold, including items sent
+// by earlier sessions (pre-downtime rounds), and ReceiveAllWith fails when
+// any of them is missing or arrived with a different digest, so a target
+// never restores from an incomplete set.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// maxManifestSize bounds the DONE payload.
+const maxManifestSize = 1 << 20
+
+// ManifestEntry is one item the destination must have received.
+type ManifestEntry struct {
+	Kind    FrameKind `json:"kind"`
+	Ordinal int       `json:"ordinal,omitempty"`
+	Name    string    `json:"name"`
+	// SHA256 is the hex digest of the item's payload. Empty when the
+	// sender no longer knows it (layers marked sent by older agents); only
+	// the item's presence is checked then.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Manifest is the payload of a version-2 DONE frame.
+type Manifest struct {
+	Items []ManifestEntry `json:"items"`
+}
+
+// itemKey identifies an item across frames and sessions.
+type itemKey struct {
+	kind    FrameKind
+	ordinal int
+	name    string
+}
+
+func (e ManifestEntry) key() itemKey { return itemKey{e.Kind, e.Ordinal, e.Name} }
+
+func (e ManifestEntry) String() string {
+	switch e.Kind {
+	case KindLayer:
+		return fmt.Sprintf("layer %d (%s)", e.Ordinal, e.Name)
+	case KindCheckpointFile:
+		return "checkpoint file " + e.Name
+	case KindCheckpointPart:
+		return fmt.Sprintf("part %d of checkpoint file %s", e.Ordinal, e.Name)
+	case KindStripedFile:
+		return "striped checkpoint file " + e.Name
+	case KindFileRange:
+		return fmt.Sprintf("range %d of checkpoint file %s", e.Ordinal, e.Name)
+	default:
+		return fmt.Sprintf("item %q of kind %d", e.Name, e.Kind)
+	}
+}
+
+func headerKey(h FrameHeader) itemKey { return itemKey{h.Kind, h.Ordinal, h.Name} }
+
+// mergeManifest returns the entries of every list in order, keeping the
+// position of an item's first occurrence and the digest of its last.
+func mergeManifest(lists ...[]ManifestEntry) Manifest {
+	var m Manifest
+	index := make(map[itemKey]int)
+	for _, list := range lists {
+		for _, e := range list {
+			if i, ok := index[e.key()]; ok {
+				if e.SHA256 != "" {
+					m.Items[i].SHA256 = e.SHA256
+				}
+				continue
+			}
+			index[e.key()] = len(m.Items)
+			m.Items = append(m.Items, e)
+		}
+	}
+	return m
+}
+
+// check verifies that every manifest item was received with the expected
+// digest. received maps items to the hex digest they arrived with; version-1
+// frames are recorded without one.
+func (m Manifest) check(received map[itemKey]string) error {
+	var problems []string
+	for _, e := range m.Items {
+		got, ok := received[e.key()]
+		switch {
+		case !ok:
+			problems = append(problems, e.String()+" missing")
+		case e.SHA256 == "":
+		case got == "":
+			problems = append(problems, e.String()+" received without a digest")
+		case got != e.SHA256:
+			problems = append(problems, fmt.Sprintf("%s digest %.12s, expected %.12s", e, got, e.SHA256))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("incomplete transfer: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readManifest reads and verifies the chunked DONE payload from r. It
+// returns the manifest and the hex digest of the payload.
+func readManifest(r io.Reader) (Manifest, string, error) {
+	var m Manifest
+	buf, digest, err := readInline(r, FrameHeader{Kind: KindDone}, "manifest", maxManifestSize)
+	if err != nil {
+		return m, "", err
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return m, "", fmt.Errorf("parse manifest: %w", err)
+	}
+	return m, digest, nil
+}
+
+// readInline reads and verifies the chunked payload of frame h, at most max
+// bytes of what, into memory. It returns the payload and its hex digest.
+func readInline(r io.Reader, h FrameHeader, what string, max int) ([]byte, string, error) {
+	var buf []byte
+	for {
+		n, off, err := wire.ReadChunkHeader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		if off != int64(len(buf)) {
+			return nil, "", fmt.Errorf("%s chunk at offset %d, expected %d", what, off, len(buf))
+		}
+		if n == 0 {
+			break
+		}
+		if len(buf)+int(n) > max {
+			return nil, "", fmt.Errorf("%s exceeds %d bytes", what, max)
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, "", fmt.Errorf("read %s: %w", what, err)
+		}
+		buf = append(buf, chunk...)
+	}
+	want, err := wire.ReadDigest(r)
+	if err != nil {
+		return nil, "", err
+	}
+	got := sha256.Sum256(buf)
+	digest := hex.EncodeToString(got[:])
+	if got != want {
+		return nil, "", digestError{h: h, got: digest, want: hex.EncodeToString(want[:])}
+	}
+	return buf, digest, nil
+}
+
+// digestError reports a frame whose payload does not match its digest
+// trailer. The receiver NAKs it and the sender retransmits.
+type digestError struct {
+	h         FrameHeader
+	got, want string
+}
+
+func (e digestError) Error() string {
+	return fmt.Sprintf("frame %d (%q): payload digest %.12s does not match trailer %.12s", e.h.Seq, e.h.Name, e.got, e.want)
+}
@@ -0,0 +1,197 @@
+package utils
+
+// Dependency-ordered execution of the preStop steps.
+//
+// A Pipeline runs named steps as soon as the steps they come after have
+// finished, on at most Workers goroutines at once. A step may spawn
+// sub-steps while it runs (e.g. one per checkpoint file it produced); it
+// only counts as finished once they have, so steps after it wait for the
+// whole family. The first failure cancels the context the steps run with,
+// no further steps start and Run returns that error once the running ones
+// have returned. Run also reports how long every step that ran took.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StepFunc is the work of one pipeline step. spawn adds a sub-step that
+// runs as soon as a worker is free.
+type StepFunc func(ctx context.Context, spawn func(name string, run StepFunc)) error
+
+// StepTiming is how long one step of a pipeline ran, not counting its
+// sub-steps.
+type StepTiming struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Pipeline is a set of steps and the order they must run in.
+type Pipeline struct {
+	// Workers bounds how many steps run at once; at least one does.
+	Workers int
+	// OnCancel, when set, is called once when a failure cancels the
+	// pipeline, e.g. to interrupt steps blocked on a connection.
+	OnCancel func()
+
+	steps []*pipelineStep
+	index map[string]*pipelineStep
+}
+
+type pipelineStep struct {
+	name   string
+	run    StepFunc
+	after  []string
+	parent *pipelineStep
+
+	started, ran, finished bool
+	children               int // sub-steps not finished yet
+	timing                 StepTiming
+}
+
+// stepEvent is sent to the scheduler by running steps.
+type stepEvent struct {
+	step  *pipelineStep
+	err   error         // the step returned; valid unless spawn is set
+	spawn *pipelineStep // a sub-step of step to add
+}
+
+// NewPipeline returns an empty pipeline running up to workers steps at
+// once.
+func NewPipeline(workers int) *Pipeline {
+	return &Pipeline{Workers: workers, index: make(map[string]*pipelineStep)}
+}
+
+// Add adds the step name, to run once every step named in after has
+// finished. Steps are started in the order they were added when more are
+// ready than there are workers.
+func (p *Pipeline) Add(name string, run StepFunc, after ...string) {
+	s := &pipelineStep{name: name, run: run, after: after}
+	p.steps = append(p.steps, s)
+	p.index[name] = s
+}
+
+// Run runs every step and returns their timings in start order. It fails
+// with the first step error, or when a step comes after one that does not
+// exist or the steps wait on each other.
+func (p *Pipeline) Run(ctx context.Context) ([]StepTiming, error) {
+	for _, s := range p.steps {
+		for _, dep := range s.after {
+			if p.index[dep] == nil {
+				return nil, fmt.Errorf("step %s comes after unknown step %s", s.name, dep)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	events := make(chan stepEvent)
+	running := 0
+	var firstErr error
+	for {
+		if firstErr == nil && ctx.Err() != nil {
+			firstErr = ctx.Err()
+		}
+		for _, s := range p.steps {
+			if firstErr != nil || running >= workers {
+				break
+			}
+			if s.started || !p.ready(s) {
+				continue
+			}
+			s.started = true
+			s.timing = StepTiming{Name: s.name, Start: time.Now()}
+			running++
+			go p.start(ctx, s, events)
+		}
+		if running == 0 {
+			break
+		}
+		ev := <-events
+		if ev.spawn != nil {
+			ev.step.children++
+			p.steps = append(p.steps, ev.spawn)
+			continue
+		}
+		running--
+		ev.step.ran = true
+		ev.step.timing.Duration = time.Since(ev.step.timing.Start)
+		ev.step.timing.Err = ev.err
+		if ev.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", ev.step.name, ev.err)
+			cancel()
+			if p.OnCancel != nil {
+				p.OnCancel()
+			}
+		}
+		p.finish(ev.step)
+	}
+
+	var timings []StepTiming
+	var waiting []string
+	for _, s := range p.steps {
+		if s.started {
+			timings = append(timings, s.timing)
+		} else {
+			waiting = append(waiting, s.name)
+		}
+	}
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].Start.Before(timings[j].Start) })
+	if firstErr == nil && len(waiting) > 0 {
+		firstErr = fmt.Errorf("steps %s wait on each other", strings.Join(waiting, ", "))
+	}
+	return timings, firstErr
+}
+
+// start runs s and reports to the scheduler.
+func (p *Pipeline) start(ctx context.Context, s *pipelineStep, events chan<- stepEvent) {
+	spawn := func(name string, run StepFunc) {
+		events <- stepEvent{step: s, spawn: &pipelineStep{name: name, run: run, parent: s}}
+	}
+	events <- stepEvent{step: s, err: s.run(ctx, spawn)}
+}
+
+// ready reports whether every step s comes after has finished.
+func (p *Pipeline) ready(s *pipelineStep) bool {
+	for _, dep := range s.after {
+		if !p.index[dep].finished {
+			return false
+		}
+	}
+	return true
+}
+
+// finish marks s, and the parents it was the last unfinished sub-step of,
+// finished once they ran.
+func (p *Pipeline) finish(s *pipelineStep) {
+	for s != nil && s.ran && s.children == 0 && !s.finished {
+		s.finished = true
+		if s.parent != nil {
+			s.parent.children--
+		}
+		s = s.parent
+	}
+}
+
+// FormatTimings summarises timings for a log line, e.g. "checkpoint 1.2s,
+// volume 300ms".
+func FormatTimings(timings []StepTiming) string {
+	parts := make([]string, 0, len(timings))
+	for _, t := range timings {
+		part := fmt.Sprintf("%s %s", t.Name, t.Duration.Round(time.Millisecond))
+		if t.Err != nil {
+			part += " (failed)"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// noSpawn adapts a plain function to a StepFunc.
+func noSpawn(f func() error) StepFunc {
+	return func(context.Context, func(string, StepFunc)) error { return f() }
+}
+
+func TestPipeline_RunsIndependentStepsTogether(t *testing.T) {
+	p := NewPipeline(2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	together := func() error {
+		wg.Done()
+		ch := make(chan struct{})
+		go func() { wg.Wait(); close(ch) }()
+		select {
+		case <-ch:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("the other step never ran alongside")
+		}
+	}
+	var order []string
+	var mu sync.Mutex
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	p.Add("a", noSpawn(func() error { err := together(); record("a"); return err }))
+	p.Add("b", noSpawn(func() error { err := together(); record("b"); return err }))
+	p.Add("c", noSpawn(func() error { record("c"); return nil }), "a", "b")
+
+	timings, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[2] != "c" {
+		t.Errorf("ran %v, want c last", order)
+	}
+	if len(timings) != 3 || timings[2].Name != "c" {
+		t.Errorf("timings %s", FormatTimings(timings))
+	}
+}
+
+func TestPipeline_WaitsForSubSteps(t *testing.T) {
+	p := NewPipeline(4)
+	var sent int32
+	p.Add("images", func(_ context.Context, spawn func(string, StepFunc)) error {
+		for _, name := range []string{"send a", "send b", "send c"} {
+			spawn(name, noSpawn(func() error {
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&sent, 1)
+				return nil
+			}))
+		}
+		return nil
+	})
+	var seen int32
+	p.Add("done", noSpawn(func() error { seen = atomic.LoadInt32(&sent); return nil }), "images")
+
+	timings, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != 3 {
+		t.Errorf("done ran after %d of 3 sub-steps", seen)
+	}
+	if len(timings) != 5 {
+		t.Errorf("timings %s, want 5 steps", FormatTimings(timings))
+	}
+}
+
+func TestPipeline_FirstErrorCancels(t *testing.T) {
+	p := NewPipeline(4)
+	var cancels int32
+	p.OnCancel = func() { atomic.AddInt32(&cancels, 1) }
+	p.Add("checkpoint", noSpawn(func() error { return errors.New("coordinator gone") }))
+	p.Add("layers", func(ctx context.Context, _ func(string, StepFunc)) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("not cancelled")
+		}
+	})
+	ran := false
+	p.Add("done", noSpawn(func() error { ran = true; return nil }), "layers")
+
+	timings, err := p.Run(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "checkpoint: coordinator gone") {
+		t.Fatalf("Run = %v", err)
+	}
+	if ran || len(timings) != 2 {
+		t.Errorf("steps after the failure ran: %s", FormatTimings(timings))
+	}
+	if n := atomic.LoadInt32(&cancels); n != 1 {
+		t.Errorf("OnCancel called %d times", n)
+	}
+}
+
+func TestPipeline_BoundsWorkers(t *testing.T) {
+	p := NewPipeline(2)
+	var mu sync.Mutex
+	running, most := 0, 0
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		p.Add(name, noSpawn(func() error {
+			mu.Lock()
+			if running++; running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		}))
+	}
+	if _, err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if most != 2 {
+		t.Errorf("%d steps ran at once, want 2", most)
+	}
+}
+
+func TestPipeline_RefusesUnknownStep(t *testing.T) {
+	p := NewPipeline(1)
+	p.Add("done", noSpawn(func() error { return nil }), "volume")
+	if _, err := p.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "unknown step volume") {
+		t.Fatalf("Run = %v", err)
+	}
+}
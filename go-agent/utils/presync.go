@@ -0,0 +1,117 @@
+package utils
+
+// Adaptive pre-downtime sync.
+//
+// With a fixed preSyncRounds a write-heavy application still ships a large
+// final layer inside the downtime window, while an idle one spends rounds
+// on empty layers. Given a target downtime the source instead measures each
+// round: the size of the layer it froze, how long that layer took to fill
+// and how fast the round's transfer went. From those it projects how long
+// the final layer would take to send were the pod stopped now: the
+// application keeps writing at the measured dirty rate for about as long as
+// the round's transfer plus the time the MC takes to react, and the result
+// moves at the measured throughput. Like the pre-copy phase of VM live
+// migration the rounds go on until the projection fits the target, stops
+// improving by a tenth from one round to the next, or the MC's maximum
+// number of rounds is reached; they never stop before its minimum. A round
+// that sent nothing, the destination not having registered yet, counts as
+// stalled too: every layer it froze still ships inside the downtime window.
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Why the source stopped its adaptive pre-downtime rounds.
+const (
+	SyncConverged = "Converged" // the projected downtime fits the target
+	SyncStalled   = "Stalled"   // it no longer shrinks from round to round
+	SyncMaxRounds = "MaxRounds" // the MC's maximum number of rounds was reached
+)
+
+// SyncRoundStats is what the source measured in one pre-downtime round.
+type SyncRoundStats struct {
+	Round int `json:"round"`
+	// LayerBytes is the size of the layer the round froze, FillMs how long
+	// the application took to write it.
+	LayerBytes int64 `json:"layerBytes"`
+	FillMs     int64 `json:"fillMs"`
+	// SentBytes is what the round sent, SendMs how long that took; zero
+	// while the destination has not registered.
+	SentBytes int64 `json:"sentBytes,omitempty"`
+	SendMs    int64 `json:"sendMs,omitempty"`
+	// ProjectedDowntimeMs is how long the final layer would take to send,
+	// -1 when the round sent nothing to measure the throughput on.
+	ProjectedDowntimeMs int64 `json:"projectedDowntimeMs"`
+}
+
+// PreSyncPolicy decides when the source stops its pre-downtime rounds.
+type PreSyncPolicy struct {
+	// TargetDowntime is the projected final-layer transfer time to reach;
+	// 0 runs MaxRounds rounds.
+	TargetDowntime time.Duration
+	MinRounds      int
+	MaxRounds      int
+	// Lag is how long after a round the final layer is frozen should the
+	// rounds stop: the source's polling plus the MC's reaction.
+	Lag time.Duration
+}
+
+// Project fills in s.ProjectedDowntimeMs.
+func (p PreSyncPolicy) Project(s *SyncRoundStats) {
+	switch {
+	case s.LayerBytes == 0:
+		s.ProjectedDowntimeMs = 0 // nothing was written while it filled
+	case s.SentBytes == 0 || s.SendMs == 0 || s.FillMs == 0:
+		s.ProjectedDowntimeMs = -1
+	default:
+		window := float64(s.SendMs) + float64(p.Lag.Milliseconds())
+		final := float64(s.LayerBytes) / float64(s.FillMs) * window
+		s.ProjectedDowntimeMs = int64(final * float64(s.SendMs) / float64(s.SentBytes))
+	}
+}
+
+// Stop returns why the rounds measured so far, oldest first, should stop,
+// or "" to run another.
+func (p PreSyncPolicy) Stop(rounds []SyncRoundStats) string {
+	if len(rounds) == 0 {
+		return ""
+	}
+	last := rounds[len(rounds)-1]
+	if p.TargetDowntime <= 0 {
+		if last.Round >= p.MaxRounds {
+			return SyncMaxRounds
+		}
+		return ""
+	}
+	if last.Round < p.MinRounds {
+		return ""
+	}
+	if last.ProjectedDowntimeMs >= 0 && last.ProjectedDowntimeMs <= p.TargetDowntime.Milliseconds() {
+		return SyncConverged
+	}
+	if last.Round >= p.MaxRounds {
+		return SyncMaxRounds
+	}
+	if last.ProjectedDowntimeMs < 0 {
+		return SyncStalled
+	}
+	if len(rounds) > 1 {
+		prev := rounds[len(rounds)-2]
+		if prev.Round == last.Round-1 && prev.ProjectedDowntimeMs >= 0 && last.ProjectedDowntimeMs*10 > prev.ProjectedDowntimeMs*9 {
+			return SyncStalled
+		}
+	}
+	return ""
+}
+
+// DirBirth returns when the directory at path was created, or the zero
+// time where the filesystem does not record it.
+func DirBirth(path string) time.Time {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPreSyncPolicy_Project(t *testing.T) {
+	p := PreSyncPolicy{Lag: time.Second}
+	// 10 MB written in 10s (1 MB/s), sent at 2 MB/s in 5s: over the 6s
+	// before the final freeze the application writes 6 MB, 3s to send.
+	s := SyncRoundStats{LayerBytes: 10e6, FillMs: 10000, SentBytes: 10e6, SendMs: 5000}
+	p.Project(&s)
+	if s.ProjectedDowntimeMs != 3000 {
+		t.Errorf("projected downtime = %dms, want 3000", s.ProjectedDowntimeMs)
+	}
+	idle := SyncRoundStats{FillMs: 10000}
+	p.Project(&idle)
+	if idle.ProjectedDowntimeMs != 0 {
+		t.Errorf("idle projection = %dms, want 0", idle.ProjectedDowntimeMs)
+	}
+	unsent := SyncRoundStats{LayerBytes: 1, FillMs: 10000}
+	p.Project(&unsent)
+	if unsent.ProjectedDowntimeMs != -1 {
+		t.Errorf("projection without a transfer = %dms, want -1", unsent.ProjectedDowntimeMs)
+	}
+}
+
+func TestPreSyncPolicy_Stop(t *testing.T) {
+	rounds := func(projected ...int64) []SyncRoundStats {
+		var out []SyncRoundStats
+		for i, ms := range projected {
+			out = append(out, SyncRoundStats{Round: i + 1, ProjectedDowntimeMs: ms})
+		}
+		return out
+	}
+	adaptive := PreSyncPolicy{TargetDowntime: time.Second, MinRounds: 2, MaxRounds: 5}
+	for _, tc := range []struct {
+		name   string
+		policy PreSyncPolicy
+		rounds []SyncRoundStats
+		want   string
+	}{
+		{"below the minimum", adaptive, rounds(100), ""},
+		{"converged", adaptive, rounds(5000, 900), SyncConverged},
+		{"converging", adaptive, rounds(5000, 3000), ""},
+		{"stalled", adaptive, rounds(5000, 3000, 2900), SyncStalled},
+		{"nothing sent below the minimum", adaptive, rounds(-1), ""},
+		{"nothing sent", adaptive, rounds(-1, -1), SyncStalled},
+		{"first measurement", adaptive, rounds(-1, 5000), ""},
+		{"maximum", adaptive, rounds(9000, 5000, 3000, 2000, 1500), SyncMaxRounds},
+		{"fixed count", PreSyncPolicy{MaxRounds: 2}, rounds(0, 0), SyncMaxRounds},
+		{"fixed count left", PreSyncPolicy{MaxRounds: 2}, rounds(0), ""},
+	} {
+		if got := tc.policy.Stop(tc.rounds); got != tc.want {
+			t.Errorf("%s: Stop = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDirBirth(t *testing.T) {
+	dir := t.TempDir()
+	born := DirBirth(dir)
+	if born.IsZero() {
+		t.Skip("the filesystem records no birth time")
+	}
+	os.WriteFile(dir+"/f", []byte("x"), 0o644)
+	if again := DirBirth(dir); !again.Equal(born) || time.Since(born) > time.Minute {
+		t.Errorf("birth %v, then %v", born, again)
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+// Transfer progress reporting.
+//
+// A Session dialled with a Progress counts what it sends: every item (a
+// layer or a checkpoint file) announces its size when it is queued, and its
+// frames count the bytes of their uncompressed tar stream as it is written.
+// A frame written again after a reconnect or a NAK does not count twice,
+// and a finished frame counts its full size, so an item ends at 100% even
+// when deduplication or delta encoding left most of it off the wire. The
+// ranges of a striped file and the parts of a streamed one add up to their
+// file. Items sent to a checkpoint store are not counted.
+//
+// ReportProgress posts a snapshot to the MC's POST /progress every
+// PROGRESS_INTERVAL_MS (default 2000) while the preStop hook transfers, so
+// the Migration shows bytes sent, throughput and an estimated time left.
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultProgressIntervalMS is how often ReportProgress posts
+// (PROGRESS_INTERVAL_MS).
+const defaultProgressIntervalMS = 2000
+
+// Progress counts the bytes a transfer sent per item. It is safe for
+// concurrent use; a nil Progress counts nothing.
+type Progress struct {
+	mu     sync.Mutex
+	items  []*itemProgress // in the order they were queued
+	byName map[string]*itemProgress
+	frames map[itemKey]*frameProgress
+
+	// The throughput is smoothed over the snapshots taken so far.
+	start    time.Time
+	lastAt   time.Time
+	lastDone int64
+	rate     float64
+}
+
+type itemProgress struct {
+	name  string
+	total int64
+	done  int64
+}
+
+type frameProgress struct {
+	item *itemProgress
+	size int64
+	done int64 // the most bytes any attempt got through
+}
+
+// NewProgress returns an empty Progress.
+func NewProgress() *Progress {
+	return &Progress{byName: make(map[string]*itemProgress), frames: make(map[itemKey]*frameProgress)}
+}
+
+// expect adds n bytes to the size of item name, queueing it first when it
+// is new.
+func (p *Progress) expect(name string, n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	it, ok := p.byName[name]
+	if !ok {
+		it = &itemProgress{name: name}
+		p.byName[name] = it
+		p.items = append(p.items, it)
+	}
+	it.total += n
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+}
+
+// DirSize is the size of the regular files under dir, what a layer of it
+// carries.
+func DirSize(dir string) int64 {
+	var n int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// track wraps writeTar, the payload of frame h carrying size bytes of item
+// name, so that writing it counts towards the item.
+func (p *Progress) track(h FrameHeader, name string, size int64, writeTar func(w io.Writer) error) func(w io.Writer) error {
+	if p == nil {
+		return writeTar
+	}
+	key := itemKey{kind: h.Kind, ordinal: h.Ordinal, name: h.Name}
+	return func(w io.Writer) error {
+		p.mu.Lock()
+		f, ok := p.frames[key]
+		if !ok {
+			f = &frameProgress{item: p.byName[name], size: size}
+			p.frames[key] = f
+		}
+		p.mu.Unlock()
+		if err := writeTar(&progressWriter{w: w, p: p, f: f}); err != nil {
+			return err
+		}
+		p.advance(f, size)
+		return nil
+	}
+}
+
+// advance raises f to n bytes written, at most its size.
+func (p *Progress) advance(f *frameProgress, n int64) {
+	if n > f.size {
+		n = f.size
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n <= f.done {
+		return
+	}
+	if f.item != nil {
+		f.item.done += n - f.done
+	}
+	f.done = n
+}
+
+// progressWriter counts what one attempt at a frame wrote.
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+	f *frameProgress
+	n int64
+}
+
+func (c *progressWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.p.advance(c.f, c.n)
+	return n, err
+}
+
+// ItemProgress is how far one item of a transfer got.
+type ItemProgress struct {
+	Name       string `json:"name"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
+}
+
+// ProgressSnapshot is how far a transfer got.
+type ProgressSnapshot struct {
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`
+	// BytesPerSecond is the throughput since the previous snapshot,
+	// averaged with the earlier ones.
+	BytesPerSecond int64          `json:"bytesPerSecond"`
+	Items          []ItemProgress `json:"items"`
+}
+
+// Snapshot returns the progress so far, items in the order they were
+// queued.
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var snap ProgressSnapshot
+	for _, it := range p.items {
+		snap.Items = append(snap.Items, ItemProgress{Name: it.name, BytesDone: it.done, BytesTotal: it.total})
+		snap.BytesDone += it.done
+		snap.BytesTotal += it.total
+	}
+	since := p.lastAt
+	if since.IsZero() {
+		since = p.start
+	}
+	now := time.Now()
+	if dt := now.Sub(since).Seconds(); !since.IsZero() && dt > 0 {
+		rate := float64(snap.BytesDone-p.lastDone) / dt
+		if p.lastAt.IsZero() {
+			p.rate = rate
+		} else {
+			p.rate = (p.rate + rate) / 2
+		}
+		p.lastAt, p.lastDone = now, snap.BytesDone
+	}
+	snap.BytesPerSecond = int64(p.rate)
+	return snap
+}
+
+// ReportProgress posts p's snapshots for podName to the MC at coordAddr
+// every PROGRESS_INTERVAL_MS until the returned stop is called, which posts
+// a last one. Failed posts are logged once and otherwise ignored: progress
+// is informational and must not hold up the transfer.
+func ReportProgress(coordAddr, podName string, p *Progress) (stop func()) {
+	every := time.Duration(EnvInt("PROGRESS_INTERVAL_MS", defaultProgressIntervalMS)) * time.Millisecond
+	url := "http://" + coordAddr + "/progress"
+	quit := make(chan struct{})
+	exited := make(chan struct{})
+	warned := false
+	post := func() {
+		snap := p.Snapshot()
+		if len(snap.Items) == 0 {
+			return
+		}
+		if _, err := PostJSON(url, ProgressNotification{PodName: podName, ProgressSnapshot: snap}); err != nil && !warned {
+			log.Printf("transfer progress not reported: %v", err)
+			warned = true
+		}
+	}
+	go func() {
+		defer close(exited)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				post()
+			case <-quit:
+				post()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-exited
+		})
+	}
+}
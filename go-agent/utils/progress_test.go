@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSession_CountsProgress(t *testing.T) {
+	t.Setenv("STRIPE_MIN_MB", "1")
+	t.Setenv("STRIPE_RANGE_MB", "1")
+	dst := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+	layer := t.TempDir()
+	os.WriteFile(filepath.Join(layer, "a"), randomData(300<<10), 0o600)
+	os.MkdirAll(filepath.Join(layer, "sub"), 0o755)
+	os.WriteFile(filepath.Join(layer, "sub", "b"), randomData(100<<10), 0o600)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_big.dmtcp")
+	os.WriteFile(ckpt, randomData(3<<20+17), 0o600)
+
+	progress := NewProgress()
+	s, err := DialSessionWith(addr, DialOptions{Streams: 2, Progress: progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(1, "u1", layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendCheckpointFile(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+
+	snap := progress.Snapshot()
+	want := []ItemProgress{
+		{Name: "u1", BytesDone: 400 << 10, BytesTotal: 400 << 10},
+		{Name: "ckpt_big.dmtcp", BytesDone: 3<<20 + 17, BytesTotal: 3<<20 + 17},
+	}
+	if len(snap.Items) != len(want) {
+		t.Fatalf("items = %+v, want %+v", snap.Items, want)
+	}
+	for i := range want {
+		if snap.Items[i] != want[i] {
+			t.Errorf("item %d = %+v, want %+v", i, snap.Items[i], want[i])
+		}
+	}
+	if snap.BytesDone != snap.BytesTotal || snap.BytesTotal != 400<<10+3<<20+17 {
+		t.Errorf("done %d of %d", snap.BytesDone, snap.BytesTotal)
+	}
+}
+
+func TestProgress_RewrittenFrameCountsOnce(t *testing.T) {
+	p := NewProgress()
+	p.expect("ckpt_a.dmtcp", 1000)
+	data := randomData(1000)
+	write := p.track(FrameHeader{Kind: KindCheckpointFile, Name: "ckpt_a.dmtcp"}, "ckpt_a.dmtcp", 1000, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	// A first attempt that broke off after 600 bytes, then a resend.
+	broken := &cutWriter{left: 600}
+	if err := write(broken); err == nil {
+		t.Fatal("cut write succeeded")
+	}
+	if got := p.Snapshot().BytesDone; got != 600 {
+		t.Fatalf("after the cut: %d bytes done, want 600", got)
+	}
+	if err := write(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Snapshot().BytesDone; got != 1000 {
+		t.Fatalf("after the resend: %d bytes done, want 1000", got)
+	}
+}
+
+// cutWriter fails once left bytes are written.
+type cutWriter struct{ left int }
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > c.left {
+		n := c.left
+		c.left = 0
+		return n, io.ErrShortWrite
+	}
+	c.left -= len(p)
+	return len(p), nil
+}
+
+func TestReportProgress_Posts(t *testing.T) {
+	t.Setenv("PROGRESS_INTERVAL_MS", "20")
+	var (
+		mu    sync.Mutex
+		posts []ProgressNotification
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/progress" {
+			http.NotFound(w, r)
+			return
+		}
+		var n ProgressNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		posts = append(posts, n)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	p := NewProgress()
+	stop := ReportProgress(srv.Listener.Addr().String(), "web-0", p)
+	p.expect("u1", 100)
+	write := p.track(FrameHeader{Kind: KindLayer, Ordinal: 1, Name: "u1"}, "u1", 100, func(w io.Writer) error {
+		_, err := w.Write(bytes.Repeat([]byte{1}, 100))
+		return err
+	})
+	time.Sleep(60 * time.Millisecond)
+	write(io.Discard)
+	stop()
+	stop() // idempotent
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posts) < 2 {
+		t.Fatalf("%d report(s) posted, want periodic ones and a last one", len(posts))
+	}
+	last := posts[len(posts)-1]
+	if last.PodName != "web-0" || last.BytesDone != 100 || last.BytesTotal != 100 || len(last.Items) != 1 {
+		t.Fatalf("last report = %+v", last)
+	}
+}
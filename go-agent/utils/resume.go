@@ -0,0 +1,372 @@
+package utils
+
+// Receiver-side state for resumable version-2 transfers.
+//
+// The payload of a session frame is piped to the FrameHandler as it
+// arrives, so a layer or a checkpoint image is extracted into its staging
+// dir while it streams in. The handler runs on its own goroutine and
+// outlives a dropped connection: a reconnecting sender is offered the
+// number of payload bytes the handler has been fed, and the chunks from
+// there go down the same pipe. The pipe reports io.EOF only once the whole
+// payload matched its digest (and a signed frame its MAC); a mismatch, or a
+// transfer that ends before the frame does, fails the handler's reads
+// instead. The extraction functions read their payload to its end before
+// they publish anything (see drainPayload).
+//
+// Frames the receiver reads more than once, or whose handler must run one
+// at a time while several arrive side by side, are spooled to disk instead,
+// next to where they end up (ReceiveOptions.SpoolDir):
+//
+//	.resume-<transfer>-<seq>  payload bytes received so far
+//
+// These are chunk queries and the description and ranges of a striped file
+// (see stripe.go); none of them is larger than a stripe range. Transfer
+// state lives in memory only, so an agent that restarted cannot resume a
+// frame; CleanStaging removes the spools it left (staging.go).
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// resumePrefix starts the name of every spool file.
+const resumePrefix = ".resume-"
+
+// errFrameAbandoned fails the handler of a frame that will not complete.
+var errFrameAbandoned = errors.New("the transfer moved on before the frame completed")
+
+// receiverState is what ReceiveAllWith remembers across the connections of
+// one transfer.
+type receiverState struct {
+	opts ReceiveOptions
+	// ln is the transfer listener. stripe is the transfer ID prefix of
+	// the stripes of the striped file being received (see stripe.go),
+	// whose sessions run side by side.
+	ln     net.Listener
+	stripe string
+	// deadline is when the transfer times out, and helloTimeout how long
+	// a connection may take to be admitted; admitting holds a token for
+	// each connection being admitted. Admitted connections arrive on
+	// opened, stripe sessions are handed to receiveStripes on stripes, and
+	// quit is closed once ReceiveAllWith returns; accepting is closed when
+	// its accept loop ended.
+	deadline     time.Time
+	helloTimeout time.Duration
+	admitting    chan struct{}
+	opened       chan *opened
+	stripes      chan *opened
+	quit         chan struct{}
+	accepting    chan struct{}
+
+	// mu guards the maps below.
+	mu        sync.Mutex
+	transfers map[string]*transferState
+	// received records the digest of every delivered item, for the DONE
+	// manifest check ("" for version-1 frames).
+	received map[itemKey]string
+	// conns are the connections being served, which an abort through
+	// ReceiveOptions.Abort closes, and abortReason is why it happened
+	// (see abort.go).
+	conns       map[net.Conn]bool
+	abortReason *string
+	// refused is why the last connection was refused.
+	refused error
+	// dropStripes is closed when the connection that carries the striped
+	// frame being received is taken over (see cancelStripes).
+	dropStripes chan struct{}
+	// streaming is the frame whose handler is running, if any.
+	streaming *partialFrame
+}
+
+func newReceiverState(opts ReceiveOptions) *receiverState {
+	return &receiverState{
+		opts:         opts,
+		transfers:    make(map[string]*transferState),
+		received:     make(map[itemKey]string),
+		conns:        make(map[net.Conn]bool),
+		helloTimeout: defaultHelloTimeout,
+		admitting:    make(chan struct{}, maxAdmitting),
+		opened:       make(chan *opened),
+		stripes:      make(chan *opened, maxStripeBacklog),
+		quit:         make(chan struct{}),
+	}
+}
+
+// transferState tracks one sender's transfer (its HELLO transfer ID) across
+// reconnects.
+type transferState struct {
+	id      string
+	lastSeq uint32        // last frame handled
+	part    *partialFrame // frame lastSeq+1 when it was interrupted
+}
+
+// transfer returns the state for transfer id, creating it on first use.
+func (rs *receiverState) transfer(id string) *transferState {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	ts, ok := rs.transfers[id]
+	if !ok {
+		ts = &transferState{id: id}
+		rs.transfers[id] = ts
+	}
+	return ts
+}
+
+// receive records the delivered item h with the digest of its payload.
+func (rs *receiverState) receive(h FrameHeader, digest string) {
+	rs.mu.Lock()
+	rs.received[headerKey(h)] = digest
+	rs.mu.Unlock()
+}
+
+// spoolDir returns where frame h is spooled.
+func (rs *receiverState) spoolDir(h FrameHeader) string {
+	if rs.opts.SpoolDir != nil {
+		if dir := rs.opts.SpoolDir(h); dir != "" {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// resumePoint returns the last handled frame and how much of the next one
+// was received.
+func (ts *transferState) resumePoint() (uint32, int64) {
+	if ts.part == nil {
+		return ts.lastSeq, 0
+	}
+	return ts.lastSeq, ts.part.size
+}
+
+// partialFrame is the payload of the frame in progress.
+type partialFrame struct {
+	h      FrameHeader
+	ts     *transferState
+	size   int64     // payload bytes received
+	sum    hash.Hash // SHA-256 of those bytes
+	digest string    // hex SHA-256, set once the payload is complete
+	mac    []byte    // MAC trailer of a signed frame, read with the digest
+
+	// A streamed payload is written to pw, which its handler reads; done
+	// delivers what the handler returned. Both are nil once it has.
+	pw   *io.PipeWriter
+	done chan error
+	// A spooled payload is written to the file data.
+	data string
+}
+
+// spooled reports whether the payload of a frame of kind k is spooled
+// rather than streamed to its handler.
+func spooled(k FrameKind) bool {
+	return k == KindChunkQuery || k == KindStripedFile || k == KindFileRange
+}
+
+// begin starts frame h of transfer ts: it opens the spool of a spooled
+// frame, or starts handle on the payload of a streamed one. Another
+// transfer's streamed frame is abandoned, so handlers run one at a time.
+func (rs *receiverState) begin(ts *transferState, h FrameHeader, handle FrameHandler) (*partialFrame, error) {
+	p := &partialFrame{h: h, ts: ts, sum: sha256.New()}
+	if spooled(h.Kind) {
+		dir := rs.spoolDir(h)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("mkdir %s: %w", dir, err)
+		}
+		p.data = filepath.Join(dir, fmt.Sprintf("%s%s-%d", resumePrefix, ts.id, h.Seq))
+		if err := os.WriteFile(p.data, nil, 0o600); err != nil {
+			return nil, fmt.Errorf("create spool: %w", err)
+		}
+		return p, nil
+	}
+	rs.abandonStreaming()
+	pr, pw := io.Pipe()
+	p.pw, p.done = pw, make(chan error, 1)
+	go func() {
+		err := handle(h, &sessionPayload{Reader: pr, raw: pr})
+		if err == nil {
+			// The frame completes once all of it was verified, even if
+			// the handler stopped reading early.
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		p.done <- err
+	}()
+	rs.mu.Lock()
+	rs.streaming = p
+	rs.mu.Unlock()
+	return p, nil
+}
+
+// abandonStreaming fails the handler of a streamed frame still waiting for
+// the rest of its payload, and forgets the frame.
+func (rs *receiverState) abandonStreaming() {
+	rs.mu.Lock()
+	p := rs.streaming
+	rs.streaming = nil
+	rs.mu.Unlock()
+	if p != nil && p.pw != nil {
+		p.discard(errFrameAbandoned)
+		if p.ts.part == p {
+			p.ts.part = nil
+		}
+	}
+}
+
+// discardAll abandons the frames of every transfer, once the receiver is
+// done with them.
+func (rs *receiverState) discardAll() {
+	rs.abandonStreaming()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, ts := range rs.transfers {
+		if ts.part != nil {
+			ts.part.discard(errFrameAbandoned)
+			ts.part = nil
+		}
+	}
+}
+
+// spool receives frame h's chunks from r, continuing a partial frame of
+// the same transfer, and passes them to its handler or spool file. It
+// returns once the terminator, the digest trailer and a signed frame's MAC
+// have been read, the digest matches the payload (a digestError otherwise)
+// and the MAC the transfer token (an authError otherwise). What arrived
+// before a read failure stays with the frame for a later resume.
+func (rs *receiverState) spool(ts *transferState, h FrameHeader, r io.Reader, handle FrameHandler) (*partialFrame, error) {
+	p := ts.part
+	if p != nil && (p.h.Seq != h.Seq || p.h.Kind != h.Kind || p.h.Name != h.Name) {
+		p.discard(errFrameAbandoned)
+		p = nil
+	}
+	if p == nil {
+		var err error
+		if p, err = rs.begin(ts, h, handle); err != nil {
+			return nil, err
+		}
+		ts.part = p
+	}
+
+	var sink io.Writer = p.pw
+	if p.pw == nil {
+		f, err := os.OpenFile(p.data, os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open spool: %w", err)
+		}
+		defer f.Close()
+		if _, err := f.Seek(p.size, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek spool: %w", err)
+		}
+		sink = f
+	}
+	size, err := wire.CopyChunks(r, io.MultiWriter(p.sum, sink), p.size)
+	p.size = size
+	if err != nil {
+		return nil, err
+	}
+	want, err := wire.ReadDigest(r)
+	if err == nil {
+		p.mac, err = readMAC(r, h)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.digest = hex.EncodeToString(p.sum.Sum(nil))
+	if exp := hex.EncodeToString(want[:]); p.digest != exp {
+		return nil, digestError{h: h, got: p.digest, want: exp}
+	}
+	if err := rs.authenticate(ts.id, h, p.digest, p.mac); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// deliver completes the verified payload: a streamed one by ending its
+// handler's input and waiting for the handler, a spooled one by handing
+// the spool to handle and removing it.
+func (p *partialFrame) deliver(handle FrameHandler) error {
+	if p.pw != nil {
+		p.pw.Close()
+		err := <-p.done
+		p.pw = nil
+		return err
+	}
+	f, err := os.Open(p.data)
+	if err != nil {
+		return fmt.Errorf("open spool: %w", err)
+	}
+	err = handle(p.h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	p.discard(nil)
+	return nil
+}
+
+// answerQuery answers the complete spooled chunk query from cache and
+// removes the spool.
+func (p *partialFrame) answerQuery(cache *ChunkCache) (string, error) {
+	if cache == nil {
+		return "", errors.New("chunk query without a chunk cache")
+	}
+	f, err := os.Open(p.data)
+	if err != nil {
+		return "", fmt.Errorf("open spool: %w", err)
+	}
+	answer, err := cache.answerQuery(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	p.discard(nil)
+	return answer, nil
+}
+
+// discard drops the frame: a streamed frame's handler fails with cause and
+// is waited for, a spool is removed.
+func (p *partialFrame) discard(cause error) {
+	if p.pw != nil {
+		p.pw.CloseWithError(cause)
+		<-p.done
+		p.pw = nil
+	}
+	if p.data != "" {
+		os.Remove(p.data)
+	}
+}
+
+// sessionPayload is the payload reader of a streamed session frame. Reader
+// is what the handler reads, raw the frame's payload as it arrived, which
+// reports io.EOF only once the payload was verified.
+type sessionPayload struct {
+	io.Reader
+	raw io.Reader
+}
+
+// drainPayload reads the rest of a session frame's payload r, so that the
+// caller publishes only what a verified payload carried; other payloads,
+// such as a version-1 frame's, which the connection does not end, are left
+// alone.
+func drainPayload(r io.Reader) error {
+	sp, ok := r.(*sessionPayload)
+	if !ok {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, sp.Reader); err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, sp.raw); err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	return nil
+}
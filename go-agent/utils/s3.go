@@ -0,0 +1,390 @@
+package utils
+
+// S3-compatible CheckpointStore (AWS S3, MinIO, Ceph RGW, ...).
+//
+// Requests use path-style addressing (endpoint/bucket/key), which every
+// S3-compatible server accepts, and are signed with AWS Signature Version 4.
+// Object bodies are sent as UNSIGNED-PAYLOAD: the transfer layer carries
+// its own SHA-256 for every payload (see upload.go), and signing the body
+// would mean reading it twice. An object larger than PartSize is sent as a
+// multipart upload, as a single PUT is capped at 5 GiB.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3UnsignedBody  = "UNSIGNED-PAYLOAD"
+	s3EmptyBodyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat    = "20060102T150405Z"
+
+	// defaultS3PartSize is the part size of a multipart upload.
+	defaultS3PartSize = 64 << 20
+	// s3MaxParts is how many parts a multipart upload may have; larger
+	// objects get larger parts.
+	s3MaxParts = 10000
+)
+
+// S3Store is a CheckpointStore in an S3 bucket, below Prefix.
+type S3Store struct {
+	// Endpoint is the service URL, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio.storage:9000.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to every key, without a trailing slash.
+	Prefix       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client overrides the default HTTP client, which has no overall
+	// timeout so large objects are not cut off.
+	Client *http.Client
+	// PartSize is the size above which an object is uploaded in parts of
+	// that size (0: 64 MiB). S3 needs parts of at least 5 MiB.
+	PartSize int64
+
+	// now is the signing clock; tests pin it.
+	now func() time.Time
+}
+
+// s3Error is the error document of a failed request.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *S3Store) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// objectURL returns the URL of key, or of the bucket when key is empty.
+func (s *S3Store) objectURL(key string) string {
+	u := s.Endpoint + "/" + s.Bucket
+	if key == "" {
+		return u
+	}
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + key
+	}
+	return u + "/" + s3Escape(key, false)
+}
+
+// do signs and sends a request and turns error responses into errors;
+// 404 wraps os.ErrNotExist.
+func (s *S3Store) do(method, rawURL string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	// Send the path exactly as it is signed.
+	req.URL.RawPath = s3Escape(req.URL.Path, false)
+	payloadHash := s3EmptyBodyHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = s3UnsignedBody
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.sign(req, payloadHash, now().UTC())
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	err = fmt.Errorf("%s %s: %s %s", method, req.URL.Path, e.Code, e.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%v: %w", err, os.ErrNotExist)
+	}
+	return nil, err
+}
+
+// Put uploads the object with a single PUT, or as a multipart upload when
+// it is larger than PartSize.
+func (s *S3Store) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+	if size > partSize {
+		if min := (size + s3MaxParts - 1) / s3MaxParts; partSize < min {
+			partSize = min
+		}
+		return s.putMultipart(key, r, size, partSize)
+	}
+	resp, err := s.do(http.MethodPut, s.objectURL(key), r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Part is a part of a multipart upload, as CompleteMultipartUpload
+// lists it.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads size bytes of r to key in parts of partSize, and
+// aborts the upload when a part fails so the store does not keep the
+// parts sent.
+func (s *S3Store) putMultipart(key string, r io.Reader, size, partSize int64) error {
+	u := s.objectURL(key)
+	resp, err := s.do(http.MethodPost, u+"?uploads", nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("start multipart upload of %s: no upload id (%v)", key, err)
+	}
+	upload := "uploadId=" + s3Escape(initiated.UploadID, true)
+
+	if err := s.putParts(u, upload, r, size, partSize); err != nil {
+		if resp, aerr := s.do(http.MethodDelete, u+"?"+upload, nil, 0); aerr == nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// putParts sends the parts of an upload and completes it.
+func (s *S3Store) putParts(u, upload string, r io.Reader, size, partSize int64) error {
+	var parts []s3Part
+	for off := int64(0); off < size; off += partSize {
+		n := size - off
+		if n > partSize {
+			n = partSize
+		}
+		number := len(parts) + 1
+		resp, err := s.do(http.MethodPut, fmt.Sprintf("%s?partNumber=%d&%s", u, number, upload), io.LimitReader(r, n), n)
+		if err != nil {
+			return fmt.Errorf("part %d: %w", number, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, u+"?"+upload, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A completion can fail after S3 answered 200; the body tells.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("complete: %w", err)
+	}
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("complete: %s %s", e.Code, e.Message)
+	}
+	return nil
+}
+
+// Get opens the object's body.
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.objectURL(key), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object. S3 answers success for a missing key, so this
+// Delete cannot report one.
+func (s *S3Store) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.objectURL(key), nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is the part of a ListObjectsV2 response List reads.
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2.
+func (s *S3Store) List(prefix string) ([]string, error) {
+	full := prefix
+	if s.Prefix != "" {
+		full = s.Prefix + "/" + prefix
+	}
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {full}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, s.objectURL("")+"?"+s3Query(q), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page listResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, c := range page.Contents {
+			key := c.Key
+			if s.Prefix != "" {
+				key = strings.TrimPrefix(key, s.Prefix+"/")
+			}
+			keys = append(keys, key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// sign adds the SigV4 headers to req. Every header already on req is
+// signed, along with Host, X-Amz-Date, X-Amz-Content-Sha256 and the session
+// token.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/" + s3Service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Query is the canonical form of q: sorted by key, values escaped.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved
+// characters, and '/' unless slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,929 @@
+package utils
+
+// Version-2 transfer sessions; the wire format is described in transfer.go.
+//
+// A Session keeps every frame until the receiver acknowledges it. When the
+// connection drops it redials with backoff, opens the same transfer again
+// with HELLO and learns how far the receiver got: frames it completed are
+// dropped, the frame in progress continues from the receiver's offset and
+// the rest are sent again. Payloads are regenerated rather than buffered;
+// the gzip-compressed tar stream of an unchanged file or layer is
+// byte-for-byte reproducible, so skipping the first offset bytes yields
+// exactly the missing tail.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+const (
+	sessionWindow = 16
+
+	// sessionMaxResends bounds how often one frame is sent again after
+	// failing verification.
+	sessionMaxResends = 3
+
+	// defaultRetrySeconds bounds how long a Session keeps reconnecting
+	// (TRANSFER_RETRY_SECONDS).
+	defaultRetrySeconds = 120
+	retryInitialDelay   = 250 * time.Millisecond
+	retryMaxDelay       = 5 * time.Second
+)
+
+// outFrame is a frame the session may have to send again after a reconnect.
+type outFrame struct {
+	h       FrameHeader
+	payload func(w io.Writer) error
+	digest  string // hex SHA-256 of the payload, set once written
+	resends int
+
+	// answer is a chunk query's ACK message; answered is set once it
+	// arrived and lost when the receiver completed the query but the
+	// reply went down with the connection.
+	answer         string
+	answered, lost bool
+}
+
+// entry describes f for the DONE manifest.
+func (f *outFrame) entry() ManifestEntry {
+	return ManifestEntry{Kind: f.h.Kind, Ordinal: f.h.Ordinal, Name: f.h.Name, SHA256: f.digest}
+}
+
+// payloadError marks a failure that reconnecting would not help: producing a
+// frame's payload, as opposed to delivering it, or the destination refusing
+// the session.
+type payloadError struct{ err error }
+
+func (e payloadError) Error() string { return e.err.Error() }
+func (e payloadError) Unwrap() error { return e.err }
+
+// Session sends frames to a destination agent over one long-lived
+// connection (protocol version 2). Send methods return once the frame is
+// written; acknowledgements are collected in the background and Flush or
+// Done wait for them. A dropped connection is re-established and the
+// transfer resumed for up to TRANSFER_RETRY_SECONDS; a NAK or running out of
+// retries fails the session and every later call returns that error. A
+// Session is safe for concurrent use; each frame is written contiguously.
+type Session struct {
+	addr     string
+	id       string
+	retryFor time.Duration
+	codec    Codec // for frames queued from now on; may be CodecAuto
+	tls      *tls.Config
+	token    string       // signs every frame when set
+	cache    *ChunkCache  // offers deduplication when set
+	streams  int          // stripes large checkpoint files when above 1
+	limit    *RateLimiter // paces writes when set
+	emulate  WANEmulation
+	progress *Progress // counts what is sent when set
+
+	// wmu serialises frames on the wire and reconnects.
+	wmu sync.Mutex
+	bw  *bufio.Writer
+	seq uint32
+
+	// mu guards the connection, the unacknowledged frames and the session
+	// error.
+	mu         sync.Mutex
+	cond       *sync.Cond
+	conn       net.Conn
+	broken     error // why conn stopped working; nil while it is healthy
+	closed     bool
+	pending    []*outFrame
+	err        error
+	reconnects int
+	dedup      bool // the receiver accepted deduplication
+	// frames are the items sent in this session and expect the items sent
+	// elsewhere; together they make up the DONE manifest.
+	frames []*outFrame
+	expect []ManifestEntry
+}
+
+// DialSession connects to the agent at addr and opens a new plaintext,
+// unsigned transfer. Payloads are compressed with TRANSFER_CODEC (default
+// gzip) until SetCodec says otherwise.
+func DialSession(addr string) (*Session, error) {
+	return DialSessionWith(addr, DialOptions{})
+}
+
+// DialOptions configures DialSessionWith.
+type DialOptions struct {
+	// TLS, when set, runs the session over TLS (see ClientTLS). Every
+	// reconnect repeats the handshake, and a rejected certificate on
+	// either side fails the session without retrying.
+	TLS *tls.Config
+	// Token, when set, signs every frame with the migration's transfer
+	// token (see auth.go). A destination that refuses the signature fails
+	// the session without retrying.
+	Token string
+	// ChunkCache, when set, offers the destination deduplication: layers
+	// and checkpoint files only carry the chunks it lacks (see chunks.go).
+	ChunkCache *ChunkCache
+	// Limit, when set, paces what the session and its stripes write (see
+	// shaping.go). Sessions sharing a limiter share its rate.
+	Limit *RateLimiter
+	// Emulate, when set, makes a connection to a loopback address behave
+	// like a long-distance link (see shaping.go).
+	Emulate WANEmulation
+	// Progress, when set, counts what the session and its stripes send
+	// (see progress.go).
+	Progress *Progress
+	// Streams, when above 1, sends checkpoint files of at least
+	// STRIPE_MIN_MB in ranges over that many extra connections (see
+	// stripe.go). Only a destination agent accepts them.
+	Streams int
+}
+
+// DialSessionWith is DialSession with opts.
+func DialSessionWith(addr string, opts DialOptions) (*Session, error) {
+	id, err := newTransferID()
+	if err != nil {
+		return nil, err
+	}
+	return dialSession(addr, id, opts)
+}
+
+// dialSession opens the transfer id to addr.
+func dialSession(addr, id string, opts DialOptions) (*Session, error) {
+	codec, err := ParseCodec(os.Getenv("TRANSFER_CODEC"))
+	if err != nil {
+		return nil, fmt.Errorf("TRANSFER_CODEC: %w", err)
+	}
+	s := &Session{
+		addr:     addr,
+		id:       id,
+		retryFor: time.Duration(EnvInt("TRANSFER_RETRY_SECONDS", defaultRetrySeconds)) * time.Second,
+		codec:    codec,
+		tls:      opts.TLS,
+		token:    opts.Token,
+		cache:    opts.ChunkCache,
+		streams:  opts.Streams,
+		limit:    opts.Limit,
+		emulate:  opts.Emulate,
+		progress: opts.Progress,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if _, _, err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newTransferID returns a random identifier for HELLO frames.
+func newTransferID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generate transfer id: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// SetCodec sets the payload codec of frames queued from now on.
+func (s *Session) SetCodec(c Codec) {
+	s.mu.Lock()
+	s.codec = c
+	s.mu.Unlock()
+}
+
+// frameCodec resolves the session codec for content at path. The choice is
+// made once per frame, so a resend produces the same bytes.
+func (s *Session) frameCodec(path string) Codec {
+	s.mu.Lock()
+	c := s.codec
+	s.mu.Unlock()
+	return resolveCodec(c, path)
+}
+
+// SendDir queues the directory dir as layer ordinal.
+func (s *Session) SendDir(ordinal int, name, dir string) error {
+	return s.SendLayer(ordinal, name, dir, nil)
+}
+
+// SendLayer queues the directory dir as layer ordinal, delta encoding large
+// files against their earlier version at base. The destination must
+// receive the base layers before this one.
+func (s *Session) SendLayer(ordinal int, name, dir string, base DeltaBase) error {
+	codec := s.frameCodec(dir)
+	var size int64
+	if s.progress != nil {
+		size = DirSize(dir)
+		s.progress.expect(name, size)
+	}
+	return s.sendItem(FrameHeader{Kind: KindLayer, Ordinal: ordinal, Name: name, Codec: codec}, name, size, func(w io.Writer) error {
+		return writeDirTar(w, dir, base)
+	})
+}
+
+// SendCheckpointFile queues the single checkpoint file at path. A large
+// file is striped when the session has streams to spare; that returns once
+// the file's ranges are acknowledged.
+func (s *Session) SendCheckpointFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	name := filepath.Base(path)
+	s.progress.expect(name, info.Size())
+	if n := s.stripes(info); n > 0 {
+		return s.sendStriped(path, info, n)
+	}
+	codec := s.frameCodec(path)
+	return s.sendItem(FrameHeader{Kind: KindCheckpointFile, Name: name, Codec: codec}, name, info.Size(), func(w io.Writer) error {
+		return writeFileTar(w, path)
+	})
+}
+
+// SendCheckpointPart queues part p of a checkpoint file being written. The
+// file must stay open until the part is acknowledged.
+func (s *Session) SendCheckpointPart(p FilePart) error {
+	codec := s.frameCodec(p.Path)
+	s.progress.expect(p.Name, p.Length)
+	return s.sendItem(FrameHeader{Kind: KindCheckpointPart, Ordinal: p.Index, Name: p.Name, Codec: codec}, p.Name, p.Length, func(w io.Writer) error {
+		return writePartTar(w, p)
+	})
+}
+
+// sendItem queues an item whose uncompressed tar stream writeTar produces,
+// carrying size bytes of the progress item name. With deduplication it first
+// asks the receiver which chunks it lacks and blocks until the answer
+// arrives.
+func (s *Session) sendItem(h FrameHeader, name string, size int64, writeTar func(w io.Writer) error) error {
+	s.mu.Lock()
+	dedup := s.dedup
+	s.mu.Unlock()
+	counted := s.progress.track(h, name, size, writeTar)
+	if !dedup {
+		return s.send(&outFrame{h: h, payload: func(w io.Writer) error {
+			return compressPayload(w, h.Codec, counted)
+		}})
+	}
+	sums, err := chunkSums(writeTar)
+	if err != nil {
+		return fmt.Errorf("frame %q: %w", h.Name, err)
+	}
+	missing, err := s.ask(h.Name, sums)
+	if err != nil {
+		return err
+	}
+	h.Chunked = true
+	return s.send(&outFrame{h: h, payload: func(w io.Writer) error {
+		return writeRecipe(w, h.Codec, sums, missing, s.cache, counted)
+	}})
+}
+
+// ask sends a chunk query for sums and returns the receiver's answer. A
+// query whose reply was lost in a reconnect is asked again.
+func (s *Session) ask(name string, sums [][sha256.Size]byte) (string, error) {
+	for {
+		q := &outFrame{h: FrameHeader{Kind: KindChunkQuery, Name: name, Codec: CodecNone}, payload: func(w io.Writer) error {
+			return writeQuery(w, sums)
+		}}
+		if err := s.send(q); err != nil {
+			return "", err
+		}
+		answer, lost, err := s.awaitAnswer(q)
+		if err != nil || !lost {
+			return answer, err
+		}
+	}
+}
+
+// awaitAnswer waits for the reply to query q, reconnecting when the
+// connection breaks. lost reports a query that has to be asked again.
+func (s *Session) awaitAnswer(q *outFrame) (string, bool, error) {
+	for {
+		s.mu.Lock()
+		for !q.answered && !q.lost && s.err == nil && s.broken == nil {
+			s.cond.Wait()
+		}
+		answered, lost, err := q.answered, q.lost, s.err
+		s.mu.Unlock()
+		switch {
+		case answered:
+			return q.answer, false, nil
+		case err != nil:
+			return "", false, err
+		case lost:
+			return "", true, nil
+		}
+		s.wmu.Lock()
+		err = s.recover()
+		s.wmu.Unlock()
+		if err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// Flush blocks until every frame sent so far has been acknowledged,
+// reconnecting if the connection drops meanwhile. It returns the session
+// error if any of them was lost.
+func (s *Session) Flush() error {
+	for {
+		s.mu.Lock()
+		for len(s.pending) > 0 && s.err == nil && s.broken == nil {
+			s.cond.Wait()
+		}
+		n, err := len(s.pending), s.err
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.wmu.Lock()
+		err = s.recover()
+		s.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Done sends the DONE frame with the manifest of the transfer and waits
+// until it and every earlier frame have been acknowledged. It fails when the
+// destination does not hold every manifest item.
+func (s *Session) Done() error {
+	if err := s.send(&outFrame{h: FrameHeader{Kind: KindDone}, payload: s.writeManifest}); err != nil {
+		return err
+	}
+	return s.Flush()
+}
+
+// Expect adds items sent to the destination by earlier sessions to the DONE
+// manifest.
+func (s *Session) Expect(items ...ManifestEntry) {
+	s.mu.Lock()
+	s.expect = append(s.expect, items...)
+	s.mu.Unlock()
+}
+
+// Sent returns the items sent in this session so far, with the digests of
+// those already written.
+func (s *Session) Sent() []ManifestEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]ManifestEntry, 0, len(s.frames))
+	for _, f := range s.frames {
+		items = append(items, f.entry())
+	}
+	return items
+}
+
+// writeManifest is the payload of the DONE frame. It is written after every
+// other frame, so all their digests are known.
+func (s *Session) writeManifest(w io.Writer) error {
+	s.mu.Lock()
+	expect := append([]ManifestEntry(nil), s.expect...)
+	s.mu.Unlock()
+	return json.NewEncoder(w).Encode(mergeManifest(expect, s.Sent()))
+}
+
+// Close closes the connection and stops reconnecting. Frames that were not
+// acknowledged yet are lost; call Flush or Done first.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+	return conn.Close()
+}
+
+// send assigns f the next sequence number and writes it.
+func (s *Session) send(f *outFrame) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	for {
+		s.mu.Lock()
+		for len(s.pending) >= sessionWindow && s.err == nil && s.broken == nil {
+			s.cond.Wait()
+		}
+		err, broken := s.err, s.broken
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if broken == nil {
+			break
+		}
+		if err := s.recover(); err != nil {
+			return err
+		}
+	}
+
+	f.h.Seq = s.seq + 1
+	f.h.Signed = s.token != ""
+	if _, err := encodeFrameHeader(f.h, wire.SessionVersion); err != nil {
+		return err
+	}
+	s.seq = f.h.Seq
+	s.mu.Lock()
+	s.pending = append(s.pending, f)
+	if f.h.Kind != KindDone && f.h.Kind != KindChunkQuery && f.h.Kind != KindAbort {
+		s.frames = append(s.frames, f)
+	}
+	conn := s.conn
+	s.mu.Unlock()
+
+	if err := s.writeFrame(f, 0); err != nil {
+		if !s.writeFailed(conn, err) {
+			return s.Flush()
+		}
+		return s.recover()
+	}
+	return nil
+}
+
+// writeFrame writes f to the current connection, starting its payload at
+// offset from. Callers hold wmu.
+func (s *Session) writeFrame(f *outFrame, from int64) error {
+	header, err := encodeFrameHeader(f.h, wire.SessionVersion)
+	if err != nil {
+		return payloadError{err}
+	}
+	if _, err := s.bw.Write(header); err != nil {
+		return err
+	}
+	cw := &wire.ChunkWriter{W: s.bw, Skip: from}
+	if err := f.payload(cw); err != nil {
+		if cw.Err != nil {
+			return cw.Err
+		}
+		return payloadError{fmt.Errorf("frame %q: %w", f.h.Name, err)}
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if s.token != "" {
+		if _, err := s.bw.Write(wire.MAC(s.token, s.id, header, cw.Digest)); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	f.digest = cw.Digest
+	s.mu.Unlock()
+	return s.bw.Flush()
+}
+
+// writeFailed classifies a writeFrame error: it fails the session and
+// returns false for payload errors (the stream is misaligned and cannot be
+// repaired), and marks conn broken and returns true for network errors.
+func (s *Session) writeFailed(conn net.Conn, err error) bool {
+	var perr payloadError
+	if errors.As(err, &perr) {
+		s.fail(fmt.Errorf("send: %w", err))
+		return false
+	}
+	s.markBroken(conn, err)
+	return true
+}
+
+// connect dials the destination, opens the transfer with HELLO and starts
+// collecting replies. It returns the receiver's resume point: the last frame
+// it completed and how many payload bytes of the next one it holds. Callers
+// hold wmu (or own the Session exclusively).
+func (s *Session) connect() (uint32, int64, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, 30*time.Second)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dial %s: %w", s.addr, err)
+	}
+	conn = shapeConn(conn, s.limit, s.emulate)
+	hello, err := encodeFrameHeader(FrameHeader{Kind: KindHello, Name: s.id, Signed: s.token != "", Chunked: s.cache != nil}, wire.SessionVersion)
+	if err != nil {
+		conn.Close()
+		return 0, 0, err
+	}
+	if s.token != "" {
+		hello = append(hello, wire.MAC(s.token, s.id, hello, "")...)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return 0, 0, s.handshakeError(err)
+		}
+		conn = tc
+	}
+	br := bufio.NewReader(conn)
+	if _, err := conn.Write(hello); err != nil {
+		conn.Close()
+		return 0, 0, fmt.Errorf("send hello: %w", err)
+	}
+	code, seq, msg, err := wire.ReadReply(br)
+	if err != nil {
+		conn.Close()
+		if s.tls != nil && tlsRejected(err) {
+			// TLS 1.3: the destination checks our certificate after
+			// the client side of the handshake has completed.
+			return 0, 0, s.handshakeError(err)
+		}
+		return 0, 0, fmt.Errorf("read hello reply: %w", err)
+	}
+	if code != wire.Ack || seq != 0 || len(msg) != wire.HelloReplySize && len(msg) != helloDedupReplySize {
+		conn.Close()
+		return 0, 0, payloadError{fmt.Errorf("destination refused session: %s", msg)}
+	}
+	conn.SetDeadline(time.Time{})
+	lastSeq, offset, err := wire.ParseResumePoint(msg)
+	if err != nil {
+		conn.Close()
+		return 0, 0, payloadError{err}
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.broken = nil
+	s.dedup = s.cache != nil && len(msg) == helloDedupReplySize
+	s.mu.Unlock()
+	s.bw = bufio.NewWriterSize(conn, wire.ChunkSize)
+	go s.readReplies(conn, br)
+	return lastSeq, offset, nil
+}
+
+// handshakeError describes a failed TLS handshake with the destination. A
+// rejected certificate is final; a network failure is retried.
+func (s *Session) handshakeError(err error) error {
+	var perr peerError
+	switch {
+	case errors.As(err, &perr):
+		return payloadError{fmt.Errorf("TLS handshake with %s: %w", s.addr, err)}
+	case tlsRejected(err):
+		return payloadError{fmt.Errorf("TLS handshake with %s: the destination rejected this agent's transfer certificate (%v); is it for the same migration and unexpired?", s.addr, err)}
+	}
+	return fmt.Errorf("TLS handshake with %s: %w", s.addr, err)
+}
+
+// recover re-establishes a broken connection and resumes the transfer,
+// retrying with backoff for up to retryFor. Callers hold wmu.
+func (s *Session) recover() error {
+	deadline := time.Now().Add(s.retryFor)
+	delay := retryInitialDelay
+	for {
+		s.mu.Lock()
+		err, broken, closed := s.err, s.broken, s.closed
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if broken == nil {
+			return nil
+		}
+		if closed {
+			s.fail(fmt.Errorf("session closed: %w", broken))
+			continue
+		}
+		if time.Now().Add(delay).After(deadline) {
+			s.fail(fmt.Errorf("transfer to %s: giving up after %s: %w", s.addr, s.retryFor, broken))
+			continue
+		}
+		log.Printf("transfer to %s interrupted (%v); resuming in %s", s.addr, broken, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		if err := s.resume(); err != nil {
+			var perr payloadError
+			if errors.As(err, &perr) {
+				s.fail(err)
+				continue
+			}
+			s.mu.Lock()
+			if s.broken != nil {
+				s.broken = err
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// resume reconnects once and sends every frame the receiver has not
+// completed, the first one from the receiver's offset.
+func (s *Session) resume() error {
+	lastSeq, offset, err := s.connect()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.reconnects++
+	i := 0
+	for i < len(s.pending) && s.pending[i].h.Seq <= lastSeq {
+		s.pending[i].lost = true // only matters to an unanswered query
+		i++
+	}
+	s.pending = s.pending[i:]
+	s.cond.Broadcast()
+	resend := append([]*outFrame(nil), s.pending...)
+	conn := s.conn
+	s.mu.Unlock()
+
+	for _, f := range resend {
+		from := int64(0)
+		if f.h.Seq == lastSeq+1 {
+			from = offset
+		}
+		if err := s.writeFrame(f, from); err != nil {
+			if s.writeFailed(conn, err) {
+				return err
+			}
+			return payloadError{err}
+		}
+	}
+	if len(resend) > 0 {
+		log.Printf("transfer to %s resumed at frame %d (offset %d)", s.addr, resend[0].h.Seq, offset)
+	}
+	return nil
+}
+
+// Reconnects returns how many times the session re-established its
+// connection.
+func (s *Session) Reconnects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reconnects
+}
+
+// readReplies matches reply records on conn to pending frames until conn
+// fails, is replaced, or a NAK arrives.
+func (s *Session) readReplies(conn net.Conn, br *bufio.Reader) {
+	for {
+		code, seq, msg, err := wire.ReadReply(br)
+		if err != nil {
+			s.markBroken(conn, fmt.Errorf("read reply: %w", err))
+			return
+		}
+		s.mu.Lock()
+		if s.conn != conn {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.pending) == 0 || s.pending[0].h.Seq != seq {
+			s.mu.Unlock()
+			s.fail(fmt.Errorf("unexpected reply for frame %d", seq))
+			return
+		}
+		f := s.pending[0]
+		switch code {
+		case wire.Ack:
+			if f.h.Kind == KindChunkQuery {
+				f.answer, f.answered = msg, true
+			}
+		case wire.Nak:
+			// The receiver dropped the connection after the NAK; the
+			// reconnect resends the frame from its first byte.
+			f.resends++
+			n := f.resends
+			s.mu.Unlock()
+			if n > sessionMaxResends {
+				s.fail(fmt.Errorf("frame %q failed verification %d times: %s", f.h.Name, n, msg))
+				return
+			}
+			log.Printf("transfer to %s: frame %q failed verification (%s); resending", s.addr, f.h.Name, msg)
+			s.markBroken(conn, fmt.Errorf("frame %q failed verification", f.h.Name))
+			return
+		default:
+			s.mu.Unlock()
+			s.fail(fmt.Errorf("destination rejected frame %q: %s", f.h.Name, msg))
+			return
+		}
+		s.pending = s.pending[1:]
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// markBroken records that conn stopped working, unless it has already been
+// replaced, and wakes all waiters so one of them reconnects.
+func (s *Session) markBroken(conn net.Conn, cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn != s.conn || s.broken != nil {
+		return
+	}
+	s.broken = cause
+	conn.Close()
+	s.cond.Broadcast()
+}
+
+// fail records the first session error, closes the connection and wakes
+// all waiters. Frames still pending stay pending so Flush reports them; a
+// failure with nothing outstanding only stops further sends.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		if len(s.pending) > 0 {
+			err = fmt.Errorf("%w (%d frame(s) unacknowledged)", err, len(s.pending))
+		}
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.conn.Close()
+}
+
+// receiveSession serves a version-2 connection whose HELLO h has already
+// been read and verified (see open). A dropped connection ends the session
+// without ending the transfer: the sender reconnects and resumes the frame
+// it was in.
+func (rs *receiverState) receiveSession(br *bufio.Reader, w io.Writer, h FrameHeader, handle FrameHandler) ([]FrameHeader, bool, error) {
+	tr := &trackingReader{r: br}
+	bw := bufio.NewWriter(w)
+	// Without a reply the sender retries: a session that is not one of
+	// the stripes being received gets in once they are done.
+	if isStripeID(h.Name) != (rs.stripe != "") || !strings.HasPrefix(h.Name, rs.stripe) {
+		return nil, false, authError{fmt.Errorf("session %s refused: not a stripe of the file being received", h.Name)}
+	}
+	ts := rs.transfer(h.Name)
+	lastSeq, offset := ts.resumePoint()
+	hello := wire.ResumePoint(lastSeq, offset)
+	if h.Chunked && rs.opts.ChunkCache != nil {
+		hello = append(hello, 1)
+	}
+	if err := wire.WriteReply(bw, wire.Ack, 0, string(hello)); err != nil {
+		return nil, false, nil
+	}
+	handle = unchunk(rs.opts.ChunkCache, handle)
+
+	var frames []FrameHeader
+	for {
+		reply := "" // the ACK message
+		h, version, err := readFrameHeader(tr)
+		if err != nil {
+			if tr.err != nil {
+				return frames, false, nil
+			}
+			return frames, false, err
+		}
+		if version != wire.SessionVersion {
+			return frames, false, fmt.Errorf("version %d frame inside a session", version)
+		}
+
+		switch {
+		case h.Kind == KindHello:
+			return frames, false, fmt.Errorf("HELLO inside a session")
+		case h.Seq <= ts.lastSeq:
+			// Completed before a reconnect; only its ACK was lost.
+			err := wire.SkipChunks(tr)
+			if err == nil {
+				_, err = readMAC(tr, h)
+			}
+			if err != nil {
+				return frames, false, rs.lost(tr, ts, err)
+			}
+		case h.Seq != ts.lastSeq+1:
+			err := fmt.Errorf("frame %d out of order, expected %d", h.Seq, ts.lastSeq+1)
+			wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+			return frames, false, err
+		case h.Kind == KindDone:
+			m, digest, err := readManifest(tr)
+			var mac []byte
+			if err == nil {
+				mac, err = readMAC(tr, h)
+			}
+			if err == nil {
+				err = rs.authenticate(ts.id, h, digest, mac)
+			}
+			if err != nil {
+				if tr.err != nil {
+					return frames, false, rs.lost(tr, ts, err)
+				}
+				return frames, false, rs.reject(bw, h, err)
+			}
+			rs.mu.Lock()
+			err = m.check(rs.received)
+			rs.mu.Unlock()
+			if err != nil {
+				wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+				return frames, false, err
+			}
+			ts.lastSeq = h.Seq
+			return frames, true, wire.WriteReply(bw, wire.Ack, h.Seq, "")
+		case h.Kind == KindAbort:
+			reason, digest, err := readInline(tr, h, "abort reason", maxAbortReasonSize)
+			var mac []byte
+			if err == nil {
+				mac, err = readMAC(tr, h)
+			}
+			if err == nil {
+				err = rs.authenticate(ts.id, h, digest, mac)
+			}
+			if err != nil {
+				if tr.err != nil {
+					return frames, false, rs.lost(tr, ts, err)
+				}
+				return frames, false, rs.reject(bw, h, err)
+			}
+			ts.lastSeq = h.Seq
+			wire.WriteReply(bw, wire.Ack, h.Seq, "")
+			return frames, false, &AbortError{Reason: string(reason), BySource: true}
+		case h.Kind == KindChunkQuery:
+			part, err := rs.spool(ts, h, tr, handle)
+			if err == nil {
+				reply, err = part.answerQuery(rs.opts.ChunkCache)
+			}
+			if err != nil {
+				if tr.err != nil {
+					return frames, false, rs.lost(tr, ts, err)
+				}
+				if ts.part != nil {
+					ts.part.discard(err)
+					ts.part = nil
+				}
+				return frames, false, rs.reject(bw, h, err)
+			}
+			ts.lastSeq = h.Seq
+			ts.part = nil
+		default:
+			part, err := rs.spool(ts, h, tr, handle)
+			if err == nil && h.Kind == KindStripedFile {
+				err = rs.receiveStripes(ts.id, h, part, handle)
+			}
+			if err == nil {
+				err = part.deliver(handle)
+			}
+			if err != nil {
+				if tr.err != nil {
+					return frames, false, rs.lost(tr, ts, err)
+				}
+				if ts.part != nil {
+					ts.part.discard(err)
+					ts.part = nil
+				}
+				return frames, false, rs.reject(bw, h, err)
+			}
+			rs.receive(h, part.digest)
+			ts.lastSeq = h.Seq
+			ts.part = nil
+			frames = append(frames, h)
+		}
+		if err := wire.WriteReply(bw, wire.Ack, h.Seq, reply); err != nil {
+			return frames, false, nil
+		}
+	}
+}
+
+// reject answers a frame the receiver could not accept. A payload that
+// failed verification is NAKed and the connection dropped so the sender
+// resends it; a frame without a valid MAC is refused with the connection;
+// any other error ends the transfer.
+func (rs *receiverState) reject(bw *bufio.Writer, h FrameHeader, err error) error {
+	var derr digestError
+	if errors.As(err, &derr) {
+		log.Printf("transfer: %v; asking the sender to resend", err)
+		wire.WriteReply(bw, wire.Nak, h.Seq, err.Error())
+		return nil
+	}
+	var aerr authError
+	if errors.As(err, &aerr) {
+		wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+		return err
+	}
+	err = fmt.Errorf("handle frame %q: %w", h.Name, err)
+	wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+	return err
+}
+
+// lost handles a connection that dropped mid-frame: the transfer stays open
+// for the sender to resume. It returns nil unless err is not a read failure.
+func (rs *receiverState) lost(tr *trackingReader, ts *transferState, err error) error {
+	if tr.err == nil {
+		return err
+	}
+	if p := ts.part; p != nil {
+		log.Printf("transfer %s: connection lost in frame %d after %d byte(s); waiting for the sender to resume", ts.id, p.h.Seq, p.size)
+	}
+	return nil
+}
+
+// trackingReader remembers the first read error of the underlying
+// connection so callers can tell a dropped connection from bad data.
+type trackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
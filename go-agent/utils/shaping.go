@@ -0,0 +1,269 @@
+package utils
+
+// Bandwidth shaping and WAN emulation for transfer connections.
+//
+// Migration traffic between edge sites must not starve the workloads'
+// own traffic, so a MigratableWorkload may cap it (maxTransferBytesPerSecond,
+// handed to both agents by the MC). The sender's RateLimiter paces what it
+// writes, the receiver's what it reads; the stripes of a striped file share
+// their session's limiter, so the cap holds for the whole transfer.
+//
+// For benchmarks, connections to and from loopback addresses can also be
+// made to behave like a long-distance link: every write is delivered
+// TRANSFER_EMULATE_LATENCY_MS later, give or take up to
+// TRANSFER_EMULATE_JITTER_MS, in order. Both ends delay what they write, so
+// a round trip takes twice the latency. Emulation never applies to other
+// peers, so a stray setting cannot slow a real migration.
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// emulatedQueue bounds how many writes an emulated link holds in flight.
+const emulatedQueue = 256
+
+// RateLimiter paces a byte stream to a rate with a token bucket. A nil
+// RateLimiter does not limit. It is safe for concurrent use.
+type RateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond, or nil when
+// bytesPerSecond is not positive. Up to a tenth of a second's worth (at
+// least 64 KiB) may go out at once.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSecond) / 10
+	if burst < 64<<10 {
+		burst = 64 << 10
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n more bytes fit the rate. A write larger than the
+// burst borrows against the future, so later ones wait longer.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// WANEmulation is the link a loopback transfer connection pretends to be.
+type WANEmulation struct {
+	Latency time.Duration // one-way delay
+	Jitter  time.Duration // the delay varies by up to this much either way
+}
+
+// WANEmulationFromEnv reads TRANSFER_EMULATE_LATENCY_MS and
+// TRANSFER_EMULATE_JITTER_MS (both default 0: off).
+func WANEmulationFromEnv() WANEmulation {
+	return WANEmulation{
+		Latency: time.Duration(EnvInt("TRANSFER_EMULATE_LATENCY_MS", 0)) * time.Millisecond,
+		Jitter:  time.Duration(EnvInt("TRANSFER_EMULATE_JITTER_MS", 0)) * time.Millisecond,
+	}
+}
+
+// delay returns how long one write is held back.
+func (e WANEmulation) delay() time.Duration {
+	d := e.Latency
+	if e.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*e.Jitter))) - e.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// shapeConn returns conn paced by limit, reads and writes alike, and
+// delayed like emu when its peer is a loopback address.
+func shapeConn(conn net.Conn, limit *RateLimiter, emu WANEmulation) net.Conn {
+	if emu.Latency > 0 || emu.Jitter > 0 {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+			conn = newEmulatedConn(conn, emu)
+		}
+	}
+	if limit == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, limit: limit}
+}
+
+// limitedConn paces a connection with a RateLimiter.
+type limitedConn struct {
+	net.Conn
+	limit *RateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limit.Wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	// Pacing per chunk keeps a large write from sleeping in one go.
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > wire.ChunkSize {
+			n = wire.ChunkSize
+		}
+		c.limit.Wait(n)
+		m, err := c.Conn.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// emulatedConn delivers every write after the emulated delay, in order.
+// Close delivers what is still held back first.
+type emulatedConn struct {
+	net.Conn
+	emu   WANEmulation
+	queue chan emulatedWrite
+	done  chan struct{}
+
+	// closing is closed by Close; a Write waiting for room in queue gives
+	// up on it, so a link that stopped delivering cannot hold Close up.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	err  error // the first failed delivery
+	last time.Time
+}
+
+type emulatedWrite struct {
+	at   time.Time
+	data []byte
+}
+
+func newEmulatedConn(conn net.Conn, emu WANEmulation) *emulatedConn {
+	c := &emulatedConn{
+		Conn:    conn,
+		emu:     emu,
+		queue:   make(chan emulatedWrite, emulatedQueue),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+func (c *emulatedConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closing:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	// Jitter varies the delay but never reorders the stream.
+	at := time.Now().Add(c.emu.delay())
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+	c.mu.Unlock()
+	select {
+	case c.queue <- emulatedWrite{at: at, data: append([]byte(nil), p...)}:
+		return len(p), nil
+	case <-c.closing:
+		return 0, net.ErrClosed
+	}
+}
+
+// deliver writes the held-back data when it is due, and what is still
+// queued once Close is called.
+func (c *emulatedConn) deliver() {
+	defer close(c.done)
+	for {
+		select {
+		case w := <-c.queue:
+			if !c.send(w) {
+				// Drain so writers do not block on a dead link.
+				for {
+					select {
+					case <-c.queue:
+					case <-c.closing:
+						return
+					}
+				}
+			}
+		case <-c.closing:
+			for {
+				select {
+				case w := <-c.queue:
+					if !c.send(w) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes w when it is due and reports whether it was delivered.
+func (c *emulatedConn) send(w emulatedWrite) bool {
+	time.Sleep(time.Until(w.at))
+	if _, err := c.Conn.Write(w.data); err != nil {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (c *emulatedConn) Close() error {
+	closed := true
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		closed = false
+	})
+	if closed {
+		return net.ErrClosed
+	}
+	select {
+	case <-c.done:
+	case <-time.After(c.emu.Latency + c.emu.Jitter + time.Second):
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Paces(t *testing.T) {
+	if NewRateLimiter(0) != nil {
+		t.Fatal("a zero rate must not limit")
+	}
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		l.Wait(64 << 10)
+	}
+	// 512 KiB at 1 MiB/s, less the ~100 KiB burst.
+	if d := time.Since(start); d < 350*time.Millisecond || d > 2*time.Second {
+		t.Errorf("512 KiB at 1 MiB/s took %s", d)
+	}
+}
+
+func TestSession_LimitedTransfer(t *testing.T) {
+	dst := t.TempDir()
+	data := randomData(1 << 20)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_a.dmtcp")
+	os.WriteFile(ckpt, data, 0o600)
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+
+	start := time.Now()
+	s, err := DialSessionWith(addr, DialOptions{Limit: NewRateLimiter(2 << 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetCodec(CodecNone)
+	if err := s.SendCheckpointFile(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("1 MiB at 2 MiB/s took only %s", d)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_a.dmtcp")); !bytes.Equal(got, data) {
+		t.Fatal("file differs after a paced transfer")
+	}
+}
+
+func TestEmulatedConn_DelaysInOrder(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			got <- nil
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		got <- b
+	}()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := shapeConn(raw, nil, WANEmulation{Latency: 60 * time.Millisecond, Jitter: 40 * time.Millisecond})
+	var want bytes.Buffer
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("message %d;", i)
+		want.WriteString(msg)
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 20*time.Millisecond {
+		t.Errorf("writes blocked for %s; the link should hold them", d)
+	}
+	// Close delivers what is still in flight.
+	c.Close()
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Close returned after %s, before anything was due", d)
+	}
+	if b := <-got; !bytes.Equal(b, want.Bytes()) {
+		t.Fatalf("received %q, want %q", b, want.Bytes())
+	}
+}
+
+func TestEmulatedConn_CloseWhileLinkStalls(t *testing.T) {
+	// Nobody reads the other end, so the link stops delivering and the
+	// queue fills up under a writer.
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	c := newEmulatedConn(raw, WANEmulation{Latency: time.Millisecond})
+	blocked := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.Write([]byte("x")); err != nil {
+				blocked <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case err := <-blocked:
+		if err != net.ErrClosed {
+			t.Errorf("blocked Write = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a Write blocked on a full queue did not return on Close")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close deadlocked behind a blocked Write")
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+// Staging of received items.
+//
+// Nothing a transfer delivers appears under its final name until it is
+// complete. A layer or a whole checkpoint file is extracted into a staging
+// directory next to its destination and renamed into place once the whole
+// payload extracted; the parts of a streamed file and the ranges of a
+// striped one are written to a staged file that its last part, or its
+// striped frame, renames over the final one. A transfer that fails or is
+// aborted half-way therefore leaves only staging entries behind, which
+// neither InitVolume nor ListCheckpoints picks up:
+//
+//	.staging-<random>       directory a payload is extracted into
+//	.staging-<name>.part    file a streamed or striped file is written to
+//
+// CleanStaging removes them, and the resume spools of a receiver that is no
+// longer running, when the agent starts.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stagingPrefix starts the name of every staging entry.
+const stagingPrefix = ".staging-"
+
+// StagingDir creates an empty staging directory in parent for an item
+// published as name.
+func StagingDir(parent, name string) (string, error) {
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", fmt.Errorf("mkdir %s: %w", parent, err)
+	}
+	dir, err := os.MkdirTemp(parent, stagingPrefix+name+"-")
+	if err != nil {
+		return "", fmt.Errorf("create staging dir in %s: %w", parent, err)
+	}
+	return dir, nil
+}
+
+// PublishDir renames the staging directory staged to final, replacing
+// whatever final was. An existing final is first renamed aside, so at no
+// point does final hold a mix of both.
+func PublishDir(staged, final string) error {
+	if _, err := os.Lstat(final); err == nil {
+		old, err := os.MkdirTemp(filepath.Dir(final), stagingPrefix+"old-")
+		if err != nil {
+			return fmt.Errorf("stage %s for replacement: %w", final, err)
+		}
+		aside := filepath.Join(old, filepath.Base(final))
+		if err := os.Rename(final, aside); err != nil {
+			os.Remove(old)
+			return fmt.Errorf("move %s aside: %w", final, err)
+		}
+		defer os.RemoveAll(old)
+	}
+	if err := os.Rename(staged, final); err != nil {
+		return fmt.Errorf("publish %s: %w", final, err)
+	}
+	return nil
+}
+
+// stagedFile is where the file at target is written until it is complete.
+func stagedFile(target string) string {
+	return filepath.Join(filepath.Dir(target), stagingPrefix+filepath.Base(target)+".part")
+}
+
+// extractStaged extracts the tar stream compressed with codec from r into a
+// staging directory in destDir and, once all of it is there, renames each
+// of its top-level entries into destDir. A failed extraction leaves destDir
+// as it was.
+func extractStaged(r io.Reader, codec Codec, destDir string) error {
+	staged, err := StagingDir(destDir, "extract")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staged)
+	if err := ExtractTar(r, codec, staged); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(staged)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		src := filepath.Join(staged, e.Name())
+		dst := filepath.Join(destDir, e.Name())
+		if e.IsDir() {
+			if err := PublishDir(src, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("publish %s: %w", dst, err)
+		}
+		// A whole file replaces the parts or ranges staged before it.
+		os.Remove(stagedFile(dst))
+	}
+	return nil
+}
+
+// CleanStaging removes the staging entries and resume spools a receiver
+// left in dirs. Call it only while no transfer into dirs is running.
+func CleanStaging(dirs ...string) error {
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", dir, err)
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), stagingPrefix) && !strings.HasPrefix(e.Name(), resumePrefix) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return fmt.Errorf("remove %s: %w", e.Name(), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractPayload_FailedFileLeavesNothing(t *testing.T) {
+	dst := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := randomData(8192)
+	tw.WriteHeader(&tar.Header{Name: "ckpt_a.dmtcp", Mode: 0o600, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	tw.Write(data)
+	tw.Close()
+	buf.Truncate(4096)
+
+	if err := ExtractPayload(FrameHeader{Kind: KindCheckpointFile, Codec: CodecNone}, &buf, dst); err == nil {
+		t.Fatal("a truncated checkpoint file was extracted")
+	}
+	if left, _ := os.ReadDir(dst); len(left) != 0 {
+		t.Fatalf("a failed extraction left %v", left)
+	}
+}
+
+func TestExtractPart_PublishesWithLastPart(t *testing.T) {
+	dst := t.TempDir()
+	data := textData(1000)
+	target := filepath.Join(dst, "ckpt_a.dmtcp")
+	for i, p := range []FilePart{
+		{Name: "ckpt_a.dmtcp", Index: 1, Offset: 0, Length: 600, Mode: 0o600},
+		{Name: "ckpt_a.dmtcp", Index: 2, Offset: 600, Length: 400, Mode: 0o600, Final: true},
+	} {
+		p.Data = bytes.NewReader(data)
+		var buf bytes.Buffer
+		if err := writePartTar(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		if err := ExtractPayload(FrameHeader{Kind: KindCheckpointPart, Codec: CodecNone}, &buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(target); i == 0 && !os.IsNotExist(err) {
+			t.Fatalf("file published before its last part: %v", err)
+		}
+	}
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, data) {
+		t.Fatal("file differs after its last part")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dst, "*.dmtcp")); len(matches) != 1 {
+		t.Errorf("images in %s: %v", dst, matches)
+	}
+}
+
+func TestCleanStaging(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(a, ".staging-l2-123", "sub"), 0o755)
+	os.WriteFile(filepath.Join(a, "keep"), nil, 0o600)
+	os.WriteFile(filepath.Join(b, ".staging-ckpt_a.dmtcp.part"), nil, 0o600)
+	os.WriteFile(filepath.Join(b, ".resume-0123-4"), nil, 0o600)
+	os.WriteFile(filepath.Join(b, ".resume-0123-4.journal"), nil, 0o600)
+	os.WriteFile(filepath.Join(b, "ckpt_a.dmtcp"), nil, 0o600)
+
+	if err := CleanStaging(a, b, filepath.Join(a, "missing")); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]string{a: "keep", b: "ckpt_a.dmtcp"} {
+		left, _ := os.ReadDir(dir)
+		if len(left) != 1 || left[0].Name() != want {
+			t.Errorf("%s holds %v, want only %s", dir, left, want)
+		}
+	}
+}
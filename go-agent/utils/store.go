@@ -0,0 +1,221 @@
+package utils
+
+// Checkpoint repository.
+//
+// Besides the direct pod-to-pod stream, a source can leave its transfer in
+// a CheckpointStore (CHECKPOINT_STORE) for the destination to download when
+// it registers, and the same store keeps point-in-time snapshots of a
+// workload. Two backends exist: a directory (a mounted shared volume) and an
+// S3-compatible object store (see s3.go). The layout of a stored transfer is
+// described in upload.go.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CheckpointStore holds objects addressed by slash-separated keys. Get and
+// Delete of a missing key return an error wrapping os.ErrNotExist.
+type CheckpointStore interface {
+	// Put stores the size bytes read from r under key, replacing any
+	// object there. A reader never sees a partly written object.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens the object at key.
+	Get(key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, sorted.
+	List(prefix string) ([]string, error)
+	// Delete removes the object at key.
+	Delete(key string) error
+}
+
+// CheckpointStoreFromEnv opens the store named by CHECKPOINT_STORE, or
+// returns nil when it is unset.
+func CheckpointStoreFromEnv() (CheckpointStore, error) {
+	spec := os.Getenv("CHECKPOINT_STORE")
+	if spec == "" {
+		return nil, nil
+	}
+	st, err := OpenCheckpointStore(spec)
+	if err != nil {
+		return nil, fmt.Errorf("CHECKPOINT_STORE: %w", err)
+	}
+	return st, nil
+}
+
+// OpenCheckpointStore opens the store named by spec:
+//
+//	/var/lib/checkpoints            a directory
+//	file:///var/lib/checkpoints     the same
+//	s3://bucket/prefix?endpoint=http://minio:9000&region=eu-west-1
+//
+// S3 credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN; the region defaults to AWS_REGION, then us-east-1, and
+// the endpoint to AWS's regional one.
+func OpenCheckpointStore(spec string) (CheckpointStore, error) {
+	if strings.HasPrefix(spec, "/") {
+		return &FSStore{Root: spec}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse store %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("store %q names no directory", spec)
+		}
+		return &FSStore{Root: u.Path}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("store %q names no bucket", spec)
+		}
+		q := u.Query()
+		region := q.Get("region")
+		if region == "" {
+			region = EnvOr("AWS_REGION", "us-east-1")
+		}
+		endpoint := q.Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return &S3Store{
+			Endpoint:     strings.TrimSuffix(endpoint, "/"),
+			Bucket:       u.Host,
+			Prefix:       strings.Trim(u.Path, "/"),
+			Region:       region,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("store %q: unsupported scheme %q (want a path, file:// or s3://)", spec, u.Scheme)
+	}
+}
+
+// checkKey refuses keys that are empty or would leave the store.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("invalid store key %q", key)
+	}
+	return nil
+}
+
+// FSStore is a CheckpointStore in a directory; keys map to paths below Root.
+type FSStore struct {
+	Root string
+}
+
+func (s *FSStore) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object to a temporary file and renames it into place.
+func (s *FSStore) Put(key string, r io.Reader, size int64) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(p), err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens the object's file.
+func (s *FSStore) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// List walks the directory holding prefix. Temporary files of unfinished
+// Puts are skipped.
+func (s *FSStore) List(prefix string) ([]string, error) {
+	root := s.Root
+	if dir := path.Dir(prefix); prefix != "" && dir != "." {
+		if err := checkKey(dir); err != nil {
+			return nil, err
+		}
+		root = filepath.Join(s.Root, filepath.FromSlash(dir))
+	}
+	var keys []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object's file and the directories it leaves empty.
+func (s *FSStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	root := filepath.Clean(s.Root)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
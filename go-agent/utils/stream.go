@@ -0,0 +1,424 @@
+package utils
+
+// Streaming checkpoint images while they are written.
+//
+// A DMTCP checkpoint writes every process image sequentially, which takes
+// seconds for a large process; sending the images only once the checkpoint
+// returns adds the transfer time to the downtime. A FileStream watches the
+// checkpoint directory with inotify instead and sends each image's new
+// bytes as they are written, as frames of kind KindCheckpointPart:
+//
+//	Ordinal  part number, starting at 1
+//	Name     the complete image's base name
+//	payload  tar holding one entry, the image's bytes [offset, offset+n),
+//	         with PAX records MYCEDRIVE.part.offset and, on the last part,
+//	         MYCEDRIVE.part.size (the complete image's size)
+//
+// The receiver appends each part to a staged copy of the image, checks the
+// size on the last one and only then renames it into place. Before sending
+// the last part the sender re-reads the image: if any byte it already sent
+// has changed since, it sends the whole image as an ordinary checkpoint
+// file frame instead, which replaces the parts.
+//
+// Parts are sent once CHECKPOINT_STREAM_PART_MB (default 16) new bytes are
+// there; the rest follows when the image is renamed into place or when
+// Finish is called after the checkpoint returned. Older destination agents
+// refuse part frames, so CHECKPOINT_STREAM=true opts in (see
+// endcontainer.go).
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	paxPartOffset = "MYCEDRIVE.part.offset"
+	paxPartSize   = "MYCEDRIVE.part.size"
+
+	defaultStreamPartMB = 16
+
+	streamEvents = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_MOVED_TO | unix.IN_CLOSE_WRITE
+)
+
+// FilePart is a byte range of a checkpoint file that is still being
+// written.
+type FilePart struct {
+	Name  string // base name of the complete file
+	Index int    // part number, starting at 1
+	// Path is where the file is now; it only guides the choice of codec.
+	Path string
+	// Data is the file; it is read again when the frame is resent.
+	Data           io.ReaderAt
+	Offset, Length int64
+	// Final marks the last part; the file's size is then Offset+Length.
+	Final   bool
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// StreamOptions configures StreamFiles.
+type StreamOptions struct {
+	// Image maps the name of a file created in the directory to the
+	// file it becomes once complete; ok is false for files not to
+	// stream.
+	Image func(name string) (image string, ok bool)
+	// MinPart is the least number of new bytes sent as a part before
+	// the file is complete. Zero means CHECKPOINT_STREAM_PART_MB.
+	MinPart int64
+}
+
+// FileStream sends the files created in a directory to a Sender while
+// they are being written.
+type FileStream struct {
+	s    Sender
+	dir  string
+	opts StreamOptions
+
+	watch *os.File // the inotify instance
+	done  chan struct{}
+
+	// mu guards the files and the stream error.
+	mu    sync.Mutex
+	files map[string]*streamedFile
+	err   error
+}
+
+// streamedFile is one file being streamed.
+type streamedFile struct {
+	name  string
+	path  string
+	f     *os.File
+	sum   hash.Hash // of the bytes sent
+	sent  int64
+	parts int
+	final bool // nothing more is streamed
+	whole bool // the last part was sent, so the receiver has it all
+}
+
+// StreamFiles starts watching dir and sends every file created there that
+// opts.Image names to s, part by part, until Finish or Close is called.
+func StreamFiles(s Sender, dir string, opts StreamOptions) (*FileStream, error) {
+	if opts.Image == nil {
+		return nil, errors.New("stream files: no image names")
+	}
+	if opts.MinPart <= 0 {
+		opts.MinPart = EnvSize("CHECKPOINT_STREAM_PART_MB", defaultStreamPartMB, 1<<20)
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, streamEvents); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+	st := &FileStream{
+		s:     s,
+		dir:   dir,
+		opts:  opts,
+		watch: os.NewFile(uintptr(fd), "inotify"),
+		done:  make(chan struct{}),
+		files: make(map[string]*streamedFile),
+	}
+	go st.run()
+	return st, nil
+}
+
+// run sends parts as the watched files grow, until the watch is closed or
+// sending fails.
+func (st *FileStream) run() {
+	defer close(st.done)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := st.watch.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				st.setErr(fmt.Errorf("read inotify events: %w", err))
+			}
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			if err := st.event(ev.Mask, string(bytes.TrimRight(nameBytes, "\x00"))); err != nil {
+				st.setErr(err)
+				return
+			}
+		}
+		if err := st.advance(); err != nil {
+			st.setErr(err)
+			return
+		}
+	}
+}
+
+// event starts streaming a created file, and completes one renamed into
+// place.
+func (st *FileStream) event(mask uint32, name string) error {
+	image, ok := st.opts.Image(name)
+	if !ok {
+		return nil
+	}
+	st.mu.Lock()
+	sf := st.files[image]
+	st.mu.Unlock()
+	switch {
+	case sf == nil && mask&unix.IN_CREATE != 0:
+		path := filepath.Join(st.dir, name)
+		f, err := os.Open(path)
+		if err != nil {
+			// Gone again: nothing to stream.
+			return nil
+		}
+		st.mu.Lock()
+		st.files[image] = &streamedFile{name: image, path: path, f: f, sum: sha256.New()}
+		st.mu.Unlock()
+	case sf != nil && mask&unix.IN_MOVED_TO != 0 && name == image:
+		sf.path = filepath.Join(st.dir, name)
+		return st.complete(sf)
+	}
+	return nil
+}
+
+// advance sends a part of every file that grew by at least MinPart.
+func (st *FileStream) advance() error {
+	for _, sf := range st.pending() {
+		info, err := sf.f.Stat()
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", sf.path, err)
+		}
+		if info.Size()-sf.sent < st.opts.MinPart {
+			continue
+		}
+		if err := st.sendPart(sf, info, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pending returns the files whose last part is still to be sent.
+func (st *FileStream) pending() []*streamedFile {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var files []*streamedFile
+	for _, sf := range st.files {
+		if !sf.final {
+			files = append(files, sf)
+		}
+	}
+	return files
+}
+
+// sendPart sends the bytes of sf written since its last part.
+func (st *FileStream) sendPart(sf *streamedFile, info os.FileInfo, final bool) error {
+	p := FilePart{
+		Name:    sf.name,
+		Index:   sf.parts + 1,
+		Path:    sf.path,
+		Data:    sf.f,
+		Offset:  sf.sent,
+		Length:  info.Size() - sf.sent,
+		Final:   final,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	if _, err := io.Copy(sf.sum, io.NewSectionReader(sf.f, p.Offset, p.Length)); err != nil {
+		return fmt.Errorf("read %s: %w", sf.path, err)
+	}
+	if err := st.s.SendCheckpointPart(p); err != nil {
+		return fmt.Errorf("send part %d of %s: %w", p.Index, sf.name, err)
+	}
+	sf.parts++
+	sf.sent += p.Length
+	return nil
+}
+
+// complete sends the last part of sf, or leaves the file to the caller
+// when bytes already sent have changed.
+func (st *FileStream) complete(sf *streamedFile) error {
+	info, err := sf.f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", sf.path, err)
+	}
+	sent := sf.sum.Sum(nil)
+	now := sha256.New()
+	if _, err := io.Copy(now, io.NewSectionReader(sf.f, 0, sf.sent)); err != nil {
+		return fmt.Errorf("read %s: %w", sf.path, err)
+	}
+	if sf.sent > info.Size() || !bytes.Equal(now.Sum(nil), sent) {
+		log.Printf("%s changed after %d part(s) were sent; sending it whole", sf.name, sf.parts)
+		sf.final = true
+		return nil
+	}
+	if err := st.sendPart(sf, info, true); err != nil {
+		return err
+	}
+	sf.final, sf.whole = true, true
+	return nil
+}
+
+// Finish stops watching, sends the rest of every file being streamed and
+// returns the base names of the files that were sent completely. The
+// others, and files that were not created while watching, are left to the
+// caller.
+func (st *FileStream) Finish() ([]string, error) {
+	st.watch.Close()
+	<-st.done
+	if err := st.streamErr(); err != nil {
+		return nil, err
+	}
+	for _, sf := range st.pending() {
+		if err := st.complete(sf); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for _, sf := range st.files {
+		if sf.whole {
+			names = append(names, sf.name)
+		}
+	}
+	return names, nil
+}
+
+// Close stops watching and closes the streamed files. Call it once the
+// parts have been acknowledged (Flush or Done): resending a part reads the
+// file again.
+func (st *FileStream) Close() error {
+	st.watch.Close()
+	<-st.done
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, sf := range st.files {
+		sf.f.Close()
+	}
+	return nil
+}
+
+func (st *FileStream) setErr(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+}
+
+func (st *FileStream) streamErr() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.err
+}
+
+// writePartTar writes an uncompressed tar stream holding part p to w.
+func writePartTar(w io.Writer, p FilePart) error {
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       p.Name,
+		Size:       p.Length,
+		Mode:       int64(p.Mode.Perm()),
+		ModTime:    p.ModTime,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxPartOffset: strconv.FormatInt(p.Offset, 10)},
+	}
+	if p.Final {
+		hdr.PAXRecords[paxPartSize] = strconv.FormatInt(p.Offset+p.Length, 10)
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	if _, err := io.Copy(tw, io.NewSectionReader(p.Data, p.Offset, p.Length)); err != nil {
+		return fmt.Errorf("copy %s: %w", p.Name, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	return nil
+}
+
+// extractPart writes the part in the tar stream compressed with codec from
+// r into the staged file of its file in destDir, and publishes the file
+// with its last part.
+func extractPart(r io.Reader, codec Codec, destDir string) error {
+	dr, err := decompressor(r, codec)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("tar next: %w", err)
+	}
+	target, err := safeJoin(destDir, hdr.Name)
+	if err != nil {
+		return err
+	}
+	off, err := strconv.ParseInt(hdr.PAXRecords[paxPartOffset], 10, 64)
+	if err != nil || off < 0 {
+		return fmt.Errorf("part of %s has no valid offset", hdr.Name)
+	}
+	staged := stagedFile(target)
+	if off == 0 {
+		os.Remove(staged)
+	}
+	f, err := os.OpenFile(staged, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", staged, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < off {
+		return fmt.Errorf("part of %s starts at byte %d but only %d arrived", hdr.Name, off, info.Size())
+	}
+	if err := f.Truncate(off); err != nil {
+		return fmt.Errorf("truncate %s: %w", target, err)
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tr); err != nil {
+		return fmt.Errorf("write %s: %w", staged, err)
+	}
+	if err := drainPayload(r); err != nil {
+		return err
+	}
+	raw, last := hdr.PAXRecords[paxPartSize]
+	if last {
+		if size, err := strconv.ParseInt(raw, 10, 64); err != nil || size != off+hdr.Size {
+			return fmt.Errorf("last part of %s ends at byte %d, not at its size %s", hdr.Name, off+hdr.Size, raw)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", staged, err)
+	}
+	if err := applyMetadata(staged, hdr); err != nil {
+		return err
+	}
+	if !last {
+		return nil
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("publish %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imageName streams *.dmtcp files, written as *.dmtcp.temp.
+func imageName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".temp")
+	return name, strings.HasSuffix(name, ".dmtcp")
+}
+
+// startStream opens a session to a receiver extracting into dst and
+// streams the files created in a new directory over it.
+func startStream(t *testing.T, dst string) (*Session, *FileStream, string, <-chan receiveResult) {
+	t.Helper()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.SetCodec(CodecNone)
+	dir := t.TempDir()
+	st, err := StreamFiles(s, dir, StreamOptions{Image: imageName, MinPart: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return s, st, dir, resCh
+}
+
+// writeSlowly writes data to a new file at path in small pieces.
+func writeSlowly(t *testing.T, path string, data []byte) *os.File {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(data); off += 16 << 10 {
+		end := off + 16<<10
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := f.Write(data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	return f
+}
+
+func TestFileStream_SendsImagesWhileWritten(t *testing.T) {
+	dst := t.TempDir()
+	s, st, dir, resCh := startStream(t, dst)
+	a, b := randomData(1<<20), textData(300<<10)
+
+	// a is renamed into place like DMTCP does, b only completes with
+	// Finish.
+	writeSlowly(t, filepath.Join(dir, "ckpt_a.dmtcp.temp"), a).Close()
+	if err := os.Rename(filepath.Join(dir, "ckpt_a.dmtcp.temp"), filepath.Join(dir, "ckpt_a.dmtcp")); err != nil {
+		t.Fatal(err)
+	}
+	writeSlowly(t, filepath.Join(dir, "ckpt_b.dmtcp"), b).Close()
+	os.WriteFile(filepath.Join(dir, "dmtcp_restart_script.sh"), []byte("#!/bin/sh\n"), 0o755)
+
+	names, err := st.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "ckpt_a.dmtcp,ckpt_b.dmtcp" {
+		t.Fatalf("Finish streamed %v", names)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	parts := make(map[string]int)
+	for _, h := range res.frames {
+		if h.Kind != KindCheckpointPart {
+			t.Errorf("unexpected frame %+v", h)
+		}
+		parts[h.Name]++
+	}
+	if parts["ckpt_a.dmtcp"] < 2 {
+		t.Errorf("ckpt_a.dmtcp arrived in %d part(s), want it streamed", parts["ckpt_a.dmtcp"])
+	}
+	for name, want := range map[string][]byte{"ckpt_a.dmtcp": a, "ckpt_b.dmtcp": b} {
+		if got, _ := os.ReadFile(filepath.Join(dst, name)); !bytes.Equal(got, want) {
+			t.Errorf("%s differs after streaming (%d bytes, want %d)", name, len(got), len(want))
+		}
+	}
+}
+
+func TestFileStream_SendsChangedImageWhole(t *testing.T) {
+	dst := t.TempDir()
+	s, st, dir, resCh := startStream(t, dst)
+	data := randomData(256 << 10)
+	path := filepath.Join(dir, "ckpt_a.dmtcp")
+	f := writeSlowly(t, path, data)
+	defer f.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(s.Sent()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no part was sent while the file was written")
+		}
+	}
+	// Rewrite bytes that were already sent.
+	copy(data, "rewritten header")
+	if _, err := f.WriteAt(data[:16], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := st.Finish()
+	if err != nil || len(names) != 0 {
+		t.Fatalf("Finish = %v, %v; want the changed file left to the caller", names, err)
+	}
+	if err := s.SendCheckpointFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_a.dmtcp")); !bytes.Equal(got, data) {
+		t.Fatal("file differs after it was sent whole")
+	}
+}
+
+func TestExtractPart_RefusesGap(t *testing.T) {
+	data := textData(1000)
+	var buf bytes.Buffer
+	p := FilePart{Name: "ckpt_a.dmtcp", Index: 2, Data: bytes.NewReader(data), Offset: 500, Length: 500, Mode: 0o600}
+	if err := writePartTar(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	err := ExtractPayload(FrameHeader{Kind: KindCheckpointPart, Codec: CodecNone}, &buf, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "only 0 arrived") {
+		t.Fatalf("ExtractPayload of a part past the end = %v", err)
+	}
+}
@@ -0,0 +1,490 @@
+package utils
+
+// Striped transfer of large checkpoint files.
+//
+// One TCP stream cannot fill a link with a high bandwidth-delay product, and
+// a multi-GB DMTCP image is a single frame. A Session dialled with Streams
+// above 1 therefore sends checkpoint files of at least STRIPE_MIN_MB
+// (default 256) as a KindStripedFile frame on its own connection, followed
+// by the file's ranges over that many extra connections to the same
+// listener:
+//
+//	KindStripedFile  payload: tar holding one empty entry with the file's
+//	                 name, mode and mtime and PAX records
+//	                 MYCEDRIVE.stripe.size (the file's size),
+//	                 MYCEDRIVE.stripe.ranges (how many ranges) and
+//	                 MYCEDRIVE.stripe.streams (how many connections)
+//	KindFileRange    Ordinal: range number, starting at 1
+//	                 payload: tar holding one entry, the file's bytes
+//	                 [offset, offset+n), with PAX record
+//	                 MYCEDRIVE.range.offset
+//
+// Every range is STRIPE_RANGE_MB (default 16) but the last; a connection
+// takes the next range once it has queued one, so a slow stream carries
+// fewer. The stripe connections are ordinary sessions whose transfer IDs
+// are "<transfer>.<seq>.<n>", seq being the striped frame's, and each ends
+// with its own DONE. The receiver accepts them while it handles the striped
+// frame, writes every range in place with pwrite into the file's staged
+// copy (see staging.go), and acknowledges the striped frame once every
+// stripe is done and every range arrived; only then does the handler get
+// the striped frame, which sets the file's size and metadata and renames it
+// into place. Stripe connections that drop reconnect and resume like any
+// session.
+//
+// The operator relay forwards one connection, so only transfers straight
+// to the destination agent are striped (see endcontainer.go).
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+const (
+	paxStripeSize    = "MYCEDRIVE.stripe.size"
+	paxStripeRanges  = "MYCEDRIVE.stripe.ranges"
+	paxStripeStreams = "MYCEDRIVE.stripe.streams"
+	paxRangeOffset   = "MYCEDRIVE.range.offset"
+
+	defaultStripeMinMB   = 256
+	defaultStripeRangeMB = 16
+)
+
+// stripeID is the transfer ID of stripe n of the striped frame seq of
+// transfer id.
+func stripeID(id string, seq uint32, n int) string {
+	return fmt.Sprintf("%s.%d.%d", id, seq, n)
+}
+
+// isStripeID reports whether a HELLO's transfer ID names a stripe;
+// newTransferID never produces a dot.
+func isStripeID(id string) bool {
+	return strings.Contains(id, ".")
+}
+
+// stripes returns how many connections a checkpoint file described by info
+// is striped over, or 0 to send it as a single frame.
+func (s *Session) stripes(info os.FileInfo) int {
+	if s.streams < 2 || info.Size() < EnvSize("STRIPE_MIN_MB", defaultStripeMinMB, 1<<20) {
+		return 0
+	}
+	return s.streams
+}
+
+// sendStriped sends the file at path over streams extra connections and
+// returns once every range has been acknowledged. The file must not change
+// meanwhile.
+func (s *Session) sendStriped(path string, info os.FileInfo, streams int) error {
+	rangeSize := EnvSize("STRIPE_RANGE_MB", defaultStripeRangeMB, 1<<20)
+	ranges := int((info.Size() + rangeSize - 1) / rangeSize)
+	if streams > ranges {
+		streams = ranges
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// The receiver accepts the stripes while it handles the striped frame,
+	// so it must not be busy with earlier frames when they dial.
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	head := &outFrame{h: FrameHeader{Kind: KindStripedFile, Name: name, Codec: CodecNone}, payload: func(w io.Writer) error {
+		return writeStripedTar(w, name, info, ranges, streams)
+	}}
+	if err := s.send(head); err != nil {
+		return err
+	}
+	log.Printf("sending %s (%d MiB) in %d range(s) over %d connections", name, info.Size()>>20, ranges, streams)
+
+	conns := make([]*Session, 0, streams)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for n := 1; n <= streams; n++ {
+		c, err := dialSession(s.addr, stripeID(s.id, head.h.Seq, n), DialOptions{TLS: s.tls, Token: s.token, Limit: s.limit, Emulate: s.emulate, Progress: s.progress})
+		if err != nil {
+			return fmt.Errorf("stripe %d of %s: %w", n, name, err)
+		}
+		conns = append(conns, c)
+	}
+
+	codec := s.frameCodec(path)
+	var (
+		mu       sync.Mutex
+		next     = 1
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	take := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr != nil || next > ranges {
+			return 0
+		}
+		next++
+		return next - 1
+	}
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Session) {
+			defer wg.Done()
+			err := sendRanges(c, f, name, info.Size(), rangeSize, codec, take)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("stripe %s: %w", c.id, err)
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// sendRanges sends the ranges take hands out over stripe c, then ends it
+// with DONE.
+func sendRanges(c *Session, f io.ReaderAt, name string, size, rangeSize int64, codec Codec, take func() int) error {
+	for i := take(); i > 0; i = take() {
+		off := int64(i-1) * rangeSize
+		n := size - off
+		if n > rangeSize {
+			n = rangeSize
+		}
+		h := FrameHeader{Kind: KindFileRange, Ordinal: i, Name: name, Codec: codec}
+		writeTar := c.progress.track(h, name, n, func(w io.Writer) error {
+			return writeRangeTar(w, name, f, off, n)
+		})
+		err := c.send(&outFrame{h: h, payload: func(w io.Writer) error {
+			return compressPayload(w, codec, writeTar)
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return c.Done()
+}
+
+// writeStripedTar writes the payload of a KindStripedFile frame.
+func writeStripedTar(w io.Writer, name string, info os.FileInfo, ranges, streams int) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxStripeSize:    strconv.FormatInt(info.Size(), 10),
+			paxStripeRanges:  strconv.Itoa(ranges),
+			paxStripeStreams: strconv.Itoa(streams),
+		},
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	return nil
+}
+
+// writeRangeTar writes the bytes [off, off+n) of the file name read from f
+// as the payload of a KindFileRange frame.
+func writeRangeTar(w io.Writer, name string, f io.ReaderAt, off, n int64) error {
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       n,
+		Mode:       0o600,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxRangeOffset: strconv.FormatInt(off, 10)},
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	if _, err := io.Copy(tw, io.NewSectionReader(f, off, n)); err != nil {
+		return fmt.Errorf("copy %s: %w", name, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	return nil
+}
+
+// stripedFile is what the receiver needs from a KindStripedFile payload.
+type stripedFile struct {
+	hdr             *tar.Header
+	size            int64
+	ranges, streams int
+}
+
+// readStripedTar parses the payload of a KindStripedFile frame.
+func readStripedTar(r io.Reader) (*stripedFile, error) {
+	hdr, err := tar.NewReader(r).Next()
+	if err != nil {
+		return nil, fmt.Errorf("tar next: %w", err)
+	}
+	sf := &stripedFile{hdr: hdr}
+	size, err1 := strconv.ParseInt(hdr.PAXRecords[paxStripeSize], 10, 64)
+	ranges, err2 := strconv.Atoi(hdr.PAXRecords[paxStripeRanges])
+	streams, err3 := strconv.Atoi(hdr.PAXRecords[paxStripeStreams])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 || ranges < 1 || streams < 1 || streams > ranges {
+		return nil, fmt.Errorf("striped file %s has no valid size, ranges and streams", hdr.Name)
+	}
+	sf.size, sf.ranges, sf.streams = size, ranges, streams
+	return sf, nil
+}
+
+// readStripedSpool parses the spooled payload of a KindStripedFile frame.
+func readStripedSpool(path string, codec Codec) (*stripedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	defer f.Close()
+	dr, err := decompressor(f, codec)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return readStripedTar(dr)
+}
+
+// maxStripeBacklog bounds the stripe sessions that wait for receiveStripes;
+// more are dropped and their senders reconnect.
+const maxStripeBacklog = 64
+
+// stripeEnd reports how one stripe connection ended.
+type stripeEnd struct {
+	id   string
+	done bool
+	err  error
+}
+
+// offerStripe hands the stripe session o to receiveStripes, which may not
+// have started yet: the stripes dial as soon as the striped frame is sent.
+func (rs *receiverState) offerStripe(o *opened) {
+	select {
+	case rs.stripes <- o:
+	default:
+		log.Printf("refusing transfer connection from %s: too many stripe sessions waiting", o.conn.RemoteAddr())
+		o.conn.Close()
+	}
+}
+
+// cancelStripes ends the striped frame being received, if any, whose
+// connection was taken over: the sender resends it on the new one.
+func (rs *receiverState) cancelStripes() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.dropStripes != nil {
+		close(rs.dropStripes)
+		rs.dropStripes = nil
+	}
+}
+
+// receiveStripes serves the stripe connections of the striped frame h of
+// transfer id, whose payload part holds, until each stripe has ended with
+// DONE and every range arrived. Stripe sessions of other frames are
+// refused; their senders retry. A stripe that reconnects takes over from
+// its earlier connection.
+func (rs *receiverState) receiveStripes(id string, h FrameHeader, part *partialFrame, handle FrameHandler) error {
+	sf, err := readStripedSpool(part.data, h.Codec)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	for i := 1; i <= sf.ranges; i++ {
+		delete(rs.received, itemKey{KindFileRange, i, h.Name})
+	}
+	rs.mu.Unlock()
+
+	// Ranges are written by the handler, which expects one frame at a
+	// time; their network reads and spooling still run side by side.
+	var hmu sync.Mutex
+	serial := func(h FrameHeader, payload io.Reader) error {
+		hmu.Lock()
+		defer hmu.Unlock()
+		return handle(h, payload)
+	}
+	rs.stripe = fmt.Sprintf("%s.%d.", id, h.Seq)
+	drop := make(chan struct{})
+	rs.mu.Lock()
+	rs.dropStripes = drop
+	rs.mu.Unlock()
+	defer func() {
+		rs.mu.Lock()
+		rs.dropStripes = nil
+		rs.mu.Unlock()
+		rs.stripe = ""
+	}()
+
+	ended := make(chan stripeEnd)
+	running := make(map[string]net.Conn) // by stripe transfer ID
+	var waiting []*opened
+	defer func() {
+		for _, c := range running {
+			c.Close()
+		}
+		for range running {
+			<-ended
+		}
+		for _, o := range waiting {
+			o.conn.Close()
+		}
+	}()
+	done := 0
+	for done < sf.streams {
+		// A stripe waits while its earlier connection winds down.
+		for i := 0; i < len(waiting) && done+len(running) < sf.streams; {
+			o := waiting[i]
+			if _, busy := running[o.h.Name]; busy {
+				i++
+				continue
+			}
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			running[o.h.Name] = o.conn
+			rs.track(o.conn)
+			go func(o *opened) {
+				_, done, err := rs.receiveConn(o, serial)
+				rs.untrack(o.conn)
+				o.conn.Close()
+				ended <- stripeEnd{o.h.Name, done, err}
+			}(o)
+		}
+		select {
+		case o := <-rs.stripes:
+			if !strings.HasPrefix(o.h.Name, rs.stripe) {
+				log.Printf("refusing transfer connection from %s: session %s is not a stripe of %s", o.conn.RemoteAddr(), o.h.Name, h.Name)
+				o.conn.Close()
+				continue
+			}
+			if old, ok := running[o.h.Name]; ok {
+				log.Printf("transfer %s: connection from %s takes over from %s", o.h.Name, o.conn.RemoteAddr(), old.RemoteAddr())
+				old.Close()
+			}
+			waiting = append(waiting, o)
+		case e := <-ended:
+			delete(running, e.id)
+			var aerr authError
+			switch {
+			case errors.As(e.err, &aerr):
+				log.Printf("refusing transfer stripe %s: %v", e.id, e.err)
+			case e.err != nil:
+				return e.err
+			case e.done:
+				done++
+			}
+		case <-rs.quit:
+			return fmt.Errorf("striped file %s: the transfer ended before its stripes did", h.Name)
+		case <-drop:
+			return fmt.Errorf("striped file %s: its connection was taken over", h.Name)
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for i := 1; i <= sf.ranges; i++ {
+		if _, ok := rs.received[itemKey{KindFileRange, i, h.Name}]; !ok {
+			return fmt.Errorf("range %d of %d of striped file %s never arrived", i, sf.ranges, h.Name)
+		}
+	}
+	return nil
+}
+
+// extractRange writes the range in the tar stream compressed with codec
+// from r into the staged file of its file in destDir, in place.
+func extractRange(r io.Reader, codec Codec, destDir string) error {
+	dr, err := decompressor(r, codec)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("tar next: %w", err)
+	}
+	target, err := safeJoin(destDir, hdr.Name)
+	if err != nil {
+		return err
+	}
+	off, err := strconv.ParseInt(hdr.PAXRecords[paxRangeOffset], 10, 64)
+	if err != nil || off < 0 {
+		return fmt.Errorf("range of %s has no valid offset", hdr.Name)
+	}
+	staged := stagedFile(target)
+	f, err := os.OpenFile(staged, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", staged, err)
+	}
+	defer f.Close()
+	buf := make([]byte, wire.ChunkSize)
+	for {
+		n, err := tr.Read(buf)
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], off); werr != nil {
+				return fmt.Errorf("write %s: %w", staged, werr)
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read range of %s: %w", hdr.Name, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", staged, err)
+	}
+	return nil
+}
+
+// extractStriped completes a striped file in destDir once all its ranges
+// were written: it drops any bytes past the file's size, restores its
+// metadata and publishes it.
+func extractStriped(r io.Reader, codec Codec, destDir string) error {
+	dr, err := decompressor(r, codec)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	sf, err := readStripedTar(dr)
+	if err != nil {
+		return err
+	}
+	target, err := safeJoin(destDir, sf.hdr.Name)
+	if err != nil {
+		return err
+	}
+	staged := stagedFile(target)
+	if err := os.Truncate(staged, sf.size); err != nil {
+		return fmt.Errorf("truncate %s: %w", staged, err)
+	}
+	if err := applyMetadata(staged, sf.hdr); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("publish %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendStripedFile sends data as the checkpoint file name over a session to
+// addr striping it over streams connections in 1 MiB ranges, and returns
+// what the receiver got.
+func sendStripedFile(t *testing.T, addr string, resCh <-chan receiveResult, name string, data []byte, streams int) receiveResult {
+	t.Helper()
+	t.Setenv("STRIPE_MIN_MB", "1")
+	t.Setenv("STRIPE_RANGE_MB", "1")
+	src := t.TempDir()
+	small := filepath.Join(src, "dmtcp_restart_script.sh")
+	os.WriteFile(small, []byte("#!/bin/sh\n"), 0o755)
+	path := filepath.Join(src, name)
+	os.WriteFile(path, data, 0o640)
+
+	s, err := DialSessionWith(addr, DialOptions{Streams: streams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetCodec(CodecNone)
+	for _, p := range []string{small, path} {
+		if err := s.SendCheckpointFile(p); err != nil {
+			t.Fatalf("SendCheckpointFile(%s): %v", filepath.Base(p), err)
+		}
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	return <-resCh
+}
+
+func TestSession_StripesLargeFile(t *testing.T) {
+	dst := t.TempDir()
+	data := randomData(5<<20 + 123)
+	// A stale, longer image of the same name is overwritten in place.
+	os.WriteFile(filepath.Join(dst, "ckpt_big.dmtcp"), randomData(7<<20), 0o600)
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+
+	res := sendStripedFile(t, addr, resCh, "ckpt_big.dmtcp", data, 3)
+	if res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	var kinds []FrameKind
+	for _, h := range res.frames {
+		kinds = append(kinds, h.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != KindCheckpointFile || kinds[1] != KindStripedFile {
+		t.Errorf("received frame kinds %v, want a checkpoint file and a striped file", kinds)
+	}
+	target := filepath.Join(dst, "ckpt_big.dmtcp")
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, data) {
+		t.Fatalf("striped file differs (%d bytes, want %d)", len(got), len(data))
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("striped file mode = %v, %v; want 0640", info.Mode(), err)
+	}
+}
+
+func TestSession_StripeResumes(t *testing.T) {
+	dst := t.TempDir()
+	data := randomData(4 << 20)
+	addr, resCh := startReceiverWith(t, ReceiveOptions{
+		Timeout:  10 * time.Second,
+		SpoolDir: func(FrameHeader) string { return dst },
+	}, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, dst)
+	})
+	// The first stripe drops right after its HELLO.
+	proxy := (&flakyProxy{target: addr, limit: 100, cutConn: 1}).start(t)
+
+	if res := sendStripedFile(t, proxy.ln.Addr().String(), resCh, "ckpt_big.dmtcp", data, 2); res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_big.dmtcp")); !bytes.Equal(got, data) {
+		t.Fatal("striped file differs after a stripe reconnected")
+	}
+	if conns, _ := proxy.stats(); conns < 4 {
+		t.Errorf("%d connection(s), want the cut stripe to reconnect", conns)
+	}
+	if spools, _ := filepath.Glob(filepath.Join(dst, ".resume-*")); len(spools) != 0 {
+		t.Errorf("spools left behind: %v", spools)
+	}
+}
+
+func TestReceive_RefusesStrayStripe(t *testing.T) {
+	addr, resCh := startReceiver(t, func(FrameHeader, io.Reader) error { return nil })
+	if _, err := dialSession(addr, stripeID("0123456789abcdef", 3, 1), DialOptions{}); err == nil {
+		t.Fatal("a stripe session was accepted while no striped file was being received")
+	}
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done after a refused stripe: %v", err)
+	}
+	if res := <-resCh; res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+}
+
+func TestExtractRange_StagesUntilStriped(t *testing.T) {
+	dst := t.TempDir()
+	data := textData(3000)
+	for _, off := range []int64{2000, 0, 1000} {
+		var buf bytes.Buffer
+		if err := writeRangeTar(&buf, "ckpt_a.dmtcp", bytes.NewReader(data), off, 1000); err != nil {
+			t.Fatal(err)
+		}
+		if err := ExtractPayload(FrameHeader{Kind: KindFileRange, Codec: CodecNone}, &buf, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := filepath.Join(dst, "ckpt_a.dmtcp")
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("file published before its striped frame: %v", err)
+	}
+	src := filepath.Join(t.TempDir(), "ckpt_a.dmtcp")
+	os.WriteFile(src, data, 0o640)
+	info, _ := os.Stat(src)
+	var buf bytes.Buffer
+	if err := writeStripedTar(&buf, "ckpt_a.dmtcp", info, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractPayload(FrameHeader{Kind: KindStripedFile, Codec: CodecNone}, &buf, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, data) {
+		t.Fatalf("ranges written out of order differ: %q", strings.TrimSpace(string(got[:40])))
+	}
+	if left, _ := filepath.Glob(filepath.Join(dst, ".staging-*")); len(left) != 0 {
+		t.Errorf("staging left behind: %v", left)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -59,6 +60,21 @@ func EnvInt(name string, def int) int {
 	return v
 }
 
+// EnvSize reads a size environment variable counted in units of unit bytes
+// (1<<20 for a _MB setting) and returns it in bytes: def units when unset,
+// invalid, not positive or too large for an int64.
+func EnvSize(name string, def, unit int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def * unit
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v <= 0 || v > math.MaxInt64/unit {
+		return def * unit
+	}
+	return v * unit
+}
+
 // EnvOr returns the value of the environment variable name, or def when unset.
 func EnvOr(name, def string) string {
 	if v := os.Getenv(name); v != "" {
@@ -86,12 +102,71 @@ type RemoveRequest struct {
 	PodName string `json:"podName"`
 }
 
+// TransferGrant is what the MC hands the source for streaming to the
+// destination, in the /remove and /poll responses (all additive):
+// Compression names the payload codec from the workload spec, TLS carries
+// the source's transfer certificate and TransferToken the key its frames
+// are signed with; /poll and /remove set both only for a caller presenting
+// the agent key of the source's registration (GetJSONAuth, PostJSONAuth).
+// TransferStreams is how many connections a large checkpoint file is
+// striped over (/remove only) and MaxTransferBytesPerSecond caps the
+// transfer's bandwidth (0: no cap).
+type TransferGrant struct {
+	Compression               string     `json:"compression,omitempty"`
+	TLS                       *TLSBundle `json:"tls,omitempty"`
+	TransferToken             string     `json:"transferToken,omitempty"`
+	TransferStreams           int        `json:"transferStreams,omitempty"`
+	MaxTransferBytesPerSecond int64      `json:"maxTransferBytesPerSecond,omitempty"`
+}
+
 // RemoveResponse is the response from POST /remove. DestAddress is an
 // additive field: when set it carries the host:port of the migration-target
 // Execution Agent so the source can stream checkpoints directly.
+// RelayAddress (additive) is the MC's transfer relay, set instead while the
+// target has not registered; the relay replays the stream to it later.
+// MigrationID (additive) names the checkpoint set a source uploads to the
+// checkpoint store (see upload.go).
 type RemoveResponse struct {
 	NeedsCheckpoint bool   `json:"needsCheckpoint"`
 	DestAddress     string `json:"destAddress,omitempty"`
+	RelayAddress    string `json:"relayAddress,omitempty"`
+	MigrationID     string `json:"migrationID,omitempty"`
+	TransferGrant
+}
+
+// PollResponse is the response from GET /poll?podName=NAME. The sync daemon
+// uses it to discover an armed migration and how many pre-downtime volume
+// rounds the MC still expects. DestAddress is set once the migration target
+// has registered. AbortedMigration (additive) names the last migration of
+// the pod the MC gave up on, AbortReason why; a destination still waiting
+// for that migration's transfer aborts it. TargetDowntimeMs and
+// MinSyncRounds (additive) make the rounds adaptive, SyncRounds then being
+// their maximum; SyncStopReason is set once the source reported stopping
+// (see presync.go).
+type PollResponse struct {
+	PodName          string `json:"podName"`
+	Migrating        bool   `json:"migrating"`
+	ProcessMigration bool   `json:"processMigration"`
+	VolumeMigration  bool   `json:"volumeMigration"`
+	CheckpointDir    string `json:"checkpointDir,omitempty"`
+	SyncRounds       int    `json:"syncRounds"`
+	SyncRound        int    `json:"syncRound"`
+	MinSyncRounds    int    `json:"minSyncRounds,omitempty"`
+	TargetDowntimeMs int64  `json:"targetDowntimeMs,omitempty"`
+	SyncStopReason   string `json:"syncStopReason,omitempty"`
+	DestAddress      string `json:"destAddress,omitempty"`
+	AbortedMigration string `json:"abortedMigration,omitempty"`
+	AbortReason      string `json:"abortReason,omitempty"`
+	TransferGrant
+}
+
+// SyncNotification is the payload sent to POST /sync after each completed
+// pre-downtime volume round. Stats and StopReason are additive.
+type SyncNotification struct {
+	PodName    string          `json:"podName"`
+	Round      int             `json:"round"`
+	Stats      *SyncRoundStats `json:"stats,omitempty"`
+	StopReason string          `json:"stopReason,omitempty"`
 }
 
 // CopyNotification is the payload sent to POST /copy. LayerCount is additive.
@@ -101,14 +176,56 @@ type CopyNotification struct {
 	LayerCount    int    `json:"layerCount,omitempty"`
 }
 
+// ProgressNotification is the payload sent to POST /progress while the
+// preStop hook transfers (see progress.go).
+type ProgressNotification struct {
+	PodName string `json:"podName"`
+	ProgressSnapshot
+}
+
+// RestoredNotification is the payload sent to POST /restored once the
+// restore supervisor has seen the restored computation rejoin the DMTCP
+// coordinator. The timing fields are additive.
+type RestoredNotification struct {
+	PodName    string `json:"podName"`
+	TransferMs int64  `json:"transferMs,omitempty"`
+	RestoreMs  int64  `json:"restoreMs,omitempty"`
+	Peers      int    `json:"peers,omitempty"`
+}
+
+// AbortNotification is the payload sent to POST /aborted once a
+// destination gave up on its migration's transfer and applied its abort
+// policy (see abort.go). Outcome says what it did.
+type AbortNotification struct {
+	PodName     string `json:"podName"`
+	MigrationID string `json:"migrationID,omitempty"`
+	Reason      string `json:"reason"`
+	Policy      string `json:"policy"`
+	Outcome     string `json:"outcome"`
+}
+
 // PostJSON marshals payload to JSON, POSTs it to url, and returns the
 // response body.
 func PostJSON(url string, payload interface{}) ([]byte, error) {
+	return PostJSONAuth(url, payload, "")
+}
+
+// PostJSONAuth is PostJSON presenting key, the agent key of this pod's
+// registration, as a bearer token; an empty key presents none.
+func PostJSONAuth(url string, payload interface{}, key string) ([]byte, error) {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("marshal: %w", err)
 	}
-	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(data))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("http post %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http post %s: %w", url, err)
 	}
@@ -118,3 +235,29 @@ func PostJSON(url string, payload interface{}) ([]byte, error) {
 	}
 	return io.ReadAll(resp.Body)
 }
+
+// GetJSON GETs url and returns the response body.
+func GetJSON(url string) ([]byte, error) {
+	return GetJSONAuth(url, "")
+}
+
+// GetJSONAuth is GetJSON presenting key, the agent key of this pod's
+// registration, as a bearer token; an empty key presents none.
+func GetJSONAuth(url, key string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http get %s: %w", url, err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http get %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned HTTP %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
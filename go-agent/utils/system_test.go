@@ -117,6 +117,19 @@ func TestEnvInt(t *testing.T) {
 	}
 }
 
+func TestEnvSize_NoPortCap(t *testing.T) {
+	t.Setenv("MYCEDRIVE_TEST_MB", "70000")
+	if got := EnvSize("MYCEDRIVE_TEST_MB", 16, 1<<20); got != 70000<<20 {
+		t.Errorf("EnvSize = %d, want %d", got, int64(70000)<<20)
+	}
+	for _, raw := range []string{"0", "-1", "lots", "9223372036854775807"} {
+		t.Setenv("MYCEDRIVE_TEST_MB", raw)
+		if got := EnvSize("MYCEDRIVE_TEST_MB", 16, 1<<20); got != 16<<20 {
+			t.Errorf("EnvSize(%q) = %d, want the default %d", raw, got, 16<<20)
+		}
+	}
+}
+
 func TestTransferPort_RespectsContainerPort(t *testing.T) {
 	t.Setenv("CONTAINER_PORT", "3001")
 	if got := TransferPort(); got != 3001 {
@@ -0,0 +1,124 @@
+package utils
+
+// Transfer authentication.
+//
+// When the MC runs its transfer CA, the /register (destination), /remove and
+// /poll (source) responses carry a TLSBundle: the CA certificate plus a
+// short-lived certificate and key for this agent's side of the migration.
+// /poll only hands one to a caller presenting the agent key of the source's
+// registration (see GetJSONAuth), so neither the destination nor anyone
+// else on the pod network can pose as the source.
+// Its URI SAN names the migration and the role,
+//
+//	spiffe://mycedrive.io/migration/<migration id>/<source|destination>
+//
+// and each end accepts the other only if the peer certificate chains to the
+// CA, names the same migration and the opposite role. The destination's
+// address is a pod IP, so the source checks this identity instead of a host
+// name; it sends the migration id as SNI instead, which the MC's transfer
+// relay uses to answer for the right migration. Without a bundle the
+// transfer stays plaintext, unless TRANSFER_REQUIRE_TLS refuses that.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// handshakeTimeout bounds the TLS handshake of an accepted connection.
+const handshakeTimeout = 30 * time.Second
+
+// TLSBundle is the per-migration certificate material from the MC, in PEM.
+type TLSBundle struct {
+	CACert string `json:"caCert"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// ClientTLS returns the configuration for dialing the destination with b,
+// or nil for a plaintext transfer when the MC sent no bundle.
+func ClientTLS(b *TLSBundle) (*tls.Config, error) {
+	return transferTLS(b, wire.RoleSource)
+}
+
+// ServerTLS returns the configuration for accepting the source's transfer
+// with b, or nil for a plaintext transfer when the MC sent no bundle.
+func ServerTLS(b *TLSBundle) (*tls.Config, error) {
+	return transferTLS(b, wire.RoleDestination)
+}
+
+func transferTLS(b *TLSBundle, role string) (*tls.Config, error) {
+	if b == nil {
+		if EnvBool("TRANSFER_REQUIRE_TLS", false) {
+			return nil, errors.New("the MC sent no transfer certificate and TRANSFER_REQUIRE_TLS is set")
+		}
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(b.Cert), []byte(b.Key))
+	if err != nil {
+		return nil, fmt.Errorf("load transfer certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse transfer certificate: %w", err)
+	}
+	migration, ownRole, err := wire.CertIdentity(leaf)
+	if err != nil {
+		return nil, fmt.Errorf("transfer certificate: %w", err)
+	}
+	if ownRole != role {
+		return nil, fmt.Errorf("transfer certificate is for the %s, this agent is the %s", ownRole, role)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(b.CACert)) {
+		return nil, errors.New("transfer CA certificate: no PEM certificate")
+	}
+
+	peerRole, usage := wire.RoleDestination, x509.ExtKeyUsageServerAuth
+	if role == wire.RoleDestination {
+		peerRole, usage = wire.RoleSource, x509.ExtKeyUsageClientAuth
+	}
+	verify := func(cs tls.ConnectionState) error {
+		if err := wire.VerifyPeer(cs.PeerCertificates, roots, usage, migration, peerRole); err != nil {
+			return peerError{err}
+		}
+		return nil
+	}
+	cfg := &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		MinVersion:       tls.VersionTLS13,
+		VerifyConnection: verify,
+	}
+	if role == wire.RoleDestination {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	} else {
+		// The chain and identity are checked by wire.VerifyPeer; there is no
+		// host name to check a pod IP against.
+		cfg.InsecureSkipVerify = true
+		cfg.ServerName = migration
+	}
+	return cfg, nil
+}
+
+// peerError is a peer certificate that failed wire.VerifyPeer.
+type peerError struct{ err error }
+
+func (e peerError) Error() string { return e.err.Error() }
+func (e peerError) Unwrap() error { return e.err }
+
+// tlsRejected reports whether err is the TLS layer refusing the peer (a bad
+// certificate on either side) rather than the network failing; retrying
+// such a connection cannot succeed.
+func tlsRejected(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "remote error" {
+		return true // the peer sent an alert
+	}
+	var perr peerError
+	return errors.As(err, &perr)
+}
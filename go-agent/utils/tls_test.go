@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// testCA issues transfer certificates the way the operator's CA does.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test transfer CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// bundle issues a certificate for role in migration, valid until notAfter.
+func (c *testCA) bundle(t *testing.T, migration, role string, notAfter time.Time) *TLSBundle {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := x509.ExtKeyUsageClientAuth
+	if role == wire.RoleDestination {
+		usage = x509.ExtKeyUsageServerAuth
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "web-0"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		URIs:         []*url.URL{wire.Identity(migration, role)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, key.Public(), c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TLSBundle{
+		CACert: c.pem,
+		Cert:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func clientTLS(t *testing.T, b *TLSBundle) *tls.Config {
+	t.Helper()
+	cfg, err := ClientTLS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func serverTLS(t *testing.T, b *TLSBundle) *tls.Config {
+	t.Helper()
+	cfg, err := ServerTLS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startTLSReceiver is startReceiver behind ServerTLS(bundle).
+func startTLSReceiver(t *testing.T, bundle *TLSBundle, dst string) (string, <-chan receiveResult) {
+	t.Helper()
+	opts := ReceiveOptions{Timeout: 10 * time.Second, TLS: serverTLS(t, bundle)}
+	return startReceiverWith(t, opts, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, filepath.Join(dst, h.Name))
+	})
+}
+
+// sendOverTLS sends one layer over a TLS session and finishes it.
+func sendOverTLS(t *testing.T, addr string, bundle *TLSBundle, src string) {
+	t.Helper()
+	sess, err := DialSessionWith(addr, DialOptions{TLS: clientTLS(t, bundle)})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := sess.SendDir(1, "u1", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Done(); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+}
+
+func TestTLSSession_MutualAuth(t *testing.T) {
+	ca := newTestCA(t)
+	valid := time.Now().Add(time.Hour)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "state.db"), []byte("secret memory"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	addr, resCh := startTLSReceiver(t, ca.bundle(t, "m1", wire.RoleDestination, valid), dst)
+
+	sendOverTLS(t, addr, ca.bundle(t, "m1", wire.RoleSource, valid), src)
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("receive = %d frame(s), %v", len(res.frames), res.err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "u1", "state.db"))
+	if err != nil || string(got) != "secret memory" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+}
+
+// TestTLSSession_RefusesStrangers checks that a source which cannot prove it
+// belongs to the migration fails fast with a clear error, while the
+// destination keeps waiting for the real source.
+func TestTLSSession_RefusesStrangers(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	valid := time.Now().Add(time.Hour)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	addr, resCh := startTLSReceiver(t, ca.bundle(t, "m1", wire.RoleDestination, valid), dst)
+
+	cases := []struct {
+		name   string
+		bundle *TLSBundle
+		want   string
+	}{
+		// These two already refuse the destination themselves.
+		{"other migration", ca.bundle(t, "m2", wire.RoleSource, valid), "is for migration m1, not m2"},
+		{"other CA", other.bundle(t, "m1", wire.RoleSource, valid), "certificate signed by unknown authority"},
+		{"expired", ca.bundle(t, "m1", wire.RoleSource, time.Now().Add(-time.Minute)), "rejected this agent's transfer certificate"},
+	}
+	for _, tc := range cases {
+		start := time.Now()
+		_, err := DialSessionWith(addr, DialOptions{TLS: clientTLS(t, tc.bundle)})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: dial error = %v, want %q", tc.name, err, tc.want)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s: a rejected certificate must not be retried", tc.name)
+		}
+	}
+	// A plaintext sender gets nowhere either.
+	if _, err := DialSession(addr); err == nil {
+		t.Error("plaintext session to a TLS destination must fail")
+	}
+
+	sendOverTLS(t, addr, ca.bundle(t, "m1", wire.RoleSource, valid), src)
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("receive after refused connections = %d frame(s), %v", len(res.frames), res.err)
+	}
+}
+
+// TestTLSSession_SourceVerifiesDestination checks the source refuses to
+// hand its data to a listener that is not the migration's destination.
+func TestTLSSession_SourceVerifiesDestination(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	valid := time.Now().Add(time.Hour)
+	cases := []struct {
+		name string
+		dest *TLSBundle
+		want string
+	}{
+		{"other CA", other.bundle(t, "m1", wire.RoleDestination, valid), "certificate signed by unknown authority"},
+		{"other migration", ca.bundle(t, "m2", wire.RoleDestination, valid), "is for migration m2, not m1"},
+		{"expired", ca.bundle(t, "m1", wire.RoleDestination, time.Now().Add(-time.Minute)), "expired"},
+	}
+	for _, tc := range cases {
+		addr, _ := startTLSReceiver(t, tc.dest, t.TempDir())
+		_, err := DialSessionWith(addr, DialOptions{TLS: clientTLS(t, ca.bundle(t, "m1", wire.RoleSource, valid))})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: dial error = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestTransferTLS_Config(t *testing.T) {
+	ca := newTestCA(t)
+	dest := ca.bundle(t, "m1", wire.RoleDestination, time.Now().Add(time.Hour))
+	if _, err := ClientTLS(dest); err == nil || !strings.Contains(err.Error(), "this agent is the source") {
+		t.Errorf("ClientTLS with the destination's certificate = %v", err)
+	}
+	if _, err := ServerTLS(&TLSBundle{CACert: dest.CACert, Cert: dest.Cert, Key: "junk"}); err == nil {
+		t.Error("ServerTLS must reject an unusable key")
+	}
+
+	t.Setenv("TRANSFER_REQUIRE_TLS", "")
+	if cfg, err := ClientTLS(nil); cfg != nil || err != nil {
+		t.Errorf("no bundle must mean plaintext, got %v, %v", cfg, err)
+	}
+	t.Setenv("TRANSFER_REQUIRE_TLS", "true")
+	if _, err := ServerTLS(nil); err == nil {
+		t.Error("TRANSFER_REQUIRE_TLS must refuse a plaintext transfer")
+	}
+}
+
+// TestVerifyPeer covers the destination's checks of a source certificate,
+// which a well-behaved source never lets it see fail.
+func TestVerifyPeer(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(ca.pem))
+	leaf := func(b *TLSBundle) []*x509.Certificate {
+		block, _ := pem.Decode([]byte(b.Cert))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*x509.Certificate{cert}
+	}
+	valid := time.Now().Add(time.Hour)
+	cases := []struct {
+		name  string
+		certs []*x509.Certificate
+		want  string
+	}{
+		{"good", leaf(ca.bundle(t, "m1", wire.RoleSource, valid)), ""},
+		{"none", nil, "the source presented no certificate"},
+		{"other migration", leaf(ca.bundle(t, "m2", wire.RoleSource, valid)), "is for migration m2, not m1"},
+		{"destination certificate", leaf(ca.bundle(t, "m1", wire.RoleDestination, valid)), "incompatible key usage"},
+	}
+	for _, tc := range cases {
+		err := wire.VerifyPeer(tc.certs, roots, x509.ExtKeyUsageClientAuth, "m1", wire.RoleSource)
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: wire.VerifyPeer = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -2,8 +2,9 @@ package utils
 
 // Transfer protocol between source and destination Execution Agents.
 //
-// Each item (an overlay layer directory, a DMTCP checkpoint file, or the
-// final DONE marker) is sent over its own TCP connection as a single frame:
+// Version 1 sends each item (an overlay layer directory, a DMTCP checkpoint
+// file, or the final DONE marker) over its own TCP connection as a single
+// frame:
 //
 //	[48-byte header][gzip-compressed tar payload]
 //
@@ -18,38 +19,97 @@ package utils
 // (0x06) back on the same connection. The sender blocks until the ACK is
 // read, which gives the source-side preStop hook its "block until the
 // destination has the data" semantics.
+//
+// Version 2 (Session) carries many frames over one long-lived connection so
+// a high-latency link pays for one handshake instead of one per item, and
+// the sender does not wait a round trip between frames. The header gains a
+// 16-byte extension and the payload is split into chunks that carry their
+// offset, so the receiver can find the next frame boundary and a dropped
+// transfer can continue where it stopped:
+//
+//	[64-byte header][chunk]...[chunk][terminator][digest]
+//	chunk      = [4-byte length][8-byte payload offset][length bytes]
+//	terminator = [4-byte zero][8-byte total payload length]
+//	digest     = [32-byte SHA-256 of the whole payload]
+//
+//	[48:52) seq     per-session frame sequence number, starting at 1
+//	[52:56) codec   payload compression (see codec.go)
+//	[56:60) flags   bit 0: signed with the transfer token (see auth.go)
+//	                bit 1: payload is a chunk recipe (see chunks.go)
+//	[60:64) reserved, zero
+//
+// A session opens with a HELLO frame (seq 0, no chunks, no digest) whose
+// name is a transfer ID the sender keeps across reconnects. The DONE frame's
+// payload is the JSON manifest of the transfer (see manifest.go), an ABORT
+// frame's the reason the sender gave up (see abort.go). For every frame the
+// receiver answers with a reply record on the same connection:
+//
+//	[1-byte code][4-byte seq][4-byte length][length bytes of message]
+//
+// where code is 0x06 (ACK), 0x15 (NAK: the payload did not match its
+// digest; the receiver drops the connection and the sender resends the
+// frame after reconnecting) or 0x18 (the receiver's error, which ends the
+// transfer). The HELLO ACK carries the resume point:
+// [4-byte last completed seq][8-byte payload bytes held of the next frame].
+// Replies arrive in frame order; up to sessionWindow frames may be
+// unacknowledged. ReceiveAll tells the versions apart per connection, so
+// older agents that dial once per frame keep working; their frames carry no
+// digest and a version-1 DONE no manifest.
+//
+// When the MC hands out transfer certificates, session connections run over
+// mutual TLS and the receiver accepts nothing else (see tls.go). With a
+// transfer token it accepts only signed sessions (see auth.go).
+//
+// The encoding itself lives in package wire, which the MC's transfer relay
+// shares.
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"encoding/binary"
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
 )
 
+// DefaultTransferPort is used when CONTAINER_PORT is not set.
+const DefaultTransferPort = 2486
+
+// defaultIdleTimeout is the default ReceiveOptions.IdleTimeout.
+const defaultIdleTimeout = 60 * time.Second
+
 const (
-	frameMagic      = 0xDEADBEEF
-	frameVersion    = 1
-	frameHeaderSize = 48
-	frameNameSize   = 32
-	ackByte         = 0x06
-
-	// DefaultTransferPort is used when CONTAINER_PORT is not set.
-	DefaultTransferPort = 2486
+	// defaultHelloTimeout bounds how long an accepted connection may take
+	// to be admitted: its TLS handshake and first frame, with the HELLO's
+	// MAC.
+	defaultHelloTimeout = 10 * time.Second
+	// maxAdmitting bounds the connections being admitted at once; more are
+	// dropped as they arrive.
+	maxAdmitting = 32
 )
 
 // FrameKind identifies the payload type of a transfer frame.
 type FrameKind uint32
 
 const (
-	KindLayer          FrameKind = 0 // tar of an overlay layer directory
-	KindCheckpointFile FrameKind = 1 // tar containing a single checkpoint file
-	KindDone           FrameKind = 2 // end of transfer, no payload
+	KindLayer          FrameKind = wire.KindLayer          // tar of an overlay layer directory
+	KindCheckpointFile FrameKind = wire.KindCheckpointFile // tar containing a single checkpoint file
+	KindDone           FrameKind = wire.KindDone           // end of transfer, no payload
+	KindHello          FrameKind = wire.KindHello          // opens a version-2 session, Name is the transfer ID
+	KindChunkQuery     FrameKind = wire.KindChunkQuery     // asks which chunks of the next frame the receiver lacks (see chunks.go)
+	KindCheckpointPart FrameKind = wire.KindCheckpointPart // tar holding a part of a checkpoint file being written (see stream.go)
+	KindStripedFile    FrameKind = wire.KindStripedFile    // completes a checkpoint file sent in ranges over several connections (see stripe.go)
+	KindFileRange      FrameKind = wire.KindFileRange      // tar holding a range of a striped checkpoint file
+	KindAbort          FrameKind = wire.KindAbort          // the transfer will not complete; the payload is why (see abort.go)
 )
 
 // FrameHeader describes one transfer frame.
@@ -57,6 +117,18 @@ type FrameHeader struct {
 	Kind    FrameKind
 	Ordinal int
 	Name    string
+
+	// Seq is the frame's sequence number within a version-2 session; 0 for
+	// version-1 frames.
+	Seq uint32
+	// Codec is the compression of the tar payload; always CodecGzip for
+	// version-1 frames.
+	Codec Codec
+	// Signed is set on version-2 frames followed by a MAC (see auth.go).
+	Signed bool
+	// Chunked is set on version-2 frames whose payload is a chunk recipe,
+	// and on a HELLO offering deduplication (see chunks.go).
+	Chunked bool
 }
 
 // TransferPort returns the TCP port used for checkpoint transfer, taken from
@@ -65,56 +137,73 @@ func TransferPort() int {
 	return EnvInt("CONTAINER_PORT", DefaultTransferPort)
 }
 
-// WriteFrameHeader encodes h and writes it to w.
+// WriteFrameHeader encodes h as a version-1 header and writes it to w.
 func WriteFrameHeader(w io.Writer, h FrameHeader) error {
-	if len(h.Name) > frameNameSize {
-		return fmt.Errorf("frame name %q longer than %d bytes", h.Name, frameNameSize)
-	}
-	buf := make([]byte, frameHeaderSize)
-	binary.BigEndian.PutUint32(buf[0:4], frameMagic)
-	binary.BigEndian.PutUint32(buf[4:8], frameVersion)
-	binary.BigEndian.PutUint32(buf[8:12], uint32(h.Kind))
-	binary.BigEndian.PutUint32(buf[12:16], uint32(h.Ordinal))
-	copy(buf[16:16+frameNameSize], h.Name)
-	_, err := w.Write(buf)
+	buf, err := encodeFrameHeader(h, wire.Version)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
 	return err
 }
 
-// ReadFrameHeader reads and validates a frame header from r.
-func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
-	buf := make([]byte, frameHeaderSize)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return FrameHeader{}, fmt.Errorf("read frame header: %w", err)
-	}
-	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != frameMagic {
-		return FrameHeader{}, fmt.Errorf("bad frame magic 0x%08X", magic)
+// encodeFrameHeader returns the wire form of h for the given protocol
+// version (with the session extension for version 2).
+func encodeFrameHeader(h FrameHeader, version uint32) ([]byte, error) {
+	wh := wire.Header{Kind: uint32(h.Kind), Ordinal: uint32(h.Ordinal), Name: h.Name}
+	if version == wire.SessionVersion {
+		wh.Seq, wh.Codec = h.Seq, uint32(h.Codec)
+		if h.Signed {
+			wh.Flags |= wire.FlagSigned
+		}
+		if h.Chunked {
+			wh.Flags |= wire.FlagChunked
+		}
+	} else if h.Codec != CodecGzip {
+		return nil, fmt.Errorf("version %d frames are gzip only, not %s", version, h.Codec)
+	} else if h.Signed || h.Chunked {
+		return nil, fmt.Errorf("version %d frames cannot be signed or chunked", version)
 	}
-	if v := binary.BigEndian.Uint32(buf[4:8]); v != frameVersion {
-		return FrameHeader{}, fmt.Errorf("unsupported frame version %d", v)
+	return wh.Encode(version)
+}
+
+// ReadFrameHeader reads and validates a version-1 frame header from r.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	h, version, err := readFrameHeader(r)
+	if err != nil {
+		return h, err
 	}
-	h := FrameHeader{
-		Kind:    FrameKind(binary.BigEndian.Uint32(buf[8:12])),
-		Ordinal: int(binary.BigEndian.Uint32(buf[12:16])),
-		Name:    strings.TrimRight(string(buf[16:16+frameNameSize]), "\x00"),
+	if version != wire.Version {
+		return FrameHeader{}, fmt.Errorf("unsupported frame version %d", version)
 	}
 	return h, nil
 }
 
+// readFrameHeader reads a version-1 or version-2 frame header from r and
+// returns it together with its version.
+func readFrameHeader(r io.Reader) (FrameHeader, uint32, error) {
+	wh, version, err := wire.ReadHeader(r)
+	if err != nil {
+		return FrameHeader{}, 0, err
+	}
+	return FrameHeader{
+		Kind:    FrameKind(wh.Kind),
+		Ordinal: int(wh.Ordinal),
+		Name:    wh.Name,
+		Seq:     wh.Seq,
+		Codec:   Codec(wh.Codec),
+		Signed:  wh.Flags&wire.FlagSigned != 0,
+		Chunked: wh.Flags&wire.FlagChunked != 0,
+	}, version, nil
+}
+
 // SendDirFrame writes a layer frame for dir over rw and waits for the ACK.
 func SendDirFrame(rw io.ReadWriter, ordinal int, name, dir string) error {
 	if err := WriteFrameHeader(rw, FrameHeader{Kind: KindLayer, Ordinal: ordinal, Name: name}); err != nil {
 		return fmt.Errorf("write header: %w", err)
 	}
-	gw := gzip.NewWriter(rw)
-	tw := tar.NewWriter(gw)
-	if err := tarDir(dir, tw); err != nil {
-		return fmt.Errorf("tar %s: %w", dir, err)
-	}
-	if err := tw.Close(); err != nil {
-		return fmt.Errorf("close tar: %w", err)
-	}
-	if err := gw.Close(); err != nil {
-		return fmt.Errorf("close gzip: %w", err)
+	if err := writeDirPayload(rw, dir, CodecGzip, nil); err != nil {
+		return err
 	}
 	return readAck(rw)
 }
@@ -122,21 +211,75 @@ func SendDirFrame(rw io.ReadWriter, ordinal int, name, dir string) error {
 // SendFileFrame writes a checkpoint-file frame containing the single file at
 // path over rw and waits for the ACK.
 func SendFileFrame(rw io.ReadWriter, path string) error {
-	info, err := os.Stat(path)
-	if err != nil {
+	if _, err := os.Stat(path); err != nil {
 		return fmt.Errorf("stat %s: %w", path, err)
 	}
-	name := filepath.Base(path)
-	if err := WriteFrameHeader(rw, FrameHeader{Kind: KindCheckpointFile, Name: name}); err != nil {
+	if err := WriteFrameHeader(rw, FrameHeader{Kind: KindCheckpointFile, Name: filepath.Base(path)}); err != nil {
 		return fmt.Errorf("write header: %w", err)
 	}
-	gw := gzip.NewWriter(rw)
-	tw := tar.NewWriter(gw)
-	hdr, err := tar.FileInfoHeader(info, "")
+	if err := writeFilePayload(rw, path, CodecGzip); err != nil {
+		return err
+	}
+	return readAck(rw)
+}
+
+// writeDirPayload writes dir as a tar stream compressed with codec to w.
+// Large files with an earlier version at base are delta encoded (see
+// delta.go); base may be nil.
+func writeDirPayload(w io.Writer, dir string, codec Codec, base DeltaBase) error {
+	return compressPayload(w, codec, func(w io.Writer) error {
+		return writeDirTar(w, dir, base)
+	})
+}
+
+// writeFilePayload writes a tar stream holding only the file at path, under
+// its base name, compressed with codec to w.
+func writeFilePayload(w io.Writer, path string, codec Codec) error {
+	return compressPayload(w, codec, func(w io.Writer) error {
+		return writeFileTar(w, path)
+	})
+}
+
+// compressPayload writes what writeTar produces, compressed with codec, to
+// w.
+func compressPayload(w io.Writer, codec Codec, writeTar func(w io.Writer) error) error {
+	cw, err := compressor(w, codec)
+	if err != nil {
+		return err
+	}
+	if err := writeTar(cw); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", codec, err)
+	}
+	return nil
+}
+
+// writeDirTar writes dir as an uncompressed tar stream to w.
+func writeDirTar(w io.Writer, dir string, base DeltaBase) error {
+	tw := tar.NewWriter(w)
+	if err := tarDir(dir, tw, base); err != nil {
+		return fmt.Errorf("tar %s: %w", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+	return nil
+}
+
+// writeFileTar writes an uncompressed tar stream holding only the file at
+// path, under its base name, to w.
+func writeFileTar(w io.Writer, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	tw := tar.NewWriter(w)
+	hdr, err := fileHeader(path, filepath.Base(path), info, nil)
 	if err != nil {
 		return fmt.Errorf("tar header %s: %w", path, err)
 	}
-	hdr.Name = name
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write tar header: %w", err)
 	}
@@ -152,10 +295,7 @@ func SendFileFrame(rw io.ReadWriter, path string) error {
 	if err := tw.Close(); err != nil {
 		return fmt.Errorf("close tar: %w", err)
 	}
-	if err := gw.Close(); err != nil {
-		return fmt.Errorf("close gzip: %w", err)
-	}
-	return readAck(rw)
+	return nil
 }
 
 // SendDoneFrame signals the end of the transfer and waits for the ACK.
@@ -167,26 +307,33 @@ func SendDoneFrame(rw io.ReadWriter) error {
 }
 
 // FrameHandler consumes the payload of one frame. The payload reader yields
-// the gzip-compressed tar stream that followed the header; the handler must
-// consume it fully (e.g. via ExtractTarGz) before returning.
+// the tar stream that followed the header, compressed with h.Codec; the
+// handler must consume it fully (e.g. via ExtractPayload) before returning.
 type FrameHandler func(h FrameHeader, payload io.Reader) error
 
-// ReceiveFrame reads one frame from rw, passes its payload to handle (not
-// called for KindDone), then writes the ACK byte. It returns the header.
+// ReceiveFrame reads one version-1 frame from rw, passes its payload to
+// handle (not called for KindDone), then writes the ACK byte. It returns the
+// header.
 func ReceiveFrame(rw io.ReadWriter, handle FrameHandler) (FrameHeader, error) {
 	h, err := ReadFrameHeader(rw)
 	if err != nil {
 		return h, err
 	}
+	return h, receiveFramePayload(rw, rw, h, handle)
+}
+
+// receiveFramePayload completes a version-1 frame whose header h has been
+// read from r, acknowledging it on w.
+func receiveFramePayload(r io.Reader, w io.Writer, h FrameHeader, handle FrameHandler) error {
 	if h.Kind != KindDone {
-		if err := handle(h, rw); err != nil {
-			return h, fmt.Errorf("handle frame %q: %w", h.Name, err)
+		if err := handle(h, r); err != nil {
+			return fmt.Errorf("handle frame %q: %w", h.Name, err)
 		}
 	}
-	if _, err := rw.Write([]byte{ackByte}); err != nil {
-		return h, fmt.Errorf("write ack: %w", err)
+	if _, err := w.Write([]byte{wire.Ack}); err != nil {
+		return fmt.Errorf("write ack: %w", err)
 	}
-	return h, nil
+	return nil
 }
 
 func readAck(r io.Reader) error {
@@ -194,13 +341,14 @@ func readAck(r io.Reader) error {
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return fmt.Errorf("wait for ack: %w", err)
 	}
-	if buf[0] != ackByte {
+	if buf[0] != wire.Ack {
 		return fmt.Errorf("unexpected ack byte 0x%02X", buf[0])
 	}
 	return nil
 }
 
-// SendDir dials addr and transfers the directory dir as layer ordinal.
+// SendDir dials addr and transfers the directory dir as layer ordinal in a
+// version-1 frame of its own. Use a Session to send several items.
 func SendDir(addr string, ordinal int, name, dir string) error {
 	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
 	if err != nil {
@@ -210,7 +358,8 @@ func SendDir(addr string, ordinal int, name, dir string) error {
 	return SendDirFrame(conn, ordinal, name, dir)
 }
 
-// SendCheckpointFile dials addr and transfers a single checkpoint file.
+// SendCheckpointFile dials addr and transfers a single checkpoint file in a
+// version-1 frame of its own.
 func SendCheckpointFile(addr, path string) error {
 	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
 	if err != nil {
@@ -230,56 +379,476 @@ func SendDone(addr string) error {
 	return SendDoneFrame(conn)
 }
 
-// ReceiveAll accepts connections on ln, processing one frame per connection
-// until a KindDone frame arrives or timeout elapses. Frames are routed via
-// handle (see ReceiveFrame). It returns the headers of the received frames
-// (excluding the DONE frame).
+// ReceiveOptions configures ReceiveAllWith.
+type ReceiveOptions struct {
+	// Timeout bounds the whole transfer: no connection is accepted, and
+	// none is read from, once it has elapsed since ReceiveAllWith started.
+	Timeout time.Duration
+	// IdleTimeout drops a connection that delivers nothing for that long,
+	// so a peer that crashed or went silent does not hold the transfer up;
+	// a sender whose session was dropped reconnects and resumes. Zero
+	// means defaultIdleTimeout.
+	IdleTimeout time.Duration
+	// SpoolDir picks the directory that holds the payload of a session
+	// frame that is spooled rather than streamed to the handler (see
+	// resume.go). Nil spools to os.TempDir().
+	SpoolDir func(h FrameHeader) string
+	// TLS, when set, makes every connection complete a TLS handshake (see
+	// ServerTLS) before it may send frames. Connections that fail it are
+	// logged and dropped; the transfer keeps waiting for the real source.
+	TLS *tls.Config
+	// Token, when set, is the migration's transfer token: only sessions
+	// signed with it may deliver frames (see auth.go). Other connections
+	// are refused like a failed TLS handshake.
+	Token string
+	// ChunkCache, when set, lets senders deduplicate against the chunks
+	// this node already holds (see chunks.go).
+	ChunkCache *ChunkCache
+	// Limit, when set, paces what the receiver reads from all its
+	// connections together (see shaping.go).
+	Limit *RateLimiter
+	// Emulate, when set, makes connections from loopback addresses behave
+	// like a long-distance link (see shaping.go).
+	Emulate WANEmulation
+	// Abort, when set, gives up on the transfer once a reason arrives on
+	// it (see abort.go).
+	Abort <-chan string
+}
+
+// ReceiveAll is ReceiveAllWith with only a timeout.
 func ReceiveAll(ln net.Listener, timeout time.Duration, handle FrameHandler) ([]FrameHeader, error) {
+	return ReceiveAllWith(ln, ReceiveOptions{Timeout: timeout}, handle)
+}
+
+// ReceiveAllWith accepts connections on ln until a KindDone frame arrives or
+// the timeout elapses. A version-1 connection carries one frame; a version-2
+// connection is a Session carrying frames until DONE or until it drops, in
+// which case the sender may reconnect and resume; the stripes of a striped
+// file are served side by side while its frame is (see stripe.go). Frames
+// are routed via handle (see ReceiveFrame), one at a time. It returns the
+// headers of the received frames (excluding the DONE frame). A transfer the
+// sender or opts.Abort aborts fails with an *AbortError.
+//
+// Connections are admitted while another is served: each must complete
+// its TLS handshake and deliver its first frame header, and a session's
+// HELLO must verify, before it may send frames (see open). One connection
+// is served at a time, the others wait their turn, except that a new
+// session of the transfer being served takes over from the connection
+// serving it, which the sender has given up on.
+func ReceiveAllWith(ln net.Listener, opts ReceiveOptions, handle FrameHandler) ([]FrameHeader, error) {
 	var received []FrameHeader
-	deadline := time.Now().Add(timeout)
+	rs := newReceiverState(opts)
+	rs.ln = ln
+	rs.deadline = time.Now().Add(opts.Timeout)
+	defer rs.discardAll()
+	if opts.Abort != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case reason := <-opts.Abort:
+				rs.abort(reason)
+			case <-stop:
+			}
+		}()
+	}
+	acceptErr := rs.acceptConns()
+	timer := time.NewTimer(time.Until(rs.deadline))
+	defer timer.Stop()
+
+	var cur *serving
+	var queue []*opened
+	defer func() {
+		close(rs.quit)
+		rs.stopAccepting()
+		if cur != nil {
+			cur.o.conn.Close()
+			<-cur.ended
+		}
+		for _, o := range queue {
+			o.conn.Close()
+		}
+		for len(rs.stripes) > 0 {
+			(<-rs.stripes).conn.Close()
+		}
+	}()
 	for {
-		if tl, ok := ln.(*net.TCPListener); ok {
-			if err := tl.SetDeadline(deadline); err != nil {
-				return received, fmt.Errorf("set accept deadline: %w", err)
+		if cur == nil && len(queue) > 0 {
+			cur = rs.serve(queue[0], handle)
+			queue = queue[1:]
+		}
+		var ended <-chan served
+		if cur != nil {
+			ended = cur.ended
+		}
+		select {
+		case o := <-rs.opened:
+			if o.version == wire.SessionVersion && isStripeID(o.h.Name) {
+				// Stripes dial once the striped frame is sent, so their
+				// transfer's connection is the one being served.
+				if cur == nil || !strings.HasPrefix(o.h.Name, cur.o.transfer()+".") {
+					log.Printf("refusing transfer connection from %s: session %s is not a stripe of the transfer being received", o.conn.RemoteAddr(), o.h.Name)
+					o.conn.Close()
+					continue
+				}
+				rs.offerStripe(o)
+				continue
+			}
+			if id := o.transfer(); id != "" {
+				// Earlier connections of the transfer are stale.
+				kept := queue[:0]
+				for _, q := range queue {
+					if q.transfer() == id {
+						q.conn.Close()
+						continue
+					}
+					kept = append(kept, q)
+				}
+				queue = kept
+				if cur != nil && cur.o.transfer() == id {
+					log.Printf("transfer %s: connection from %s takes over from %s", id, o.conn.RemoteAddr(), cur.o.conn.RemoteAddr())
+					cur.o.conn.Close()
+					rs.cancelStripes()
+					queue = append([]*opened{o}, queue...)
+					continue
+				}
+			}
+			queue = append(queue, o)
+		case r := <-ended:
+			conn := cur.o.conn
+			cur = nil
+			received = append(received, r.frames...)
+			if aerr := rs.aborted(); aerr != nil {
+				return received, aerr
+			}
+			var aerr authError
+			if errors.As(r.err, &aerr) {
+				log.Printf("refusing transfer connection from %s: %v", conn.RemoteAddr(), r.err)
+				rs.refuse(r.err)
+				continue
+			}
+			if r.err != nil {
+				return received, r.err
+			}
+			if r.done {
+				return received, nil
+			}
+		case err := <-acceptErr:
+			if aerr := rs.aborted(); aerr != nil {
+				return received, aerr
+			}
+			return received, rs.withRefused(fmt.Errorf("accept: %w", err))
+		case <-timer.C:
+			return received, rs.withRefused(fmt.Errorf("transfer not complete after %s", opts.Timeout))
+		}
+	}
+}
+
+// opened is an admitted connection whose first frame header, h, was read
+// from br.
+type opened struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	h       FrameHeader
+	version uint32
+}
+
+// transfer returns the transfer ID of a session, "" for a version-1 frame.
+func (o *opened) transfer() string {
+	if o.version != wire.SessionVersion {
+		return ""
+	}
+	return o.h.Name
+}
+
+// serving is the connection being served and where its outcome arrives.
+type serving struct {
+	o     *opened
+	ended chan served
+}
+
+// served is the outcome of receiveConn.
+type served struct {
+	frames []FrameHeader
+	done   bool
+	err    error
+}
+
+// serve serves o on a goroutine of its own.
+func (rs *receiverState) serve(o *opened, handle FrameHandler) *serving {
+	s := &serving{o: o, ended: make(chan served, 1)}
+	rs.track(o.conn)
+	go func() {
+		frames, done, err := rs.receiveConn(o, handle)
+		rs.untrack(o.conn)
+		o.conn.Close()
+		s.ended <- served{frames, done, err}
+	}()
+	return s
+}
+
+// acceptConns accepts connections on rs.ln until stopAccepting, admitting
+// each on a goroutine of its own; admitted ones arrive on rs.opened. The
+// returned channel receives the error that ended accepting otherwise.
+func (rs *receiverState) acceptConns() <-chan error {
+	errc := make(chan error, 1)
+	rs.accepting = make(chan struct{})
+	go func() {
+		defer close(rs.accepting)
+		for {
+			conn, err := rs.ln.Accept()
+			select {
+			case <-rs.quit:
+				if err == nil {
+					conn.Close()
+				}
+				return
+			default:
 			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case rs.admitting <- struct{}{}:
+			default:
+				log.Printf("refusing transfer connection from %s: %d connections are being admitted already", conn.RemoteAddr(), maxAdmitting)
+				conn.Close()
+				continue
+			}
+			go func() {
+				o, err := rs.open(conn)
+				<-rs.admitting
+				if err != nil {
+					log.Printf("refusing transfer connection from %s: %v", conn.RemoteAddr(), err)
+					rs.refuse(err)
+					return
+				}
+				select {
+				case rs.opened <- o:
+				case <-rs.quit:
+					o.conn.Close()
+				}
+			}()
 		}
-		conn, err := ln.Accept()
+	}()
+	return errc
+}
+
+// stopAccepting ends acceptConns once rs.quit is closed, leaving ln open
+// for the caller.
+func (rs *receiverState) stopAccepting() {
+	dl, ok := rs.ln.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return // Accept returns when the caller closes ln
+	}
+	dl.SetDeadline(time.Now())
+	<-rs.accepting
+	dl.SetDeadline(time.Time{})
+}
+
+// open admits the accepted conn: it completes the TLS handshake, reads the
+// first frame header and, of a session, checks the HELLO's MAC against the
+// token, all within rs.helloTimeout. Reads and writes are bounded by the
+// idle timeout and the transfer's deadline from then on (see deadlineConn).
+// A connection that fails is closed here; an unsigned or forged HELLO is
+// told why first.
+func (rs *receiverState) open(raw net.Conn) (*opened, error) {
+	idle := rs.opts.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	dc := &deadlineConn{Conn: raw, idle: idle, until: rs.deadline}
+	if admit := time.Now().Add(rs.helloTimeout); admit.Before(rs.deadline) {
+		dc.until = admit
+	}
+	conn := shapeConn(dc, rs.opts.Limit, rs.opts.Emulate)
+	if rs.opts.TLS != nil {
+		tc, err := serverHandshake(conn, rs.opts.TLS)
 		if err != nil {
-			return received, fmt.Errorf("accept: %w", err)
+			conn.Close()
+			return nil, err
 		}
-		h, err := ReceiveFrame(conn, handle)
+		conn = tc
+	}
+	br := bufio.NewReader(conn)
+	h, version, err := readFrameHeader(br)
+	if err != nil {
 		conn.Close()
-		if err != nil {
-			return received, err
+		return nil, err
+	}
+	o := &opened{conn: conn, br: br, h: h, version: version}
+	if version != wire.SessionVersion {
+		if rs.opts.Token != "" {
+			conn.Close()
+			return nil, fmt.Errorf("version-%d frame %q refused: this destination requires a signed session", version, h.Name)
 		}
-		if h.Kind == KindDone {
-			return received, nil
+		dc.setUntil(rs.deadline)
+		return o, nil
+	}
+	if h.Kind != KindHello {
+		conn.Close()
+		return nil, fmt.Errorf("session opened with frame kind %d instead of HELLO", h.Kind)
+	}
+	mac, err := readMAC(br, h)
+	if err == nil {
+		err = rs.authenticate(h.Name, h, "", mac)
+		if err != nil {
+			wire.WriteReply(bufio.NewWriter(conn), wire.Err, 0, err.Error())
 		}
-		received = append(received, h)
 	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	dc.setUntil(rs.deadline)
+	return o, nil
+}
+
+// refuse records err as the reason the last connection was refused.
+func (rs *receiverState) refuse(err error) {
+	rs.mu.Lock()
+	rs.refused = err
+	rs.mu.Unlock()
+}
+
+// withRefused adds why the last connection was refused to err, the error
+// that ends the transfer.
+func (rs *receiverState) withRefused(err error) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.refused == nil {
+		return err
+	}
+	return fmt.Errorf("%w (last refused connection: %v)", err, rs.refused)
+}
+
+// deadlineConn bounds every read and write of an accepted connection: each
+// fails once the peer went idle for idle, and at until in any case.
+type deadlineConn struct {
+	net.Conn
+	idle time.Duration
+
+	mu    sync.Mutex // the WAN emulation writes from a goroutine of its own
+	until time.Time
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(c.next())
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(c.next())
+	return c.Conn.Write(p)
+}
+
+// setUntil moves the deadline that bounds the connection to t.
+func (c *deadlineConn) setUntil(t time.Time) {
+	c.mu.Lock()
+	c.until = t
+	c.mu.Unlock()
+}
+
+func (c *deadlineConn) next() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := time.Now().Add(c.idle)
+	if c.until.Before(t) {
+		return c.until
+	}
+	return t
+}
+
+// serverHandshake runs the TLS handshake of an accepted connection.
+func serverHandshake(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tc := tls.Server(conn, cfg)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
 }
 
-// ExtractTarGz decompresses a gzip-compressed tar stream from r into destDir.
-// Entry names are sanitised so the archive cannot escape destDir.
+// receiveConn serves an admitted connection of either protocol version and
+// reports whether it ended the transfer with DONE.
+func (rs *receiverState) receiveConn(o *opened, handle FrameHandler) ([]FrameHeader, bool, error) {
+	h := o.h
+	if o.version == wire.SessionVersion {
+		return rs.receiveSession(o.br, o.conn, h, handle)
+	}
+	if rs.stripe != "" {
+		return nil, false, authError{fmt.Errorf("version-%d frame %q refused while the stripes of a file arrive", o.version, h.Name)}
+	}
+	rs.abandonStreaming()
+	if err := receiveFramePayload(o.br, o.conn, h, handle); err != nil {
+		return nil, false, err
+	}
+	if h.Kind == KindDone {
+		return nil, true, nil
+	}
+	rs.receive(h, "")
+	return []FrameHeader{h}, false, nil
+}
+
+// ExtractPayload extracts the payload of frame h into destDir, publishing
+// what it holds only once all of it extracted; a checkpoint file part or
+// range is written into its staged file there, which the last part or the
+// striped frame publishes (see staging.go).
+func ExtractPayload(h FrameHeader, payload io.Reader, destDir string) error {
+	switch h.Kind {
+	case KindCheckpointPart:
+		return extractPart(payload, h.Codec, destDir)
+	case KindFileRange:
+		return extractRange(payload, h.Codec, destDir)
+	case KindStripedFile:
+		return extractStriped(payload, h.Codec, destDir)
+	}
+	return extractStaged(payload, h.Codec, destDir)
+}
+
+// ExtractTarGz decompresses a gzip-compressed tar stream from r into
+// destDir, publishing its entries only once all of them extracted.
 func ExtractTarGz(r io.Reader, destDir string) error {
+	return extractStaged(r, CodecGzip, destDir)
+}
+
+// ExtractTar decompresses a tar stream compressed with codec from r into
+// destDir. Entry names are sanitised so the archive cannot escape destDir.
+// Device nodes (overlay whiteouts), hardlinks, xattrs, ownership and mtimes
+// are restored (see archive.go).
+func ExtractTar(r io.Reader, codec Codec, destDir string) error {
+	return ExtractTarWith(r, codec, destDir, ExtractOptions{})
+}
+
+// ExtractTarWith is ExtractTar with opts; it also rebuilds delta-encoded
+// files from their base layer (see delta.go). It returns once a session
+// frame's payload was verified (see drainPayload).
+func ExtractTarWith(r io.Reader, codec Codec, destDir string, opts ExtractOptions) error {
 	if err := os.MkdirAll(destDir, 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", destDir, err)
 	}
-	gr, err := gzip.NewReader(r)
+	dr, err := decompressor(r, codec)
 	if err != nil {
-		return fmt.Errorf("gzip reader: %w", err)
+		return err
 	}
-	defer gr.Close()
-	// The payload is a single gzip member; the same connection is then used
-	// for the ACK exchange. Multistream mode would block probing the
-	// connection for a second gzip member that never arrives.
-	gr.Multistream(false)
+	defer dr.Close()
 
-	tr := tar.NewReader(gr)
+	// Creating entries changes their parent's mtime and a read-only mode
+	// would stop them being created, so directories get both once the
+	// whole archive is in place.
+	type dirEntry struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirEntry
+
+	tr := tar.NewReader(dr)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
-			return nil
+			break
 		}
 		if err != nil {
 			return fmt.Errorf("tar next: %w", err)
@@ -288,37 +857,57 @@ func ExtractTarGz(r io.Reader, destDir string) error {
 		if err != nil {
 			return err
 		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return fmt.Errorf("mkdir parent of %s: %w", target, err)
+			}
+			// Replace, never write through, whatever is there: it may be
+			// a hardlink shared with another file.
+			os.Remove(target)
+		}
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)&os.ModePerm); err != nil {
+			if err := os.MkdirAll(target, 0o755); err != nil {
 				return fmt.Errorf("mkdir %s: %w", target, err)
 			}
+			dirs = append(dirs, dirEntry{target, hdr})
 		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-				return fmt.Errorf("mkdir parent of %s: %w", target, err)
-			}
-			os.Remove(target)
 			if err := os.Symlink(hdr.Linkname, target); err != nil {
 				return fmt.Errorf("symlink %s: %w", target, err)
 			}
-		default:
-			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-				return fmt.Errorf("mkdir parent of %s: %w", target, err)
-			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&os.ModePerm)
+		case tar.TypeLink:
+			src, err := safeJoin(destDir, hdr.Linkname)
 			if err != nil {
-				return fmt.Errorf("create %s: %w", target, err)
+				return err
 			}
-			_, copyErr := io.Copy(f, tr)
-			closeErr := f.Close()
-			if copyErr != nil {
-				return fmt.Errorf("write %s: %w", target, copyErr)
+			if err := os.Link(src, target); err != nil {
+				return fmt.Errorf("link %s: %w", target, err)
 			}
-			if closeErr != nil {
-				return fmt.Errorf("close %s: %w", target, closeErr)
+			continue // shares the first link's metadata
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := mknod(target, hdr); err != nil {
+				return err
+			}
+		default:
+			if isDelta(hdr) {
+				err = applyDelta(target, hdr, tr, opts)
+			} else {
+				err = writeSparse(target, tr)
+			}
+			if err != nil {
+				return err
 			}
 		}
+		if err := applyMetadata(target, hdr); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := finishDir(dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
 	}
+	return drainPayload(r)
 }
 
 // safeJoin joins name under dir, rejecting absolute or escaping paths.
@@ -333,8 +922,11 @@ func safeJoin(dir, name string) (string, error) {
 	return filepath.Join(dir, cleaned), nil
 }
 
-// tarDir writes the contents of dir (relative paths) to tw.
-func tarDir(dir string, tw *tar.Writer) error {
+// tarDir writes the contents of dir (relative paths) to tw, delta encoding
+// large files that have an earlier version at base.
+func tarDir(dir string, tw *tar.Writer, base DeltaBase) error {
+	links := make(map[inode]string)
+	minDelta := deltaMinSize()
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -346,21 +938,19 @@ func tarDir(dir string, tw *tar.Writer) error {
 		if rel == "." {
 			return nil
 		}
-		var link string
-		if info.Mode()&os.ModeSymlink != 0 {
-			if link, err = os.Readlink(path); err != nil {
-				return err
-			}
-		}
-		hdr, err := tar.FileInfoHeader(info, link)
+		hdr, err := fileHeader(path, filepath.ToSlash(rel), info, links)
 		if err != nil {
 			return err
 		}
-		hdr.Name = filepath.ToSlash(rel)
+		if base != nil && minDelta > 0 && hdr.Typeflag == tar.TypeReg && hdr.Size >= minDelta {
+			if done, err := writeDeltaEntry(tw, hdr, path, base); done || err != nil {
+				return err
+			}
+		}
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
-		if info.Mode().IsRegular() {
+		if hdr.Typeflag == tar.TypeReg {
 			f, err := os.Open(path)
 			if err != nil {
 				return err
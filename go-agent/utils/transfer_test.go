@@ -1,13 +1,23 @@
 package utils
 
 import (
+	"archive/tar"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	mrand "math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+	"golang.org/x/sys/unix"
 )
 
 // --- frame header ---
@@ -24,8 +34,8 @@ func TestFrameHeader_RoundTrip(t *testing.T) {
 		if err := WriteFrameHeader(&buf, h); err != nil {
 			t.Fatalf("write header %+v: %v", h, err)
 		}
-		if buf.Len() != frameHeaderSize {
-			t.Errorf("header size = %d, want %d", buf.Len(), frameHeaderSize)
+		if buf.Len() != wire.HeaderSize {
+			t.Errorf("header size = %d, want %d", buf.Len(), wire.HeaderSize)
 		}
 		got, err := ReadFrameHeader(&buf)
 		if err != nil {
@@ -38,7 +48,7 @@ func TestFrameHeader_RoundTrip(t *testing.T) {
 }
 
 func TestFrameHeader_RejectsBadMagic(t *testing.T) {
-	buf := make([]byte, frameHeaderSize) // all zero: bad magic
+	buf := make([]byte, wire.HeaderSize) // all zero: bad magic
 	if _, err := ReadFrameHeader(bytes.NewReader(buf)); err == nil {
 		t.Error("expected error for bad magic")
 	}
@@ -46,7 +56,7 @@ func TestFrameHeader_RejectsBadMagic(t *testing.T) {
 
 func TestFrameHeader_RejectsLongName(t *testing.T) {
 	var buf bytes.Buffer
-	name := make([]byte, frameNameSize+1)
+	name := make([]byte, wire.NameSize+1)
 	for i := range name {
 		name[i] = 'x'
 	}
@@ -210,6 +220,756 @@ func TestReceiveAll_UntilDone(t *testing.T) {
 	}
 }
 
+// --- version-2 sessions ---
+
+type receiveResult struct {
+	frames []FrameHeader
+	err    error
+}
+
+// startReceiver runs ReceiveAll on a loopback listener and returns its
+// address and a channel delivering the result.
+func startReceiver(t *testing.T, handle FrameHandler) (string, <-chan receiveResult) {
+	t.Helper()
+	return startReceiverWith(t, ReceiveOptions{Timeout: 5 * time.Second}, handle)
+}
+
+// startReceiverWith is startReceiver with ReceiveAllWith and opts.
+func startReceiverWith(t *testing.T, opts ReceiveOptions, handle FrameHandler) (string, <-chan receiveResult) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	resCh := make(chan receiveResult, 1)
+	go func() {
+		frames, err := ReceiveAllWith(ln, opts, handle)
+		resCh <- receiveResult{frames, err}
+	}()
+	return ln.Addr().String(), resCh
+}
+
+func TestSession_MixedWithV1_UntilDone(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "data.bin"), []byte("xyz"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Large enough to span several payload chunks.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*wire.ChunkSize/16+7)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_a.dmtcp")
+	if err := os.WriteFile(ckpt, big, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractTarGz(payload, filepath.Join(dst, h.Name))
+	})
+
+	// An older agent's per-connection frame first.
+	if err := SendDir(addr, 1, "u1", src); err != nil {
+		t.Fatalf("v1 SendDir: %v", err)
+	}
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(2, "u2", src); err != nil {
+		t.Fatalf("SendDir: %v", err)
+	}
+	if err := s.SendCheckpointFile(ckpt); err != nil {
+		t.Fatalf("SendCheckpointFile: %v", err)
+	}
+	if err := s.SendDir(3, "u3", src); err != nil {
+		t.Fatalf("SendDir 3: %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("ReceiveAll: %v", res.err)
+	}
+	if len(res.frames) != 4 {
+		t.Fatalf("expected 4 frames, got %+v", res.frames)
+	}
+	for i, want := range []uint32{0, 1, 2, 3} {
+		if res.frames[i].Seq != want {
+			t.Errorf("frame %d seq = %d, want %d", i, res.frames[i].Seq, want)
+		}
+	}
+	for _, name := range []string{"u1", "u2", "u3"} {
+		if _, err := os.Stat(filepath.Join(dst, name, "data.bin")); err != nil {
+			t.Errorf("layer %s not extracted: %v", name, err)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "ckpt_a.dmtcp", "ckpt_a.dmtcp")); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("checkpoint file mismatch (%d bytes, %v)", len(got), err)
+	}
+}
+
+func TestSession_PipelinesWithoutWaitingForAcks(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		<-release
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 4; i++ {
+			if err := s.SendDir(i, "u", src); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("SendDir: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("sends blocked on acknowledgements")
+	}
+	close(release)
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil || len(res.frames) != 4 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+}
+
+func TestSession_ConcurrentSenders(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 8; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("ckpt_%d.dmtcp", i))
+		if err := os.WriteFile(f, bytes.Repeat([]byte{byte('a' + i)}, 20000), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	dst := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractTarGz(payload, dst)
+	})
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(files))
+	for _, f := range files {
+		wg.Add(1)
+		go func(f string) {
+			defer wg.Done()
+			errs <- s.SendCheckpointFile(f)
+		}(f)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("SendCheckpointFile: %v", err)
+		}
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil || len(res.frames) != len(files) {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	for i, f := range files {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.Base(f)))
+		if err != nil || !bytes.Equal(got, bytes.Repeat([]byte{byte('a' + i)}, 20000)) {
+			t.Errorf("%s corrupted (%d bytes, %v)", f, len(got), err)
+		}
+	}
+}
+
+func TestSession_NakFailsSession(t *testing.T) {
+	src := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		if h.Name == "bad" {
+			return fmt.Errorf("disk full")
+		}
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SendDir(1, "good", src); err != nil {
+		t.Fatalf("SendDir good: %v", err)
+	}
+	s.SendDir(2, "bad", src)
+	err = s.Flush()
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Flush = %v, want the receiver's rejection", err)
+	}
+	if err := s.SendDir(3, "later", src); err == nil {
+		t.Error("sends after a NAK must fail")
+	}
+	res := <-resCh
+	if res.err == nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v; want 1 and an error", len(res.frames), res.err)
+	}
+}
+
+func TestSession_CloseBetweenFramesKeepsReceiving(t *testing.T) {
+	src := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	for i := 1; i <= 2; i++ {
+		s, err := DialSession(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SendDir(i, "u", src); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		s.Close()
+	}
+	if err := SendDone(addr); err != nil {
+		t.Fatalf("SendDone: %v", err)
+	}
+	if res := <-resCh; res.err != nil || len(res.frames) != 2 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+}
+
+// --- resumable sessions ---
+
+// flakyProxy forwards connections to target and cuts the first one after
+// limit client-to-target bytes. With refuseAfterCut it also stops
+// accepting, so the sender cannot reconnect. With corrupt > 0 it instead
+// flips the byte at that client-to-target offset of the first connection.
+// cutConn picks another connection than the first (1 is the second). With
+// stall the cut connection stays open both ways, silent; with halfOpen only
+// the client side is closed, so the target never learns of the cut.
+type flakyProxy struct {
+	ln             net.Listener
+	target         string
+	limit          int64
+	refuseAfterCut bool
+	corrupt        int64
+	cutConn        int
+	stall          bool
+	halfOpen       bool
+
+	mu    sync.Mutex
+	conns int
+	up    int64
+}
+
+func startFlakyProxy(t *testing.T, target string, limit int64, refuseAfterCut bool) *flakyProxy {
+	return (&flakyProxy{target: target, limit: limit, refuseAfterCut: refuseAfterCut}).start(t)
+}
+
+func (p *flakyProxy) start(t *testing.T) *flakyProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p.ln = ln
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.forward(c)
+		}
+	}()
+	return p
+}
+
+func (p *flakyProxy) forward(c net.Conn) {
+	p.mu.Lock()
+	p.conns++
+	first := p.conns == p.cutConn+1
+	p.mu.Unlock()
+	up, err := net.Dial("tcp", p.target)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go func() {
+		io.Copy(c, up)
+		c.Close()
+	}()
+	var src io.Reader = c
+	switch {
+	case first && p.corrupt > 0:
+		src = &flipReader{r: c, at: p.corrupt}
+	case first:
+		src = io.LimitReader(c, p.limit)
+	}
+	n, _ := io.Copy(up, src)
+	p.mu.Lock()
+	p.up += n
+	p.mu.Unlock()
+	if first && p.refuseAfterCut {
+		p.ln.Close()
+	}
+	switch {
+	case first && p.stall:
+		return // closed once the target drops up
+	case first && p.halfOpen:
+		c.Close()
+		return
+	}
+	c.Close()
+	up.Close()
+}
+
+// flipReader inverts the byte at offset at of the stream.
+type flipReader struct {
+	r   io.Reader
+	pos int64
+	at  int64
+}
+
+func (f *flipReader) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if i := f.at - f.pos; i >= 0 && i < int64(n) {
+		b[i] ^= 0xFF
+	}
+	f.pos += int64(n)
+	return n, err
+}
+
+func (p *flakyProxy) stats() (conns int, up int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns, p.up
+}
+
+func TestSession_ResumesAfterDroppedConnection(t *testing.T) {
+	// Incompressible, so the gzip payload is about as large as the file.
+	data := make([]byte, 1536<<10)
+	mrand.New(mrand.NewSource(1)).Read(data)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_big.dmtcp")
+	if err := os.WriteFile(ckpt, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst, spool := t.TempDir(), t.TempDir()
+
+	addr, resCh := startReceiverWith(t, ReceiveOptions{
+		Timeout:  10 * time.Second,
+		SpoolDir: func(FrameHeader) string { return spool },
+	}, func(h FrameHeader, payload io.Reader) error {
+		return ExtractTarGz(payload, dst)
+	})
+	proxy := startFlakyProxy(t, addr, 600<<10, false)
+
+	s, err := DialSession(proxy.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendCheckpointFile(ckpt); err != nil {
+		t.Fatalf("SendCheckpointFile: %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	res := <-resCh
+	if res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "ckpt_big.dmtcp"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("checkpoint corrupted after resume (%d bytes, %v)", len(got), err)
+	}
+	if n := s.Reconnects(); n != 1 {
+		t.Errorf("Reconnects = %d, want 1", n)
+	}
+	// Restarting the item would push the cut prefix through twice.
+	conns, up := proxy.stats()
+	if conns != 2 || up > int64(len(data))*13/10 {
+		t.Errorf("proxy saw %d connection(s) and %d upstream bytes for a %d-byte file", conns, up, len(data))
+	}
+	if left, _ := filepath.Glob(filepath.Join(spool, ".resume-*")); len(left) != 0 {
+		t.Errorf("spool not cleaned up: %v", left)
+	}
+}
+
+// sendBlob sends a 256 KiB directory frame and DONE through addr.
+func sendBlob(t *testing.T, addr string) {
+	t.Helper()
+	src := t.TempDir()
+	data := make([]byte, 256<<10)
+	mrand.New(mrand.NewSource(4)).Read(data)
+	if err := os.WriteFile(filepath.Join(src, "blob"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(1, "u1", src); err != nil {
+		t.Fatalf("SendDir: %v", err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+}
+
+func TestSession_ResumeTakesOverHalfOpenConnection(t *testing.T) {
+	addr, resCh := startReceiverWith(t, ReceiveOptions{Timeout: 10 * time.Second, IdleTimeout: time.Minute}, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	// The receiver keeps reading the cut connection until the idle
+	// timeout unless the resumed one takes over.
+	proxy := (&flakyProxy{target: addr, limit: 64 << 10, halfOpen: true}).start(t)
+	start := time.Now()
+	sendBlob(t, proxy.ln.Addr().String())
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("transfer took %s, want the resumed connection served at once", d)
+	}
+}
+
+func TestReceive_DropsIdleConnection(t *testing.T) {
+	addr, resCh := startReceiverWith(t, ReceiveOptions{Timeout: 10 * time.Second, IdleTimeout: 300 * time.Millisecond}, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	// The sender waits for its reply on the stalled connection until the
+	// receiver drops it, then resumes.
+	proxy := (&flakyProxy{target: addr, limit: 64 << 10, stall: true}).start(t)
+	sendBlob(t, proxy.ln.Addr().String())
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	if conns, _ := proxy.stats(); conns != 2 {
+		t.Errorf("proxy saw %d connection(s), want the stalled one and its resumption", conns)
+	}
+}
+
+func TestReceive_TimeoutBoundsOpenSession(t *testing.T) {
+	addr, resCh := startReceiverWith(t, ReceiveOptions{Timeout: 500 * time.Millisecond, IdleTimeout: time.Minute}, func(FrameHeader, io.Reader) error { return nil })
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	select {
+	case res := <-resCh:
+		if res.err == nil || !strings.Contains(res.err.Error(), "not complete after") {
+			t.Fatalf("ReceiveAll = %v, want the transfer to time out", res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("an open session kept the receiver past its timeout")
+	}
+}
+
+func TestSession_GivesUpWhenDestinationStaysAway(t *testing.T) {
+	src := t.TempDir()
+	data := make([]byte, 256<<10)
+	mrand.New(mrand.NewSource(2)).Read(data)
+	if err := os.WriteFile(filepath.Join(src, "blob"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	proxy := startFlakyProxy(t, addr, 64<<10, true)
+
+	s, err := DialSession(proxy.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.retryFor = time.Second
+	s.SendDir(1, "u1", src)
+	start := time.Now()
+	err = s.Flush()
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("Flush = %v, want a giving-up error", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("gave up after %s, want about retryFor", time.Since(start))
+	}
+}
+
+func TestSession_ResendsFrameThatFailsVerification(t *testing.T) {
+	data := make([]byte, 200<<10)
+	mrand.New(mrand.NewSource(3)).Read(data)
+	ckpt := filepath.Join(t.TempDir(), "ckpt_c.dmtcp")
+	if err := os.WriteFile(ckpt, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		return ExtractTarGz(payload, dst)
+	})
+	// HELLO, the frame header and the first chunk header, then payload.
+	proxy := (&flakyProxy{target: addr, corrupt: 2*(wire.HeaderSize+wire.SessionExtSize) + wire.ChunkHeaderSize + 1000}).start(t)
+
+	s, err := DialSession(proxy.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendCheckpointFile(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil || len(res.frames) != 1 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "ckpt_c.dmtcp"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("checkpoint corrupted (%d bytes, %v)", len(got), err)
+	}
+	if n := s.Reconnects(); n != 1 {
+		t.Errorf("Reconnects = %d, want 1 (one resend)", n)
+	}
+}
+
+func TestSession_DoneManifestRefusesIncompleteSet(t *testing.T) {
+	src := t.TempDir()
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(2, "u2", src); err != nil {
+		t.Fatal(err)
+	}
+	// Layer 1 was supposedly shipped by an earlier session.
+	s.Expect(ManifestEntry{Kind: KindLayer, Ordinal: 1, Name: "u1", SHA256: strings.Repeat("ab", 32)})
+	err = s.Done()
+	if err == nil || !strings.Contains(err.Error(), "layer 1 (u1) missing") {
+		t.Fatalf("Done = %v, want the missing layer reported", err)
+	}
+	if res := <-resCh; res.err == nil || !strings.Contains(res.err.Error(), "incomplete transfer") {
+		t.Fatalf("ReceiveAll = %v, want an incomplete-transfer error", res.err)
+	}
+}
+
+func TestSession_DoneManifestAcceptsEarlierSessions(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		_, err := io.Copy(io.Discard, payload)
+		return err
+	})
+	first, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.SendDir(1, "u1", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	earlier := first.Sent()
+	first.Close()
+	if len(earlier) != 1 || len(earlier[0].SHA256) != 64 {
+		t.Fatalf("Sent = %+v, want one entry with a digest", earlier)
+	}
+
+	s, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendDir(2, "u2", src); err != nil {
+		t.Fatal(err)
+	}
+	s.Expect(earlier...)
+	if err := s.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if res := <-resCh; res.err != nil || len(res.frames) != 2 {
+		t.Fatalf("ReceiveAll = %d frame(s), %v", len(res.frames), res.err)
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	digest := strings.Repeat("0f", 32)
+	received := map[itemKey]string{
+		{KindLayer, 1, "u1"}:              digest,
+		{KindLayer, 2, "u2"}:              "",
+		{KindCheckpointFile, 0, "ckpt_a"}: strings.Repeat("11", 32),
+	}
+	ok := Manifest{Items: []ManifestEntry{
+		{Kind: KindLayer, Ordinal: 1, Name: "u1", SHA256: digest},
+		{Kind: KindLayer, Ordinal: 2, Name: "u2"},
+	}}
+	if err := ok.check(received); err != nil {
+		t.Errorf("check = %v", err)
+	}
+	bad := Manifest{Items: []ManifestEntry{
+		{Kind: KindLayer, Ordinal: 2, Name: "u2", SHA256: digest},
+		{Kind: KindCheckpointFile, Name: "ckpt_a", SHA256: digest},
+		{Kind: KindCheckpointFile, Name: "ckpt_b"},
+	}}
+	err := bad.check(received)
+	for _, want := range []string{"u2) received without a digest", "ckpt_a digest 111111111111", "ckpt_b missing"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("check = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestMergeManifest_KeepsFirstPositionAndLastDigest(t *testing.T) {
+	m := mergeManifest(
+		[]ManifestEntry{{Kind: KindLayer, Ordinal: 1, Name: "u1"}, {Kind: KindLayer, Ordinal: 2, Name: "u2", SHA256: "old"}},
+		[]ManifestEntry{{Kind: KindLayer, Ordinal: 2, Name: "u2", SHA256: "new"}, {Kind: KindDone + 10, Name: "x"}},
+	)
+	if len(m.Items) != 3 || m.Items[1].SHA256 != "new" || m.Items[2].Name != "x" {
+		t.Errorf("mergeManifest = %+v", m.Items)
+	}
+}
+
+// chunkStream encodes payload[from:] as session chunks of size n followed by
+// the terminator.
+func chunkStream(payload []byte, from int64, n int) []byte {
+	var buf bytes.Buffer
+	cw := &wire.ChunkWriter{W: &buf, Skip: from}
+	for i := 0; i < len(payload); i += n {
+		end := i + n
+		if end > len(payload) {
+			end = len(payload)
+		}
+		cw.Write(payload[i:end])
+		cw.Flush()
+	}
+	cw.Close()
+	return buf.Bytes()
+}
+
+func TestSpool_StreamsAndResumesWithOverlap(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	rs := newReceiverState(ReceiveOptions{})
+	ts := rs.transfer("abc")
+	h := FrameHeader{Kind: KindCheckpointFile, Name: "ckpt.dmtcp", Seq: 1}
+	var got []byte
+	handle := func(_ FrameHeader, r io.Reader) error {
+		var err error
+		got, err = io.ReadAll(r)
+		return err
+	}
+
+	// The connection drops a little way into the fourth chunk.
+	stream := chunkStream(payload, 0, 3000)
+	cut := 3*(wire.ChunkHeaderSize+3000) + wire.ChunkHeaderSize + 100
+	if _, err := rs.spool(ts, h, bytes.NewReader(stream[:cut]), handle); err == nil {
+		t.Fatal("spool of a truncated stream must fail")
+	}
+	last, off := ts.resumePoint()
+	if last != 0 || off != 9100 {
+		t.Fatalf("resumePoint = (%d, %d), want (0, 9100)", last, off)
+	}
+
+	// The sender resumes from an older offset; the overlap is dropped.
+	p, err := rs.spool(ts, h, bytes.NewReader(chunkStream(payload, 8000, 3000)), handle)
+	if err != nil {
+		t.Fatalf("resumed spool: %v", err)
+	}
+	if err := p.deliver(handle); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("streamed payload differs (%d bytes)", len(got))
+	}
+}
+
+func TestSpool_DoesNotPublishCorruptPayload(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "app.txt", Mode: 0o644, Size: 2, Typeflag: tar.TypeReg})
+	tw.Write([]byte("v1"))
+	tw.Close()
+	stream := chunkStream(archive.Bytes(), 0, 512)
+	stream[len(stream)-1] ^= 0xff // the digest trailer
+
+	dest := t.TempDir()
+	rs := newReceiverState(ReceiveOptions{})
+	ts := rs.transfer("abc")
+	h := FrameHeader{Kind: KindLayer, Name: "u1", Seq: 1, Codec: CodecNone}
+	handle := func(h FrameHeader, r io.Reader) error { return ExtractPayload(h, r, dest) }
+	_, err := rs.spool(ts, h, bytes.NewReader(stream), handle)
+	var derr digestError
+	if !errors.As(err, &derr) {
+		t.Fatalf("spool = %v, want a digestError", err)
+	}
+	ts.part.discard(err)
+	if _, err := os.Stat(filepath.Join(dest, "app.txt")); !os.IsNotExist(err) {
+		t.Errorf("app.txt was published from a corrupt payload: %v", err)
+	}
+}
+
+func TestSpool_RejectsGapAndLengthMismatch(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 5000)
+	rs := newReceiverState(ReceiveOptions{})
+	h := FrameHeader{Kind: KindLayer, Name: "u1", Seq: 1}
+	handle := func(_ FrameHeader, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	ts := rs.transfer("gap")
+	if _, err := rs.spool(ts, h, bytes.NewReader(chunkStream(payload, 1000, 2000)), handle); err == nil {
+		t.Error("a stream starting past the received bytes must be rejected")
+	}
+	ts.part.discard(errFrameAbandoned)
+	var buf bytes.Buffer
+	cw := &wire.ChunkWriter{W: &buf}
+	cw.Write(payload)
+	cw.Flush()
+	wire.WriteChunk(&buf, 0, 4000, nil)
+	ts = rs.transfer("len")
+	if _, err := rs.spool(ts, h, &buf, handle); err == nil {
+		t.Error("a terminator disagreeing with the received length must be rejected")
+	}
+	ts.part.discard(errFrameAbandoned)
+}
+
 // --- extraction safety ---
 
 func TestExtractTarGz_RejectsEscapingPaths(t *testing.T) {
@@ -220,3 +980,357 @@ func TestExtractTarGz_RejectsEscapingPaths(t *testing.T) {
 		t.Errorf("safeJoin valid path: got %q, %v", got, err)
 	}
 }
+
+// --- layer fidelity ---
+
+// roundTripDir archives src the way layer frames do and extracts it to a
+// new directory.
+func roundTripDir(t *testing.T, src string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeDirPayload(&buf, src, CodecGzip, nil); err != nil {
+		t.Fatalf("writeDirPayload: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), "l1")
+	if err := ExtractTarGz(&buf, dst); err != nil {
+		t.Fatalf("ExtractTarGz: %v", err)
+	}
+	return dst
+}
+
+func TestLayerRoundTrip_HardlinksMtimesSparse(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 891011121, time.UTC)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.Mkdir(filepath.Join(src, "ro"), 0o755))
+	must(os.WriteFile(filepath.Join(src, "ro", "a"), []byte("shared"), 0o640))
+	must(os.Link(filepath.Join(src, "ro", "a"), filepath.Join(src, "b")))
+	must(os.Symlink("ro/a", filepath.Join(src, "link")))
+	must(os.WriteFile(filepath.Join(src, "suid"), nil, 0o755))
+	must(os.Chmod(filepath.Join(src, "suid"), 0o755|os.ModeSetuid))
+
+	// 8 MiB with one written block in the middle.
+	sparse, err := os.Create(filepath.Join(src, "sparse"))
+	must(err)
+	must(sparse.Truncate(8 << 20))
+	_, err = sparse.WriteAt([]byte("x"), 4<<20)
+	must(err)
+	must(sparse.Close())
+
+	for _, p := range []string{"ro/a", "sparse", "link", "ro"} {
+		must(setMtime(filepath.Join(src, p), mtime))
+	}
+	must(os.Chmod(filepath.Join(src, "ro"), 0o555))
+	t.Cleanup(func() { os.Chmod(filepath.Join(src, "ro"), 0o755) })
+
+	dst := roundTripDir(t, src)
+	t.Cleanup(func() { os.Chmod(filepath.Join(dst, "ro"), 0o755) })
+
+	a, err := os.Stat(filepath.Join(dst, "ro", "a"))
+	must(err)
+	b, err := os.Stat(filepath.Join(dst, "b"))
+	must(err)
+	if !os.SameFile(a, b) {
+		t.Error("hardlinked files arrived as separate inodes")
+	}
+	if a.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", a.Mode())
+	}
+	if st, _ := os.Stat(filepath.Join(dst, "suid")); st == nil || st.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit lost: %v", st)
+	}
+	for _, p := range []string{"ro/a", "sparse", "ro"} {
+		st, err := os.Stat(filepath.Join(dst, p))
+		if err != nil || !st.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, %v; want %v", p, st.ModTime(), err, mtime)
+		}
+	}
+	if st, err := os.Lstat(filepath.Join(dst, "link")); err != nil || !st.ModTime().Equal(mtime) {
+		t.Errorf("symlink mtime = %v, %v; want %v", st.ModTime(), err, mtime)
+	}
+	if st, _ := os.Stat(filepath.Join(dst, "ro")); st == nil || st.Mode().Perm() != 0o555 {
+		t.Errorf("read-only dir mode = %v", st)
+	}
+
+	st, err := os.Stat(filepath.Join(dst, "sparse"))
+	must(err)
+	if st.Size() != 8<<20 {
+		t.Fatalf("sparse size = %d", st.Size())
+	}
+	if blocks := st.Sys().(*syscall.Stat_t).Blocks * 512; blocks > 1<<20 {
+		t.Errorf("sparse file allocates %d bytes, want its holes kept", blocks)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "sparse"))
+	must(err)
+	if data[4<<20] != 'x' || bytes.Count(data, []byte{0}) != len(data)-1 {
+		t.Error("sparse file content changed")
+	}
+}
+
+func TestLayerRoundTrip_WhiteoutsXattrsOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts, trusted.* xattrs and chown need root")
+	}
+	src := t.TempDir()
+	whiteout := filepath.Join(src, "deleted.txt")
+	if err := unix.Mknod(whiteout, unix.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod whiteout: %v", err)
+	}
+	opaque := filepath.Join(src, "opaque")
+	if err := os.Mkdir(opaque, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(opaque, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattrs unsupported here: %v", err)
+	}
+	owned := filepath.Join(opaque, "owned")
+	if err := os.WriteFile(owned, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(owned, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(owned, "user.note", []byte("kept"), 0); err != nil {
+		t.Skipf("user xattrs unsupported here: %v", err)
+	}
+
+	dst := roundTripDir(t, src)
+
+	st, err := os.Lstat(filepath.Join(dst, "deleted.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := st.Sys().(*syscall.Stat_t)
+	if st.Mode()&os.ModeCharDevice == 0 || sys.Rdev != 0 {
+		t.Errorf("whiteout arrived as %v (rdev %d), want a 0/0 char device", st.Mode(), sys.Rdev)
+	}
+	buf := make([]byte, 16)
+	if n, err := unix.Lgetxattr(filepath.Join(dst, "opaque"), "trusted.overlay.opaque", buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("opaque marker = %q, %v", buf[:n], err)
+	}
+	if n, err := unix.Lgetxattr(filepath.Join(dst, "opaque", "owned"), "user.note", buf); err != nil || string(buf[:n]) != "kept" {
+		t.Errorf("user xattr = %q, %v", buf[:n], err)
+	}
+	st, err = os.Stat(filepath.Join(dst, "opaque", "owned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys := st.Sys().(*syscall.Stat_t); sys.Uid != 1234 || sys.Gid != 5678 {
+		t.Errorf("owner = %d:%d, want 1234:5678", sys.Uid, sys.Gid)
+	}
+}
+
+func TestWriteDirPayload_Reproducible(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("same"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Several MiB, so the multi-threaded codecs split it into blocks.
+	if err := os.WriteFile(filepath.Join(src, "big"), textData(4<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Codec{CodecGzip, CodecNone, CodecZstd, CodecLZ4, CodecPgzip} {
+		var first, second bytes.Buffer
+		if err := writeDirPayload(&first, src, c, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Reading the files must not change the next stream (atime).
+		time.Sleep(10 * time.Millisecond)
+		if _, err := os.ReadFile(filepath.Join(src, "f")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeDirPayload(&second, src, c, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s payload of an unchanged layer differs between runs; resume would corrupt it", c)
+		}
+	}
+}
+
+// --- payload codecs ---
+
+// textData returns n bytes of compressible, non-repeating text.
+func textData(n int) []byte {
+	rng := mrand.New(mrand.NewSource(1))
+	words := []string{"broker", "topic", "retain", "qos", "client", "session", "will", "payload"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%s/%d ", words[rng.Intn(len(words))], rng.Intn(1000))
+	}
+	return b.Bytes()[:n]
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	mrand.New(mrand.NewSource(2)).Read(b)
+	return b
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"text.log":       textData(3 << 20),
+		"sub/random.bin": randomData(200 << 10),
+		"empty":          nil,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizes := make(map[Codec]int)
+	for _, c := range []Codec{CodecGzip, CodecNone, CodecZstd, CodecLZ4, CodecPgzip} {
+		var buf bytes.Buffer
+		if err := writeDirPayload(&buf, src, c, nil); err != nil {
+			t.Fatalf("%s: writeDirPayload: %v", c, err)
+		}
+		sizes[c] = buf.Len()
+		dst := t.TempDir()
+		if err := ExtractTar(&buf, c, dst); err != nil {
+			t.Fatalf("%s: ExtractTar: %v", c, err)
+		}
+		for name, want := range files {
+			got, err := os.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Fatalf("%s: %v", c, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: %s differs after round trip", c, name)
+			}
+		}
+	}
+	for _, c := range []Codec{CodecGzip, CodecZstd, CodecLZ4, CodecPgzip} {
+		if sizes[c] >= sizes[CodecNone] {
+			t.Errorf("%s payload is %d bytes, uncompressed is %d", c, sizes[c], sizes[CodecNone])
+		}
+	}
+}
+
+func TestExtractTar_WrongCodecFails(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), textData(4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeDirPayload(&buf, src, CodecZstd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractTar(&buf, CodecGzip, t.TempDir()); err == nil {
+		t.Fatal("a zstd payload must not extract as gzip")
+	}
+	if err := ExtractTar(strings.NewReader(""), Codec(42), t.TempDir()); err == nil {
+		t.Fatal("an unknown codec must be rejected")
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for name, want := range map[string]Codec{
+		"": CodecGzip, "gzip": CodecGzip, "none": CodecNone, "zstd": CodecZstd,
+		"LZ4": CodecLZ4, " pgzip ": CodecPgzip, "auto": CodecAuto,
+	} {
+		got, err := ParseCodec(name)
+		if err != nil || got != want {
+			t.Errorf("ParseCodec(%q) = %s, %v; want %s", name, got, err, want)
+		}
+	}
+	if _, err := ParseCodec("brotli"); err == nil {
+		t.Error("ParseCodec must reject unknown names")
+	}
+}
+
+func TestFrameHeader_CarriesCodecInVersion2(t *testing.T) {
+	h := FrameHeader{Kind: KindLayer, Ordinal: 3, Name: "u3", Seq: 7, Codec: CodecZstd}
+	buf, err := encodeFrameHeader(h, wire.SessionVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, version, err := readFrameHeader(bytes.NewReader(buf))
+	if err != nil || version != wire.SessionVersion || got != h {
+		t.Fatalf("round trip = %+v v%d %v, want %+v", got, version, err, h)
+	}
+	if _, err := encodeFrameHeader(h, wire.Version); err == nil {
+		t.Fatal("a version-1 header must not carry a codec")
+	}
+}
+
+func TestResolveCodec_Auto(t *testing.T) {
+	dir := t.TempDir()
+	packed := filepath.Join(dir, "ckpt_app.dmtcp")
+	if err := os.WriteFile(packed, randomData(300<<10), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	text := filepath.Join(dir, "mosquitto.log")
+	if err := os.WriteFile(text, textData(300<<10), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolveCodec(CodecAuto, packed); got != CodecNone {
+		t.Errorf("auto for incompressible file = %s, want none", got)
+	}
+	if got := resolveCodec(CodecAuto, text); got != CodecZstd {
+		t.Errorf("auto for text = %s, want zstd", got)
+	}
+	if got := resolveCodec(CodecLZ4, packed); got != CodecLZ4 {
+		t.Errorf("explicit codec must be kept, got %s", got)
+	}
+}
+
+func TestSession_AutoCodecPerFrame(t *testing.T) {
+	packedDir, textDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(packedDir, "mosquitto.db"), randomData(200<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(textDir, "app.log"), textData(200<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	var mu sync.Mutex
+	codecs := make(map[string]Codec)
+	addr, resCh := startReceiver(t, func(h FrameHeader, payload io.Reader) error {
+		mu.Lock()
+		codecs[h.Name] = h.Codec
+		mu.Unlock()
+		return ExtractPayload(h, payload, filepath.Join(dst, h.Name))
+	})
+
+	sess, err := DialSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.SetCodec(CodecAuto)
+	if err := sess.SendDir(1, "packed", packedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SendDir(2, "text", textDir); err != nil {
+		t.Fatal(err)
+	}
+	sess.SetCodec(CodecLZ4)
+	if err := sess.SendDir(3, "fast", textDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-resCh; res.err != nil {
+		t.Fatalf("receive: %v", res.err)
+	}
+
+	want := map[string]Codec{"packed": CodecNone, "text": CodecZstd, "fast": CodecLZ4}
+	for name, c := range want {
+		if codecs[name] != c {
+			t.Errorf("frame %s codec = %s, want %s", name, codecs[name], c)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "text", "app.log"))
+	if err != nil || !bytes.Equal(got, textData(200<<10)) {
+		t.Errorf("text layer differs after transfer (err %v)", err)
+	}
+}
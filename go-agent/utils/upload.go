@@ -0,0 +1,392 @@
+package utils
+
+// Transfers kept in a CheckpointStore.
+//
+// An Upload is the store-backed counterpart of a Session: the source queues
+// the same frames, and each becomes one object of a checkpoint set:
+//
+//	<set>/000001.frame   payload of frame 1 (the compressed tar)
+//	<set>/000002.frame   ...
+//	<set>/index.json     SetIndex: the frames and the DONE manifest
+//
+// The index is written by Done, after every payload, so a set without one
+// is incomplete and never restored. Download verifies each payload against
+// the SHA-256 in the index before its handler sees it, and the manifest
+// like ReceiveAllWith does.
+//
+// Migrations use the set MigrationSet(pod, migration id); snapshots one
+// SnapshotSet(pod, time) per point in time.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	setIndexName  = "index.json"
+	maxIndexSize  = 4 << 20
+	snapshotStamp = "20060102T150405Z"
+)
+
+// Sender is the source side of a transfer: a Session to the destination or
+// an Upload to a checkpoint store.
+type Sender interface {
+	SendDir(ordinal int, name, dir string) error
+	SendLayer(ordinal int, name, dir string, base DeltaBase) error
+	SendCheckpointFile(path string) error
+	SendCheckpointPart(p FilePart) error
+	Flush() error
+	Expect(items ...ManifestEntry)
+	Sent() []ManifestEntry
+	Done() error
+	Close() error
+}
+
+var (
+	_ Sender = (*Session)(nil)
+	_ Sender = (*Upload)(nil)
+)
+
+// SetIndex describes a complete checkpoint set.
+type SetIndex struct {
+	Created  time.Time     `json:"created"`
+	Frames   []StoredFrame `json:"frames"`
+	Manifest Manifest      `json:"manifest"`
+}
+
+// StoredFrame is one frame of a set; it is stored as object <n>.frame,
+// n being its position in SetIndex.Frames plus one.
+type StoredFrame struct {
+	Kind    FrameKind `json:"kind"`
+	Ordinal int       `json:"ordinal,omitempty"`
+	Name    string    `json:"name"`
+	Codec   Codec     `json:"codec"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+}
+
+func (f StoredFrame) header() FrameHeader {
+	return FrameHeader{Kind: f.Kind, Ordinal: f.Ordinal, Name: f.Name, Codec: f.Codec}
+}
+
+// MigrationSet is the set a source uploads for migration id of pod.
+func MigrationSet(pod, migration string) string {
+	return "migrations/" + pod + "/" + migration
+}
+
+// SnapshotSet is the set of pod's snapshot taken at t.
+func SnapshotSet(pod string, t time.Time) string {
+	return "snapshots/" + pod + "/" + t.UTC().Format(snapshotStamp)
+}
+
+func frameKey(set string, n int) string { return fmt.Sprintf("%s/%06d.frame", set, n) }
+
+// UploadOptions configures OpenUpload.
+type UploadOptions struct {
+	// SpoolDir holds each payload while it is produced, so its size and
+	// digest are known before it is stored. Empty means os.TempDir().
+	SpoolDir string
+}
+
+// Upload writes a transfer to a checkpoint set. Frames are stored as they
+// are sent, so Flush has nothing to wait for. An Upload is safe for
+// concurrent use.
+type Upload struct {
+	store CheckpointStore
+	set   string
+	spool string
+
+	mu     sync.Mutex
+	codec  Codec
+	frames []StoredFrame
+	expect []ManifestEntry
+	err    error
+}
+
+// OpenUpload starts a new upload to set, replacing any set there. Payloads
+// are compressed with TRANSFER_CODEC (default gzip) until SetCodec says
+// otherwise.
+func OpenUpload(store CheckpointStore, set string, opts UploadOptions) (*Upload, error) {
+	if err := checkKey(set); err != nil {
+		return nil, err
+	}
+	codec, err := ParseCodec(os.Getenv("TRANSFER_CODEC"))
+	if err != nil {
+		return nil, fmt.Errorf("TRANSFER_CODEC: %w", err)
+	}
+	if err := DeleteSet(store, set); err != nil {
+		return nil, fmt.Errorf("replace set %s: %w", set, err)
+	}
+	return &Upload{store: store, set: set, spool: opts.SpoolDir, codec: codec}, nil
+}
+
+// SetCodec sets the payload codec of frames sent from now on.
+func (u *Upload) SetCodec(c Codec) {
+	u.mu.Lock()
+	u.codec = c
+	u.mu.Unlock()
+}
+
+func (u *Upload) frameCodec(path string) Codec {
+	u.mu.Lock()
+	c := u.codec
+	u.mu.Unlock()
+	return resolveCodec(c, path)
+}
+
+// SendDir stores the directory dir as layer ordinal.
+func (u *Upload) SendDir(ordinal int, name, dir string) error {
+	return u.SendLayer(ordinal, name, dir, nil)
+}
+
+// SendLayer stores the directory dir as layer ordinal, delta encoding large
+// files against their earlier version at base.
+func (u *Upload) SendLayer(ordinal int, name, dir string, base DeltaBase) error {
+	codec := u.frameCodec(dir)
+	return u.put(FrameHeader{Kind: KindLayer, Ordinal: ordinal, Name: name, Codec: codec}, func(w io.Writer) error {
+		return writeDirPayload(w, dir, codec, base)
+	})
+}
+
+// SendCheckpointFile stores the single checkpoint file at path.
+func (u *Upload) SendCheckpointFile(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	codec := u.frameCodec(path)
+	return u.put(FrameHeader{Kind: KindCheckpointFile, Name: filepath.Base(path), Codec: codec}, func(w io.Writer) error {
+		return writeFilePayload(w, path, codec)
+	})
+}
+
+// SendCheckpointPart stores part p of a checkpoint file being written.
+func (u *Upload) SendCheckpointPart(p FilePart) error {
+	codec := u.frameCodec(p.Path)
+	return u.put(FrameHeader{Kind: KindCheckpointPart, Ordinal: p.Index, Name: p.Name, Codec: codec}, func(w io.Writer) error {
+		return compressPayload(w, codec, func(w io.Writer) error {
+			return writePartTar(w, p)
+		})
+	})
+}
+
+// put spools the payload of h, stores it as the next frame and records it.
+// The first failure sticks: every later call returns it.
+func (u *Upload) put(h FrameHeader, payload func(w io.Writer) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	if err := u.putLocked(h, payload); err != nil {
+		u.err = fmt.Errorf("upload %q to %s: %w", h.Name, u.set, err)
+		return u.err
+	}
+	return nil
+}
+
+func (u *Upload) putLocked(h FrameHeader, payload func(w io.Writer) error) error {
+	f, err := os.CreateTemp(u.spool, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("create spool: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	sum := sha256.New()
+	if err := payload(io.MultiWriter(f, sum)); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := u.store.Put(frameKey(u.set, len(u.frames)+1), f, size); err != nil {
+		return err
+	}
+	u.frames = append(u.frames, StoredFrame{
+		Kind: h.Kind, Ordinal: h.Ordinal, Name: h.Name, Codec: h.Codec,
+		Size: size, SHA256: hex.EncodeToString(sum.Sum(nil)),
+	})
+	return nil
+}
+
+// Flush returns the upload error, if any; frames are stored when sent.
+func (u *Upload) Flush() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// Expect adds items the destination received elsewhere to the manifest.
+func (u *Upload) Expect(items ...ManifestEntry) {
+	u.mu.Lock()
+	u.expect = append(u.expect, items...)
+	u.mu.Unlock()
+}
+
+// Sent returns the items stored so far.
+func (u *Upload) Sent() []ManifestEntry {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	items := make([]ManifestEntry, 0, len(u.frames))
+	for _, f := range u.frames {
+		items = append(items, ManifestEntry{Kind: f.Kind, Ordinal: f.Ordinal, Name: f.Name, SHA256: f.SHA256})
+	}
+	return items
+}
+
+// Done writes the set's index, which completes it.
+func (u *Upload) Done() error {
+	sent := u.Sent()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	idx := SetIndex{Created: time.Now().UTC(), Frames: u.frames, Manifest: mergeManifest(u.expect, sent)}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := u.store.Put(u.set+"/"+setIndexName, strings.NewReader(string(data)), int64(len(data))); err != nil {
+		u.err = fmt.Errorf("complete set %s: %w", u.set, err)
+		return u.err
+	}
+	return nil
+}
+
+// Close releases nothing; an Upload holds no connection.
+func (u *Upload) Close() error { return nil }
+
+// ReadSet returns the index of set. An incomplete or missing set returns an
+// error wrapping os.ErrNotExist.
+func ReadSet(store CheckpointStore, set string) (SetIndex, error) {
+	var idx SetIndex
+	rc, err := store.Get(set + "/" + setIndexName)
+	if err != nil {
+		return idx, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxIndexSize+1))
+	if err != nil {
+		return idx, fmt.Errorf("read index of %s: %w", set, err)
+	}
+	if len(data) > maxIndexSize {
+		return idx, fmt.Errorf("index of %s exceeds %d bytes", set, maxIndexSize)
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return idx, fmt.Errorf("parse index of %s: %w", set, err)
+	}
+	return idx, nil
+}
+
+// ListSets returns the complete sets below prefix (e.g. "snapshots/web-0"),
+// oldest name first.
+func ListSets(store CheckpointStore, prefix string) ([]string, error) {
+	keys, err := store.List(strings.TrimSuffix(prefix, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	var sets []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/"+setIndexName) {
+			sets = append(sets, strings.TrimSuffix(k, "/"+setIndexName))
+		}
+	}
+	sort.Strings(sets)
+	return sets, nil
+}
+
+// DeleteSet removes every object of set, the index first so an interrupted
+// delete leaves an incomplete set rather than a damaged complete one.
+func DeleteSet(store CheckpointStore, set string) error {
+	keys, err := store.List(set + "/")
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return strings.HasSuffix(keys[i], "/"+setIndexName) && !strings.HasSuffix(keys[j], "/"+setIndexName)
+	})
+	for _, k := range keys {
+		if err := store.Delete(k); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadOptions configures Download.
+type DownloadOptions struct {
+	// SpoolDir picks the directory a frame's payload is verified in before
+	// its handler runs. Nil spools to os.TempDir().
+	SpoolDir func(h FrameHeader) string
+}
+
+// Download hands every frame of the complete set to handle, in order, and
+// checks the set's manifest. It returns the headers of the frames; a set
+// that is missing or incomplete returns an error wrapping os.ErrNotExist.
+func Download(store CheckpointStore, set string, opts DownloadOptions, handle FrameHandler) ([]FrameHeader, error) {
+	idx, err := ReadSet(store, set)
+	if err != nil {
+		return nil, err
+	}
+	var frames []FrameHeader
+	received := make(map[itemKey]string)
+	for i, f := range idx.Frames {
+		h := f.header()
+		h.Seq = uint32(i + 1)
+		dir := ""
+		if opts.SpoolDir != nil {
+			dir = opts.SpoolDir(h)
+		}
+		if err := downloadFrame(store, frameKey(set, i+1), dir, f, func(r io.Reader) error { return handle(h, r) }); err != nil {
+			return frames, fmt.Errorf("%s of %s: %w", ManifestEntry{Kind: f.Kind, Ordinal: f.Ordinal, Name: f.Name}, set, err)
+		}
+		received[headerKey(h)] = f.SHA256
+		frames = append(frames, h)
+	}
+	if err := idx.Manifest.check(received); err != nil {
+		return frames, err
+	}
+	return frames, nil
+}
+
+// downloadFrame spools the object at key to dir, checks it against f and
+// passes it to deliver.
+func downloadFrame(store CheckpointStore, key, dir string, f StoredFrame, deliver func(r io.Reader) error) error {
+	rc, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return fmt.Errorf("create spool: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), rc)
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); size != f.Size || got != f.SHA256 {
+		return fmt.Errorf("stored payload (%d bytes, digest %.12s) does not match the index (%d bytes, digest %.12s)", size, got, f.Size, f.SHA256)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return deliver(tmp)
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadFixture stores a layer directory and a checkpoint file in set.
+func uploadFixture(t *testing.T, st CheckpointStore, set string) {
+	t.Helper()
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "layer", "etc"), 0o755)
+	os.WriteFile(filepath.Join(src, "layer", "etc", "app.conf"), []byte("listener 1883"), 0o644)
+	os.WriteFile(filepath.Join(src, "ckpt_app.dmtcp"), []byte("process image"), 0o644)
+
+	up, err := OpenUpload(st, set, UploadOptions{SpoolDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.SetCodec(CodecZstd)
+	if err := up.SendDir(1, "u1", filepath.Join(src, "layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.SendCheckpointFile(filepath.Join(src, "ckpt_app.dmtcp")); err != nil {
+		t.Fatal(err)
+	}
+	if sent := up.Sent(); len(sent) != 2 || len(sent[0].SHA256) != 64 {
+		t.Fatalf("Sent = %+v", sent)
+	}
+	if err := up.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// downloadAll extracts every frame of set below dir.
+func downloadAll(st CheckpointStore, set, dir string) ([]FrameHeader, error) {
+	return Download(st, set, DownloadOptions{}, func(h FrameHeader, payload io.Reader) error {
+		return ExtractPayload(h, payload, filepath.Join(dir, h.Name))
+	})
+}
+
+func TestUploadDownload(t *testing.T) {
+	_, s3 := newFakeS3(t)
+	for name, st := range map[string]CheckpointStore{"fs": &FSStore{Root: t.TempDir()}, "s3": s3} {
+		t.Run(name, func(t *testing.T) {
+			set := MigrationSet("web-0", "uid-1")
+			if _, err := downloadAll(st, set, t.TempDir()); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("Download of a missing set = %v, want os.ErrNotExist", err)
+			}
+			uploadFixture(t, st, set)
+
+			dst := t.TempDir()
+			frames, err := downloadAll(st, set, dst)
+			if err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			want := []FrameHeader{
+				{Kind: KindLayer, Ordinal: 1, Name: "u1", Seq: 1, Codec: CodecZstd},
+				{Kind: KindCheckpointFile, Name: "ckpt_app.dmtcp", Seq: 2, Codec: CodecZstd},
+			}
+			if !reflect.DeepEqual(frames, want) {
+				t.Fatalf("frames = %+v, want %+v", frames, want)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dst, "u1", "etc", "app.conf")); string(got) != "listener 1883" {
+				t.Errorf("layer content = %q", got)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dst, "ckpt_app.dmtcp", "ckpt_app.dmtcp")); string(got) != "process image" {
+				t.Errorf("checkpoint content = %q", got)
+			}
+
+			if err := DeleteSet(st, set); err != nil {
+				t.Fatal(err)
+			}
+			if keys, _ := st.List(set + "/"); len(keys) != 0 {
+				t.Fatalf("DeleteSet left %v", keys)
+			}
+		})
+	}
+}
+
+// TestDownload_RefusesDamagedSets checks a set is only restored when every
+// payload matches the index and the manifest is satisfied.
+func TestDownload_RefusesDamagedSets(t *testing.T) {
+	st := &FSStore{Root: t.TempDir()}
+	set := MigrationSet("web-0", "uid-1")
+	uploadFixture(t, st, set)
+	if err := st.Put(set+"/000002.frame", strings.NewReader("tampered"), 8); err != nil {
+		t.Fatal(err)
+	}
+	handled := 0
+	_, err := Download(st, set, DownloadOptions{}, func(h FrameHeader, payload io.Reader) error {
+		handled++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not match the index") {
+		t.Fatalf("Download of a tampered set = %v", err)
+	}
+	if handled != 1 {
+		t.Errorf("the tampered frame must not reach the handler (%d handled)", handled)
+	}
+
+	// Items the source vouched for but sent elsewhere must be present.
+	up, err := OpenUpload(st, set, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Expect(ManifestEntry{Kind: KindLayer, Ordinal: 1, Name: "u1"})
+	if err := up.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadAll(st, set, t.TempDir()); err == nil || !strings.Contains(err.Error(), "layer 1 (u1) missing") {
+		t.Fatalf("Download of an incomplete manifest = %v", err)
+	}
+
+	// An upload that never reached Done leaves no restorable set.
+	if _, err := OpenUpload(st, set, UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSet(st, set); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadSet of an unfinished upload = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestListSets(t *testing.T) {
+	st := &FSStore{Root: t.TempDir()}
+	t0 := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	for _, at := range []time.Time{t0.Add(time.Hour), t0} {
+		up, err := OpenUpload(st, SnapshotSet("web-0", at), UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := up.Done(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unfinished: no index.
+	st.Put("snapshots/web-0/20261018T120000Z/000001.frame", strings.NewReader("x"), 1)
+
+	sets, err := ListSets(st, "snapshots/web-0")
+	want := []string{"snapshots/web-0/20261018T090000Z", "snapshots/web-0/20261018T100000Z"}
+	if err != nil || !reflect.DeepEqual(sets, want) {
+		t.Fatalf("ListSets = %v, %v; want %v", sets, err, want)
+	}
+}
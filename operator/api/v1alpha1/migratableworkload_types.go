@@ -18,6 +18,11 @@ const (
 	DefaultTransferPort        = 2486
 	DefaultLayerCount          = 1
 	DefaultPreSyncRounds       = 1
+	DefaultMaxPreSyncRounds    = 10
+	DefaultCompression         = "gzip"
+	DefaultTransferStreams     = 1
+	DefaultAbortPolicy         = "Fail"
+	DefaultVolumeMountMode     = "Privileged"
 )
 
 // WorkloadReference points at the Kubernetes workload (in the same namespace
@@ -86,6 +91,72 @@ type MigratableWorkloadSpec struct {
 	// VolumeMigration is enabled. Defaults to 1; 0 disables pre-sync.
 	// +optional
 	PreSyncRounds *int32 `json:"preSyncRounds,omitempty"`
+
+	// TargetDowntimeMs makes the pre-sync rounds adaptive: after each one
+	// the source Execution Agent projects from the measured dirty rate and
+	// throughput how long the final layer would take to transfer, and
+	// keeps iterating until that fits TargetDowntimeMs, the rounds stop
+	// converging, or MaxPreSyncRounds is reached. PreSyncRounds is then
+	// the minimum. 0 (the default) runs exactly PreSyncRounds rounds.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TargetDowntimeMs int32 `json:"targetDowntimeMs,omitempty"`
+
+	// MaxPreSyncRounds bounds the adaptive pre-sync rounds. Only used
+	// with TargetDowntimeMs. Defaults to 10.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxPreSyncRounds int32 `json:"maxPreSyncRounds,omitempty"`
+
+	// Compression is the codec the source Execution Agent compresses
+	// transfer payloads with: none, gzip, pgzip (multi-core gzip), zstd,
+	// lz4, or auto (zstd, skipped for files that do not compress, such as
+	// DMTCP gzip images). Propagated via the /remove and /poll responses.
+	// Defaults to gzip.
+	// +kubebuilder:validation:Enum=none;gzip;pgzip;zstd;lz4;auto
+	// +optional
+	Compression string `json:"compression,omitempty"`
+
+	// TransferStreams is how many parallel connections the source
+	// Execution Agent stripes a large checkpoint file over when it sends
+	// straight to the destination, to fill links with a high
+	// bandwidth-delay product. Propagated via the /remove response.
+	// Defaults to 1 (no striping).
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=16
+	// +optional
+	TransferStreams int32 `json:"transferStreams,omitempty"`
+
+	// MaxTransferBytesPerSecond caps the bandwidth of the migration's
+	// transfer, so migration traffic between edge sites leaves room for
+	// the workloads' own. Both Execution Agents pace their connections to
+	// it; the cap holds for all striping connections together. Propagated
+	// via the /register, /remove and /poll responses. 0 (the default)
+	// does not cap.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond,omitempty"`
+
+	// AbortPolicy is what the destination Execution Agent does when the
+	// migration is aborted before its transfer completed (the source
+	// aborted, the Migration failed or was deleted, or the transfer timed
+	// out): Fresh starts the application without migrated state,
+	// KeepVolume starts it on the volume layers received so far, and Fail
+	// keeps the destination failing until someone intervenes. Propagated
+	// via the /register response. Defaults to Fail.
+	// +kubebuilder:validation:Enum=Fresh;KeepVolume;Fail
+	// +optional
+	AbortPolicy string `json:"abortPolicy,omitempty"`
+
+	// VolumeMountMode is how the Execution Agent mounts the overlay volume
+	// stack: Privileged uses the kernel's overlayfs and needs a privileged
+	// container; UserNamespace uses it too, from the pod's own user
+	// namespace (hostUsers: false, Linux 5.11+); FUSE uses fuse-overlayfs,
+	// also from the pod's own user namespace, with /dev/fuse. Propagated
+	// via the /register response. Defaults to Privileged.
+	// +kubebuilder:validation:Enum=Privileged;UserNamespace;FUSE
+	// +optional
+	VolumeMountMode string `json:"volumeMountMode,omitempty"`
 }
 
 // RegisteredPod mirrors one Execution Agent registration from the operator's
@@ -198,6 +269,68 @@ func (m *MigratableWorkload) EffectivePreSyncRounds() int32 {
 	return DefaultPreSyncRounds
 }
 
+// EffectiveTargetDowntimeMs returns the target downtime of adaptive
+// pre-sync rounds, 0 when they are not adaptive.
+func (m *MigratableWorkload) EffectiveTargetDowntimeMs() int32 {
+	if !m.VolumeMigrationEnabled() || m.Spec.TargetDowntimeMs < 0 {
+		return 0
+	}
+	return m.Spec.TargetDowntimeMs
+}
+
+// EffectiveMaxPreSyncRounds returns how many pre-downtime overlay sync
+// rounds the source may run: EffectivePreSyncRounds, or with a target
+// downtime MaxPreSyncRounds (default 10, never below the minimum).
+func (m *MigratableWorkload) EffectiveMaxPreSyncRounds() int32 {
+	rounds := m.EffectivePreSyncRounds()
+	if m.EffectiveTargetDowntimeMs() == 0 {
+		return rounds
+	}
+	max := m.Spec.MaxPreSyncRounds
+	if max < 1 {
+		max = DefaultMaxPreSyncRounds
+	}
+	if max < rounds {
+		return rounds
+	}
+	return max
+}
+
+// EffectiveCompression returns the transfer payload codec (default gzip).
+func (m *MigratableWorkload) EffectiveCompression() string {
+	if m.Spec.Compression == "" {
+		return DefaultCompression
+	}
+	return m.Spec.Compression
+}
+
+// EffectiveTransferStreams returns how many connections a large checkpoint
+// file is striped over (default 1).
+func (m *MigratableWorkload) EffectiveTransferStreams() int32 {
+	if m.Spec.TransferStreams < 1 {
+		return DefaultTransferStreams
+	}
+	return m.Spec.TransferStreams
+}
+
+// EffectiveAbortPolicy returns what the destination does after an abort
+// (default Fail).
+func (m *MigratableWorkload) EffectiveAbortPolicy() string {
+	if m.Spec.AbortPolicy == "" {
+		return DefaultAbortPolicy
+	}
+	return m.Spec.AbortPolicy
+}
+
+// EffectiveVolumeMountMode returns how the overlay volume is mounted
+// (default Privileged).
+func (m *MigratableWorkload) EffectiveVolumeMountMode() string {
+	if m.Spec.VolumeMountMode == "" {
+		return DefaultVolumeMountMode
+	}
+	return m.Spec.VolumeMountMode
+}
+
 func init() {
 	SchemeBuilder.Register(&MigratableWorkload{}, &MigratableWorkloadList{})
 }
@@ -35,6 +35,12 @@ const (
 	MigrationPhaseFailed MigrationPhase = "Failed"
 )
 
+// MigrationConditionTransferred is the condition reporting the transfer of
+// the checkpoint and overlay layers: False (reason InProgress) while the
+// source Execution Agent reports progress, True (reason Complete) once it
+// called POST /copy.
+const MigrationConditionTransferred = "Transferred"
+
 // MigrationSpec is a request to move one pod of a MigratableWorkload from
 // sourceNode to targetNode.
 type MigrationSpec struct {
@@ -78,13 +84,59 @@ type MigrationStatus struct {
 	// MigratableWorkload when the migration started.
 	// +optional
 	VolumeMigration bool `json:"volumeMigration,omitempty"`
-	// SyncRounds is the number of pre-downtime overlay rounds requested.
+	// SyncRounds is the number of pre-downtime overlay rounds requested,
+	// their maximum when TargetDowntimeMs makes them adaptive.
 	// +optional
 	SyncRounds int32 `json:"syncRounds,omitempty"`
+	// MinSyncRounds is the minimum number of adaptive pre-downtime rounds.
+	// +optional
+	MinSyncRounds int32 `json:"minSyncRounds,omitempty"`
+	// TargetDowntimeMs is the target downtime of adaptive pre-downtime
+	// rounds copied from the MigratableWorkload when the migration started
+	// (0: a fixed number of rounds).
+	// +optional
+	TargetDowntimeMs int32 `json:"targetDowntimeMs,omitempty"`
 	// SyncRound is the last pre-downtime overlay round completed by the
 	// source Execution Agent.
 	// +optional
 	SyncRound int32 `json:"syncRound,omitempty"`
+	// SyncStopReason is why the source Execution Agent stopped adaptive
+	// rounds: Converged, Stalled or MaxRounds.
+	// +optional
+	SyncStopReason string `json:"syncStopReason,omitempty"`
+	// PreSync is what the source Execution Agent measured in each
+	// pre-downtime round.
+	// +optional
+	PreSync []SyncRoundStatus `json:"preSync,omitempty"`
+	// Compression is the transfer payload codec copied from the
+	// MigratableWorkload when the migration started.
+	// +optional
+	Compression string `json:"compression,omitempty"`
+	// TransferStreams is the number of striping connections copied from
+	// the MigratableWorkload when the migration started.
+	// +optional
+	TransferStreams int32 `json:"transferStreams,omitempty"`
+	// MaxTransferBytesPerSecond is the bandwidth cap copied from the
+	// MigratableWorkload when the migration started (0: none).
+	// +optional
+	MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond,omitempty"`
+	// AbortPolicy is what the destination does should the migration be
+	// aborted, copied from the MigratableWorkload when the migration
+	// started.
+	// +optional
+	AbortPolicy string `json:"abortPolicy,omitempty"`
+	// Abort describes how the migration was aborted before its transfer
+	// completed and what the destination Execution Agent did about it.
+	// +optional
+	Abort *MigrationAbort `json:"abort,omitempty"`
+	// Transfer is how far the source Execution Agent's transfer got, as it
+	// last reported with POST /progress.
+	// +optional
+	Transfer *TransferProgress `json:"transfer,omitempty"`
+	// LayerCount is the number of overlay layers the source Execution Agent
+	// reported sending with POST /copy.
+	// +optional
+	LayerCount int32 `json:"layerCount,omitempty"`
 	// ScaledUp records that the operator scaled a Deployment up and still
 	// owes a compensating scale-down on completion.
 	// +optional
@@ -100,6 +152,73 @@ type MigrationStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+// TransferProgress is how far the transfer of a migration's checkpoint and
+// overlay layers got.
+type TransferProgress struct {
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`
+	// Percent is BytesDone as a share of BytesTotal.
+	Percent int32 `json:"percent"`
+	// BytesPerSecond is the recent throughput.
+	// +optional
+	BytesPerSecond int64 `json:"bytesPerSecond,omitempty"`
+	// ETASeconds estimates the time left at BytesPerSecond.
+	// +optional
+	ETASeconds int64 `json:"etaSeconds,omitempty"`
+	// Items is the progress per layer or checkpoint file, in the order the
+	// source queued them.
+	// +optional
+	Items []TransferItemProgress `json:"items,omitempty"`
+	// LastUpdateTime is when the report arrived.
+	// +optional
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// TransferItemProgress is how far the transfer of one layer or checkpoint
+// file got.
+type TransferItemProgress struct {
+	Name       string `json:"name"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
+}
+
+// SyncRoundStatus is what the source Execution Agent measured in one
+// pre-downtime overlay round.
+type SyncRoundStatus struct {
+	Round int32 `json:"round"`
+	// LayerBytes is the size of the layer the round froze, FillMs how long
+	// the application took to write it.
+	LayerBytes int64 `json:"layerBytes"`
+	// +optional
+	FillMs int64 `json:"fillMs,omitempty"`
+	// SentBytes is what the round transferred, SendMs how long that took;
+	// zero while the destination had not registered.
+	// +optional
+	SentBytes int64 `json:"sentBytes,omitempty"`
+	// +optional
+	SendMs int64 `json:"sendMs,omitempty"`
+	// ProjectedDowntimeMs is how long the final layer would have taken to
+	// transfer had the rounds stopped here; -1 when the round transferred
+	// nothing to measure the throughput on.
+	ProjectedDowntimeMs int64 `json:"projectedDowntimeMs"`
+}
+
+// MigrationAbort describes an aborted transfer.
+type MigrationAbort struct {
+	// Reason is why the transfer was aborted.
+	Reason string `json:"reason"`
+	// Policy is the abort policy the destination applied.
+	// +optional
+	Policy string `json:"policy,omitempty"`
+	// Outcome is what the destination Execution Agent reported doing
+	// (POST /aborted); empty until it reports.
+	// +optional
+	Outcome string `json:"outcome,omitempty"`
+	// ReportTime is when the destination's report arrived.
+	// +optional
+	ReportTime *metav1.Time `json:"reportTime,omitempty"`
+}
+
 // IsTerminal reports whether the migration reached a terminal phase.
 func (s *MigrationStatus) IsTerminal() bool {
 	return s.Phase == MigrationPhaseCompleted || s.Phase == MigrationPhaseFailed
@@ -113,6 +232,7 @@ func (s *MigrationStatus) IsTerminal() bool {
 // +kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.spec.sourceNode`
 // +kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.spec.targetNode`
 // +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Transferred",type=integer,JSONPath=`.status.transfer.percent`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Migration represents one stateful pod migration request.
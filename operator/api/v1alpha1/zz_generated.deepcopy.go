@@ -195,6 +195,19 @@ func (in *MigrationSpec) DeepCopy() *MigrationSpec {
 // DeepCopyInto copies the receiver into out.
 func (in *MigrationStatus) DeepCopyInto(out *MigrationStatus) {
 	*out = *in
+	if in.PreSync != nil {
+		in, out := &in.PreSync, &out.PreSync
+		*out = make([]SyncRoundStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Abort != nil {
+		in, out := &in.Abort, &out.Abort
+		*out = (*in).DeepCopy()
+	}
+	if in.Transfer != nil {
+		in, out := &in.Transfer, &out.Transfer
+		*out = (*in).DeepCopy()
+	}
 	if in.StartTime != nil {
 		in, out := &in.StartTime, &out.StartTime
 		*out = (*in).DeepCopy()
@@ -226,6 +239,49 @@ func (in *MigrationStatus) DeepCopy() *MigrationStatus {
 	return out
 }
 
+// DeepCopyInto copies the receiver into out.
+func (in *MigrationAbort) DeepCopyInto(out *MigrationAbort) {
+	*out = *in
+	if in.ReportTime != nil {
+		in, out := &in.ReportTime, &out.ReportTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy creates a new MigrationAbort.
+func (in *MigrationAbort) DeepCopy() *MigrationAbort {
+	if in == nil {
+		return nil
+	}
+	out := new(MigrationAbort)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *TransferProgress) DeepCopyInto(out *TransferProgress) {
+	*out = *in
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TransferItemProgress, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastUpdateTime != nil {
+		in, out := &in.LastUpdateTime, &out.LastUpdateTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy creates a new TransferProgress.
+func (in *TransferProgress) DeepCopy() *TransferProgress {
+	if in == nil {
+		return nil
+	}
+	out := new(TransferProgress)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto copies the receiver into out.
 func (in *Migration) DeepCopyInto(out *Migration) {
 	*out = *in
@@ -52,6 +52,9 @@ func (r *MigratableWorkloadReconciler) Reconcile(ctx context.Context, req ctrl.R
 		phase, message = "Pending", mw.Spec.WorkloadRef.Kind+" "+mw.Spec.WorkloadRef.Name+" not found"
 	}
 
+	// Agents of the workload learn its mount mode when they register.
+	r.Registry.SetMountMode(mw.Spec.WorkloadRef.Name, mw.EffectiveVolumeMountMode())
+
 	// Mirror registry records belonging to this workload into status.
 	var mirrored []mycedrivev1alpha1.RegisteredPod
 	for _, rec := range r.Registry.List() {
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -64,7 +66,7 @@ func (r *MigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return r.finalize(ctx, mig)
 	}
 	if mig.Status.IsTerminal() {
-		return ctrl.Result{}, nil
+		return r.awaitAbortReport(ctx, mig)
 	}
 
 	if !controllerutil.ContainsFinalizer(mig, migrationFinalizer) {
@@ -83,9 +85,15 @@ func (r *MigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	if report, ok := r.abortReport(mig); ok {
+		return r.fail(ctx, mig, fmt.Sprintf("destination Execution Agent aborted the transfer: %s", report.Reason))
+	}
 	if expired, msg := r.phaseExpired(mig); expired {
 		return r.fail(ctx, mig, msg)
 	}
+	if lost, msg := r.armLost(mig); lost {
+		return r.fail(ctx, mig, msg)
+	}
 
 	var (
 		res ctrl.Result
@@ -170,7 +178,15 @@ func (r *MigrationReconciler) reconcilePending(ctx context.Context, mig *mycedri
 		// not change an in-flight migration.
 		mig.Status.ProcessMigration = mw.ProcessMigrationEnabled()
 		mig.Status.VolumeMigration = mw.VolumeMigrationEnabled()
-		mig.Status.SyncRounds = mw.EffectivePreSyncRounds()
+		mig.Status.SyncRounds = mw.EffectiveMaxPreSyncRounds()
+		mig.Status.TargetDowntimeMs = mw.EffectiveTargetDowntimeMs()
+		if mig.Status.TargetDowntimeMs > 0 {
+			mig.Status.MinSyncRounds = mw.EffectivePreSyncRounds()
+		}
+		mig.Status.Compression = mw.EffectiveCompression()
+		mig.Status.TransferStreams = mw.EffectiveTransferStreams()
+		mig.Status.MaxTransferBytesPerSecond = mw.Spec.MaxTransferBytesPerSecond
+		mig.Status.AbortPolicy = mw.EffectiveAbortPolicy()
 		if mw.Spec.WorkloadRef.Kind == mycedrivev1alpha1.WorkloadKindStatefulSet {
 			// Stable names: the destination pod is the recreated source pod.
 			mig.Status.DestinationPod = source.Name
@@ -181,6 +197,14 @@ func (r *MigrationReconciler) reconcilePending(ctx context.Context, mig *mycedri
 		return ctrl.Result{Requeue: true}, nil
 	}
 
+	// The source EA's agent key is what hands it the transfer token; one
+	// that registered with an earlier operator process is unknown here.
+	if mig.Status.ProcessMigration || mig.Status.VolumeMigration {
+		if rec, ok := r.Registry.Get(mig.Status.SourcePod); !ok || rec.AgentKey == "" {
+			return r.requeueWithMessage(ctx, mig, fmt.Sprintf("waiting for the source Execution Agent of pod %q to register; an agent that registered before an operator restart is only known again once its pod restarts", mig.Status.SourcePod))
+		}
+	}
+
 	// 2. Steer scheduling: placement label on target, removed from source.
 	key, value := mw.EffectivePlacementLabel()
 	if err := setNodeLabel(ctx, r.Client, mig.Spec.TargetNode, key, value); err != nil {
@@ -197,6 +221,15 @@ func (r *MigrationReconciler) reconcilePending(ctx context.Context, mig *mycedri
 		ProcessMigration: mig.Status.ProcessMigration,
 		VolumeMigration:  mig.Status.VolumeMigration,
 		SyncRounds:       int(mig.Status.SyncRounds),
+		MinSyncRounds:    int(mig.Status.MinSyncRounds),
+		TargetDowntimeMs: int64(mig.Status.TargetDowntimeMs),
+		Compression:      mig.Status.Compression,
+		TransferStreams:  int(mig.Status.TransferStreams),
+		MaxBytesPerSec:   mig.Status.MaxTransferBytesPerSecond,
+		AbortPolicy:      mig.Status.AbortPolicy,
+		MigrationID:      string(mig.UID),
+		Namespace:        mig.Namespace,
+		TargetNode:       mig.Spec.TargetNode,
 	})
 	r.Registry.SetNode(mig.Status.SourcePod, mig.Spec.SourceNode)
 
@@ -233,8 +266,12 @@ func (r *MigrationReconciler) reconcilePending(ctx context.Context, mig *mycedri
 	// snapshot rounds while the pod is still running (CloudCom 2020) before
 	// taking the downtime hit.
 	if mig.Status.SyncRounds > 0 {
-		return r.setPhase(ctx, mig, mycedrivev1alpha1.MigrationPhaseSyncing,
-			fmt.Sprintf("pre-downtime overlay sync: waiting for %d round(s) from source Execution Agent", mig.Status.SyncRounds))
+		msg := fmt.Sprintf("pre-downtime overlay sync: waiting for %d round(s) from source Execution Agent", mig.Status.SyncRounds)
+		if mig.Status.TargetDowntimeMs > 0 {
+			msg = fmt.Sprintf("pre-downtime overlay sync: waiting for %d to %d round(s) from source Execution Agent, until the projected downtime is within %dms",
+				mig.Status.MinSyncRounds, mig.Status.SyncRounds, mig.Status.TargetDowntimeMs)
+		}
+		return r.setPhase(ctx, mig, mycedrivev1alpha1.MigrationPhaseSyncing, msg)
 	}
 
 	// 6. No pre-sync requested: enter downtime immediately.
@@ -242,25 +279,58 @@ func (r *MigrationReconciler) reconcilePending(ctx context.Context, mig *mycedri
 }
 
 // reconcileSyncing waits for the source EA to complete the requested
-// pre-downtime overlay snapshot rounds (reported via POST /sync), then
-// deletes the source pod to enter the downtime window.
+// pre-downtime overlay snapshot rounds (reported via POST /sync), or with a
+// target downtime to report why it stopped, then deletes the source pod to
+// enter the downtime window.
 func (r *MigrationReconciler) reconcileSyncing(ctx context.Context, mig *mycedrivev1alpha1.Migration, _ *mycedrivev1alpha1.MigratableWorkload) (ctrl.Result, error) {
 	rec, ok := r.Registry.Get(mig.Status.SourcePod)
 	if !ok {
 		return ctrl.Result{RequeueAfter: requeueInterval}, nil
 	}
-	if int32(rec.SyncRound) != mig.Status.SyncRound {
-		mig.Status.SyncRound = int32(rec.SyncRound)
+	if r.applySyncRounds(mig, rec) {
 		if err := r.Status().Update(ctx, mig); err != nil && !apierrors.IsConflict(err) {
 			return ctrl.Result{}, err
 		}
 	}
-	if rec.SyncRound < rec.SyncRounds {
+	if rec.SyncRound < rec.SyncRounds && rec.SyncStopReason == "" {
 		return ctrl.Result{RequeueAfter: requeueInterval}, nil
 	}
+	if rec.SyncStopReason != "" {
+		logf.FromContext(ctx).Info("pre-downtime rounds stopped", "rounds", rec.SyncRound, "reason", rec.SyncStopReason)
+	}
 	return r.deleteSourceAndAdvance(ctx, mig)
 }
 
+// applySyncRounds copies the source EA's pre-downtime round reports into
+// the status. It reports whether the status changed.
+func (r *MigrationReconciler) applySyncRounds(mig *mycedrivev1alpha1.Migration, rec registry.PodRecord) bool {
+	changed := false
+	if int32(rec.SyncRound) != mig.Status.SyncRound {
+		mig.Status.SyncRound = int32(rec.SyncRound)
+		changed = true
+	}
+	if rec.SyncStopReason != mig.Status.SyncStopReason {
+		mig.Status.SyncStopReason = rec.SyncStopReason
+		changed = true
+	}
+	var rounds []mycedrivev1alpha1.SyncRoundStatus
+	for _, s := range rec.SyncStats {
+		rounds = append(rounds, mycedrivev1alpha1.SyncRoundStatus{
+			Round:               int32(s.Round),
+			LayerBytes:          s.LayerBytes,
+			FillMs:              s.FillMs,
+			SentBytes:           s.SentBytes,
+			SendMs:              s.SendMs,
+			ProjectedDowntimeMs: s.ProjectedDowntimeMs,
+		})
+	}
+	if !equality.Semantic.DeepEqual(mig.Status.PreSync, rounds) {
+		mig.Status.PreSync = rounds
+		changed = true
+	}
+	return changed
+}
+
 // deleteSourceAndAdvance deletes the source pod (kubelet runs preStop → EA
 // calls /remove → checkpoint work begins) and moves to the next phase:
 // Checkpointing when any state mechanism is enabled, otherwise straight to
@@ -288,15 +358,109 @@ func (r *MigrationReconciler) deleteSourceAndAdvance(ctx context.Context, mig *m
 		"waiting for source Execution Agent to produce its final checkpoint")
 }
 
-// reconcileCheckpointing waits for the source EA to call POST /copy.
+// reconcileCheckpointing waits for the source EA to call POST /copy,
+// publishing the transfer progress it reports meanwhile.
 func (r *MigrationReconciler) reconcileCheckpointing(ctx context.Context, mig *mycedrivev1alpha1.Migration) (ctrl.Result, error) {
 	rec, ok := r.Registry.Get(mig.Status.SourcePod)
-	if ok && rec.CheckpointReady {
+	if !ok {
+		return ctrl.Result{RequeueAfter: requeueInterval}, nil
+	}
+	changed := r.applyProgress(mig, rec)
+	if rec.CheckpointReady {
 		return r.setPhase(ctx, mig, mycedrivev1alpha1.MigrationPhaseTransferring, "checkpoint written; transferring checkpoint and overlay layers to destination")
 	}
+	if changed {
+		if err := r.Status().Update(ctx, mig); err != nil && !apierrors.IsConflict(err) {
+			return ctrl.Result{}, err
+		}
+	}
 	return ctrl.Result{RequeueAfter: requeueInterval}, nil
 }
 
+// applyProgress copies the source EA's latest transfer progress report and,
+// once it called POST /copy, its layer count into the status and the
+// Transferred condition, and forwards the report to the metrics module. It
+// reports whether the status changed.
+func (r *MigrationReconciler) applyProgress(mig *mycedrivev1alpha1.Migration, rec registry.PodRecord) bool {
+	changed := false
+	if p := rec.Progress; !p.UpdatedAt.IsZero() {
+		updated := metav1.NewTime(p.UpdatedAt.Truncate(time.Second)) // what survives the round trip
+		next := &mycedrivev1alpha1.TransferProgress{
+			BytesDone:      p.BytesDone,
+			BytesTotal:     p.BytesTotal,
+			BytesPerSecond: p.BytesPerSecond,
+			LastUpdateTime: &updated,
+		}
+		if p.BytesTotal > 0 {
+			next.Percent = int32(p.BytesDone * 100 / p.BytesTotal)
+		}
+		if left := p.BytesTotal - p.BytesDone; left > 0 && p.BytesPerSecond > 0 {
+			next.ETASeconds = (left + p.BytesPerSecond - 1) / p.BytesPerSecond
+		}
+		for _, it := range p.Items {
+			next.Items = append(next.Items, mycedrivev1alpha1.TransferItemProgress{Name: it.Name, BytesDone: it.BytesDone, BytesTotal: it.BytesTotal})
+		}
+		if !equality.Semantic.DeepEqual(mig.Status.Transfer, next) {
+			mig.Status.Transfer = next
+			changed = true
+			if r.History != nil {
+				r.History.RecordProgress(mig.Namespace, mig.Name, history.Transfer{BytesDone: p.BytesDone, BytesTotal: p.BytesTotal, BytesPerSecond: p.BytesPerSecond})
+			}
+		}
+	}
+	if !rec.CheckpointReady && mig.Status.Transfer == nil {
+		return changed
+	}
+
+	cond := metav1.Condition{
+		Type:               mycedrivev1alpha1.MigrationConditionTransferred,
+		Status:             metav1.ConditionFalse,
+		Reason:             "InProgress",
+		ObservedGeneration: mig.Generation,
+	}
+	if t := mig.Status.Transfer; t != nil {
+		cond.Message = fmt.Sprintf("%s of %s sent (%d%%)", formatBytes(t.BytesDone), formatBytes(t.BytesTotal), t.Percent)
+		if t.BytesPerSecond > 0 {
+			cond.Message += fmt.Sprintf(" at %s/s", formatBytes(t.BytesPerSecond))
+		}
+		if t.ETASeconds > 0 {
+			cond.Message += fmt.Sprintf(", about %s left", time.Duration(t.ETASeconds)*time.Second)
+		}
+	}
+	if rec.CheckpointReady {
+		if int32(rec.LayerCount) != mig.Status.LayerCount {
+			mig.Status.LayerCount = int32(rec.LayerCount)
+			changed = true
+		}
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "Complete"
+		if cond.Message == "" {
+			cond.Message = "source Execution Agent finished its transfer"
+		}
+		if mig.Status.LayerCount > 0 {
+			cond.Message += fmt.Sprintf("; %d volume layer(s)", mig.Status.LayerCount)
+		}
+	}
+	if meta.SetStatusCondition(&mig.Status.Conditions, cond) {
+		changed = true
+	}
+	return changed
+}
+
+// formatBytes renders n bytes for condition messages.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
 // reconcileTransferring waits for the destination EA to register.
 func (r *MigrationReconciler) reconcileTransferring(ctx context.Context, mig *mycedrivev1alpha1.Migration, mw *mycedrivev1alpha1.MigratableWorkload) (ctrl.Result, error) {
 	destUp := false
@@ -318,8 +482,10 @@ func (r *MigrationReconciler) reconcileTransferring(ctx context.Context, mig *my
 // the destination pod to report Ready, then completes the migration.
 func (r *MigrationReconciler) reconcileRestoring(ctx context.Context, mig *mycedrivev1alpha1.Migration, mw *mycedrivev1alpha1.MigratableWorkload) (ctrl.Result, error) {
 	restored := false
+	var timing registry.RestoreTiming
 	if rec, ok := r.Registry.Get(mig.Status.DestinationPod); ok && rec.Restored {
 		restored = true
+		timing = rec.RestoreTiming
 	}
 	if !restored {
 		var pod corev1.Pod
@@ -345,13 +511,18 @@ func (r *MigrationReconciler) reconcileRestoring(ctx context.Context, mig *myced
 	r.clearRegistryFlags(mig)
 	now := metav1.Now()
 	mig.Status.CompletionTime = &now
-	return r.setPhase(ctx, mig, mycedrivev1alpha1.MigrationPhaseCompleted, fmt.Sprintf("pod %s restored on node %s", mig.Status.DestinationPod, mig.Spec.TargetNode))
+	msg := fmt.Sprintf("pod %s restored on node %s", mig.Status.DestinationPod, mig.Spec.TargetNode)
+	if timing.Peers > 0 {
+		msg += fmt.Sprintf(" (%d process(es) rejoined the DMTCP coordinator %dms after dmtcp_restart; transfer took %dms)", timing.Peers, timing.RestoreMs, timing.TransferMs)
+	}
+	return r.setPhase(ctx, mig, mycedrivev1alpha1.MigrationPhaseCompleted, msg)
 }
 
 // finalize cleans registry state when a Migration is deleted mid-flight.
 func (r *MigrationReconciler) finalize(ctx context.Context, mig *mycedrivev1alpha1.Migration) (ctrl.Result, error) {
 	if controllerutil.ContainsFinalizer(mig, migrationFinalizer) {
 		if !mig.Status.IsTerminal() {
+			r.abortTransfer(mig, "the Migration was deleted")
 			r.clearRegistryFlags(mig)
 		}
 		controllerutil.RemoveFinalizer(mig, migrationFinalizer)
@@ -362,6 +533,79 @@ func (r *MigrationReconciler) finalize(ctx context.Context, mig *mycedrivev1alph
 	return ctrl.Result{}, nil
 }
 
+// destinationRecord names the registry record of the destination EA: the
+// destination pod, or the source pod while a Deployment's destination is
+// unknown.
+func destinationRecord(mig *mycedrivev1alpha1.Migration) string {
+	if mig.Status.DestinationPod != "" {
+		return mig.Status.DestinationPod
+	}
+	return mig.Status.SourcePod
+}
+
+// transferUnderway reports whether the destination EA may be waiting for,
+// or receiving, the transfer of mig.
+func transferUnderway(mig *mycedrivev1alpha1.Migration) bool {
+	switch mig.Status.Phase {
+	case mycedrivev1alpha1.MigrationPhaseCheckpointing,
+		mycedrivev1alpha1.MigrationPhaseTransferring,
+		mycedrivev1alpha1.MigrationPhaseRestoring:
+		return true
+	}
+	return false
+}
+
+// abortTransfer tells the destination EA of mig, through /poll, to stop
+// waiting for a transfer that will not complete and apply its abort policy.
+// Its report (POST /aborted) is copied into status.abort by
+// awaitAbortReport.
+func (r *MigrationReconciler) abortTransfer(mig *mycedrivev1alpha1.Migration, reason string) {
+	if !transferUnderway(mig) || mig.Status.Abort != nil {
+		return
+	}
+	r.Registry.Abort(destinationRecord(mig), string(mig.UID), reason)
+	mig.Status.Abort = &mycedrivev1alpha1.MigrationAbort{Reason: reason, Policy: mig.Status.AbortPolicy}
+}
+
+// abortReport returns the destination EA's report of having aborted the
+// transfer of mig, if it sent one.
+func (r *MigrationReconciler) abortReport(mig *mycedrivev1alpha1.Migration) (registry.AbortReport, bool) {
+	rec, ok := r.Registry.Get(destinationRecord(mig))
+	if !ok || rec.AbortReport.ReportedAt.IsZero() || rec.AbortReport.MigrationID != string(mig.UID) {
+		return registry.AbortReport{}, false
+	}
+	return rec.AbortReport, true
+}
+
+// awaitAbortReport copies the destination EA's account of an aborted
+// transfer into status.abort, polling for up to phaseTimeout after the
+// migration ended.
+func (r *MigrationReconciler) awaitAbortReport(ctx context.Context, mig *mycedrivev1alpha1.Migration) (ctrl.Result, error) {
+	abort := mig.Status.Abort
+	if abort == nil || abort.ReportTime != nil {
+		return ctrl.Result{}, nil
+	}
+	report, ok := r.abortReport(mig)
+	if !ok {
+		if mig.Status.CompletionTime != nil && time.Since(mig.Status.CompletionTime.Time) > phaseTimeout {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{RequeueAfter: requeueInterval}, nil
+	}
+	reported := metav1.NewTime(report.ReportedAt)
+	abort.Policy = report.Policy
+	abort.Outcome = report.Outcome
+	abort.ReportTime = &reported
+	if err := r.Status().Update(ctx, mig); err != nil {
+		if apierrors.IsConflict(err) {
+			return ctrl.Result{RequeueAfter: time.Second}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	logf.FromContext(ctx).Info("destination applied its abort policy", "policy", report.Policy, "outcome", report.Outcome)
+	return ctrl.Result{}, nil
+}
+
 func (r *MigrationReconciler) clearRegistryFlags(mig *mycedrivev1alpha1.Migration) {
 	if mig.Status.SourcePod != "" {
 		r.Registry.Disarm(mig.Status.SourcePod)
@@ -453,6 +697,7 @@ func SeedHistory(ctx context.Context, reader client.Reader, store *history.Store
 // fail moves the migration to the terminal Failed phase.
 func (r *MigrationReconciler) fail(ctx context.Context, mig *mycedrivev1alpha1.Migration, message string) (ctrl.Result, error) {
 	logf.FromContext(ctx).Info("migration failed", "reason", message)
+	r.abortTransfer(mig, message)
 	r.clearRegistryFlags(mig)
 	now := metav1.Now()
 	mig.Status.CompletionTime = &now
@@ -470,6 +715,26 @@ func (r *MigrationReconciler) requeueWithMessage(ctx context.Context, mig *myced
 	return ctrl.Result{RequeueAfter: requeueInterval}, nil
 }
 
+// armLost reports whether the registry no longer holds the armed state of
+// a migration past Pending. The registry lives in memory, so an operator
+// restart drops the arm and with it the agent keys and the transfer token
+// the source and destination EAs were handed; the migration cannot finish
+// and fails at once rather than when its phase times out.
+func (r *MigrationReconciler) armLost(mig *mycedrivev1alpha1.Migration) (bool, string) {
+	switch mig.Status.Phase {
+	case mycedrivev1alpha1.MigrationPhaseSyncing, mycedrivev1alpha1.MigrationPhaseCheckpointing, mycedrivev1alpha1.MigrationPhaseTransferring:
+	default:
+		return false, ""
+	}
+	if !mig.Status.ProcessMigration && !mig.Status.VolumeMigration {
+		return false, ""
+	}
+	if r.Registry.Armed(mig.Status.SourcePod, string(mig.UID)) {
+		return false, ""
+	}
+	return true, fmt.Sprintf("operator restarted during phase %s: the migration's transfer credentials were lost; create a new Migration", mig.Status.Phase)
+}
+
 // phaseExpired reports whether the current non-terminal phase exceeded
 // phaseTimeout.
 func (r *MigrationReconciler) phaseExpired(mig *mycedrivev1alpha1.Migration) (bool, string) {
@@ -20,8 +20,10 @@ import (
 
 	mycedrivev1alpha1 "github.com/paulosouzajr/mycedrive-k8s/operator/api/v1alpha1"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/internal/controller"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/history"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/relay"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/restapi"
 )
 
@@ -44,6 +46,13 @@ func main() {
 		enableLeaderElection bool
 		historyEnabled       bool
 		historyLimit         int
+		transferTLS          bool
+		transferCACert       string
+		transferCAKey        string
+		transferCertTTL      time.Duration
+		relayAddr            string
+		relayAdvertise       string
+		relayDir             string
 	)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to ('0' disables it).")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the health probe endpoint binds to.")
@@ -52,6 +61,13 @@ func main() {
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false, "Enable leader election for controller manager.")
 	flag.BoolVar(&historyEnabled, "history-enabled", true, "Enable the migration history & metrics module (also toggleable at runtime via the REST API).")
 	flag.IntVar(&historyLimit, "history-limit", history.DefaultLimit, "Maximum number of migrations kept in the in-memory history.")
+	flag.BoolVar(&transferTLS, "transfer-tls", true, "Issue per-migration certificates so Execution Agents transfer checkpoints over mutual TLS.")
+	flag.StringVar(&transferCACert, "transfer-ca-cert", "", "PEM CA certificate for transfer certificates (with --transfer-ca-key); a CA is generated at start-up when empty.")
+	flag.StringVar(&transferCAKey, "transfer-ca-key", "", "PEM private key of --transfer-ca-cert.")
+	flag.DurationVar(&transferCertTTL, "transfer-cert-ttl", ca.DefaultTTL, "Lifetime of an issued transfer certificate.")
+	flag.StringVar(&relayAddr, "relay-bind-address", "", "The address the transfer relay binds to; empty disables the relay.")
+	flag.StringVar(&relayAdvertise, "relay-advertise-address", "", "The host:port source agents dial to reach the transfer relay.")
+	flag.StringVar(&relayDir, "relay-dir", "/var/lib/mycedrive/relay", "Directory the transfer relay buffers checkpoints in.")
 
 	opts := zap.Options{Development: false}
 	opts.BindFlags(flag.CommandLine)
@@ -71,7 +87,41 @@ func main() {
 		os.Exit(1)
 	}
 
+	var transferCA *ca.CA
+	if transferTLS {
+		if transferCACert != "" {
+			transferCA, err = ca.Load(transferCACert, transferCAKey, transferCertTTL)
+		} else {
+			setupLog.Info("generating a transfer CA; certificates issued before a restart will not verify after it")
+			transferCA, err = ca.New(transferCertTTL)
+		}
+		if err != nil {
+			setupLog.Error(err, "unable to set up the transfer CA")
+			os.Exit(1)
+		}
+	}
+
 	reg := registry.New()
+
+	var transferRelay *relay.Relay
+	if relayAddr != "" {
+		if relayAdvertise == "" {
+			setupLog.Error(nil, "--relay-advertise-address is required with --relay-bind-address")
+			os.Exit(1)
+		}
+		transferRelay = &relay.Relay{
+			Addr:      relayAddr,
+			Advertise: relayAdvertise,
+			Dir:       relayDir,
+			Registry:  reg,
+			CA:        transferCA,
+			Log:       ctrl.Log.WithName("relay"),
+		}
+		if err := mgr.Add(transferRelay); err != nil {
+			setupLog.Error(err, "unable to add transfer relay")
+			os.Exit(1)
+		}
+	}
 	hist := history.NewStore(historyEnabled, historyLimit)
 	// Restore agent registrations mirrored into MigratableWorkload statuses
 	// and coarse migration history from Migration CRs so both survive
@@ -120,6 +170,8 @@ func main() {
 		DefaultNamespace: defaultNamespace,
 		Log:              ctrl.Log.WithName("restapi"),
 		History:          hist,
+		CA:               transferCA,
+		Relay:            transferRelay,
 	}); err != nil {
 		setupLog.Error(err, "unable to add REST API server")
 		os.Exit(1)
@@ -0,0 +1,265 @@
+// Package ca is the operator's transfer certificate authority. The source
+// and destination Execution Agents of a migration stream process images and
+// volume layers to each other directly; the CA issues each of them a
+// short-lived certificate naming the migration and the agent's role, handed
+// out in the /register, /remove and /poll responses, so both ends can
+// authenticate each other (mutual TLS) without any cluster-wide PKI.
+//
+// A leaf certificate carries one URI SAN:
+//
+//	spiffe://mycedrive.io/migration/<migration id>/<source|destination>
+//
+// and an agent accepts a peer only if it chains to the CA, carries the same
+// migration id and the opposite role. The CA key is generated at start-up
+// unless main loads one (from a Secret) so certificates issued before an
+// operator restart keep verifying.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// DefaultTTL is the lifetime of an issued leaf certificate.
+const DefaultTTL = time.Hour
+
+const (
+	// IdentityHost is the trust domain of leaf certificate URIs.
+	IdentityHost = wire.IdentityHost
+
+	caLifetime = 10 * 365 * 24 * time.Hour
+	// clockSkew backdates NotBefore so agents on nodes whose clock runs
+	// slightly behind accept a fresh certificate.
+	clockSkew = 5 * time.Minute
+)
+
+// Role is the side of the transfer a certificate is issued to.
+type Role string
+
+const (
+	// RoleSource dials the destination (TLS client).
+	RoleSource Role = wire.RoleSource
+	// RoleDestination listens for the transfer (TLS server).
+	RoleDestination Role = wire.RoleDestination
+)
+
+// Bundle is the PEM material an agent needs for one migration. It is the
+// "tls" object of the REST responses.
+type Bundle struct {
+	CACert string `json:"caCert"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// CA issues per-migration transfer certificates. It is safe for concurrent
+// use.
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM string
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	issued map[issueKey]issued
+}
+
+type issueKey struct {
+	migration string
+	role      Role
+}
+
+type issued struct {
+	bundle   *Bundle
+	notAfter time.Time
+}
+
+// New returns a CA with a freshly generated self-signed key.
+func New(ttl time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate CA key: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mycedrive transfer CA"},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return newCA(cert, key, ttl), nil
+}
+
+// Load returns a CA using the PEM certificate and private key in certFile
+// and keyFile (a kubernetes.io/tls Secret mounted into the operator).
+func Load(certFile, keyFile string, ttl time.Duration) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("%s does not hold the key of %s", keyFile, certFile)
+	}
+	return newCA(cert, key, ttl), nil
+}
+
+func newCA(cert *x509.Certificate, key crypto.Signer, ttl time.Duration) *CA {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &CA{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		ttl:     ttl,
+		issued:  make(map[issueKey]issued),
+	}
+}
+
+func parseKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM key")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// CertPEM returns the CA certificate agents verify their peers against.
+func (c *CA) CertPEM() string { return c.certPEM }
+
+// Issue returns the bundle for podName acting as role in migration. A
+// bundle is reused while it has more than half its lifetime left, so
+// agents polling the REST API do not mint a key per request.
+func (c *CA) Issue(migration, podName string, role Role) (*Bundle, error) {
+	if migration == "" {
+		return nil, errors.New("migration id is required")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	k := issueKey{migration, role}
+	if prev, ok := c.issued[k]; ok && prev.notAfter.Sub(now) > c.ttl/2 {
+		return prev.bundle, nil
+	}
+	for k, prev := range c.issued {
+		if now.After(prev.notAfter) {
+			delete(c.issued, k)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	usage := x509.ExtKeyUsageClientAuth
+	if role == RoleDestination {
+		usage = x509.ExtKeyUsageServerAuth
+	}
+	notAfter := now.Add(c.ttl)
+	if notAfter.After(c.cert.NotAfter) {
+		notAfter = c.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: podName},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		URIs:         []*url.URL{Identity(migration, role)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, key.Public(), c.key)
+	if err != nil {
+		return nil, fmt.Errorf("sign %s certificate for %s: %w", role, podName, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{
+		CACert: c.certPEM,
+		Cert:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+	c.issued[k] = issued{bundle: b, notAfter: notAfter}
+	return b, nil
+}
+
+// Identity returns the URI SAN of role's certificate in migration.
+func Identity(migration string, role Role) *url.URL {
+	return wire.Identity(migration, string(role))
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,158 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func parseLeaf(t *testing.T, b *Bundle) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(b.Cert))
+	if block == nil {
+		t.Fatalf("bundle has no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// TestIssue checks a leaf chains to the CA and names migration and role.
+func TestIssue(t *testing.T) {
+	c, err := New(10 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := c.Issue("uid-1", "web-0", RoleSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := c.Issue("uid-1", "web-0", RoleDestination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.CACert != c.CertPEM() {
+		t.Fatalf("bundle must carry the CA certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(c.CertPEM()))
+	for _, tc := range []struct {
+		b     *Bundle
+		role  Role
+		usage x509.ExtKeyUsage
+	}{
+		{src, RoleSource, x509.ExtKeyUsageClientAuth},
+		{dst, RoleDestination, x509.ExtKeyUsageServerAuth},
+	} {
+		leaf := parseLeaf(t, tc.b)
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{tc.usage}}); err != nil {
+			t.Errorf("%s certificate does not verify: %v", tc.role, err)
+		}
+		if len(leaf.URIs) != 1 || leaf.URIs[0].String() != Identity("uid-1", tc.role).String() {
+			t.Errorf("%s certificate URIs = %v", tc.role, leaf.URIs)
+		}
+		if life := leaf.NotAfter.Sub(time.Now()); life > 10*time.Minute || life < 9*time.Minute {
+			t.Errorf("%s certificate lifetime = %s, want the TTL", tc.role, life)
+		}
+		if leaf.Subject.CommonName != "web-0" {
+			t.Errorf("CommonName = %q, want the pod name", leaf.Subject.CommonName)
+		}
+	}
+	if got := Identity("uid-1", RoleSource).String(); got != "spiffe://mycedrive.io/migration/uid-1/source" {
+		t.Errorf("Identity = %s", got)
+	}
+}
+
+// TestIssueReusesFreshBundle checks polling agents get the same key until
+// the certificate is half-way through its lifetime.
+func TestIssueReusesFreshBundle(t *testing.T) {
+	c, err := New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := c.Issue("uid-1", "web-0", RoleSource)
+	b, _ := c.Issue("uid-1", "web-0", RoleSource)
+	if a != b {
+		t.Fatalf("a fresh bundle must be reused")
+	}
+	other, _ := c.Issue("uid-2", "web-0", RoleSource)
+	if other.Key == a.Key {
+		t.Fatalf("another migration must get its own key")
+	}
+
+	// Age the cached bundle past half its lifetime.
+	c.mu.Lock()
+	k := issueKey{"uid-1", RoleSource}
+	e := c.issued[k]
+	e.notAfter = time.Now().Add(20 * time.Minute)
+	c.issued[k] = e
+	c.mu.Unlock()
+	if renewed, _ := c.Issue("uid-1", "web-0", RoleSource); renewed == a {
+		t.Fatalf("a bundle past half its lifetime must be renewed")
+	}
+
+	if _, err := c.Issue("", "web-0", RoleSource); err == nil {
+		t.Fatalf("Issue without a migration id must fail")
+	}
+}
+
+// TestLoad checks a CA read from a mounted Secret signs verifiable leaves.
+func TestLoad(t *testing.T) {
+	orig, err := New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(orig.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, []byte(orig.CertPEM()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(certFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loaded.Issue("uid-1", "web-0", RoleDestination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(orig.CertPEM()))
+	if _, err := parseLeaf(t, b).Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		t.Fatalf("leaf from the loaded CA does not verify against the original: %v", err)
+	}
+
+	// A key that does not belong to the certificate.
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherDER, _ := x509.MarshalECPrivateKey(other)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(certFile, keyFile, time.Hour); err == nil {
+		t.Fatalf("Load must refuse a key that does not match the certificate")
+	}
+
+	// A leaf certificate is not a CA.
+	if err := os.WriteFile(certFile, []byte(b.Cert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(certFile, keyFile, time.Hour); err == nil {
+		t.Fatalf("Load must refuse a non-CA certificate")
+	}
+}
@@ -44,6 +44,15 @@ type Step struct {
 	EndedAt    *time.Time `json:"endedAt,omitempty"`
 	DurationMs int64      `json:"durationMs"`
 	Accessible bool       `json:"accessible"`
+	// Transfer is the last transfer progress reported during the step.
+	Transfer *Transfer `json:"transfer,omitempty"`
+}
+
+// Transfer is a transfer progress report of the source Execution Agent.
+type Transfer struct {
+	BytesDone      int64 `json:"bytesDone"`
+	BytesTotal     int64 `json:"bytesTotal"`
+	BytesPerSecond int64 `json:"bytesPerSecond,omitempty"`
 }
 
 // Record is the recorded history of one migration.
@@ -200,6 +209,24 @@ func (s *Store) RecordTransition(tr Transition) {
 	})
 }
 
+// RecordProgress attaches a transfer progress report to the migration's
+// current step, replacing the previous one. Dropped while the module is
+// disabled or when the migration has no open step.
+func (s *Store) RecordProgress(namespace, name string, tr Transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return
+	}
+	rec, ok := s.records[namespace+"/"+name]
+	if !ok {
+		return
+	}
+	if n := len(rec.Steps); n > 0 && rec.Steps[n-1].EndedAt == nil {
+		rec.Steps[n-1].Transfer = &tr
+	}
+}
+
 // Seed restores records (typically rebuilt from Migration CRs after an
 // operator restart) without overwriting live entries.
 func (s *Store) Seed(records []Record) {
@@ -110,6 +110,36 @@ func TestActiveRecordLiveDurations(t *testing.T) {
 	}
 }
 
+// TestRecordProgress checks transfer progress lands on the open step and
+// stays with it once the migration moves on.
+func TestRecordProgress(t *testing.T) {
+	s := NewStore(true, 10)
+	base := time.Now().Add(-time.Minute)
+	s.RecordProgress("mig-ready", "web-abc12", Transfer{BytesDone: 1}) // unknown migration
+	s.RecordTransition(transitionAt("Pending", "preparing", base))
+	s.RecordTransition(transitionAt("Checkpointing", "checkpointing", base.Add(time.Second)))
+	s.RecordProgress("mig-ready", "web-abc12", Transfer{BytesDone: 2 << 20, BytesTotal: 8 << 20, BytesPerSecond: 1 << 20})
+	s.RecordProgress("mig-ready", "web-abc12", Transfer{BytesDone: 8 << 20, BytesTotal: 8 << 20, BytesPerSecond: 2 << 20})
+	s.RecordTransition(transitionAt("Transferring", "transferring", base.Add(5*time.Second)))
+
+	steps := s.Snapshot()[0].Steps
+	if len(steps) != 3 {
+		t.Fatalf("steps = %+v", steps)
+	}
+	if steps[0].Transfer != nil || steps[2].Transfer != nil {
+		t.Fatalf("progress must only land on the step it was reported in: %+v", steps)
+	}
+	if tr := steps[1].Transfer; tr == nil || *tr != (Transfer{BytesDone: 8 << 20, BytesTotal: 8 << 20, BytesPerSecond: 2 << 20}) {
+		t.Fatalf("checkpointing step transfer = %+v, want the last report", tr)
+	}
+
+	s.SetEnabled(false)
+	s.RecordProgress("mig-ready", "web-abc12", Transfer{BytesDone: 1})
+	if tr := s.Snapshot()[0].Steps[2].Transfer; tr != nil {
+		t.Fatalf("disabled store must drop progress, got %+v", tr)
+	}
+}
+
 // TestDisabledDropsTransitions checks the runtime toggle: disabled stores
 // drop transitions but keep already-recorded history.
 func TestDisabledDropsTransitions(t *testing.T) {
@@ -3,9 +3,14 @@
 // API (written to by agents) and the Migration controller (read to advance
 // migration phases). The MigratableWorkload controller mirrors records into
 // CRD status so the registry can be re-seeded after an operator restart.
+// Agent keys, transfer tokens and armed migrations are not mirrored: a
+// restart fails the migrations in flight and leaves the running agents
+// without a key until their pods restart and register again.
 package registry
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net"
 	"sort"
 	"strconv"
@@ -56,8 +61,9 @@ type PodRecord struct {
 	//   Migrating       — an active Migration targets this pod; /remove
 	//                     answers needsCheckpoint=true.
 	//   CheckpointReady — the source EA called /copy.
-	//   DestRegistered  — a registration arrived while Migrating (the
-	//                     destination EA came up; StatefulSet same-name flow).
+	//   DestRegistered  — the destination EA registered under the pod's
+	//                     name (RegisterDestination; StatefulSet same-name
+	//                     flow).
 	//   Restored        — the destination EA called /restored.
 	Migrating       bool
 	CheckpointDir   string
@@ -72,35 +78,185 @@ type PodRecord struct {
 
 	// Pre-downtime overlay sync progress (volume migration): SyncRounds is
 	// requested by the controller, SyncRound is the last round the source
-	// EA reported via POST /sync.
-	SyncRounds int
-	SyncRound  int
+	// EA reported via POST /sync. With a TargetDowntimeMs the rounds are
+	// adaptive: SyncRounds is their maximum, MinSyncRounds their minimum,
+	// and SyncStopReason is set once the source EA reported stopping.
+	// SyncStats is what it measured per round; a report replaces the
+	// slice, so copies may share it.
+	SyncRounds       int
+	SyncRound        int
+	MinSyncRounds    int
+	TargetDowntimeMs int64
+	SyncStopReason   string
+	SyncStats        []SyncRoundStats
+
+	// Compression is the transfer payload codec the source EA is told to
+	// use (empty: the agent's default).
+	Compression string
+
+	// TransferStreams is how many connections the source EA stripes a
+	// large checkpoint file over (0 or 1: one).
+	TransferStreams int
+
+	// MaxBytesPerSec caps the transfer bandwidth of both EAs (0: none).
+	MaxBytesPerSec int64
+
+	// AbortPolicy is what the destination EA does should the armed
+	// migration be aborted (empty: the agent's default).
+	AbortPolicy string
+
+	// MigrationID identifies the armed migration (the Migration's UID) in
+	// the transfer certificates issued to its source and destination EAs.
+	MigrationID string
+
+	// TransferToken is the random secret minted by Arm for the armed
+	// migration. Both EAs get it (/register, /remove, and /poll for the
+	// authenticated source) and the destination only accepts transfer
+	// frames signed with it.
+	TransferToken string
+
+	// TargetNode is the node the armed migration moves the pod to; only a
+	// registration the REST API traced to the pod running there is the
+	// destination's (RegisterDestination).
+	TargetNode string
 
 	// DestAddress is the migration-target EA's transfer endpoint
-	// ("host:port"), captured from the duplicate /register that arrives
-	// while a migration is armed. Returned to the source EA in the /remove
+	// ("host:port"), captured from the destination's registration
+	// (RegisterDestination) while a migration is armed. Returned to the source EA in the /remove
 	// response so it can stream checkpoints directly to the destination.
 	DestAddress string
 
+	// LayerCount is the number of volume layers the source EA reported
+	// with POST /copy; zero for agents that do not send it.
+	LayerCount int
+
+	// Progress is the source EA's latest transfer progress report
+	// (POST /progress); zero until the first one arrives.
+	Progress TransferProgress
+
+	// RestoreTiming is what the destination EA's restore supervisor
+	// reported with POST /restored; zero for agents that do not send it.
+	RestoreTiming RestoreTiming
+
+	// AbortedMigration is the migration of this pod the controller gave
+	// up on, AbortReason why; /poll hands both to a destination EA still
+	// waiting for its transfer. Unlike the flow flags they outlive Disarm,
+	// until a different migration is armed.
+	AbortedMigration string
+	AbortReason      string
+
+	// AbortReport is what the destination EA reported with POST /aborted
+	// after it applied its abort policy; zero until it does.
+	AbortReport AbortReport
+
+	// AgentKey is the secret the pod's registration got in its /register
+	// response. An EA proves with it on /poll that it is that
+	// registration; it is not mirrored into status, so a pod seeded after
+	// an operator restart has none until it registers again. A
+	// registration while Migrating, the destination's, leaves it to the
+	// source and gets DestKey instead, which Disarm makes the AgentKey.
+	AgentKey string
+	DestKey  string
+
 	Registrations int
 	RegisteredAt  time.Time
 	LastSeen      time.Time
 }
 
+// RestoreTiming describes a completed restore as measured by the
+// destination EA.
+type RestoreTiming struct {
+	// TransferMs is the time from the first received frame to DONE.
+	TransferMs int64
+	// RestoreMs is the time from starting dmtcp_restart until every
+	// restored process had rejoined the DMTCP coordinator.
+	RestoreMs int64
+	// Peers is the number of restored processes the coordinator reported.
+	Peers int
+}
+
+// SyncRoundStats is what the source EA measured in one pre-downtime round.
+type SyncRoundStats struct {
+	Round               int
+	LayerBytes          int64
+	FillMs              int64
+	SentBytes           int64
+	SendMs              int64
+	ProjectedDowntimeMs int64
+}
+
+// AbortReport is a destination EA's account of an aborted migration.
+type AbortReport struct {
+	MigrationID string
+	Reason      string
+	Policy      string
+	Outcome     string
+	ReportedAt  time.Time
+}
+
+// TransferProgress is how far the source EA's transfer got, as it last
+// reported.
+type TransferProgress struct {
+	BytesDone      int64
+	BytesTotal     int64
+	BytesPerSecond int64
+	// Items is per layer or checkpoint file, in the order they were
+	// queued. A report replaces the slice, so copies may share it.
+	Items     []ItemProgress
+	UpdatedAt time.Time
+}
+
+// ItemProgress is how far one item of a transfer got.
+type ItemProgress struct {
+	Name       string
+	BytesDone  int64
+	BytesTotal int64
+}
+
 // Registry is a thread-safe pod registration store keyed by pod name.
 type Registry struct {
 	mu      sync.RWMutex
 	records map[string]*PodRecord
+
+	// mountModes is the volume mount mode of each MigratableWorkload, by
+	// the name of the workload it wraps. A pod's first registration
+	// precedes its record being linked to a workload, so it is looked up
+	// by pod name prefix.
+	mountModes map[string]string
 }
 
 // New returns an empty Registry.
 func New() *Registry {
-	return &Registry{records: make(map[string]*PodRecord)}
+	return &Registry{records: make(map[string]*PodRecord), mountModes: make(map[string]string)}
+}
+
+// SetMountMode records the volume mount mode of the pods of workload.
+func (r *Registry) SetMountMode(workload, mode string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mountModes[workload] = mode
+}
+
+// MountMode returns the volume mount mode of the named pod's workload, or
+// "" when no workload it belongs to is known.
+func (r *Registry) MountMode(podName string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var mode string
+	best := -1
+	for workload, m := range r.mountModes {
+		// The longest match wins: web-0 belongs to web, not to we.
+		if strings.HasPrefix(podName, workload+"-") && len(workload) > best {
+			mode, best = m, len(workload)
+		}
+	}
+	return mode
 }
 
 // Register records a pod registration and returns a snapshot of the record as
 // it was *before* this call, plus whether the pod was previously unknown.
-// Re-registration while a migration is active marks the destination as up.
+// Each registration mints a new AgentKey; the destination of an armed
+// migration registers with RegisterDestination instead.
 func (r *Registry) Register(name, address string, port int) (prev PodRecord, isNew bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -112,6 +268,7 @@ func (r *Registry) Register(name, address string, port int) (prev PodRecord, isN
 			Name:          name,
 			Address:       address,
 			ContainerPort: port,
+			AgentKey:      newSecret(),
 			Registrations: 1,
 			RegisteredAt:  now,
 			LastSeen:      now,
@@ -125,18 +282,39 @@ func (r *Registry) Register(name, address string, port int) (prev PodRecord, isN
 	if port != 0 {
 		rec.ContainerPort = port
 	}
+	rec.AgentKey = newSecret()
 	rec.Registrations++
 	rec.LastSeen = now
-	if rec.Migrating {
-		// Duplicate registration while armed: this caller is the migration
-		// target. Record its transfer endpoint so /remove can hand it to
-		// the source EA for the direct checkpoint stream.
-		rec.DestRegistered = true
-		rec.DestAddress = joinHostPort(address, port)
-	}
 	return prev, false
 }
 
+// RegisterDestination records the registration of the migration target of
+// the armed migration of name, which the caller verified comes from it: the
+// destination is marked as up and its transfer endpoint recorded, so
+// /remove can hand it to the source EA for the direct checkpoint stream. It
+// gets a DestKey; the source's AgentKey stays valid. Returns a snapshot of
+// the record as it was before, and false when no migration is armed.
+func (r *Registry) RegisterDestination(name, address string, port int) (prev PodRecord, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[name]
+	if !ok || !rec.Migrating {
+		return PodRecord{}, false
+	}
+	prev = *rec
+	rec.LastAddress = rec.Address
+	rec.Address = address
+	if port != 0 {
+		rec.ContainerPort = port
+	}
+	rec.Registrations++
+	rec.LastSeen = time.Now()
+	rec.DestRegistered = true
+	rec.DestAddress = joinHostPort(address, port)
+	rec.DestKey = newSecret()
+	return prev, true
+}
+
 // Get returns a snapshot of the record for name.
 func (r *Registry) Get(name string) (PodRecord, bool) {
 	r.mu.RLock()
@@ -173,11 +351,24 @@ type ArmInfo struct {
 	ProcessMigration bool
 	VolumeMigration  bool
 	SyncRounds       int
+	MinSyncRounds    int
+	TargetDowntimeMs int64
+	Compression      string
+	TransferStreams  int
+	MaxBytesPerSec   int64
+	AbortPolicy      string
+	MigrationID      string
+	// Namespace and TargetNode locate the destination pod, whose
+	// registration is checked against them.
+	Namespace  string
+	TargetNode string
 }
 
 // Arm marks a pod as the target of an active Migration. The record is
 // created if the pod has not registered yet, so a Migration can be armed
-// before its source EA first checks in.
+// before its source EA first checks in. Arming mints the migration's
+// transfer token; re-arming the same migration keeps it, so agents that
+// already fetched it stay authorized.
 func (r *Registry) Arm(name string, info ArmInfo) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -186,6 +377,9 @@ func (r *Registry) Arm(name string, info ArmInfo) {
 		rec = &PodRecord{Name: name, RegisteredAt: time.Now()}
 		r.records[name] = rec
 	}
+	if !rec.Migrating || rec.MigrationID != info.MigrationID || rec.TransferToken == "" {
+		rec.TransferToken = newSecret()
+	}
 	rec.Migrating = true
 	if info.CheckpointDir != "" {
 		rec.CheckpointDir = info.CheckpointDir
@@ -193,9 +387,50 @@ func (r *Registry) Arm(name string, info ArmInfo) {
 	rec.ProcessMigration = info.ProcessMigration
 	rec.VolumeMigration = info.VolumeMigration
 	rec.SyncRounds = info.SyncRounds
+	rec.MinSyncRounds = info.MinSyncRounds
+	rec.TargetDowntimeMs = info.TargetDowntimeMs
+	rec.Compression = info.Compression
+	rec.TransferStreams = info.TransferStreams
+	rec.MaxBytesPerSec = info.MaxBytesPerSec
+	rec.AbortPolicy = info.AbortPolicy
+	rec.MigrationID = info.MigrationID
+	if info.Namespace != "" {
+		rec.WorkloadNamespace = info.Namespace
+	}
+	rec.TargetNode = info.TargetNode
+	if rec.AbortedMigration != info.MigrationID {
+		rec.AbortedMigration = ""
+		rec.AbortReason = ""
+	}
+	if rec.AbortReport.MigrationID != info.MigrationID {
+		rec.AbortReport = AbortReport{}
+	}
 }
 
-// Disarm clears the active-migration flag and all flow flags on a pod.
+// newSecret returns 256 random bits, hex encoded.
+func newSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails when the kernel has no entropy source,
+		// and a guessable secret is not an acceptable fallback.
+		panic("registry: read random secret: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Armed reports whether migration is armed on name with its transfer
+// token. Arming lives in memory only: after an operator restart it is false
+// for every migration, including on records Seed restored.
+func (r *Registry) Armed(name, migration string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.records[name]
+	return ok && rec.Migrating && rec.MigrationID == migration && rec.TransferToken != ""
+}
+
+// Disarm clears the active-migration flag and all flow flags on a pod. A
+// destination that registered is the pod from now on, so its key becomes
+// the AgentKey.
 func (r *Registry) Disarm(name string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -203,13 +438,61 @@ func (r *Registry) Disarm(name string) {
 	if !ok {
 		return
 	}
+	if rec.DestKey != "" {
+		rec.AgentKey = rec.DestKey
+		rec.DestKey = ""
+	}
 	rec.Migrating = false
 	rec.CheckpointReady = false
 	rec.DestRegistered = false
 	rec.Restored = false
 	rec.SyncRounds = 0
 	rec.SyncRound = 0
+	rec.MinSyncRounds = 0
+	rec.TargetDowntimeMs = 0
+	rec.SyncStopReason = ""
+	rec.SyncStats = nil
+	rec.Compression = ""
+	rec.TransferStreams = 0
+	rec.MaxBytesPerSec = 0
+	rec.AbortPolicy = ""
+	rec.MigrationID = ""
+	rec.TransferToken = ""
+	rec.TargetNode = ""
 	rec.DestAddress = ""
+	rec.LayerCount = 0
+	rec.Progress = TransferProgress{}
+	rec.RestoreTiming = RestoreTiming{}
+}
+
+// Abort records that the controller gave up on migration of the named pod
+// for reason, so a destination EA still waiting for the transfer stops
+// waiting. Returns false when the pod is unknown.
+func (r *Registry) Abort(name, migration, reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[name]
+	if !ok {
+		return false
+	}
+	rec.AbortedMigration = migration
+	rec.AbortReason = reason
+	return true
+}
+
+// RecordAbort stores the destination EA's report of an aborted migration
+// (POST /aborted), stamped with the time it arrived. Returns false when the
+// pod is unknown.
+func (r *Registry) RecordAbort(name string, report AbortReport) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[name]
+	if !ok {
+		return false
+	}
+	report.ReportedAt = time.Now()
+	rec.AbortReport = report
+	return true
 }
 
 // RecordSyncRound stores the latest completed pre-downtime overlay sync
@@ -228,6 +511,34 @@ func (r *Registry) RecordSyncRound(name string, round int) bool {
 	return true
 }
 
+// RecordSyncStats is RecordSyncRound for a report that carries what the
+// source EA measured in the round and, when it stops adaptive rounds, why.
+// A repeated report of a round replaces the earlier one.
+func (r *Registry) RecordSyncStats(name string, stats SyncRoundStats, stopReason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[name]
+	if !ok {
+		return false
+	}
+	if stats.Round > rec.SyncRound {
+		rec.SyncRound = stats.Round
+	}
+	next := make([]SyncRoundStats, 0, len(rec.SyncStats)+1)
+	for _, s := range rec.SyncStats {
+		if s.Round != stats.Round {
+			next = append(next, s)
+		}
+	}
+	next = append(next, stats)
+	sort.Slice(next, func(i, j int) bool { return next[i].Round < next[j].Round })
+	rec.SyncStats = next
+	if stopReason != "" {
+		rec.SyncStopReason = stopReason
+	}
+	return true
+}
+
 // NeedsCheckpoint reports whether the named pod must checkpoint before
 // stopping (i.e. an active Migration targets it).
 func (r *Registry) NeedsCheckpoint(name string) (needs, known bool) {
@@ -241,8 +552,9 @@ func (r *Registry) NeedsCheckpoint(name string) (needs, known bool) {
 }
 
 // MarkCheckpointReady records that the source EA finished writing checkpoint
-// files (POST /copy). Returns false when the pod is unknown.
-func (r *Registry) MarkCheckpointReady(name, dir string) bool {
+// files (POST /copy) and how many volume layers it sent. Returns false when
+// the pod is unknown.
+func (r *Registry) MarkCheckpointReady(name, dir string, layers int) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	rec, ok := r.records[name]
@@ -253,12 +565,29 @@ func (r *Registry) MarkCheckpointReady(name, dir string) bool {
 	if dir != "" {
 		rec.CheckpointDir = dir
 	}
+	rec.LayerCount = layers
+	return true
+}
+
+// RecordProgress stores the source EA's latest transfer progress report
+// (POST /progress), stamped with the time it arrived. Returns false when
+// the pod is unknown.
+func (r *Registry) RecordProgress(name string, p TransferProgress) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[name]
+	if !ok {
+		return false
+	}
+	p.UpdatedAt = time.Now()
+	rec.Progress = p
 	return true
 }
 
 // MarkRestored records that the destination EA completed a DMTCP restore
-// (POST /restored). Returns false when the pod is unknown.
-func (r *Registry) MarkRestored(name string) bool {
+// (POST /restored) together with its reported timing. Returns false when
+// the pod is unknown.
+func (r *Registry) MarkRestored(name string, timing RestoreTiming) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	rec, ok := r.records[name]
@@ -266,6 +595,7 @@ func (r *Registry) MarkRestored(name string) bool {
 		return false
 	}
 	rec.Restored = true
+	rec.RestoreTiming = timing
 	return true
 }
 
@@ -49,8 +49,18 @@ func TestMigrationFlowFlags(t *testing.T) {
 		ProcessMigration: true,
 		VolumeMigration:  true,
 		SyncRounds:       2,
+		Compression:      "zstd",
+		TransferStreams:  4,
+		MaxBytesPerSec:   1 << 20,
+		MigrationID:      "uid-1",
 	})
 
+	if rec, _ := r.Get("web-0"); rec.Compression != "zstd" {
+		t.Fatalf("Arm must store the codec, got %q", rec.Compression)
+	}
+	if rec, _ := r.Get("web-0"); rec.TransferStreams != 4 || rec.MaxBytesPerSec != 1<<20 {
+		t.Fatalf("Arm must store the striping connections and the bandwidth cap, got %d, %d", rec.TransferStreams, rec.MaxBytesPerSec)
+	}
 	if needs, known := r.NeedsCheckpoint("web-0"); !needs || !known {
 		t.Fatalf("armed pod must need a checkpoint (needs=%v known=%v)", needs, known)
 	}
@@ -68,27 +78,154 @@ func TestMigrationFlowFlags(t *testing.T) {
 		t.Fatalf("SyncRound = %d, want 2", rec.SyncRound)
 	}
 
-	// Source EA wrote checkpoint files.
-	if !r.MarkCheckpointReady("web-0", "/dmtcp/checkpoints") {
+	// Source EA reports transfer progress, then wrote checkpoint files.
+	progress := TransferProgress{BytesDone: 3 << 20, BytesTotal: 8 << 20, BytesPerSecond: 1 << 20, Items: []ItemProgress{{Name: "ckpt_a.dmtcp", BytesDone: 3 << 20, BytesTotal: 8 << 20}}}
+	if !r.RecordProgress("web-0", progress) {
+		t.Fatalf("progress on known pod must succeed")
+	}
+	if r.RecordProgress("ghost", progress) {
+		t.Fatalf("progress on unknown pod must fail")
+	}
+	if rec, _ := r.Get("web-0"); rec.Progress.BytesDone != 3<<20 || len(rec.Progress.Items) != 1 || rec.Progress.UpdatedAt.IsZero() {
+		t.Fatalf("RecordProgress must store the report with its arrival time: %+v", rec.Progress)
+	}
+	if !r.MarkCheckpointReady("web-0", "/dmtcp/checkpoints", 3) {
 		t.Fatalf("checkpoint-ready on known pod must succeed")
 	}
+	if rec, _ := r.Get("web-0"); rec.LayerCount != 3 {
+		t.Fatalf("LayerCount = %d, want 3", rec.LayerCount)
+	}
+
+	// The source restarting is not the destination.
+	r.Register("web-0", "10.0.0.5:2486", 2486)
+	if rec, _ := r.Get("web-0"); rec.DestRegistered || rec.DestAddress != "" {
+		t.Fatalf("Register while migrating must not mark the destination: %+v", rec)
+	}
 
 	// Destination EA re-registers under the same (StatefulSet) name.
-	r.Register("web-0", "10.0.1.7:2486", 2486)
+	source, _ := r.Get("web-0")
+	if _, ok := r.RegisterDestination("web-0", "10.0.1.7:2486", 2486); !ok {
+		t.Fatalf("RegisterDestination while migrating must succeed")
+	}
 	rec, _ := r.Get("web-0")
-	if !rec.DestRegistered {
-		t.Fatalf("re-registration while migrating must set DestRegistered")
+	if !rec.DestRegistered || rec.DestAddress != "10.0.1.7:2486" {
+		t.Fatalf("RegisterDestination must set DestRegistered and DestAddress: %+v", rec)
+	}
+	if rec.AgentKey != source.AgentKey || rec.DestKey == "" || rec.DestKey == rec.AgentKey {
+		t.Fatalf("the destination must get a key of its own and leave the source's: %+v", rec)
 	}
+	destKey := rec.DestKey
 
-	if !r.MarkRestored("web-0") {
+	if !r.MarkRestored("web-0", RestoreTiming{TransferMs: 900, RestoreMs: 350, Peers: 2}) {
 		t.Fatalf("restored on known pod must succeed")
 	}
+	if rec, _ := r.Get("web-0"); rec.RestoreTiming.Peers != 2 || rec.RestoreTiming.RestoreMs != 350 {
+		t.Fatalf("MarkRestored must store the timing: %+v", rec.RestoreTiming)
+	}
 
 	r.Disarm("web-0")
 	rec, _ = r.Get("web-0")
-	if rec.Migrating || rec.CheckpointReady || rec.DestRegistered || rec.Restored || rec.SyncRound != 0 {
+	if rec.Migrating || rec.CheckpointReady || rec.DestRegistered || rec.Restored || rec.SyncRound != 0 || rec.Compression != "" || rec.TransferStreams != 0 || rec.MaxBytesPerSec != 0 || rec.MigrationID != "" || rec.TransferToken != "" || rec.LayerCount != 0 || !rec.Progress.UpdatedAt.IsZero() || rec.RestoreTiming != (RestoreTiming{}) {
 		t.Fatalf("Disarm must clear all flow flags: %+v", rec)
 	}
+	if rec.AgentKey != destKey || rec.DestKey != "" {
+		t.Fatalf("Disarm must hand the pod's key to the destination: %+v", rec)
+	}
+}
+
+// TestArmTransferToken checks the token is stable while one migration stays
+// armed and fresh for every other.
+func TestArmTransferToken(t *testing.T) {
+	r := New()
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-1"})
+	first, _ := r.Get("web-0")
+	if len(first.TransferToken) != 64 {
+		t.Fatalf("TransferToken = %q, want 32 random bytes in hex", first.TransferToken)
+	}
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-1", SyncRounds: 2})
+	if rec, _ := r.Get("web-0"); rec.TransferToken != first.TransferToken {
+		t.Fatalf("re-arming the same migration must keep its token")
+	}
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-2"})
+	second, _ := r.Get("web-0")
+	if second.TransferToken == first.TransferToken {
+		t.Fatalf("another migration must get a new token")
+	}
+	r.Disarm("web-0")
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-2"})
+	if rec, _ := r.Get("web-0"); rec.TransferToken == second.TransferToken || rec.TransferToken == "" {
+		t.Fatalf("a disarmed migration's token must not be reused")
+	}
+}
+
+// TestArmedAfterRestart checks a migration counts as armed only in the
+// registry that armed it, not in one re-seeded after an operator restart.
+func TestArmedAfterRestart(t *testing.T) {
+	r := New()
+	r.Register("web-0", "10.0.0.5", 2486)
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-1"})
+	if !r.Armed("web-0", "uid-1") || r.Armed("web-0", "uid-2") || r.Armed("db-0", "uid-1") {
+		t.Fatalf("Armed must hold for the armed migration of the pod only")
+	}
+	rec, _ := r.Get("web-0")
+
+	restarted := New()
+	restarted.Seed([]PodRecord{{Name: rec.Name, Address: rec.Address, Migrating: rec.Migrating}})
+	if restarted.Armed("web-0", "uid-1") {
+		t.Fatalf("a re-seeded record must not count as armed")
+	}
+	r.Disarm("web-0")
+	if r.Armed("web-0", "uid-1") {
+		t.Fatalf("a disarmed migration must not count as armed")
+	}
+}
+
+// TestAbortOutlivesDisarm checks the abort of a migration stays visible
+// after the controller disarmed it, until another migration is armed.
+func TestAbortOutlivesDisarm(t *testing.T) {
+	r := New()
+	if r.Abort("ghost", "uid-1", "timed out") || r.RecordAbort("ghost", AbortReport{}) {
+		t.Fatalf("aborting an unknown pod must fail")
+	}
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-1", AbortPolicy: "KeepVolume"})
+	if rec, _ := r.Get("web-0"); rec.AbortPolicy != "KeepVolume" {
+		t.Fatalf("Arm must store the abort policy, got %q", rec.AbortPolicy)
+	}
+	r.Abort("web-0", "uid-1", "timed out")
+	r.Disarm("web-0")
+	r.RecordAbort("web-0", AbortReport{MigrationID: "uid-1", Policy: "KeepVolume", Outcome: "started"})
+	rec, _ := r.Get("web-0")
+	if rec.AbortPolicy != "" || rec.AbortedMigration != "uid-1" || rec.AbortReason != "timed out" || rec.AbortReport.Outcome != "started" || rec.AbortReport.ReportedAt.IsZero() {
+		t.Fatalf("the abort must outlive Disarm: %+v", rec)
+	}
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-2"})
+	if rec, _ := r.Get("web-0"); rec.AbortedMigration != "" || rec.AbortReason != "" || rec.AbortReport != (AbortReport{}) {
+		t.Fatalf("arming another migration must clear the abort: %+v", rec)
+	}
+}
+
+// TestRecordSyncStats checks adaptive pre-downtime round reports.
+func TestRecordSyncStats(t *testing.T) {
+	r := New()
+	if r.RecordSyncStats("ghost", SyncRoundStats{Round: 1}, "") {
+		t.Fatalf("stats for an unknown pod must fail")
+	}
+	r.Arm("web-0", ArmInfo{MigrationID: "uid-1", SyncRounds: 10, MinSyncRounds: 1, TargetDowntimeMs: 500})
+	r.RecordSyncStats("web-0", SyncRoundStats{Round: 1, LayerBytes: 100, ProjectedDowntimeMs: 2000}, "")
+	before, _ := r.Get("web-0")
+	r.RecordSyncStats("web-0", SyncRoundStats{Round: 1, LayerBytes: 90, ProjectedDowntimeMs: 1800}, "") // a retried report
+	r.RecordSyncStats("web-0", SyncRoundStats{Round: 2, LayerBytes: 10, ProjectedDowntimeMs: 300}, "Converged")
+	rec, _ := r.Get("web-0")
+	if rec.SyncRound != 2 || rec.SyncStopReason != "Converged" || len(rec.SyncStats) != 2 || rec.SyncStats[0].LayerBytes != 90 {
+		t.Fatalf("after two rounds: round %d, reason %q, stats %+v", rec.SyncRound, rec.SyncStopReason, rec.SyncStats)
+	}
+	if before.SyncStats[0].LayerBytes != 100 {
+		t.Fatalf("a copy taken earlier changed: %+v", before.SyncStats)
+	}
+	r.Disarm("web-0")
+	if rec, _ := r.Get("web-0"); rec.SyncStopReason != "" || rec.SyncStats != nil || rec.TargetDowntimeMs != 0 || rec.MinSyncRounds != 0 {
+		t.Fatalf("Disarm must clear the pre-downtime rounds: %+v", rec)
+	}
 }
 
 func TestArmBeforeRegistration(t *testing.T) {
@@ -100,6 +237,18 @@ func TestArmBeforeRegistration(t *testing.T) {
 	}
 }
 
+func TestMountModeByWorkloadPrefix(t *testing.T) {
+	r := New()
+	r.SetMountMode("we", "FUSE")
+	r.SetMountMode("web", "UserNamespace")
+	if got := r.MountMode("web-0"); got != "UserNamespace" {
+		t.Fatalf("MountMode(web-0) = %q, want the longest matching workload's", got)
+	}
+	if got := r.MountMode("db-0"); got != "" {
+		t.Fatalf("MountMode(db-0) = %q, want none", got)
+	}
+}
+
 func TestSeedDoesNotOverwrite(t *testing.T) {
 	r := New()
 	r.Register("web-0", "live", 1)
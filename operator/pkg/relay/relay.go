@@ -0,0 +1,533 @@
+// Package relay is the operator's store-and-forward transfer relay. A
+// StatefulSet pod cannot coexist with its replacement, so when the source
+// Execution Agent checkpoints there is usually no destination to stream to
+// yet. The /remove response then names the relay instead: the source opens
+// its transfer session to it exactly as it would to the destination, the
+// relay buffers the frames on its volume and, once the destination
+// registers with isMig=true, replays them to it with the same protocol.
+//
+// Sessions must be signed with the migration's transfer token, which also
+// tells the relay which pod a session belongs to. With the transfer CA the
+// relay terminates TLS as the migration's destination towards the source
+// (the source names the migration in SNI) and dials the destination as its
+// source. Both legs use the agents' wire encoding (package wire).
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+const (
+	// DefaultPort is the relay's default transfer port.
+	DefaultPort = 2487
+	// DefaultReplayTimeout bounds how long a replay keeps redialing a
+	// destination that is not listening yet or dropped the connection.
+	DefaultReplayTimeout = 5 * time.Minute
+
+	handshakeTimeout  = 30 * time.Second
+	retryInitialDelay = 250 * time.Millisecond
+	retryMaxDelay     = 5 * time.Second
+)
+
+// Relay accepts transfer sessions from source agents and replays them to
+// their destinations. It runs as a manager Runnable on every replica, like
+// the REST API; its buffer is local to the replica, so run one replica or
+// give the relay a shared volume.
+type Relay struct {
+	// Addr is the address the relay listens on.
+	Addr string
+	// Advertise is the host:port source agents are told to dial.
+	Advertise string
+	// Dir holds the buffered transfers.
+	Dir      string
+	Registry *registry.Registry
+	// CA, when set, runs both legs over mutual TLS.
+	CA  *ca.CA
+	Log logr.Logger
+	// ReplayTimeout overrides DefaultReplayTimeout.
+	ReplayTimeout time.Duration
+
+	mu       sync.Mutex
+	locks    map[string]*sync.Mutex
+	sessions map[string]net.Conn // the connection each pod's source uses
+}
+
+// lock serialises the session and replays of pod.
+func (r *Relay) lock(pod string) func() {
+	r.mu.Lock()
+	if r.locks == nil {
+		r.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := r.locks[pod]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[pod] = l
+	}
+	r.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// claim makes conn the session of pod, closing the connection an earlier
+// session of the pod may still hold (a source only reconnects when it lost
+// the old one), and locks pod.
+func (r *Relay) claim(pod string, conn net.Conn) func() {
+	r.mu.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]net.Conn)
+	}
+	if old := r.sessions[pod]; old != nil {
+		old.Close()
+	}
+	r.sessions[pod] = conn
+	r.mu.Unlock()
+	unlock := r.lock(pod)
+	return func() {
+		r.mu.Lock()
+		if r.sessions[pod] == conn {
+			delete(r.sessions, pod)
+		}
+		r.mu.Unlock()
+		unlock()
+	}
+}
+
+// Start implements manager.Runnable: it serves until the context is done.
+// Transfers buffered before a restart are replayed once their destination
+// is known.
+func (r *Relay) Start(ctx context.Context) error {
+	if err := os.MkdirAll(r.Dir, 0o700); err != nil {
+		return fmt.Errorf("relay directory: %w", err)
+	}
+	ln, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		return fmt.Errorf("relay listen on %s: %w", r.Addr, err)
+	}
+	r.Log.Info("transfer relay listening", "addr", r.Addr, "advertise", r.Advertise, "dir", r.Dir)
+	if entries, err := os.ReadDir(r.Dir); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				r.Kick(e.Name())
+			}
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	return r.Serve(ln)
+}
+
+// NeedLeaderElection keeps the relay up on non-leader replicas.
+func (r *Relay) NeedLeaderElection() bool { return false }
+
+// Serve accepts source sessions on ln until it is closed.
+func (r *Relay) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("relay accept: %w", err)
+		}
+		go r.serve(conn)
+	}
+}
+
+func (r *Relay) serve(conn net.Conn) {
+	defer conn.Close()
+	migration := ""
+	if r.CA != nil {
+		tc := tls.Server(conn, r.serverTLS())
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			r.Log.Info("refusing relay connection", "remote", conn.RemoteAddr().String(), "reason", err.Error())
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		migration = tc.ConnectionState().ServerName
+		conn = tc
+	}
+	if err := r.receive(conn, migration); err != nil {
+		r.Log.Info("relay session failed", "remote", conn.RemoteAddr().String(), "reason", err.Error())
+	}
+}
+
+// receive buffers one source session. A dropped connection leaves the
+// buffer, and the part of the frame in progress that arrived, for the
+// source to resume; the DONE frame completes it and starts the replay.
+func (r *Relay) receive(conn net.Conn, migration string) error {
+	tr := &trackingReader{r: conn}
+	br := bufio.NewReader(tr)
+	bw := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	if h.Kind != wire.KindHello || h.Flags&wire.FlagSigned == 0 {
+		err := errors.New("the relay only takes sessions signed with the migration's transfer token")
+		wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+		return err
+	}
+	mac, err := wire.ReadMAC(br)
+	if err != nil {
+		return err
+	}
+	rec, err := r.authorize(h, mac, migration)
+	if err != nil {
+		wire.WriteReply(bw, wire.Err, 0, err.Error())
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	unlock := r.claim(rec.Name, conn)
+	defer unlock()
+	st, err := openStore(r.Dir, rec.Name, migrationID(rec), h.Name)
+	if err != nil {
+		wire.WriteReply(bw, wire.Err, 0, err.Error())
+		return err
+	}
+	if err := wire.WriteReply(bw, wire.Ack, 0, string(wire.ResumePoint(st.resumePoint()))); err != nil {
+		return nil
+	}
+	id := h.Name
+	for {
+		h, err := readHeader(br)
+		if err != nil {
+			if tr.err != nil {
+				return nil // the source resumes with a new connection
+			}
+			wire.WriteReply(bw, wire.Err, 0, err.Error())
+			return err
+		}
+		if h.Flags&wire.FlagSigned == 0 {
+			err := fmt.Errorf("frame %d (%q) is not signed", h.Seq, h.Name)
+			wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+			return err
+		}
+		last := st.lastSeq()
+		switch {
+		case h.Seq <= last:
+			// Completed before a reconnect; only its ACK was lost.
+			if err := wire.SkipChunks(br); err != nil {
+				return nil
+			}
+			if _, err := wire.ReadMAC(br); err != nil {
+				return nil
+			}
+		case h.Seq != last+1 || h.Kind == wire.KindHello:
+			err := fmt.Errorf("frame %d out of order, expected %d", h.Seq, last+1)
+			wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+			return err
+		default:
+			encoded, err := h.Encode(wire.SessionVersion)
+			if err != nil {
+				wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+				return err
+			}
+			err = st.add(h, br, func(digest string) error {
+				mac, err := wire.ReadMAC(br)
+				if err != nil {
+					return err
+				}
+				if !hmac.Equal(mac, wire.MAC(rec.TransferToken, id, encoded, digest)) {
+					return fmt.Errorf("frame %d (%q): bad transfer token MAC", h.Seq, h.Name)
+				}
+				return nil
+			})
+			if err != nil && tr.err != nil {
+				return nil // the source resumes the frame with a new connection
+			}
+			if err != nil {
+				if derr := st.discardPartial(); derr != nil {
+					r.Log.Error(derr, "discard relay buffer", "pod", rec.Name)
+				}
+			}
+			if errors.Is(err, errDigest) {
+				wire.WriteReply(bw, wire.Nak, h.Seq, fmt.Sprintf("frame %d (%q): %v", h.Seq, h.Name, err))
+				return nil
+			}
+			if err != nil {
+				wire.WriteReply(bw, wire.Err, h.Seq, err.Error())
+				return err
+			}
+		}
+		if err := wire.WriteReply(bw, wire.Ack, h.Seq, ""); err != nil {
+			return nil
+		}
+		if h.Kind == wire.KindDone {
+			r.Log.Info("transfer buffered", "pod", rec.Name, "frames", len(st.Frames))
+			r.Kick(rec.Name)
+			return nil
+		}
+	}
+}
+
+// readHeader reads a version-2 frame header. Version-1 frames carry no MAC
+// and are refused.
+func readHeader(r io.Reader) (wire.Header, error) {
+	h, version, err := wire.ReadHeader(r)
+	if err != nil {
+		return wire.Header{}, err
+	}
+	if version != wire.SessionVersion {
+		return wire.Header{}, fmt.Errorf("frame version %d: the relay only takes version-%d sessions", version, wire.SessionVersion)
+	}
+	return h, nil
+}
+
+// trackingReader remembers the first read error of the connection, so a
+// dropped connection can be told from bad data.
+type trackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// authorize finds the armed migration whose transfer token signed the
+// HELLO frame h. With TLS the migration named in SNI must be the same.
+func (r *Relay) authorize(h wire.Header, mac []byte, migration string) (registry.PodRecord, error) {
+	encoded, err := h.Encode(wire.SessionVersion)
+	if err != nil {
+		return registry.PodRecord{}, err
+	}
+	for _, rec := range r.Registry.List() {
+		if !rec.Migrating || rec.TransferToken == "" {
+			continue
+		}
+		if !hmac.Equal(mac, wire.MAC(rec.TransferToken, h.Name, encoded, "")) {
+			continue
+		}
+		if r.CA != nil && migration != migrationID(rec) {
+			return registry.PodRecord{}, fmt.Errorf("the session is signed for migration %s, the certificate is for %s", migrationID(rec), migration)
+		}
+		return rec, nil
+	}
+	return registry.PodRecord{}, errors.New("session " + h.Name + ": bad transfer token MAC; no armed migration matches")
+}
+
+// migrationID is the id rec's transfer certificates are issued for (see
+// the REST API's transferTLS).
+func migrationID(rec registry.PodRecord) string {
+	if rec.MigrationID != "" {
+		return rec.MigrationID
+	}
+	return rec.Name
+}
+
+// Kick replays the transfer buffered for pod in the background if it is
+// complete and its destination has registered. It is a no-op otherwise, so
+// callers may kick whenever either happens.
+func (r *Relay) Kick(pod string) {
+	go func() {
+		if err := r.forward(pod); err != nil {
+			r.Log.Error(err, "relay replay failed", "pod", pod)
+		}
+	}()
+}
+
+func (r *Relay) forward(pod string) error {
+	unlock := r.lock(pod)
+	defer unlock()
+	st, err := loadStore(r.Dir, pod)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !st.Complete {
+		return nil
+	}
+	rec, ok := r.Registry.Get(pod)
+	if !ok || !rec.Migrating || !rec.DestRegistered || rec.DestAddress == "" {
+		return nil
+	}
+	if migrationID(rec) != st.MigrationID {
+		r.Log.Info("discarding a relayed transfer of another migration", "pod", pod, "migration", st.MigrationID)
+		return st.remove()
+	}
+	if err := r.replay(st, rec); err != nil {
+		return fmt.Errorf("replay to %s: %w", rec.DestAddress, err)
+	}
+	r.Log.Info("relayed transfer delivered", "pod", pod, "dest", rec.DestAddress, "frames", len(st.Frames))
+	return st.remove()
+}
+
+// fatalError is a replay failure that redialing cannot fix.
+type fatalError struct{ err error }
+
+func (e fatalError) Error() string { return e.err.Error() }
+func (e fatalError) Unwrap() error { return e.err }
+
+// replay sends the buffered transfer to the destination, redialing with
+// backoff and resuming from the destination's resume point until the
+// replay timeout.
+func (r *Relay) replay(st *store, rec registry.PodRecord) error {
+	timeout := r.ReplayTimeout
+	if timeout <= 0 {
+		timeout = DefaultReplayTimeout
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Errorf("generate transfer id: %w", err)
+	}
+	id := hex.EncodeToString(b[:])
+	deadline := time.Now().Add(timeout)
+	delay := retryInitialDelay
+	for {
+		err := r.replayOnce(st, rec, id)
+		if err == nil {
+			return nil
+		}
+		var ferr fatalError
+		if errors.As(err, &ferr) {
+			return err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("giving up after %s: %w", timeout, err)
+		}
+		r.Log.V(1).Info("relay replay interrupted; retrying", "pod", rec.Name, "reason", err.Error(), "delay", delay.String())
+		time.Sleep(delay)
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// replayOnce opens one session to the destination and sends every frame it
+// has not completed, then DONE, waiting for each acknowledgement.
+func (r *Relay) replayOnce(st *store, rec registry.PodRecord, id string) error {
+	conn, err := net.DialTimeout("tcp", rec.DestAddress, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if r.CA != nil {
+		cfg, err := r.clientTLS(st.MigrationID)
+		if err != nil {
+			return fatalError{err}
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn = tc
+	}
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriterSize(conn, wire.ChunkSize)
+
+	hello, err := wire.Header{Kind: wire.KindHello, Name: id, Flags: wire.FlagSigned}.Encode(wire.SessionVersion)
+	if err != nil {
+		return fatalError{err}
+	}
+	bw.Write(hello)
+	bw.Write(wire.MAC(rec.TransferToken, id, hello, ""))
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	code, _, msg, err := wire.ReadReply(br)
+	if err != nil {
+		return fmt.Errorf("read hello reply: %w", err)
+	}
+	if code != wire.Ack || len(msg) != wire.HelloReplySize {
+		return fatalError{fmt.Errorf("destination refused the session: %s", msg)}
+	}
+	conn.SetDeadline(time.Time{})
+	lastSeq, offset, err := wire.ParseResumePoint(msg)
+	if err != nil {
+		return fatalError{err}
+	}
+
+	for i := int(lastSeq); i <= len(st.Frames); i++ {
+		h := wire.Header{Kind: wire.KindDone, Seq: uint32(i + 1), Flags: wire.FlagSigned}
+		want := ""
+		if i < len(st.Frames) {
+			f := st.Frames[i]
+			h = wire.Header{Kind: f.Kind, Ordinal: f.Ordinal, Name: f.Name, Seq: uint32(i + 1), Codec: f.Codec, Flags: wire.FlagSigned}
+			want = f.SHA256
+		}
+		from := int64(0)
+		if h.Seq == lastSeq+1 {
+			from = offset
+		}
+		if err := sendFrame(bw, h, st.payloadPath(i), from, want, rec.TransferToken, id); err != nil {
+			return err
+		}
+		code, seq, msg, err := wire.ReadReply(br)
+		if err != nil {
+			return fmt.Errorf("read reply: %w", err)
+		}
+		switch {
+		case seq != h.Seq:
+			return fatalError{fmt.Errorf("reply for frame %d, expected %d", seq, h.Seq)}
+		case code == wire.Nak:
+			return fmt.Errorf("frame %d failed verification: %s", h.Seq, msg)
+		case code != wire.Ack:
+			return fatalError{fmt.Errorf("destination rejected frame %d (%q): %s", h.Seq, h.Name, msg)}
+		}
+	}
+	return nil
+}
+
+// sendFrame writes frame h with the payload buffered at path, starting at
+// offset from, and its MAC.
+func sendFrame(bw *bufio.Writer, h wire.Header, path string, from int64, want, token, id string) error {
+	encoded, err := h.Encode(wire.SessionVersion)
+	if err != nil {
+		return fatalError{err}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fatalError{fmt.Errorf("open relay buffer: %w", err)}
+	}
+	defer f.Close()
+	if _, err := bw.Write(encoded); err != nil {
+		return err
+	}
+	cw := &wire.ChunkWriter{W: bw, Skip: from}
+	if _, err := io.Copy(cw, f); err != nil {
+		if cw.Err != nil {
+			return cw.Err
+		}
+		return fatalError{fmt.Errorf("read relay buffer: %w", err)}
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if want != "" && cw.Digest != want {
+		return fatalError{fmt.Errorf("buffered frame %d (%q) is corrupt: digest %.12s, received %.12s", h.Seq, h.Name, cw.Digest, want)}
+	}
+	if _, err := bw.Write(wire.MAC(token, id, encoded, cw.Digest)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,363 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// newTestRelay serves a plaintext relay for an armed migration of web-0 and
+// returns it with its address and the transfer token.
+func newTestRelay(t *testing.T) (*Relay, string, string) {
+	t.Helper()
+	reg := registry.New()
+	reg.Register("web-0", "10.0.0.5:2486", 2486)
+	reg.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1"})
+	rec, _ := reg.Get("web-0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &Relay{Dir: t.TempDir(), Registry: reg, Log: logr.Discard(), ReplayTimeout: 10 * time.Second}
+	go r.Serve(ln)
+	return r, ln.Addr().String(), rec.TransferToken
+}
+
+// source is a minimal signing sender of the agents' session protocol.
+type source struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	id    string
+	token string
+	// offset is how much of the next frame the relay held at HELLO.
+	offset int64
+}
+
+// dialSource opens a session and returns it with the last frame the relay
+// completed.
+func dialSource(t *testing.T, addr, id, token string) (*source, uint32) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &source{conn: conn, br: bufio.NewReader(conn), id: id, token: token}
+	h := wire.Header{Kind: wire.KindHello, Name: id}
+	if token != "" {
+		h.Flags = wire.FlagSigned
+	}
+	hello, _ := h.Encode(wire.SessionVersion)
+	if token != "" {
+		hello = append(hello, wire.MAC(token, id, hello, "")...)
+	}
+	conn.Write(hello)
+	code, _, msg, err := wire.ReadReply(s.br)
+	if err != nil {
+		t.Fatalf("hello reply: %v", err)
+	}
+	if code != wire.Ack {
+		return nil, 0
+	}
+	last, offset, err := wire.ParseResumePoint(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.offset = offset
+	return s, last
+}
+
+// frame encodes frame h with payload, signed, starting at offset from.
+func (s *source) frame(h wire.Header, payload []byte, from int64) []byte {
+	h.Flags |= wire.FlagSigned
+	encoded, _ := h.Encode(wire.SessionVersion)
+	var buf bytes.Buffer
+	buf.Write(encoded)
+	cw := &wire.ChunkWriter{W: &buf, Skip: from}
+	cw.Write(payload)
+	cw.Close()
+	buf.Write(wire.MAC(s.token, s.id, encoded, cw.Digest))
+	return buf.Bytes()
+}
+
+// send writes frame h with payload and returns the reply.
+func (s *source) send(t *testing.T, h wire.Header, payload []byte) (byte, string) {
+	t.Helper()
+	s.conn.Write(s.frame(h, payload, 0))
+	code, _, msg, err := wire.ReadReply(s.br)
+	if err != nil {
+		t.Fatalf("reply for frame %d: %v", h.Seq, err)
+	}
+	return code, msg
+}
+
+type received struct {
+	h       wire.Header
+	payload []byte
+}
+
+// fakeDestination accepts one relayed session signed with token and
+// delivers its frames, DONE last, on the returned channel.
+func fakeDestination(t *testing.T, token string) (string, <-chan []received) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan []received, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br, bw := bufio.NewReader(conn), bufio.NewWriter(conn)
+		hello, err := readHeader(br)
+		if err != nil {
+			return
+		}
+		mac, _ := wire.ReadMAC(br)
+		encoded, _ := hello.Encode(wire.SessionVersion)
+		if !hmac.Equal(mac, wire.MAC(token, hello.Name, encoded, "")) {
+			wire.WriteReply(bw, wire.Err, 0, "bad hello MAC")
+			return
+		}
+		wire.WriteReply(bw, wire.Ack, 0, string(wire.ResumePoint(0, 0)))
+		var frames []received
+		for {
+			h, err := readHeader(br)
+			if err != nil {
+				return
+			}
+			var buf bytes.Buffer
+			if _, err := wire.CopyChunks(br, &buf, 0); err != nil {
+				return
+			}
+			if _, err := wire.ReadDigest(br); err != nil {
+				return
+			}
+			sum := sha256.Sum256(buf.Bytes())
+			digest := hex.EncodeToString(sum[:])
+			mac, _ := wire.ReadMAC(br)
+			encoded, _ := h.Encode(wire.SessionVersion)
+			if !hmac.Equal(mac, wire.MAC(token, hello.Name, encoded, digest)) {
+				wire.WriteReply(bw, wire.Err, h.Seq, "bad MAC")
+				return
+			}
+			frames = append(frames, received{h, buf.Bytes()})
+			wire.WriteReply(bw, wire.Ack, h.Seq, "")
+			if h.Kind == wire.KindDone {
+				out <- frames
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestRelay_BuffersAndReplays(t *testing.T) {
+	r, addr, token := newTestRelay(t)
+	layer := bytes.Repeat([]byte("layer-bytes "), 20000) // several chunks
+	ckpt := []byte("checkpoint image")
+	manifest := []byte(`{"items":[]}`)
+
+	src, last := dialSource(t, addr, "t1", token)
+	if src == nil || last != 0 {
+		t.Fatalf("fresh session refused or resumed at %d", last)
+	}
+	for _, f := range []struct {
+		h       wire.Header
+		payload []byte
+	}{
+		{wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1, Codec: 3}, layer},
+		{wire.Header{Kind: wire.KindCheckpointFile, Name: "ckpt.dmtcp", Seq: 2, Codec: 1}, ckpt},
+		{wire.Header{Kind: wire.KindDone, Seq: 3}, manifest},
+	} {
+		if code, msg := src.send(t, f.h, f.payload); code != wire.Ack {
+			t.Fatalf("frame %d: reply 0x%02X %q", f.h.Seq, code, msg)
+		}
+	}
+	st, err := loadStore(r.Dir, "web-0")
+	if err != nil || !st.Complete || len(st.Frames) != 2 {
+		t.Fatalf("buffered store = %+v, %v", st, err)
+	}
+
+	// The destination registers; the REST API kicks the relay.
+	destAddr, out := fakeDestination(t, token)
+	r.Registry.RegisterDestination("web-0", destAddr, 0)
+	r.Kick("web-0")
+	var frames []received
+	select {
+	case frames = <-out:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the relay did not replay the transfer")
+	}
+	if len(frames) != 3 {
+		t.Fatalf("replayed %d frame(s), want 3", len(frames))
+	}
+	want := []struct {
+		h       wire.Header
+		payload []byte
+	}{
+		{wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1, Codec: 3, Flags: wire.FlagSigned}, layer},
+		{wire.Header{Kind: wire.KindCheckpointFile, Name: "ckpt.dmtcp", Seq: 2, Codec: 1, Flags: wire.FlagSigned}, ckpt},
+		{wire.Header{Kind: wire.KindDone, Seq: 3, Flags: wire.FlagSigned}, manifest},
+	}
+	for i, w := range want {
+		if frames[i].h != w.h || !bytes.Equal(frames[i].payload, w.payload) {
+			t.Errorf("frame %d = %+v (%d bytes), want %+v (%d bytes)", i+1, frames[i].h, len(frames[i].payload), w.h, len(w.payload))
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(r.Dir, "web-0")); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a delivered transfer must be removed from the relay")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestRelay_ResumesSession checks a source that lost its connection picks
+// up after the last frame the relay completed.
+func TestRelay_ResumesSession(t *testing.T) {
+	r, addr, token := newTestRelay(t)
+	src, _ := dialSource(t, addr, "t1", token)
+	if code, _ := src.send(t, wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1}, []byte("one")); code != wire.Ack {
+		t.Fatal("frame 1 refused")
+	}
+	src.conn.Close()
+
+	src, last := dialSource(t, addr, "t1", token)
+	if last != 1 {
+		t.Fatalf("resume point = %d, want 1", last)
+	}
+	// A frame resent although completed is acknowledged and dropped.
+	if code, _ := src.send(t, wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1}, []byte("one")); code != wire.Ack {
+		t.Fatal("a duplicate frame must be acknowledged")
+	}
+	if code, _ := src.send(t, wire.Header{Kind: wire.KindLayer, Ordinal: 2, Name: "u2", Seq: 2}, []byte("two")); code != wire.Ack {
+		t.Fatal("frame 2 refused")
+	}
+	st, err := loadStore(r.Dir, "web-0")
+	if err != nil || len(st.Frames) != 2 || st.Complete {
+		t.Fatalf("store after resume = %+v, %v", st, err)
+	}
+
+	// A new transfer of the same pod starts over.
+	if _, last := dialSource(t, addr, "t2", token); last != 0 {
+		t.Fatalf("new transfer resumed at %d", last)
+	}
+}
+
+// TestRelay_ResumesPartialFrame checks a source that lost its connection
+// in the middle of a frame resends only what the relay does not hold.
+func TestRelay_ResumesPartialFrame(t *testing.T) {
+	r, addr, token := newTestRelay(t)
+	layer := bytes.Repeat([]byte("layer-bytes "), 20000)
+	h := wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1}
+	src, _ := dialSource(t, addr, "t1", token)
+	frame := src.frame(h, layer, 0)
+	// The header, two full chunks and some of the third.
+	cut := wire.HeaderSize + wire.SessionExtSize + 2*(wire.ChunkHeaderSize+wire.ChunkSize) + wire.ChunkHeaderSize + 1000
+	held := int64(2*wire.ChunkSize + 1000)
+	src.conn.Write(frame[:cut])
+	src.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fi, err := os.Stat(filepath.Join(r.Dir, "web-0", partialFile))
+		if err == nil && fi.Size() == held {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the relay did not buffer the partial frame: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	src, last := dialSource(t, addr, "t1", token)
+	if last != 0 || src.offset != held {
+		t.Fatalf("resume point = (%d, %d), want (0, %d)", last, src.offset, held)
+	}
+	src.conn.Write(src.frame(h, layer, src.offset))
+	if code, _, msg, err := wire.ReadReply(src.br); err != nil || code != wire.Ack {
+		t.Fatalf("resumed frame reply = 0x%02X %q, %v", code, msg, err)
+	}
+	st, err := loadStore(r.Dir, "web-0")
+	if err != nil || len(st.Frames) != 1 || st.Partial != nil {
+		t.Fatalf("store after resume = %+v, %v", st, err)
+	}
+	if got, err := os.ReadFile(st.payloadPath(0)); err != nil || !bytes.Equal(got, layer) {
+		t.Fatalf("buffered payload differs (%d bytes), %v", len(got), err)
+	}
+}
+
+func TestRelay_RefusesStrangers(t *testing.T) {
+	r, addr, token := newTestRelay(t)
+	if src, _ := dialSource(t, addr, "t1", ""); src != nil {
+		t.Error("an unsigned session must be refused")
+	}
+	if src, _ := dialSource(t, addr, "t1", "guess"); src != nil {
+		t.Error("a session signed with another token must be refused")
+	}
+
+	src, _ := dialSource(t, addr, "t1", token)
+	src.token = "guess"
+	code, msg := src.send(t, wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1}, []byte("forged"))
+	if code != wire.Err || !strings.Contains(msg, "bad transfer token MAC") {
+		t.Fatalf("forged frame reply = 0x%02X %q", code, msg)
+	}
+	if st, err := loadStore(r.Dir, "web-0"); err != nil || len(st.Frames) != 0 {
+		t.Fatalf("a forged frame must not be buffered: %+v, %v", st, err)
+	}
+
+	r.Registry.Disarm("web-0")
+	if src, _ := dialSource(t, addr, "t3", token); src != nil {
+		t.Error("a disarmed migration's token must be refused")
+	}
+}
+
+func TestStore_DigestMismatch(t *testing.T) {
+	st, err := openStore(t.TempDir(), "web-0", "uid-1", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cw := &wire.ChunkWriter{W: &buf}
+	cw.Write([]byte("payload"))
+	cw.Close()
+	b := buf.Bytes()
+	b[wire.ChunkHeaderSize] ^= 0xFF // flip a payload byte
+	h := wire.Header{Kind: wire.KindLayer, Ordinal: 1, Name: "u1", Seq: 1}
+	accept := func(string) error { return nil }
+	if err := st.add(h, bytes.NewReader(b), accept); !errors.Is(err, errDigest) {
+		t.Fatalf("add of a corrupted payload = %v, want errDigest", err)
+	}
+	if err := st.discardPartial(); err != nil {
+		t.Fatal(err)
+	}
+	if last, off := st.resumePoint(); last != 0 || off != 0 {
+		t.Fatalf("resume point after a digest mismatch = (%d, %d), want (0, 0)", last, off)
+	}
+	if _, err := podDir("/relay", "../etc"); err == nil {
+		t.Fatal("a pod name must not escape the relay directory")
+	}
+}
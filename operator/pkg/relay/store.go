@@ -0,0 +1,265 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+const (
+	indexFile    = "index.json"
+	manifestFile = "done.json"
+	partialFile  = "incoming.part"
+)
+
+// errDigest is a payload that does not match its digest trailer; the
+// sender is asked to resend it.
+var errDigest = errors.New("payload does not match its digest")
+
+// store is the relay's buffer for one pod's transfer on the relay volume:
+//
+//	<dir>/<pod>/index.json     the frames received so far, in order
+//	<dir>/<pod>/000001.frame   payload of frame 1 (the compressed tar)
+//	<dir>/<pod>/done.json      payload of the DONE frame (the manifest)
+//	<dir>/<pod>/incoming.part  what arrived of the frame in progress
+//
+// A payload is renamed into place once its digest and MAC have been
+// checked, and the index is rewritten atomically after each frame. A source
+// that lost its connection is offered the partial payload's length as its
+// resume point, so it resends only the rest.
+type store struct {
+	dir string
+	index
+}
+
+type index struct {
+	Pod         string        `json:"pod"`
+	MigrationID string        `json:"migrationID"`
+	TransferID  string        `json:"transferID"`
+	Frames      []storedFrame `json:"frames"`
+	Complete    bool          `json:"complete"`
+	// Partial is the frame whose payload incoming.part holds, without its
+	// size and digest.
+	Partial *storedFrame `json:"partial,omitempty"`
+}
+
+// storedFrame is a buffered frame; its sequence number is its position in
+// the index plus one.
+type storedFrame struct {
+	Kind    uint32 `json:"kind"`
+	Ordinal uint32 `json:"ordinal"`
+	Name    string `json:"name"`
+	Codec   uint32 `json:"codec"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// podDir returns the store directory of pod under root, refusing names that
+// are not a single path element.
+func podDir(root, pod string) (string, error) {
+	if pod == "" || pod != filepath.Base(pod) || pod == "." || pod == ".." {
+		return "", fmt.Errorf("invalid pod name %q", pod)
+	}
+	return filepath.Join(root, pod), nil
+}
+
+// loadStore reads the store of pod, returning os.ErrNotExist when the relay
+// holds nothing for it.
+func loadStore(root, pod string) (*store, error) {
+	dir, err := podDir(root, pod)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	s := &store{dir: dir}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filepath.Join(dir, indexFile), err)
+	}
+	return s, nil
+}
+
+// openStore returns the store of pod for transfer id in migration. A store
+// left by another transfer (an earlier attempt or migration) is discarded:
+// the source sends everything again in a new session.
+func openStore(root, pod, migration, id string) (*store, error) {
+	s, err := loadStore(root, pod)
+	switch {
+	case err == nil && s.MigrationID == migration && s.TransferID == id:
+		return s, nil
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	dir, err := podDir(root, pod)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("discard stale relay buffer: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	s = &store{dir: dir, index: index{Pod: pod, MigrationID: migration, TransferID: id}}
+	return s, s.save()
+}
+
+// lastSeq is the last frame the store completed, counting DONE.
+func (s *store) lastSeq() uint32 {
+	n := uint32(len(s.Frames))
+	if s.Complete {
+		n++
+	}
+	return n
+}
+
+// resumePoint returns the last frame the store completed and how many
+// payload bytes of the next one it holds.
+func (s *store) resumePoint() (uint32, int64) {
+	if s.Partial == nil {
+		return s.lastSeq(), 0
+	}
+	fi, err := os.Stat(filepath.Join(s.dir, partialFile))
+	if err != nil {
+		return s.lastSeq(), 0
+	}
+	return s.lastSeq(), fi.Size()
+}
+
+// payloadPath returns the file holding the payload of the frame at position
+// i, or of the DONE frame when i is len(Frames).
+func (s *store) payloadPath(i int) string {
+	if i == len(s.Frames) {
+		return filepath.Join(s.dir, manifestFile)
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.frame", i+1))
+}
+
+// add reads the chunks of frame h from r, continuing the partial payload
+// of the same frame, and, once accept approves its digest, records it as
+// the next frame (or the DONE frame). What arrived before an error stays
+// in the partial payload until discardPartial.
+func (s *store) add(h wire.Header, r io.Reader, accept func(digest string) error) error {
+	final := filepath.Join(s.dir, manifestFile)
+	if h.Kind != wire.KindDone {
+		final = filepath.Join(s.dir, fmt.Sprintf("%06d.frame", len(s.Frames)+1))
+	}
+	f, held, sum, err := s.openPartial(h)
+	if err != nil {
+		return err
+	}
+	size, err := wire.CopyChunks(r, io.MultiWriter(f, sum), held)
+	if serr := f.Sync(); err == nil && serr != nil {
+		err = fmt.Errorf("write relay buffer: %w", serr)
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("write relay buffer: %w", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	want, err := wire.ReadDigest(r)
+	if err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(sum.Sum(nil))
+	if digest != hex.EncodeToString(want[:]) {
+		return errDigest
+	}
+	if err := accept(digest); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), final); err != nil {
+		return fmt.Errorf("commit relay buffer: %w", err)
+	}
+	s.Partial = nil
+	if h.Kind == wire.KindDone {
+		s.Complete = true
+	} else {
+		s.Frames = append(s.Frames, storedFrame{Kind: h.Kind, Ordinal: h.Ordinal, Name: h.Name, Codec: h.Codec, Size: size, SHA256: digest})
+	}
+	return s.save()
+}
+
+// openPartial opens the partial payload of frame h for appending, with how
+// many bytes it holds and their running digest. A partial payload of
+// another frame is discarded.
+func (s *store) openPartial(h wire.Header) (*os.File, int64, hash.Hash, error) {
+	path := filepath.Join(s.dir, partialFile)
+	frame := storedFrame{Kind: h.Kind, Ordinal: h.Ordinal, Name: h.Name, Codec: h.Codec}
+	sum := sha256.New()
+	if s.Partial == nil || *s.Partial != frame {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("create relay buffer: %w", err)
+		}
+		s.Partial = &frame
+		if err := s.save(); err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+		return f, 0, sum, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("open relay buffer: %w", err)
+	}
+	held, err := io.Copy(sum, f)
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, fmt.Errorf("read relay buffer: %w", err)
+	}
+	return f, held, sum, nil
+}
+
+// discardPartial drops the partial payload of a frame that will be sent
+// again from its start.
+func (s *store) discardPartial() error {
+	if s.Partial == nil {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, partialFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("discard relay buffer: %w", err)
+	}
+	s.Partial = nil
+	return s.save()
+}
+
+// save rewrites the index atomically.
+func (s *store) save() error {
+	data, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, indexFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("write relay index: %w", err)
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write relay index: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, indexFile))
+}
+
+// remove deletes the store once the destination holds the transfer.
+func (s *store) remove() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
+	"github.com/paulosouzajr/mycedrive-k8s/wire"
+)
+
+// relayName is the CommonName of the relay's transfer certificates.
+const relayName = "mycedrive-relay"
+
+// serverTLS answers a source as the destination of the migration it names
+// in SNI, and accepts only that migration's source certificate.
+func (r *Relay) serverTLS() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			migration := hello.ServerName
+			if migration == "" {
+				return nil, errors.New("the source named no migration (SNI)")
+			}
+			cfg, err := r.transferTLS(migration, ca.RoleDestination)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ClientAuth = tls.RequireAnyClientCert
+			return cfg, nil
+		},
+	}
+}
+
+// clientTLS dials a destination as the source of migration.
+func (r *Relay) clientTLS(migration string) (*tls.Config, error) {
+	cfg, err := r.transferTLS(migration, ca.RoleSource)
+	if err != nil {
+		return nil, err
+	}
+	// wire.VerifyPeer checks the chain and identity; a pod IP has no
+	// host name to check.
+	cfg.InsecureSkipVerify = true
+	return cfg, nil
+}
+
+// transferTLS is the configuration for the relay acting as role in
+// migration, accepting only the peer in the opposite role.
+func (r *Relay) transferTLS(migration string, role ca.Role) (*tls.Config, error) {
+	b, err := r.CA.Issue(migration, relayName, role)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(b.Cert), []byte(b.Key))
+	if err != nil {
+		return nil, fmt.Errorf("load relay certificate: %w", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(r.CA.CertPEM()))
+	peer, usage := ca.RoleDestination, x509.ExtKeyUsageServerAuth
+	if role == ca.RoleDestination {
+		peer, usage = ca.RoleSource, x509.ExtKeyUsageClientAuth
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return wire.VerifyPeer(cs.PeerCertificates, roots, usage, migration, string(peer))
+		},
+	}, nil
+}
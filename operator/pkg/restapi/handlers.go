@@ -2,16 +2,21 @@ package restapi
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
 	mycedrivev1alpha1 "github.com/paulosouzajr/mycedrive-k8s/operator/api/v1alpha1"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
 )
 
 // Message is the /register payload. The request fields are byte-compatible
@@ -29,6 +34,41 @@ type Message struct {
 	VolumeMigration  bool   `json:"volumeMigration"`
 	CheckpointDir    string `json:"checkpointDir,omitempty"`
 	SyncRounds       int    `json:"syncRounds,omitempty"`
+
+	// TLS (additive) is the destination EA's transfer certificate, set on
+	// the isMig=true response when the transfer CA is enabled.
+	TLS *ca.Bundle `json:"tls,omitempty"`
+
+	// TransferToken (additive) is the armed migration's transfer token, set
+	// on the isMig=true response; the destination EA refuses frames that
+	// are not signed with it.
+	TransferToken string `json:"transferToken,omitempty"`
+
+	// MigrationID (additive) identifies the armed migration on the
+	// isMig=true response; the destination EA looks for a checkpoint set
+	// the source left in the checkpoint store under it.
+	MigrationID string `json:"migrationID,omitempty"`
+
+	// MaxTransferBytesPerSecond (additive) is the armed migration's cap on
+	// transfer bandwidth, set on the isMig=true response; the destination
+	// EA paces what it reads to it.
+	MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond,omitempty"`
+
+	// AbortPolicy (additive) is what the destination EA does should the
+	// armed migration be aborted, set on the isMig=true response when the
+	// workload chose one.
+	AbortPolicy string `json:"abortPolicy,omitempty"`
+
+	// AgentKey (additive) is the secret of this registration, set on both
+	// responses; the EA sends it with GET /poll to be handed its source
+	// transfer certificate. The destination's (isMig=true) only becomes
+	// valid there once its migration ended.
+	AgentKey string `json:"agentKey,omitempty"`
+
+	// VolumeMountMode (additive) is how the EA mounts its overlay volume
+	// (Privileged, UserNamespace or FUSE), set on both responses once the
+	// pod's MigratableWorkload is known.
+	VolumeMountMode string `json:"volumeMountMode,omitempty"`
 }
 
 // RemoveRequest / RemoveResponse implement POST /remove.
@@ -46,25 +86,104 @@ type RemoveResponse struct {
 	// Empty when no target has registered yet; the agent then keeps the
 	// checkpoints local for MC-driven copy.
 	DestAddress string `json:"destAddress,omitempty"`
+
+	// RelayAddress (additive, optional) is the operator's transfer relay,
+	// set instead of DestAddress while the target has not registered: the
+	// source streams there and the relay replays to the destination.
+	RelayAddress string `json:"relayAddress,omitempty"`
+
+	// Compression (additive, optional) is the codec the source EA
+	// compresses transfer payloads with; empty keeps the agent's default.
+	Compression string `json:"compression,omitempty"`
+
+	// TransferStreams (additive, optional) is how many connections the
+	// source EA stripes a large checkpoint file over when it streams to
+	// DestAddress; omitted, or 1, sends everything over one.
+	TransferStreams int `json:"transferStreams,omitempty"`
+
+	// MaxTransferBytesPerSecond (additive, optional) caps the bandwidth the
+	// source EA transfers with; omitted when the workload sets no cap.
+	MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond,omitempty"`
+
+	// TLS (additive, optional) is the source EA's client certificate for
+	// the transfer, set while a migration is armed and the transfer CA is
+	// enabled. It, TransferToken and MigrationID are only set for a caller
+	// presenting the source's agent key, as on GET /poll.
+	TLS *ca.Bundle `json:"tls,omitempty"`
+
+	// TransferToken (additive, optional) is the key the source EA signs
+	// its transfer frames with, set while a migration is armed.
+	TransferToken string `json:"transferToken,omitempty"`
+
+	// MigrationID (additive, optional) identifies the armed migration; a
+	// source that uploads to the checkpoint store names its set after it.
+	MigrationID string `json:"migrationID,omitempty"`
 }
 
-// CopyNotification implements POST /copy.
+// CopyNotification implements POST /copy. LayerCount (additive) is the
+// number of volume layers the source EA sent.
 type CopyNotification struct {
 	PodName       string `json:"podName"`
 	CheckpointDir string `json:"checkpointDir"`
+	LayerCount    int    `json:"layerCount,omitempty"`
+}
+
+// ProgressNotification implements POST /progress (additive: the source EA's
+// periodic report of its transfer to the destination).
+type ProgressNotification struct {
+	PodName        string         `json:"podName"`
+	BytesDone      int64          `json:"bytesDone"`
+	BytesTotal     int64          `json:"bytesTotal"`
+	BytesPerSecond int64          `json:"bytesPerSecond"`
+	Items          []ItemProgress `json:"items,omitempty"`
+}
+
+// ItemProgress is one layer or checkpoint file of a ProgressNotification.
+type ItemProgress struct {
+	Name       string `json:"name"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
 }
 
 // SyncNotification implements POST /sync (additive: pre-downtime overlay
-// snapshot round completed by the source EA).
+// snapshot round completed by the source EA). Stats is what the source
+// measured in the round and StopReason, with a target downtime, why it runs
+// no more rounds.
 type SyncNotification struct {
-	PodName string `json:"podName"`
-	Round   int    `json:"round"`
+	PodName    string          `json:"podName"`
+	Round      int             `json:"round"`
+	Stats      *SyncRoundStats `json:"stats,omitempty"`
+	StopReason string          `json:"stopReason,omitempty"`
+}
+
+// SyncRoundStats is the measurement part of a SyncNotification.
+type SyncRoundStats struct {
+	Round               int   `json:"round"`
+	LayerBytes          int64 `json:"layerBytes"`
+	FillMs              int64 `json:"fillMs"`
+	SentBytes           int64 `json:"sentBytes,omitempty"`
+	SendMs              int64 `json:"sendMs,omitempty"`
+	ProjectedDowntimeMs int64 `json:"projectedDowntimeMs"`
 }
 
 // RestoredNotification implements POST /restored (additive: destination EA
-// finished dmtcp_restart).
+// finished dmtcp_restart). The timing fields are sent by the EA's restore
+// supervisor once the restored processes rejoined the DMTCP coordinator.
 type RestoredNotification struct {
-	PodName string `json:"podName"`
+	PodName    string `json:"podName"`
+	TransferMs int64  `json:"transferMs,omitempty"`
+	RestoreMs  int64  `json:"restoreMs,omitempty"`
+	Peers      int    `json:"peers,omitempty"`
+}
+
+// AbortNotification implements POST /aborted (additive: the destination EA
+// gave up on its migration's transfer and applied its abort policy).
+type AbortNotification struct {
+	PodName     string `json:"podName"`
+	MigrationID string `json:"migrationID,omitempty"`
+	Reason      string `json:"reason"`
+	Policy      string `json:"policy"`
+	Outcome     string `json:"outcome"`
 }
 
 // MigrateRequest accepts both the legacy shape (deployment/originNode/
@@ -93,7 +212,24 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	prev, isNew := s.Registry.Register(msg.PodName, msg.PodAddress, msg.ContainerPort)
+	var prev registry.PodRecord
+	isNew, dest := false, false
+	if rec, ok := s.Registry.Get(msg.PodName); ok && rec.Migrating {
+		// The destination is handed the transfer token, so it must be the
+		// pod of that name on the target node; the pod on any other node
+		// is the source restarting.
+		node, err := s.callerNode(r, rec)
+		if err != nil {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		}
+		if node == rec.TargetNode {
+			prev, dest = s.Registry.RegisterDestination(msg.PodName, msg.PodAddress, msg.ContainerPort)
+		}
+	}
+	if !dest {
+		prev, isNew = s.Registry.Register(msg.PodName, msg.PodAddress, msg.ContainerPort)
+	}
 	rec, _ := s.Registry.Get(msg.PodName)
 
 	if isNew {
@@ -104,25 +240,103 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 			IsMig:            false,
 			ProcessMigration: rec.ProcessMigration,
 			VolumeMigration:  rec.VolumeMigration,
+			AgentKey:         rec.AgentKey,
+			VolumeMountMode:  s.Registry.MountMode(msg.PodName),
 		})
 		return
 	}
 
 	// Duplicate name: either the destination EA of an active migration
 	// (isMig=true: block and wait for the checkpoint) or a plain restart.
+	var bundle *ca.Bundle
+	token, migration, maxRate, abortPolicy, key := "", "", int64(0), "", rec.AgentKey
+	if dest {
+		var err error
+		if bundle, err = s.transferTLS(rec, ca.RoleDestination); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		token, migration, maxRate, abortPolicy, key = rec.TransferToken, migrationID(rec), rec.MaxBytesPerSec, rec.AbortPolicy, rec.DestKey
+		if s.Relay != nil {
+			// The source may have left its transfer with the relay.
+			s.Relay.Kick(rec.Name)
+		}
+	}
 	writeJSON(w, http.StatusOK, Message{
 		PodName:          msg.PodName,
 		PodAddress:       prev.Address,
 		ContainerPort:    msg.ContainerPort,
 		IsNew:            false,
-		IsMig:            rec.Migrating,
+		IsMig:            dest,
 		ProcessMigration: rec.ProcessMigration,
 		VolumeMigration:  rec.VolumeMigration,
 		CheckpointDir:    rec.CheckpointDir,
 		SyncRounds:       rec.SyncRounds,
+		TLS:              bundle,
+		TransferToken:    token,
+		MigrationID:      migration,
+
+		MaxTransferBytesPerSecond: maxRate,
+		AbortPolicy:               abortPolicy,
+		AgentKey:                  key,
+		VolumeMountMode:           s.Registry.MountMode(msg.PodName),
 	})
 }
 
+// callerNode returns the node of the pod rec names when r comes from that
+// pod's IP, and fails otherwise.
+func (s *Server) callerNode(r *http.Request, rec registry.PodRecord) (string, error) {
+	if s.Client == nil {
+		return "", fmt.Errorf("pod %q has a migration armed and its registration cannot be checked", rec.Name)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	caller := net.ParseIP(host)
+	namespace := rec.WorkloadNamespace
+	if namespace == "" {
+		namespace = s.DefaultNamespace
+	}
+	var pod corev1.Pod
+	if err := s.Client.Get(r.Context(), types.NamespacedName{Namespace: namespace, Name: rec.Name}, &pod); err != nil {
+		return "", fmt.Errorf("look up pod %s/%s: %w", namespace, rec.Name, err)
+	}
+	ips := []string{pod.Status.PodIP}
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	for _, ip := range ips {
+		if caller != nil && caller.Equal(net.ParseIP(ip)) {
+			return pod.Spec.NodeName, nil
+		}
+	}
+	return "", fmt.Errorf("registration of pod %q comes from %s, which is not the pod's address", rec.Name, host)
+}
+
+// migrationID identifies the armed migration of rec. Migrations armed
+// without an id (legacy callers) are identified by the pod name.
+func migrationID(rec registry.PodRecord) string {
+	if rec.MigrationID != "" {
+		return rec.MigrationID
+	}
+	return rec.Name
+}
+
+// transferTLS returns the transfer certificate for the EA of rec acting as
+// role in its armed migration, or nil when no migration is armed or the
+// transfer CA is disabled.
+func (s *Server) transferTLS(rec registry.PodRecord, role ca.Role) (*ca.Bundle, error) {
+	if s.CA == nil || !rec.Migrating {
+		return nil, nil
+	}
+	b, err := s.CA.Issue(migrationID(rec), rec.Name, role)
+	if err != nil {
+		return nil, fmt.Errorf("issue transfer certificate: %w", err)
+	}
+	return b, nil
+}
+
 func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
 	var req RemoveRequest
 	if !decodeJSON(w, r, &req) {
@@ -140,6 +354,26 @@ func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
 	}
 	if rec.Migrating {
 		resp.DestAddress = rec.DestAddress
+		if rec.DestAddress == "" && s.Relay != nil {
+			resp.RelayAddress = s.Relay.Advertise
+		}
+		resp.Compression = rec.Compression
+		resp.TransferStreams = rec.TransferStreams
+		resp.MaxTransferBytesPerSecond = rec.MaxBytesPerSec
+	}
+	// As on /poll, what the transfer is signed and authenticated with goes
+	// to the source alone.
+	if isSource(r, rec) {
+		if rec.Migrating {
+			resp.TransferToken = rec.TransferToken
+			resp.MigrationID = migrationID(rec)
+		}
+		bundle, err := s.transferTLS(rec, ca.RoleSource)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		resp.TLS = bundle
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
@@ -149,28 +383,64 @@ func (s *Server) handleCopy(w http.ResponseWriter, r *http.Request) {
 	if !decodeJSON(w, r, &notif) {
 		return
 	}
-	if !s.Registry.MarkCheckpointReady(notif.PodName, notif.CheckpointDir) {
+	if !s.Registry.MarkCheckpointReady(notif.PodName, notif.CheckpointDir, notif.LayerCount) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
 		return
 	}
-	s.Log.Info("checkpoint acknowledged", "pod", notif.PodName, "dir", notif.CheckpointDir)
+	s.Log.Info("checkpoint acknowledged", "pod", notif.PodName, "dir", notif.CheckpointDir, "layers", notif.LayerCount)
 	writeJSON(w, http.StatusOK, map[string]string{"status": "copy_initiated", "pod": notif.PodName})
 }
 
+func (s *Server) handleProgress(w http.ResponseWriter, r *http.Request) {
+	var notif ProgressNotification
+	if !decodeJSON(w, r, &notif) {
+		return
+	}
+	p := registry.TransferProgress{BytesDone: notif.BytesDone, BytesTotal: notif.BytesTotal, BytesPerSecond: notif.BytesPerSecond}
+	for _, it := range notif.Items {
+		p.Items = append(p.Items, registry.ItemProgress{Name: it.Name, BytesDone: it.BytesDone, BytesTotal: it.BytesTotal})
+	}
+	if !s.Registry.RecordProgress(notif.PodName, p) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "progress_recorded", "pod": notif.PodName})
+}
+
 func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
 	var notif SyncNotification
 	if !decodeJSON(w, r, &notif) {
 		return
 	}
-	if !s.Registry.RecordSyncRound(notif.PodName, notif.Round) {
+	var known bool
+	if notif.Stats != nil || notif.StopReason != "" {
+		stats := registry.SyncRoundStats{Round: notif.Round}
+		if st := notif.Stats; st != nil {
+			stats = registry.SyncRoundStats{
+				Round:               notif.Round,
+				LayerBytes:          st.LayerBytes,
+				FillMs:              st.FillMs,
+				SentBytes:           st.SentBytes,
+				SendMs:              st.SendMs,
+				ProjectedDowntimeMs: st.ProjectedDowntimeMs,
+			}
+		}
+		known = s.Registry.RecordSyncStats(notif.PodName, stats, notif.StopReason)
+	} else {
+		known = s.Registry.RecordSyncRound(notif.PodName, notif.Round)
+	}
+	if !known {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
 		return
 	}
 	rec, _ := s.Registry.Get(notif.PodName)
 	remaining := rec.SyncRounds - rec.SyncRound
-	if remaining < 0 {
+	if remaining < 0 || rec.SyncStopReason != "" {
 		remaining = 0
 	}
+	if notif.StopReason != "" {
+		s.Log.Info("pre-downtime rounds stopped", "pod", notif.PodName, "round", notif.Round, "reason", notif.StopReason)
+	}
 	writeJSON(w, http.StatusOK, map[string]any{"status": "sync_recorded", "pod": notif.PodName, "round": rec.SyncRound, "remaining": remaining})
 }
 
@@ -179,16 +449,55 @@ func (s *Server) handleRestored(w http.ResponseWriter, r *http.Request) {
 	if !decodeJSON(w, r, &notif) {
 		return
 	}
-	if !s.Registry.MarkRestored(notif.PodName) {
+	timing := registry.RestoreTiming{TransferMs: notif.TransferMs, RestoreMs: notif.RestoreMs, Peers: notif.Peers}
+	if !s.Registry.MarkRestored(notif.PodName, timing) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
 		return
 	}
-	s.Log.Info("restore acknowledged", "pod", notif.PodName)
+	s.Log.Info("restore acknowledged", "pod", notif.PodName, "peers", notif.Peers, "transferMs", notif.TransferMs, "restoreMs", notif.RestoreMs)
 	writeJSON(w, http.StatusOK, map[string]string{"status": "restored", "pod": notif.PodName})
 }
 
+// handleAborted records what a destination EA did after its migration's
+// transfer was abandoned. Only an agent of the pod (isAgent) may report it,
+// and only for the migration armed on the pod or the one the controller
+// aborted, so a stale or forged report cannot land on another Migration.
+func (s *Server) handleAborted(w http.ResponseWriter, r *http.Request) {
+	var notif AbortNotification
+	if !decodeJSON(w, r, &notif) {
+		return
+	}
+	rec, known := s.Registry.Get(notif.PodName)
+	if !known {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
+		return
+	}
+	if !isAgent(r, rec) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "an abort is reported with the pod's agent key"})
+		return
+	}
+	if !abortable(rec, notif.MigrationID) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("migration %q of pod %q is neither armed nor aborted", notif.MigrationID, notif.PodName)})
+		return
+	}
+	report := registry.AbortReport{MigrationID: notif.MigrationID, Reason: notif.Reason, Policy: notif.Policy, Outcome: notif.Outcome}
+	if !s.Registry.RecordAbort(notif.PodName, report) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", notif.PodName)})
+		return
+	}
+	s.Log.Info("abort acknowledged", "pod", notif.PodName, "migration", notif.MigrationID,
+		"reason", notif.Reason, "policy", notif.Policy, "outcome", notif.Outcome)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "abort_recorded", "pod": notif.PodName})
+}
+
 // handlePoll lets a running source EA discover an armed migration:
-// GET /poll?podName=NAME.
+// GET /poll?podName=NAME. The agent's sync daemon drives its pre-downtime
+// rounds from syncRounds/syncRound (adaptive ones from minSyncRounds and
+// targetDowntimeMs too, until syncStopReason is set) and ships layers to
+// destAddress once the migration target has registered. A destination EA
+// waiting for its transfer polls it too, for abortedMigration. Only a
+// caller that proves it is the source (isSource) gets the transfer token
+// and the source transfer certificate.
 func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("podName")
 	if name == "" {
@@ -200,7 +509,7 @@ func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pod %q not registered", name)})
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{
+	resp := map[string]any{
 		"podName":          rec.Name,
 		"migrating":        rec.Migrating,
 		"processMigration": rec.ProcessMigration,
@@ -208,7 +517,75 @@ func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
 		"checkpointDir":    rec.CheckpointDir,
 		"syncRounds":       rec.SyncRounds,
 		"syncRound":        rec.SyncRound,
-	})
+	}
+	if rec.Migrating && rec.TargetDowntimeMs > 0 {
+		resp["minSyncRounds"] = rec.MinSyncRounds
+		resp["targetDowntimeMs"] = rec.TargetDowntimeMs
+	}
+	if rec.SyncStopReason != "" {
+		resp["syncStopReason"] = rec.SyncStopReason
+	}
+	if rec.Migrating && rec.DestAddress != "" {
+		resp["destAddress"] = rec.DestAddress
+	}
+	if rec.Migrating && rec.Compression != "" {
+		resp["compression"] = rec.Compression
+	}
+	if rec.Migrating && rec.MaxBytesPerSec > 0 {
+		resp["maxTransferBytesPerSecond"] = rec.MaxBytesPerSec
+	}
+	if rec.AbortedMigration != "" {
+		resp["abortedMigration"] = rec.AbortedMigration
+		resp["abortReason"] = rec.AbortReason
+	}
+	// The sync daemon streams pre-downtime rounds to the destination too.
+	if isSource(r, rec) {
+		if rec.Migrating && rec.TransferToken != "" {
+			resp["transferToken"] = rec.TransferToken
+		}
+		bundle, err := s.transferTLS(rec, ca.RoleSource)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if bundle != nil {
+			resp["tls"] = bundle
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// isSource reports whether the caller of r is the migration source of rec:
+// it presents the pod's AgentKey as a bearer token. The destination's
+// registration has a key of its own (DestKey), so the source keeps its
+// grant once the destination is up.
+func isSource(r *http.Request, rec registry.PodRecord) bool {
+	return bearerIs(r, rec.AgentKey)
+}
+
+// isAgent reports whether the caller of r is one of the agents of rec: it
+// presents the AgentKey or, while a migration is armed, the destination's
+// DestKey as a bearer token.
+func isAgent(r *http.Request, rec registry.PodRecord) bool {
+	return bearerIs(r, rec.AgentKey) || bearerIs(r, rec.DestKey)
+}
+
+// bearerIs reports whether r carries key as its bearer token.
+func bearerIs(r *http.Request, key string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1
+}
+
+// abortable reports whether an abort of migration may be recorded for rec:
+// it is the migration armed on the pod or the one the controller gave up on.
+func abortable(rec registry.PodRecord, migration string) bool {
+	if migration == "" {
+		return false
+	}
+	return (rec.Migrating && migration == migrationID(rec)) || migration == rec.AbortedMigration
 }
 
 func (s *Server) handleMigrate(w http.ResponseWriter, r *http.Request) {
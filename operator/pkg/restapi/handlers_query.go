@@ -29,6 +29,9 @@ type apiPod struct {
 	VolumeMigration  bool       `json:"volumeMigration"`
 	SyncRound        int        `json:"syncRound,omitempty"`
 	SyncRounds       int        `json:"syncRounds,omitempty"`
+	TransferMs       int64      `json:"transferMs,omitempty"`
+	RestoreMs        int64      `json:"restoreMs,omitempty"`
+	RestoredPeers    int        `json:"restoredPeers,omitempty"`
 	RegisteredAt     *time.Time `json:"registeredAt,omitempty"`
 	LastSeen         *time.Time `json:"lastSeen,omitempty"`
 }
@@ -49,8 +52,20 @@ type apiMigration struct {
 	VolumeMigration  bool       `json:"volumeMigration"`
 	SyncRound        int32      `json:"syncRound,omitempty"`
 	SyncRounds       int32      `json:"syncRounds,omitempty"`
+	SyncStopReason   string     `json:"syncStopReason,omitempty"`
+	LayerCount       int32      `json:"layerCount,omitempty"`
 	StartTime        *time.Time `json:"startTime,omitempty"`
 	CompletionTime   *time.Time `json:"completionTime,omitempty"`
+
+	// Transfer is the source EA's transfer progress, per item included.
+	Transfer *mycedrivev1alpha1.TransferProgress `json:"transfer,omitempty"`
+
+	// PreSync is what the source EA measured in each pre-downtime round.
+	PreSync []mycedrivev1alpha1.SyncRoundStatus `json:"preSync,omitempty"`
+
+	// Abort is set when the transfer was aborted, with what the
+	// destination EA did about it.
+	Abort *mycedrivev1alpha1.MigrationAbort `json:"abort,omitempty"`
 }
 
 // handleLegacyPods implements GET /pods (legacy dashboard shape).
@@ -83,6 +98,9 @@ func (s *Server) handleAPIPods(w http.ResponseWriter, _ *http.Request) {
 			VolumeMigration:  rec.VolumeMigration,
 			SyncRound:        rec.SyncRound,
 			SyncRounds:       rec.SyncRounds,
+			TransferMs:       rec.RestoreTiming.TransferMs,
+			RestoreMs:        rec.RestoreTiming.RestoreMs,
+			RestoredPeers:    rec.RestoreTiming.Peers,
 		}
 		if !registeredAt.IsZero() {
 			p.RegisteredAt = &registeredAt
@@ -120,6 +138,11 @@ func (s *Server) handleAPIMigrations(w http.ResponseWriter, r *http.Request) {
 			VolumeMigration:  mig.Status.VolumeMigration,
 			SyncRound:        mig.Status.SyncRound,
 			SyncRounds:       mig.Status.SyncRounds,
+			SyncStopReason:   mig.Status.SyncStopReason,
+			PreSync:          mig.Status.PreSync,
+			LayerCount:       mig.Status.LayerCount,
+			Transfer:         mig.Status.Transfer,
+			Abort:            mig.Status.Abort,
 		}
 		if m.Phase == "" {
 			m.Phase = "Pending"
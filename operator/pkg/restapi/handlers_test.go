@@ -2,20 +2,36 @@ package restapi
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/relay"
 )
 
-// newTestServer returns a Server wired to a fresh registry and a test mux.
-// The Kubernetes client is nil: routes touching it are not exercised here.
+// newTestServer returns a Server wired to a fresh registry, a fake
+// Kubernetes client holding no objects, and a test mux.
 func newTestServer() (*Server, *http.ServeMux) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
 	s := &Server{
+		Client:           fake.NewClientBuilder().WithScheme(scheme).Build(),
 		Registry:         registry.New(),
 		DefaultNamespace: "mig-ready",
 		Log:              logr.Discard(),
@@ -26,6 +42,12 @@ func newTestServer() (*Server, *http.ServeMux) {
 }
 
 func doJSON(t *testing.T, mux *http.ServeMux, method, path string, body any) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	return doJSONAs(t, mux, method, path, "", body)
+}
+
+// doJSONAs is doJSON with key, when set, as the bearer token.
+func doJSONAs(t *testing.T, mux *http.ServeMux, method, path, key string, body any) (*httptest.ResponseRecorder, map[string]any) {
 	t.Helper()
 	var buf bytes.Buffer
 	if body != nil {
@@ -35,6 +57,9 @@ func doJSON(t *testing.T, mux *http.ServeMux, method, path string, body any) (*h
 	}
 	req := httptest.NewRequest(method, path, &buf)
 	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
 	rr := httptest.NewRecorder()
 	mux.ServeHTTP(rr, req)
 
@@ -47,6 +72,62 @@ func doJSON(t *testing.T, mux *http.ServeMux, method, path string, body any) (*h
 	return rr, decoded
 }
 
+// pollAs is GET /poll for pod with key as the bearer token.
+func pollAs(t *testing.T, mux *http.ServeMux, pod, key string) map[string]any {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/poll?podName="+pod, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var decoded map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode response %q: %v", rr.Body.String(), err)
+	}
+	return decoded
+}
+
+// destNode is the node tests arm migrations to.
+const destNode = "node-b"
+
+// placePod creates the pod name on node with the address httptest requests
+// come from, as if the scheduler had put it there, replacing any earlier
+// pod of that name.
+func placePod(t *testing.T, s *Server, name, node string) {
+	t.Helper()
+	placePodAt(t, s, name, node, "192.0.2.1")
+}
+
+// placePodAt is placePod with the pod's address.
+func placePodAt(t *testing.T, s *Server, name, node, ip string) {
+	t.Helper()
+	ctx := context.Background()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: s.DefaultNamespace, Name: name}}
+	if err := s.Client.Delete(ctx, pod); err != nil && !apierrors.IsNotFound(err) {
+		t.Fatal(err)
+	}
+	pod.Spec.NodeName = node
+	pod.Status.PodIP = ip
+	if err := s.Client.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeAs is POST /remove for pod with key as the bearer token.
+func removeAs(t *testing.T, mux *http.ServeMux, pod, key string) map[string]any {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"podName": pod})
+	req := httptest.NewRequest(http.MethodPost, "/remove", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var decoded map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode response %q: %v", rr.Body.String(), err)
+	}
+	return decoded
+}
+
 // TestRegisterCopyHandshake walks the full agent handshake of a StatefulSet
 // migration: fresh register → arm → remove → copy → destination re-register
 // → restored.
@@ -73,6 +154,10 @@ func TestRegisterCopyHandshake(t *testing.T) {
 		ProcessMigration: true,
 		VolumeMigration:  true,
 		SyncRounds:       1,
+		Compression:      "auto",
+		TransferStreams:  4,
+		MaxBytesPerSec:   8 << 20,
+		TargetNode:       destNode,
 	})
 
 	// 3. Source EA polls and sees the armed migration.
@@ -83,6 +168,15 @@ func TestRegisterCopyHandshake(t *testing.T) {
 	if resp["processMigration"] != true || resp["volumeMigration"] != true {
 		t.Fatalf("poll must carry mechanism toggles: %v", resp)
 	}
+	if _, ok := resp["destAddress"]; ok {
+		t.Fatalf("poll must omit destAddress before the migration target registers: %v", resp)
+	}
+	if resp["compression"] != "auto" {
+		t.Fatalf("poll must carry the payload codec: %v", resp)
+	}
+	if resp["maxTransferBytesPerSecond"] != float64(8<<20) {
+		t.Fatalf("poll must carry the bandwidth cap: %v", resp)
+	}
 
 	// 4. Source EA reports the pre-downtime sync round.
 	rr, resp = doJSON(t, mux, http.MethodPost, "/sync", map[string]any{"podName": "web-0", "round": 1})
@@ -98,24 +192,49 @@ func TestRegisterCopyHandshake(t *testing.T) {
 	if resp["processMigration"] != true || resp["volumeMigration"] != true {
 		t.Fatalf("remove must carry mechanism toggles: %v", resp)
 	}
+	if resp["compression"] != "auto" {
+		t.Fatalf("remove must carry the payload codec: %v", resp)
+	}
+	if resp["transferStreams"] != float64(4) || resp["maxTransferBytesPerSecond"] != float64(8<<20) {
+		t.Fatalf("remove must carry the striping connections and the bandwidth cap: %v", resp)
+	}
 	if _, ok := resp["destAddress"]; ok {
 		t.Fatalf("destAddress must be omitted before the migration target registers: %v", resp)
 	}
 
-	// 6. Source EA finished writing checkpoint files.
+	// 6. Source EA reports its transfer progress, then finished writing
+	// checkpoint files.
+	rr, resp = doJSON(t, mux, http.MethodPost, "/progress", map[string]any{
+		"podName":        "web-0",
+		"bytesDone":      3 << 20,
+		"bytesTotal":     8 << 20,
+		"bytesPerSecond": 1 << 20,
+		"items":          []map[string]any{{"name": "ckpt_a.dmtcp", "bytesDone": 3 << 20, "bytesTotal": 8 << 20}},
+	})
+	if rr.Code != http.StatusOK || resp["status"] != "progress_recorded" {
+		t.Fatalf("progress = %d %v", rr.Code, resp)
+	}
+	if rec, _ := s.Registry.Get("web-0"); rec.Progress.BytesDone != 3<<20 || rec.Progress.BytesTotal != 8<<20 || len(rec.Progress.Items) != 1 || rec.Progress.Items[0].Name != "ckpt_a.dmtcp" {
+		t.Fatalf("progress must be stored: %+v", rec.Progress)
+	}
+	if rr, _ = doJSON(t, mux, http.MethodPost, "/progress", map[string]any{"podName": "ghost"}); rr.Code != http.StatusNotFound {
+		t.Fatalf("progress for an unknown pod = %d, want 404", rr.Code)
+	}
 	rr, resp = doJSON(t, mux, http.MethodPost, "/copy", map[string]any{
 		"podName":       "web-0",
 		"checkpointDir": "/dmtcp/checkpoints",
+		"layerCount":    2,
 	})
 	if rr.Code != http.StatusOK || resp["status"] != "copy_initiated" {
 		t.Fatalf("copy = %d %v", rr.Code, resp)
 	}
-	if rec, _ := s.Registry.Get("web-0"); !rec.CheckpointReady {
-		t.Fatalf("copy must mark the checkpoint ready")
+	if rec, _ := s.Registry.Get("web-0"); !rec.CheckpointReady || rec.LayerCount != 2 {
+		t.Fatalf("copy must mark the checkpoint ready and keep the layer count: %+v", rec)
 	}
 
 	// 7. Destination EA re-registers under the same StatefulSet pod name:
 	// 200, isMig=true, carries checkpointDir.
+	placePod(t, s, "web-0", destNode)
 	rr, resp = doJSON(t, mux, http.MethodPost, "/register", map[string]any{
 		"podName":       "web-0",
 		"podAddress":    "10.0.1.7:2486",
@@ -128,8 +247,8 @@ func TestRegisterCopyHandshake(t *testing.T) {
 	if resp["isNew"] != false || resp["isMig"] != true {
 		t.Fatalf("dest register flags wrong: %v", resp)
 	}
-	if resp["checkpointDir"] != "/dmtcp/checkpoints" {
-		t.Fatalf("dest register must carry checkpointDir: %v", resp)
+	if resp["checkpointDir"] != "/dmtcp/checkpoints" || resp["maxTransferBytesPerSecond"] != float64(8<<20) {
+		t.Fatalf("dest register must carry checkpointDir and the bandwidth cap: %v", resp)
 	}
 	if resp["podAddress"] != "10.0.0.5:2486" {
 		t.Fatalf("dest register must return the previous (source) address: %v", resp)
@@ -148,14 +267,26 @@ func TestRegisterCopyHandshake(t *testing.T) {
 		t.Fatalf("remove must carry the migration target's destAddress: %v", resp)
 	}
 
+	// 7c. The source's sync daemon learns the same endpoint through /poll.
+	rr, resp = doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil)
+	if rr.Code != http.StatusOK || resp["destAddress"] != "10.0.1.7:2486" {
+		t.Fatalf("poll after dest register = %d %v, want destAddress", rr.Code, resp)
+	}
+
 	// 8. Destination EA signals restore completion.
-	rr, resp = doJSON(t, mux, http.MethodPost, "/restored", map[string]any{"podName": "web-0"})
+	rr, resp = doJSON(t, mux, http.MethodPost, "/restored", map[string]any{
+		"podName": "web-0", "transferMs": 1200, "restoreMs": 450, "peers": 2,
+	})
 	if rr.Code != http.StatusOK || resp["status"] != "restored" {
 		t.Fatalf("restored = %d %v", rr.Code, resp)
 	}
-	if rec, _ := s.Registry.Get("web-0"); !rec.Restored {
+	rec, _ := s.Registry.Get("web-0")
+	if !rec.Restored {
 		t.Fatalf("restored must mark the record")
 	}
+	if want := (registry.RestoreTiming{TransferMs: 1200, RestoreMs: 450, Peers: 2}); rec.RestoreTiming != want {
+		t.Fatalf("restore timing = %+v, want %+v", rec.RestoreTiming, want)
+	}
 }
 
 // TestRemoveDestAddressDefaults covers the destAddress port-defaulting rules
@@ -175,10 +306,14 @@ func TestRemoveDestAddressDefaults(t *testing.T) {
 	if _, ok := resp["destAddress"]; ok {
 		t.Fatalf("destAddress must be omitted when no migration is armed: %v", resp)
 	}
+	if _, ok := resp["compression"]; ok {
+		t.Fatalf("compression must be omitted when no migration is armed: %v", resp)
+	}
 
 	// Bare host + explicit containerPort → host:containerPort.
 	s.Registry.Register("web-1", "10.0.0.5:2486", 2486)
-	s.Registry.Arm("web-1", registry.ArmInfo{ProcessMigration: true})
+	s.Registry.Arm("web-1", registry.ArmInfo{ProcessMigration: true, TargetNode: destNode})
+	placePod(t, s, "web-1", destNode)
 	doJSON(t, mux, http.MethodPost, "/register", map[string]any{
 		"podName": "web-1", "podAddress": "10.0.1.8", "containerPort": 2400,
 	})
@@ -189,7 +324,8 @@ func TestRemoveDestAddressDefaults(t *testing.T) {
 
 	// Bare host without containerPort → default transfer port 2486.
 	s.Registry.Register("web-2", "10.0.0.6:2486", 2486)
-	s.Registry.Arm("web-2", registry.ArmInfo{ProcessMigration: true})
+	s.Registry.Arm("web-2", registry.ArmInfo{ProcessMigration: true, TargetNode: destNode})
+	placePod(t, s, "web-2", destNode)
 	doJSON(t, mux, http.MethodPost, "/register", map[string]any{
 		"podName": "web-2", "podAddress": "10.0.1.9",
 	})
@@ -199,6 +335,311 @@ func TestRemoveDestAddressDefaults(t *testing.T) {
 	}
 }
 
+// leafURI returns the URI SAN of the certificate in a response's tls
+// object.
+func leafURI(t *testing.T, resp map[string]any) string {
+	t.Helper()
+	bundle, ok := resp["tls"].(map[string]any)
+	if !ok {
+		t.Fatalf("response carries no tls bundle: %v", resp)
+	}
+	if bundle["caCert"] == "" || bundle["key"] == "" {
+		t.Fatalf("tls bundle incomplete: %v", bundle)
+	}
+	block, _ := pem.Decode([]byte(bundle["cert"].(string)))
+	if block == nil {
+		t.Fatalf("tls bundle has no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.URIs) != 1 {
+		t.Fatalf("certificate URIs = %v", cert.URIs)
+	}
+	return cert.URIs[0].String()
+}
+
+// TestTransferCertificates checks that an armed migration's source gets a
+// source certificate from /remove and from /poll with its agent key, and
+// its destination a destination certificate from /register, all naming the
+// migration. Nobody else gets a source certificate from /poll.
+func TestTransferCertificates(t *testing.T) {
+	s, mux := newTestServer()
+	authority, err := ca.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CA = authority
+
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	source, _ := s.Registry.Get("web-0")
+	resp := removeAs(t, mux, "web-0", source.AgentKey)
+	if _, ok := resp["tls"]; ok {
+		t.Fatalf("no certificate may be issued without an armed migration: %v", resp)
+	}
+
+	s.Registry.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1", TargetNode: destNode})
+	placePod(t, s, "web-0", destNode)
+	resp = pollAs(t, mux, "web-0", source.AgentKey)
+	if got, want := leafURI(t, resp), "spiffe://mycedrive.io/migration/uid-1/source"; got != want {
+		t.Fatalf("poll certificate URI = %s, want %s", got, want)
+	}
+	for _, key := range []string{"", "forged"} {
+		if resp = pollAs(t, mux, "web-0", key); resp["tls"] != nil {
+			t.Fatalf("poll with key %q = %v, want no certificate", key, resp)
+		}
+	}
+
+	_, resp = doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+		"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+	})
+	if got, want := leafURI(t, resp), "spiffe://mycedrive.io/migration/uid-1/destination"; got != want {
+		t.Fatalf("destination certificate URI = %s, want %s", got, want)
+	}
+	destKey, _ := resp["agentKey"].(string)
+	if destKey == "" || destKey == source.AgentKey {
+		t.Fatalf("destination agent key = %q, want a fresh one", destKey)
+	}
+	if resp = pollAs(t, mux, "web-0", destKey); resp["tls"] != nil {
+		t.Fatalf("the destination's poll = %v, want no source certificate", resp)
+	}
+	for _, key := range []string{"", "forged", destKey} {
+		if resp = removeAs(t, mux, "web-0", key); resp["tls"] != nil || resp["needsCheckpoint"] != true {
+			t.Fatalf("remove with key %q = %v, want needsCheckpoint and no certificate", key, resp)
+		}
+	}
+	resp = removeAs(t, mux, "web-0", source.AgentKey)
+	if got, want := leafURI(t, resp), "spiffe://mycedrive.io/migration/uid-1/source"; got != want {
+		t.Fatalf("source certificate URI = %s, want %s", got, want)
+	}
+
+	// Without the CA the transfer stays plaintext.
+	s.CA = nil
+	resp = removeAs(t, mux, "web-0", source.AgentKey)
+	if _, ok := resp["tls"]; ok {
+		t.Fatalf("no certificate may be issued with the CA disabled: %v", resp)
+	}
+}
+
+// TestTransferToken checks both ends of an armed migration get the same
+// token, /poll hands it to the source alone, and nobody gets one without an
+// armed migration.
+func TestTransferToken(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	_, resp := doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "web-0"})
+	if _, ok := resp["transferToken"]; ok {
+		t.Fatalf("no token may be handed out without an armed migration: %v", resp)
+	}
+
+	s.Registry.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1", TargetNode: destNode})
+	placePod(t, s, "web-0", destNode)
+	rec, _ := s.Registry.Get("web-0")
+	if resp = pollAs(t, mux, "web-0", rec.AgentKey); resp["transferToken"] != rec.TransferToken {
+		t.Fatalf("source poll token = %v, want the armed token", resp["transferToken"])
+	}
+	if _, resp = doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil); resp["transferToken"] != nil {
+		t.Fatalf("an unauthenticated poll = %v, want no token", resp)
+	}
+	_, resp = doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+		"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+	})
+	if resp["transferToken"] != rec.TransferToken || rec.TransferToken == "" {
+		t.Fatalf("destination token = %v, want the armed token", resp["transferToken"])
+	}
+	destKey, _ := resp["agentKey"].(string)
+	if pollAs(t, mux, "web-0", destKey)["transferToken"] != nil {
+		t.Fatal("the destination's poll must not carry the token")
+	}
+	// The sync daemon keeps shipping rounds once the destination is up.
+	if resp := pollAs(t, mux, "web-0", rec.AgentKey); resp["transferToken"] != rec.TransferToken {
+		t.Fatalf("source poll after the destination registered = %v, want the armed token", resp["transferToken"])
+	}
+	if resp["migrationID"] != "uid-1" {
+		t.Fatalf("destination migrationID = %v, want uid-1", resp["migrationID"])
+	}
+	_, resp = doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "web-0"})
+	if resp["needsCheckpoint"] != true || resp["transferToken"] != nil || resp["migrationID"] != nil {
+		t.Fatalf("an unauthenticated remove = %v, want needsCheckpoint and no token", resp)
+	}
+	resp = removeAs(t, mux, "web-0", rec.AgentKey)
+	if resp["transferToken"] != rec.TransferToken || resp["migrationID"] != "uid-1" {
+		t.Fatalf("source token = %v, migrationID = %v; want the armed migration's", resp["transferToken"], resp["migrationID"])
+	}
+
+	s.Registry.Disarm("web-0")
+	if after, _ := s.Registry.Get("web-0"); after.AgentKey != destKey {
+		t.Fatal("the destination's key must be the pod's once the migration ended")
+	}
+	_, resp = doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+		"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+	})
+	if _, ok := resp["transferToken"]; ok {
+		t.Fatalf("a disarmed pod must not get a token: %v", resp)
+	}
+}
+
+// TestDestinationRegistration checks only the pod on the target node gets
+// the destination's credentials from a registration while a migration is
+// armed, and the source restarting on its node is told nothing of it.
+func TestDestinationRegistration(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	s.Registry.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1", TargetNode: destNode})
+	register := func() (*httptest.ResponseRecorder, map[string]any) {
+		return doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+			"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+		})
+	}
+
+	if rr, resp := register(); rr.Code != http.StatusForbidden || resp["transferToken"] != nil {
+		t.Fatalf("register without the pod = %d %v, want 403", rr.Code, resp)
+	}
+	placePodAt(t, s, "web-0", destNode, "10.0.1.7")
+	if rr, resp := register(); rr.Code != http.StatusForbidden || resp["transferToken"] != nil {
+		t.Fatalf("register from another address than the pod's = %d %v, want 403", rr.Code, resp)
+	}
+
+	source, _ := s.Registry.Get("web-0")
+	placePod(t, s, "web-0", "node-a")
+	rr, resp := register()
+	if rr.Code != http.StatusOK || resp["isMig"] != false || resp["transferToken"] != nil {
+		t.Fatalf("the source restarting = %d %v, want a plain registration", rr.Code, resp)
+	}
+	if rec, _ := s.Registry.Get("web-0"); rec.DestRegistered || rec.DestAddress != "" || rec.AgentKey == source.AgentKey {
+		t.Fatalf("the source restarting must get a new key and leave the destination unknown: %+v", rec)
+	}
+
+	placePod(t, s, "web-0", destNode)
+	rr, resp = register()
+	if rec, _ := s.Registry.Get("web-0"); rr.Code != http.StatusOK || resp["isMig"] != true || resp["transferToken"] != rec.TransferToken || !rec.DestRegistered {
+		t.Fatalf("the destination's register = %d %v, want the armed migration's", rr.Code, resp)
+	}
+}
+
+// TestRelayAddress checks the source is pointed at the relay only while its
+// destination is unknown.
+func TestRelayAddress(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	s.Registry.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1", TargetNode: destNode})
+	placePod(t, s, "web-0", destNode)
+	_, resp := doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "web-0"})
+	if _, ok := resp["relayAddress"]; ok {
+		t.Fatalf("relayAddress must be omitted with the relay disabled: %v", resp)
+	}
+
+	s.Relay = &relay.Relay{Advertise: "mycedrive-operator.mig.svc:2487", Dir: t.TempDir(), Registry: s.Registry, Log: logr.Discard()}
+	_, resp = doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "web-0"})
+	if resp["relayAddress"] != "mycedrive-operator.mig.svc:2487" {
+		t.Fatalf("relayAddress = %v, want the relay's advertised address", resp["relayAddress"])
+	}
+
+	doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+		"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+	})
+	_, resp = doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "web-0"})
+	if _, ok := resp["relayAddress"]; ok || resp["destAddress"] != "10.0.1.7:2486" {
+		t.Fatalf("a known destination must be dialed directly: %v", resp)
+	}
+}
+
+// TestAbortHandshake checks a waiting destination learns its migration was
+// aborted from /poll and its report of what it did is recorded.
+func TestAbortHandshake(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	s.Registry.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-1", AbortPolicy: "Fresh", TargetNode: destNode})
+	placePod(t, s, "web-0", destNode)
+	_, resp := doJSON(t, mux, http.MethodPost, "/register", map[string]any{
+		"podName": "web-0", "podAddress": "10.0.1.7:2486", "containerPort": 2486,
+	})
+	if resp["abortPolicy"] != "Fresh" {
+		t.Fatalf("destination abortPolicy = %v, want Fresh", resp["abortPolicy"])
+	}
+	destKey, _ := resp["agentKey"].(string)
+	_, resp = doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil)
+	if _, ok := resp["abortedMigration"]; ok {
+		t.Fatalf("abortedMigration before any abort: %v", resp)
+	}
+	report := map[string]any{
+		"podName": "web-0", "migrationID": "uid-1", "reason": "phase Transferring timed out", "policy": "Fresh", "outcome": "the application started without migrated state",
+	}
+	if rr, _ := doJSON(t, mux, http.MethodPost, "/aborted", report); rr.Code != http.StatusForbidden {
+		t.Fatalf("aborted without the agent key = %d, want 403", rr.Code)
+	}
+	if rr, _ := doJSONAs(t, mux, http.MethodPost, "/aborted", "forged", report); rr.Code != http.StatusForbidden {
+		t.Fatalf("aborted with a wrong key = %d, want 403", rr.Code)
+	}
+	stale := map[string]any{"podName": "web-0", "migrationID": "uid-0", "reason": "old", "policy": "Fail", "outcome": "old"}
+	if rr, _ := doJSONAs(t, mux, http.MethodPost, "/aborted", destKey, stale); rr.Code != http.StatusConflict {
+		t.Fatalf("aborted for another migration = %d, want 409", rr.Code)
+	}
+	if rec, _ := s.Registry.Get("web-0"); !rec.AbortReport.ReportedAt.IsZero() {
+		t.Fatalf("a rejected report was recorded: %+v", rec.AbortReport)
+	}
+
+	s.Registry.Abort("web-0", "uid-1", "phase Transferring timed out")
+	s.Registry.Disarm("web-0")
+	_, resp = doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil)
+	if resp["abortedMigration"] != "uid-1" || resp["abortReason"] != "phase Transferring timed out" {
+		t.Fatalf("poll after the abort = %v", resp)
+	}
+
+	rr, resp := doJSONAs(t, mux, http.MethodPost, "/aborted", destKey, report)
+	if rr.Code != http.StatusOK || resp["status"] != "abort_recorded" {
+		t.Fatalf("aborted = %d %v", rr.Code, resp)
+	}
+	if rec, _ := s.Registry.Get("web-0"); rec.AbortReport.MigrationID != "uid-1" || rec.AbortReport.Policy != "Fresh" || rec.AbortReport.ReportedAt.IsZero() {
+		t.Fatalf("abort report = %+v", rec.AbortReport)
+	}
+	rr, _ = doJSON(t, mux, http.MethodPost, "/aborted", map[string]any{"podName": "ghost"})
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("aborted for an unknown pod = %d, want 404", rr.Code)
+	}
+}
+
+func TestAdaptiveSync(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.Register("web-0", "10.0.0.5:2486", 2486)
+	s.Registry.Arm("web-0", registry.ArmInfo{VolumeMigration: true, MigrationID: "uid-1", SyncRounds: 8, MinSyncRounds: 1, TargetDowntimeMs: 500})
+	_, resp := doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil)
+	if resp["targetDowntimeMs"] != float64(500) || resp["minSyncRounds"] != float64(1) || resp["syncRounds"] != float64(8) {
+		t.Fatalf("poll = %v, want the adaptive rounds", resp)
+	}
+
+	rr, resp := doJSON(t, mux, http.MethodPost, "/sync", map[string]any{
+		"podName": "web-0", "round": 1,
+		"stats":      map[string]any{"round": 1, "layerBytes": 4096, "fillMs": 2000, "sentBytes": 8192, "sendMs": 100, "projectedDowntimeMs": 250},
+		"stopReason": "Converged",
+	})
+	if rr.Code != http.StatusOK || resp["remaining"] != float64(0) {
+		t.Fatalf("sync = %d %v, want nothing remaining", rr.Code, resp)
+	}
+	rec, _ := s.Registry.Get("web-0")
+	if rec.SyncRound != 1 || rec.SyncStopReason != "Converged" || len(rec.SyncStats) != 1 || rec.SyncStats[0].ProjectedDowntimeMs != 250 || rec.SyncStats[0].SentBytes != 8192 {
+		t.Fatalf("recorded round = %+v", rec)
+	}
+	if _, resp = doJSON(t, mux, http.MethodGet, "/poll?podName=web-0", nil); resp["syncStopReason"] != "Converged" {
+		t.Fatalf("poll after stopping = %v", resp)
+	}
+}
+
+func TestRegisterMountMode(t *testing.T) {
+	s, mux := newTestServer()
+	s.Registry.SetMountMode("web", "FUSE")
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		rr, resp := doJSON(t, mux, http.MethodPost, "/register", map[string]any{"podName": "web-0", "podAddress": "10.0.0.5", "containerPort": 2486})
+		if rr.Code != want || resp["volumeMountMode"] != "FUSE" {
+			t.Fatalf("register = %d %v, want %d with the workload's mount mode", rr.Code, resp, want)
+		}
+	}
+	if _, resp := doJSON(t, mux, http.MethodPost, "/register", map[string]any{"podName": "db-0", "podAddress": "10.0.0.6", "containerPort": 2486}); resp["volumeMountMode"] != nil {
+		t.Fatalf("register of an unknown workload's pod = %v, want no mount mode", resp)
+	}
+}
+
 func TestRemoveUnknownPod(t *testing.T) {
 	_, mux := newTestServer()
 	rr, _ := doJSON(t, mux, http.MethodPost, "/remove", map[string]any{"podName": "ghost"})
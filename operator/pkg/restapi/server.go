@@ -16,8 +16,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/paulosouzajr/mycedrive-k8s/operator/dashboard"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/history"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/relay"
 )
 
 // Server is the operator's embedded Migration Coordinator REST API. It runs
@@ -31,6 +33,12 @@ type Server struct {
 	Log              logr.Logger
 	// History is the optional migration-metrics module; nil when not wired.
 	History *history.Store
+	// CA issues the agents' transfer certificates; nil leaves the
+	// agent-to-agent transfer in plaintext.
+	CA *ca.CA
+	// Relay buffers the transfer of a source whose destination has not
+	// registered yet; nil leaves such checkpoints on the source.
+	Relay *relay.Relay
 }
 
 // Handler returns the fully-routed HTTP handler. Exported so functional
@@ -88,7 +96,9 @@ func (s *Server) routes(mux *http.ServeMux) {
 
 	// Additive agent endpoints (fixed agent flow).
 	mux.HandleFunc("POST /sync", s.handleSync)
+	mux.HandleFunc("POST /progress", s.handleProgress)
 	mux.HandleFunc("POST /restored", s.handleRestored)
+	mux.HandleFunc("POST /aborted", s.handleAborted)
 	mux.HandleFunc("GET /poll", s.handlePoll)
 
 	// Dashboard / UI JSON.
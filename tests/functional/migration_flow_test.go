@@ -6,28 +6,61 @@ package functional
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
 	agent "go-agent/utils"
 
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/ca"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/registry"
+	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/relay"
 	"github.com/paulosouzajr/mycedrive-k8s/operator/pkg/restapi"
 )
 
+// destNode is the node the tests migrate to. Every agent in these tests
+// calls the API from loopback, so the destination pods are placed there at
+// 127.0.0.1, which is how the operator traces a registration to them.
+const destNode = "node-b"
+
+// destPods returns a fake Kubernetes client holding the named pods on
+// destNode at the loopback address.
+func destPods(t *testing.T, names ...string) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	b := fake.NewClientBuilder().WithScheme(scheme)
+	for _, name := range names {
+		b = b.WithObjects(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "mig-ready"},
+			Spec:       corev1.PodSpec{NodeName: destNode},
+			Status:     corev1.PodStatus{PodIP: "127.0.0.1"},
+		})
+	}
+	return b.Build()
+}
+
 // newAPI starts the operator REST API on a loopback HTTP server.
 func newAPI(t *testing.T) (*registry.Registry, string) {
 	t.Helper()
 	reg := registry.New()
-	srv := &restapi.Server{Registry: reg, DefaultNamespace: "mig-ready", Log: logr.Discard()}
+	srv := &restapi.Server{Client: destPods(t, "web-0", "db-0"), Registry: reg, DefaultNamespace: "mig-ready", Log: logr.Discard()}
 	api := httptest.NewServer(srv.Handler())
 	t.Cleanup(api.Close)
 	return reg, api.URL
@@ -85,6 +118,7 @@ func TestMigrationFlow_EndToEnd(t *testing.T) {
 		ProcessMigration: true,
 		VolumeMigration:  true,
 		SyncRounds:       1,
+		TargetNode:       destNode,
 	})
 
 	// 3. Source EA polls, sees the armed migration, reports its sync round.
@@ -115,9 +149,9 @@ func TestMigrationFlow_EndToEnd(t *testing.T) {
 	go func() {
 		frames, err := agent.ReceiveAll(ln, 10*time.Second, func(h agent.FrameHeader, payload io.Reader) error {
 			if h.Kind == agent.KindCheckpointFile {
-				return agent.ExtractTarGz(payload, destCkpt)
+				return agent.ExtractPayload(h, payload, destCkpt)
 			}
-			return agent.ExtractTarGz(payload, filepath.Join(destLayers, h.Name))
+			return agent.ExtractPayload(h, payload, filepath.Join(destLayers, h.Name))
 		})
 		recvCh <- recvResult{frames, err}
 	}()
@@ -146,7 +180,8 @@ func TestMigrationFlow_EndToEnd(t *testing.T) {
 		t.Fatalf("destAddress = %q, want %q", rm.DestAddress, ln.Addr().String())
 	}
 
-	// 6. Source streams two overlay layers and the DMTCP image, then DONE.
+	// 6. Source streams two overlay layers and the DMTCP image, then DONE,
+	// over one transfer session.
 	srcLayer := t.TempDir()
 	if err := os.WriteFile(filepath.Join(srcLayer, "mosquitto.db"), []byte("retained-messages"), 0o644); err != nil {
 		t.Fatal(err)
@@ -155,17 +190,26 @@ func TestMigrationFlow_EndToEnd(t *testing.T) {
 	if err := os.WriteFile(ckpt, []byte("dmtcp-image"), 0o600); err != nil {
 		t.Fatal(err)
 	}
+	// The session's progress is reported to the MC as it goes.
+	progress := agent.NewProgress()
+	sess, err := agent.DialSessionWith(rm.DestAddress, agent.DialOptions{Progress: progress})
+	if err != nil {
+		t.Fatalf("dial session: %v", err)
+	}
+	defer sess.Close()
+	stopProgress := agent.ReportProgress(strings.TrimPrefix(apiURL, "http://"), "web-0", progress)
 	for ord, name := range map[int]string{1: "u1", 2: "u2"} {
-		if err := agent.SendDir(rm.DestAddress, ord, name, srcLayer); err != nil {
+		if err := sess.SendDir(ord, name, srcLayer); err != nil {
 			t.Fatalf("SendDir %s: %v", name, err)
 		}
 	}
-	if err := agent.SendCheckpointFile(rm.DestAddress, ckpt); err != nil {
+	if err := sess.SendCheckpointFile(ckpt); err != nil {
 		t.Fatalf("SendCheckpointFile: %v", err)
 	}
-	if err := agent.SendDone(rm.DestAddress); err != nil {
-		t.Fatalf("SendDone: %v", err)
+	if err := sess.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
 	}
+	stopProgress()
 
 	res := <-recvCh
 	if res.err != nil {
@@ -190,12 +234,483 @@ func TestMigrationFlow_EndToEnd(t *testing.T) {
 	}); err != nil {
 		t.Fatalf("copy: %v", err)
 	}
-	postJSON(t, apiURL+"/restored", map[string]any{"podName": "web-0"})
+	if _, err := agent.PostJSON(apiURL+"/restored", agent.RestoredNotification{
+		PodName: "web-0", TransferMs: 40, RestoreMs: 15, Peers: 1,
+	}); err != nil {
+		t.Fatalf("restored: %v", err)
+	}
 
 	rec, ok := reg.Get("web-0")
 	if !ok || !rec.CheckpointReady || !rec.Restored {
 		t.Fatalf("final registry state: %+v (ok=%v)", rec, ok)
 	}
+	if rec.RestoreTiming.Peers != 1 || rec.RestoreTiming.RestoreMs != 15 {
+		t.Fatalf("restore timing did not reach the registry: %+v", rec.RestoreTiming)
+	}
+	if p := rec.Progress; len(p.Items) != 3 || p.BytesTotal != 2*17+11 || p.BytesDone != p.BytesTotal {
+		t.Fatalf("the final progress report did not reach the registry: %+v", p)
+	}
+	if rec.LayerCount != 2 {
+		t.Fatalf("LayerCount = %d, want 2", rec.LayerCount)
+	}
+}
+
+// TestMigrationFlow_MutualTLS checks that the certificates and transfer
+// tokens the operator hands out through /register and /remove are what the
+// agents' transfer accepts, and that another migration's source is refused.
+func TestMigrationFlow_MutualTLS(t *testing.T) {
+	authority, err := ca.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.New()
+	srv := &restapi.Server{Client: destPods(t, "web-0", "db-0"), Registry: reg, DefaultNamespace: "mig-ready", Log: logr.Discard(), CA: authority}
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	keys := map[string]string{}
+	for pod, addr := range map[string]string{"web-0": "10.0.0.5:2486", "db-0": "10.0.0.6:2486"} {
+		keys[pod], _ = postJSON(t, api.URL+"/register", map[string]any{"podName": pod, "podAddress": addr})["agentKey"].(string)
+	}
+	reg.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-web", TargetNode: destNode})
+	reg.Arm("db-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-db", TargetNode: destNode})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	body, err := agent.PostJSON(api.URL+"/register", map[string]any{"podName": "web-0", "podAddress": ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dest struct {
+		IsMig         bool             `json:"isMig"`
+		TLS           *agent.TLSBundle `json:"tls"`
+		TransferToken string           `json:"transferToken"`
+	}
+	if err := json.Unmarshal(body, &dest); err != nil || !dest.IsMig || dest.TLS == nil || dest.TransferToken == "" {
+		t.Fatalf("dest register must carry a certificate and a token: %s (%v)", body, err)
+	}
+	serverCfg, err := agent.ServerTLS(dest.TLS)
+	if err != nil {
+		t.Fatalf("ServerTLS: %v", err)
+	}
+	destDir := t.TempDir()
+	recvCh := make(chan error, 1)
+	go func() {
+		_, err := agent.ReceiveAllWith(ln, agent.ReceiveOptions{Timeout: 10 * time.Second, TLS: serverCfg, Token: dest.TransferToken}, func(h agent.FrameHeader, payload io.Reader) error {
+			return agent.ExtractPayload(h, payload, filepath.Join(destDir, h.Name))
+		})
+		recvCh <- err
+	}()
+
+	grant := func(pod string) agent.TransferGrant {
+		body, err := agent.PostJSONAuth(api.URL+"/remove", agent.RemoveRequest{PodName: pod}, keys[pod])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rm agent.RemoveResponse
+		if err := json.Unmarshal(body, &rm); err != nil || rm.TLS == nil || rm.TransferToken == "" {
+			t.Fatalf("remove must carry a certificate and a token: %s (%v)", body, err)
+		}
+		return rm.TransferGrant
+	}
+	web, db := grant("web-0"), grant("db-0")
+	if web.TransferToken != dest.TransferToken {
+		t.Fatalf("source and destination must share the migration's token")
+	}
+
+	// The other migration's source holds a valid certificate from the same
+	// CA, but not for this transfer.
+	strangerCfg, err := agent.ClientTLS(db.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.DialSessionWith(ln.Addr().String(), agent.DialOptions{TLS: strangerCfg, Token: db.TransferToken}); err == nil {
+		t.Fatalf("a source of another migration must be refused")
+	}
+
+	clientCfg, err := agent.ClientTLS(web.TLS)
+	if err != nil {
+		t.Fatalf("ClientTLS: %v", err)
+	}
+	// The right certificate is not enough without the token.
+	if _, err := agent.DialSessionWith(ln.Addr().String(), agent.DialOptions{TLS: clientCfg, Token: db.TransferToken}); err == nil {
+		t.Fatalf("a session signed with another migration's token must be refused")
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "mosquitto.db"), []byte("retained-messages"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := agent.DialSessionWith(ln.Addr().String(), agent.DialOptions{TLS: clientCfg, Token: web.TransferToken})
+	if err != nil {
+		t.Fatalf("dial session: %v", err)
+	}
+	defer sess.Close()
+	if err := sess.SendDir(1, "u1", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	if err := <-recvCh; err != nil {
+		t.Fatalf("ReceiveAllWith: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(destDir, "u1", "mosquitto.db")); err != nil || string(got) != "retained-messages" {
+		t.Fatalf("layer content: %q, %v", got, err)
+	}
+}
+
+// TestMigrationFlow_PreSyncWithCredentials runs a pre-downtime sync round
+// with the transfer CA and token enabled: the source's sync daemon keeps its
+// grant from /poll once the destination registered, streams a layer with
+// it, and the final transfer completes the set.
+func TestMigrationFlow_PreSyncWithCredentials(t *testing.T) {
+	authority, err := ca.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.New()
+	srv := &restapi.Server{Client: destPods(t, "web-0", "db-0"), Registry: reg, DefaultNamespace: "mig-ready", Log: logr.Discard(), CA: authority}
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	source := postJSON(t, api.URL+"/register", map[string]any{"podName": "web-0", "podAddress": "10.0.0.5:2486"})
+	sourceKey, _ := source["agentKey"].(string)
+	reg.Arm("web-0", registry.ArmInfo{VolumeMigration: true, SyncRounds: 2, MigrationID: "uid-web", TargetNode: destNode})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	body, err := agent.PostJSON(api.URL+"/register", map[string]any{"podName": "web-0", "podAddress": ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dest struct {
+		TLS           *agent.TLSBundle `json:"tls"`
+		TransferToken string           `json:"transferToken"`
+		AgentKey      string           `json:"agentKey"`
+	}
+	if err := json.Unmarshal(body, &dest); err != nil || dest.TLS == nil || dest.TransferToken == "" {
+		t.Fatalf("dest register must carry a certificate and a token: %s (%v)", body, err)
+	}
+	if dest.AgentKey == "" || dest.AgentKey == sourceKey {
+		t.Fatalf("destination agent key = %q, want one of its own", dest.AgentKey)
+	}
+	serverCfg, err := agent.ServerTLS(dest.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+	recvCh := make(chan error, 1)
+	go func() {
+		_, err := agent.ReceiveAllWith(ln, agent.ReceiveOptions{Timeout: 10 * time.Second, TLS: serverCfg, Token: dest.TransferToken}, func(h agent.FrameHeader, payload io.Reader) error {
+			return agent.ExtractPayload(h, payload, filepath.Join(destDir, h.Name))
+		})
+		recvCh <- err
+	}()
+
+	// send streams the layer u<n> the way the agent does, with grant.
+	send := func(grant agent.TransferGrant, n int, done bool) {
+		t.Helper()
+		cfg, err := agent.ClientTLS(grant.TLS)
+		if err != nil {
+			t.Fatalf("ClientTLS: %v", err)
+		}
+		src := t.TempDir()
+		if err := os.WriteFile(filepath.Join(src, "round"), []byte{byte('0' + n)}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := agent.DialSessionWith(ln.Addr().String(), agent.DialOptions{TLS: cfg, Token: grant.TransferToken})
+		if err != nil {
+			t.Fatalf("dial session: %v", err)
+		}
+		defer sess.Close()
+		if err := sess.SendDir(n, fmt.Sprintf("u%d", n), src); err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			err = sess.Done()
+		} else {
+			err = sess.Flush()
+		}
+		if err != nil {
+			t.Fatalf("layer %d: %v", n, err)
+		}
+	}
+
+	// Sync round 1, after the destination registered.
+	body, err = agent.GetJSONAuth(api.URL+"/poll?podName=web-0", sourceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var poll agent.PollResponse
+	if err := json.Unmarshal(body, &poll); err != nil || poll.DestAddress != ln.Addr().String() || poll.TLS == nil || poll.TransferToken != dest.TransferToken {
+		t.Fatalf("the source's poll must carry the destination and its grant: %s (%v)", body, err)
+	}
+	send(poll.TransferGrant, 1, false)
+	if sync := postJSON(t, api.URL+"/sync", map[string]any{"podName": "web-0", "round": 1}); sync["remaining"] != float64(1) {
+		t.Fatalf("sync: %v", sync)
+	}
+
+	// The final transfer, from the preStop hook.
+	body, err = agent.PostJSONAuth(api.URL+"/remove", agent.RemoveRequest{PodName: "web-0"}, sourceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rm agent.RemoveResponse
+	if err := json.Unmarshal(body, &rm); err != nil || rm.TransferToken != dest.TransferToken {
+		t.Fatalf("remove must carry the migration's grant: %s (%v)", body, err)
+	}
+	send(rm.TransferGrant, 2, true)
+	if err := <-recvCh; err != nil {
+		t.Fatalf("ReceiveAllWith: %v", err)
+	}
+	for n := 1; n <= 2; n++ {
+		if got, err := os.ReadFile(filepath.Join(destDir, fmt.Sprintf("u%d", n), "round")); err != nil || string(got) != fmt.Sprint(n) {
+			t.Fatalf("layer u%d: %q, %v", n, got, err)
+		}
+	}
+}
+
+// TestMigrationFlow_Relay checks a source whose destination has not
+// registered yet hands its transfer to the operator's relay, and that the
+// relay replays it to the destination once it registers, over mutual TLS
+// and signed with the migration's token on both legs.
+func TestMigrationFlow_Relay(t *testing.T) {
+	authority, err := ca.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.New()
+	relayLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayLn.Close()
+	rl := &relay.Relay{Advertise: relayLn.Addr().String(), Dir: t.TempDir(), Registry: reg, CA: authority, Log: logr.Discard()}
+	go rl.Serve(relayLn)
+	srv := &restapi.Server{Client: destPods(t, "web-0", "db-0"), Registry: reg, DefaultNamespace: "mig-ready", Log: logr.Discard(), CA: authority, Relay: rl}
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	key, _ := postJSON(t, api.URL+"/register", map[string]any{"podName": "web-0", "podAddress": "10.0.0.5:2486"})["agentKey"].(string)
+	reg.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-web", TargetNode: destNode})
+
+	// The old pod checkpoints before its replacement exists.
+	body, err := agent.PostJSONAuth(api.URL+"/remove", agent.RemoveRequest{PodName: "web-0"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rm agent.RemoveResponse
+	if err := json.Unmarshal(body, &rm); err != nil || rm.DestAddress != "" || rm.RelayAddress != rl.Advertise {
+		t.Fatalf("remove without a destination must name the relay: %s (%v)", body, err)
+	}
+	clientCfg, err := agent.ClientTLS(rm.TLS)
+	if err != nil {
+		t.Fatalf("ClientTLS: %v", err)
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "mosquitto.db"), []byte("retained-messages"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := agent.DialSessionWith(rm.RelayAddress, agent.DialOptions{TLS: clientCfg, Token: rm.TransferToken})
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	if err := sess.SendDir(1, "u1", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Done(); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	sess.Close()
+
+	// The replacement registers; the relay replays the buffered transfer.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	body, err = agent.PostJSON(api.URL+"/register", map[string]any{"podName": "web-0", "podAddress": ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dest struct {
+		IsMig         bool             `json:"isMig"`
+		TLS           *agent.TLSBundle `json:"tls"`
+		TransferToken string           `json:"transferToken"`
+	}
+	if err := json.Unmarshal(body, &dest); err != nil || !dest.IsMig || dest.TLS == nil {
+		t.Fatalf("dest register: %s (%v)", body, err)
+	}
+	serverCfg, err := agent.ServerTLS(dest.TLS)
+	if err != nil {
+		t.Fatalf("ServerTLS: %v", err)
+	}
+	destDir := t.TempDir()
+	if _, err := agent.ReceiveAllWith(ln, agent.ReceiveOptions{Timeout: 10 * time.Second, TLS: serverCfg, Token: dest.TransferToken}, func(h agent.FrameHeader, payload io.Reader) error {
+		return agent.ExtractPayload(h, payload, filepath.Join(destDir, h.Name))
+	}); err != nil {
+		t.Fatalf("ReceiveAllWith: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(destDir, "u1", "mosquitto.db")); err != nil || string(got) != "retained-messages" {
+		t.Fatalf("layer content: %q, %v", got, err)
+	}
+}
+
+// TestMigrationFlow_CheckpointStore checks a source that checkpoints before
+// its destination exists can leave the transfer in the checkpoint store
+// under the migration the MC names, and the destination finds it there.
+func TestMigrationFlow_CheckpointStore(t *testing.T) {
+	reg, apiURL := newAPI(t)
+	store := &agent.FSStore{Root: t.TempDir()}
+	key, _ := postJSON(t, apiURL+"/register", map[string]any{"podName": "web-0", "podAddress": "10.0.0.5:2486"})["agentKey"].(string)
+	reg.Arm("web-0", registry.ArmInfo{ProcessMigration: true, MigrationID: "uid-web", TargetNode: destNode})
+
+	body, err := agent.PostJSONAuth(apiURL+"/remove", agent.RemoveRequest{PodName: "web-0"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rm agent.RemoveResponse
+	if err := json.Unmarshal(body, &rm); err != nil || rm.DestAddress != "" || rm.MigrationID != "uid-web" {
+		t.Fatalf("remove must name the migration: %s (%v)", body, err)
+	}
+	src := t.TempDir()
+	ckpt := filepath.Join(src, "ckpt_mosquitto.dmtcp")
+	if err := os.WriteFile(ckpt, []byte("process image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	up, err := agent.OpenUpload(store, agent.MigrationSet("web-0", rm.MigrationID), agent.UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.SendCheckpointFile(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Done(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := postJSON(t, apiURL+"/register", map[string]any{"podName": "web-0", "podAddress": "10.0.1.7:2486"})
+	if dest["isMig"] != true || dest["migrationID"] != "uid-web" {
+		t.Fatalf("dest register must name the migration: %v", dest)
+	}
+	destDir := t.TempDir()
+	frames, err := agent.Download(store, agent.MigrationSet("web-0", dest["migrationID"].(string)), agent.DownloadOptions{}, func(h agent.FrameHeader, payload io.Reader) error {
+		return agent.ExtractPayload(h, payload, destDir)
+	})
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("Download = %v, %v", frames, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(destDir, "ckpt_mosquitto.dmtcp")); err != nil || string(got) != "process image" {
+		t.Fatalf("checkpoint content: %q, %v", got, err)
+	}
+}
+
+// TestMigrationFlow_SlowLinks runs the data plane over emulated links and
+// logs how long the transfer takes on each, with the bandwidth cap coming
+// from the workload through /register and /remove like in a cluster.
+func TestMigrationFlow_SlowLinks(t *testing.T) {
+	links := []struct {
+		name    string
+		emulate agent.WANEmulation
+		maxRate int64
+		atLeast time.Duration
+	}{
+		{name: "loopback"},
+		{name: "wan-40ms", emulate: agent.WANEmulation{Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond}, atLeast: 60 * time.Millisecond},
+		{name: "wan-40ms-capped", emulate: agent.WANEmulation{Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond}, maxRate: 4 << 20, atLeast: 350 * time.Millisecond},
+	}
+	image := make([]byte, 2<<20)
+	for i := range image {
+		image[i] = byte(i * 7 / 5)
+	}
+	for _, link := range links {
+		t.Run(link.name, func(t *testing.T) {
+			reg, apiURL := newAPI(t)
+			postJSON(t, apiURL+"/register", map[string]any{"podName": "web-0", "podAddress": "10.0.0.5:2486"})
+			reg.Arm("web-0", registry.ArmInfo{ProcessMigration: true, VolumeMigration: true, MaxBytesPerSec: link.maxRate, TargetNode: destNode})
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			body, err := agent.PostJSON(apiURL+"/register", map[string]any{"podName": "web-0", "podAddress": ln.Addr().String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dest struct {
+				MaxTransferBytesPerSecond int64 `json:"maxTransferBytesPerSecond"`
+			}
+			if err := json.Unmarshal(body, &dest); err != nil || dest.MaxTransferBytesPerSecond != link.maxRate {
+				t.Fatalf("dest register must carry the bandwidth cap: %s (%v)", body, err)
+			}
+			destDir := t.TempDir()
+			recvCh := make(chan error, 1)
+			go func() {
+				_, err := agent.ReceiveAllWith(ln, agent.ReceiveOptions{
+					Timeout: 10 * time.Second,
+					Limit:   agent.NewRateLimiter(dest.MaxTransferBytesPerSecond),
+					Emulate: link.emulate,
+				}, func(h agent.FrameHeader, payload io.Reader) error {
+					if h.Kind == agent.KindCheckpointFile {
+						return agent.ExtractPayload(h, payload, destDir)
+					}
+					return agent.ExtractPayload(h, payload, filepath.Join(destDir, h.Name))
+				})
+				recvCh <- err
+			}()
+
+			body, err = agent.PostJSON(apiURL+"/remove", agent.RemoveRequest{PodName: "web-0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rm agent.RemoveResponse
+			if err := json.Unmarshal(body, &rm); err != nil || rm.MaxTransferBytesPerSecond != link.maxRate {
+				t.Fatalf("remove must carry the bandwidth cap: %s (%v)", body, err)
+			}
+			src := t.TempDir()
+			os.WriteFile(filepath.Join(src, "mosquitto.db"), []byte("retained-messages"), 0o644)
+			ckpt := filepath.Join(t.TempDir(), "ckpt_web-0.dmtcp")
+			os.WriteFile(ckpt, image, 0o600)
+
+			start := time.Now()
+			sess, err := agent.DialSessionWith(rm.DestAddress, agent.DialOptions{
+				Limit:   agent.NewRateLimiter(rm.MaxTransferBytesPerSecond),
+				Emulate: link.emulate,
+			})
+			if err != nil {
+				t.Fatalf("dial session: %v", err)
+			}
+			defer sess.Close()
+			sess.SetCodec(agent.CodecNone)
+			if err := sess.SendDir(1, "u1", src); err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.SendCheckpointFile(ckpt); err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.Done(); err != nil {
+				t.Fatalf("Done: %v", err)
+			}
+			if err := <-recvCh; err != nil {
+				t.Fatalf("ReceiveAllWith: %v", err)
+			}
+			took := time.Since(start)
+			t.Logf("%s: layer and %d MiB image in %s", link.name, len(image)>>20, took.Round(time.Millisecond))
+			if took < link.atLeast {
+				t.Errorf("transfer took %s, faster than the link allows (%s)", took, link.atLeast)
+			}
+			if got, err := os.ReadFile(filepath.Join(destDir, "ckpt_web-0.dmtcp")); err != nil || len(got) != len(image) {
+				t.Fatalf("checkpoint: %d bytes, %v", len(got), err)
+			}
+		})
+	}
 }
 
 // TestMechanismToggles_Independent asserts each mechanism can be enabled on
@@ -217,6 +732,7 @@ func TestMechanismToggles_Independent(t *testing.T) {
 			reg.Arm("db-0", registry.ArmInfo{
 				ProcessMigration: tc.process,
 				VolumeMigration:  tc.volume,
+				TargetNode:       destNode,
 			})
 
 			poll := getJSON(t, apiURL+"/poll?podName=db-0")
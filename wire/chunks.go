@@ -0,0 +1,221 @@
+package wire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	ChunkHeaderSize = 12
+	// ChunkSize is how much payload a ChunkWriter puts in one chunk.
+	ChunkSize = 64 << 10
+	// MaxChunk bounds the chunks a receiver accepts.
+	MaxChunk   = 16 << 20
+	DigestSize = sha256.Size
+	MACSize    = sha256.Size
+)
+
+// ChunkWriter frames a payload as offset-tagged chunks, dropping the first
+// Skip bytes (already held by the receiver). Close writes the pending
+// chunk, the terminator with the total payload length and the digest
+// trailer over the whole payload, skipped bytes included. Err records the
+// first failure of W.
+type ChunkWriter struct {
+	W    io.Writer
+	Skip int64
+	// Digest is the hex SHA-256 of the payload, set by Close.
+	Digest string
+	Err    error
+
+	pos   int64 // payload bytes seen so far
+	start int64 // payload offset of buf[0]
+	buf   []byte
+	sum   hash.Hash
+}
+
+func (c *ChunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.sum == nil {
+		c.sum = sha256.New()
+	}
+	c.sum.Write(p)
+	if c.pos < c.Skip {
+		k := c.Skip - c.pos
+		if k >= int64(len(p)) {
+			c.pos += int64(len(p))
+			return n, nil
+		}
+		p = p[k:]
+		c.pos += k
+	}
+	for len(p) > 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, ChunkSize)
+		}
+		if len(c.buf) == 0 {
+			c.start = c.pos
+		}
+		k := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+k]
+		c.pos += int64(k)
+		p = p[k:]
+		if len(c.buf) == cap(c.buf) {
+			if err := c.Flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the buffered payload as a chunk.
+func (c *ChunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if err := c.writeChunk(uint32(len(c.buf)), c.start, c.buf); err != nil {
+		return err
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+func (c *ChunkWriter) writeChunk(n uint32, off int64, data []byte) error {
+	if err := WriteChunk(c.W, n, off, data); err != nil {
+		c.Err = err
+		return err
+	}
+	return nil
+}
+
+func (c *ChunkWriter) Close() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if c.sum == nil {
+		c.sum = sha256.New()
+	}
+	sum := c.sum.Sum(nil)
+	if err := c.writeChunk(0, c.pos, sum); err != nil {
+		return err
+	}
+	c.Digest = hex.EncodeToString(sum)
+	return nil
+}
+
+// WriteChunk writes a chunk header for n bytes at payload offset off,
+// followed by data. A zero n with data set to the digest writes the
+// terminator and the digest trailer.
+func WriteChunk(w io.Writer, n uint32, off int64, data []byte) error {
+	var hdr [ChunkHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], n)
+	binary.BigEndian.PutUint64(hdr[4:12], uint64(off))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadChunkHeader reads a chunk's length and payload offset. A zero length
+// marks the terminator, whose offset is the total payload length.
+func ReadChunkHeader(r io.Reader) (uint32, int64, error) {
+	var hdr [ChunkHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, fmt.Errorf("read chunk header: %w", err)
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n > MaxChunk {
+		return 0, 0, fmt.Errorf("chunk of %d bytes exceeds %d", n, MaxChunk)
+	}
+	return n, int64(binary.BigEndian.Uint64(hdr[4:12])), nil
+}
+
+// CopyChunks copies a frame's chunks from r to w up to and including the
+// terminator, for a receiver that already holds the first held bytes of
+// the payload: a sender resuming from an older offset resends some of
+// them, and those are dropped. It returns how many payload bytes the
+// receiver holds, also after a failure, which a later resume continues
+// from. The digest trailer is left to the caller.
+func CopyChunks(r io.Reader, w io.Writer, held int64) (int64, error) {
+	for {
+		n, off, err := ReadChunkHeader(r)
+		if err != nil {
+			return held, err
+		}
+		if n == 0 {
+			if off != held {
+				return held, fmt.Errorf("payload ends at %d but %d byte(s) were received", off, held)
+			}
+			return held, nil
+		}
+		if off > held {
+			return held, fmt.Errorf("chunk at offset %d leaves a gap after %d byte(s)", off, held)
+		}
+		if dup := held - off; dup > 0 {
+			if dup > int64(n) {
+				dup = int64(n)
+			}
+			if _, err := io.CopyN(io.Discard, r, dup); err != nil {
+				return held, err
+			}
+			n -= uint32(dup)
+		}
+		written, err := io.CopyN(w, r, int64(n))
+		held += written
+		if err != nil {
+			return held, err
+		}
+	}
+}
+
+// SkipChunks discards a frame's chunks up to and including its digest
+// trailer.
+func SkipChunks(r io.Reader) error {
+	for {
+		n, _, err := ReadChunkHeader(r)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			_, err := ReadDigest(r)
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return fmt.Errorf("skip chunk: %w", err)
+		}
+	}
+}
+
+// ReadDigest reads the digest trailer that follows a frame's terminator.
+func ReadDigest(r io.Reader) ([DigestSize]byte, error) {
+	var d [DigestSize]byte
+	if _, err := io.ReadFull(r, d[:]); err != nil {
+		return d, fmt.Errorf("read payload digest: %w", err)
+	}
+	return d, nil
+}
+
+// MAC returns the MAC of the frame with the encoded header in transfer id,
+// whose payload has the hex digest (empty for HELLO).
+func MAC(token, id string, header []byte, digest string) []byte {
+	m := hmac.New(sha256.New, []byte(token))
+	m.Write([]byte(id))
+	m.Write(header)
+	m.Write([]byte(digest))
+	return m.Sum(nil)
+}
+
+// ReadMAC reads the MAC trailer of a signed frame.
+func ReadMAC(r io.Reader) ([]byte, error) {
+	mac := make([]byte, MACSize)
+	if _, err := io.ReadFull(r, mac); err != nil {
+		return nil, fmt.Errorf("read frame MAC: %w", err)
+	}
+	return mac, nil
+}
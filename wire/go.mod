@@ -0,0 +1,3 @@
+module github.com/paulosouzajr/mycedrive-k8s/wire
+
+go 1.18
@@ -0,0 +1,84 @@
+package wire
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Transfer certificates name the migration and the holder's role in a URI
+// SAN,
+//
+//	spiffe://mycedrive.io/migration/<migration id>/<source|destination>
+//
+// and each end of a transfer accepts the other only if its certificate
+// chains to the transfer CA, names the same migration and the opposite
+// role.
+const (
+	RoleSource      = "source"
+	RoleDestination = "destination"
+
+	IdentityHost   = "mycedrive.io"
+	identityPrefix = "/migration/"
+)
+
+// Identity returns the URI SAN of role's certificate in migration.
+func Identity(migration, role string) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: IdentityHost, Path: identityPrefix + migration + "/" + role}
+}
+
+// ParseIdentity returns the migration and role u names, if it is an
+// identity URI.
+func ParseIdentity(u *url.URL) (migration, role string, ok bool) {
+	if u.Scheme != "spiffe" || u.Host != IdentityHost || !strings.HasPrefix(u.Path, identityPrefix) {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(u.Path, identityPrefix)
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+	migration, role = rest[:i], rest[i+1:]
+	if role != RoleSource && role != RoleDestination {
+		return "", "", false
+	}
+	return migration, role, true
+}
+
+// CertIdentity returns the migration and role named by cert's URI SAN.
+func CertIdentity(cert *x509.Certificate) (migration, role string, err error) {
+	for _, u := range cert.URIs {
+		if m, r, ok := ParseIdentity(u); ok {
+			return m, r, nil
+		}
+	}
+	return "", "", fmt.Errorf("%q carries no migration identity", cert.Subject.CommonName)
+}
+
+// VerifyPeer checks that the peer's certificate chain certs was issued by
+// roots for usage and names role in migration.
+func VerifyPeer(certs []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage, migration, role string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("the %s presented no certificate", role)
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: inter, KeyUsages: []x509.ExtKeyUsage{usage}}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("the %s's certificate is not valid for this transfer: %w", role, err)
+	}
+	gotMigration, gotRole, err := CertIdentity(certs[0])
+	if err != nil {
+		return fmt.Errorf("the %s's certificate: %w", role, err)
+	}
+	if gotMigration != migration {
+		return fmt.Errorf("the %s's certificate is for migration %s, not %s", role, gotMigration, migration)
+	}
+	if gotRole != role {
+		return fmt.Errorf("the peer's certificate is for the %s, expected the %s", gotRole, role)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package wire is the encoding of the transfer protocol spoken by the
+// Execution Agents (go-agent/utils) and the MC's transfer relay
+// (operator/pkg/relay). The agents' transfer.go describes the protocol;
+// this package owns its bytes, so both ends change together.
+//
+//	header     = [48 bytes][16-byte session extension, version 2 only]
+//	frame      = header [chunk]...[terminator][digest][MAC, signed only]
+//	chunk      = [4-byte length][8-byte payload offset][length bytes]
+//	terminator = [4-byte zero][8-byte total payload length]
+//	digest     = [32-byte SHA-256 of the whole payload]
+//	MAC        = HMAC-SHA256(token, transfer ID || header || hex digest)
+//	reply      = [1-byte code][4-byte seq][4-byte length][message]
+//
+// The HELLO frame that opens a session has no chunks and no digest; its ACK
+// carries the resume point, [4-byte last completed seq][8-byte payload
+// offset of the next frame], optionally followed by protocol extensions.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	Magic          = 0xDEADBEEF
+	Version        = 1
+	SessionVersion = 2
+	HeaderSize     = 48
+	SessionExtSize = 16
+	NameSize       = 32
+
+	// FlagSigned in the header flags marks a frame followed by a MAC.
+	FlagSigned = 1 << 0
+	// FlagChunked marks a frame whose payload is a chunk recipe, and a
+	// HELLO offering deduplication.
+	FlagChunked = 1 << 1
+)
+
+// Frame kinds.
+const (
+	KindLayer          = 0 // tar of an overlay layer directory
+	KindCheckpointFile = 1 // tar containing a single checkpoint file
+	KindDone           = 2 // end of transfer; the payload is the manifest
+	KindHello          = 3 // opens a version-2 session, Name is the transfer ID
+	KindChunkQuery     = 4 // asks which chunks of the next frame the receiver lacks
+	KindCheckpointPart = 5 // tar holding a part of a checkpoint file being written
+	KindStripedFile    = 6 // completes a checkpoint file sent in ranges over several connections
+	KindFileRange      = 7 // tar holding a range of a striped checkpoint file
+	KindAbort          = 8 // the transfer will not complete; the payload is why
+)
+
+// Reply codes.
+const (
+	Ack = 0x06
+	Nak = 0x15 // payload failed verification; resend it
+	Err = 0x18 // receiver error; the transfer is over
+
+	// MaxReplySize bounds a reply message; a chunk query's answer is a
+	// bitmap.
+	MaxReplySize = 1 << 20
+	// HelloReplySize is the length of the resume point in a HELLO ACK.
+	HelloReplySize = 12
+)
+
+// Header is a frame header. Version-1 headers carry only Kind, Ordinal and
+// Name.
+type Header struct {
+	Kind    uint32
+	Ordinal uint32
+	Name    string
+	Seq     uint32
+	Codec   uint32
+	Flags   uint32
+}
+
+// Encode returns the wire form of h for the given protocol version.
+func (h Header) Encode(version uint32) ([]byte, error) {
+	if len(h.Name) > NameSize {
+		return nil, fmt.Errorf("frame name %q longer than %d bytes", h.Name, NameSize)
+	}
+	size := HeaderSize
+	if version == SessionVersion {
+		size += SessionExtSize
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], Magic)
+	binary.BigEndian.PutUint32(buf[4:8], version)
+	binary.BigEndian.PutUint32(buf[8:12], h.Kind)
+	binary.BigEndian.PutUint32(buf[12:16], h.Ordinal)
+	copy(buf[16:16+NameSize], h.Name)
+	if version == SessionVersion {
+		binary.BigEndian.PutUint32(buf[48:52], h.Seq)
+		binary.BigEndian.PutUint32(buf[52:56], h.Codec)
+		binary.BigEndian.PutUint32(buf[56:60], h.Flags)
+	}
+	return buf, nil
+}
+
+// ReadHeader reads a version-1 or version-2 frame header from r and returns
+// it together with its version.
+func ReadHeader(r io.Reader) (Header, uint32, error) {
+	buf := make([]byte, HeaderSize+SessionExtSize)
+	if _, err := io.ReadFull(r, buf[:HeaderSize]); err != nil {
+		return Header{}, 0, fmt.Errorf("read frame header: %w", err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != Magic {
+		return Header{}, 0, fmt.Errorf("bad frame magic 0x%08X", magic)
+	}
+	version := binary.BigEndian.Uint32(buf[4:8])
+	if version != Version && version != SessionVersion {
+		return Header{}, 0, fmt.Errorf("unsupported frame version %d", version)
+	}
+	h := Header{
+		Kind:    binary.BigEndian.Uint32(buf[8:12]),
+		Ordinal: binary.BigEndian.Uint32(buf[12:16]),
+		Name:    strings.TrimRight(string(buf[16:16+NameSize]), "\x00"),
+	}
+	if version == SessionVersion {
+		if _, err := io.ReadFull(r, buf[HeaderSize:]); err != nil {
+			return Header{}, 0, fmt.Errorf("read session header: %w", err)
+		}
+		h.Seq = binary.BigEndian.Uint32(buf[48:52])
+		h.Codec = binary.BigEndian.Uint32(buf[52:56])
+		h.Flags = binary.BigEndian.Uint32(buf[56:60])
+	}
+	return h, version, nil
+}
+
+// WriteReply writes one reply record and flushes it.
+func WriteReply(bw *bufio.Writer, code byte, seq uint32, msg string) error {
+	if len(msg) > MaxReplySize {
+		msg = msg[:MaxReplySize]
+	}
+	var rec [9]byte
+	rec[0] = code
+	binary.BigEndian.PutUint32(rec[1:5], seq)
+	binary.BigEndian.PutUint32(rec[5:9], uint32(len(msg)))
+	bw.Write(rec[:])
+	bw.WriteString(msg)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write reply for frame %d: %w", seq, err)
+	}
+	return nil
+}
+
+// ReadReply reads one reply record.
+func ReadReply(r io.Reader) (code byte, seq uint32, msg string, err error) {
+	var rec [9]byte
+	if _, err := io.ReadFull(r, rec[:]); err != nil {
+		return 0, 0, "", err
+	}
+	n := binary.BigEndian.Uint32(rec[5:9])
+	if n > MaxReplySize {
+		return 0, 0, "", fmt.Errorf("reply message of %d bytes exceeds %d", n, MaxReplySize)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, "", err
+	}
+	return rec[0], binary.BigEndian.Uint32(rec[1:5]), string(body), nil
+}
+
+// ResumePoint returns the message of a HELLO ACK: the last frame the
+// receiver completed and how many payload bytes of the next one it holds.
+func ResumePoint(lastSeq uint32, offset int64) []byte {
+	msg := make([]byte, HelloReplySize)
+	binary.BigEndian.PutUint32(msg[0:4], lastSeq)
+	binary.BigEndian.PutUint64(msg[4:12], uint64(offset))
+	return msg
+}
+
+// ParseResumePoint reads the resume point at the start of a HELLO ACK's
+// message.
+func ParseResumePoint(msg string) (lastSeq uint32, offset int64, err error) {
+	if len(msg) < HelloReplySize {
+		return 0, 0, errors.New("HELLO reply carries no resume point")
+	}
+	return binary.BigEndian.Uint32([]byte(msg[0:4])), int64(binary.BigEndian.Uint64([]byte(msg[4:12]))), nil
+}
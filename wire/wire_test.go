@@ -0,0 +1,77 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHeader_RoundTrip(t *testing.T) {
+	for _, version := range []uint32{Version, SessionVersion} {
+		h := Header{Kind: KindLayer, Ordinal: 12, Name: "u12"}
+		if version == SessionVersion {
+			h.Seq, h.Codec, h.Flags = 7, 3, FlagSigned|FlagChunked
+		}
+		buf, err := h.Encode(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, v, err := ReadHeader(bytes.NewReader(buf))
+		if err != nil || v != version || got != h {
+			t.Errorf("version %d: ReadHeader = %+v, %d, %v; want %+v", version, got, v, err, h)
+		}
+	}
+	if _, err := (Header{Name: strings.Repeat("x", NameSize+1)}).Encode(SessionVersion); err == nil {
+		t.Error("a name longer than the header field must be refused")
+	}
+	bad := make([]byte, HeaderSize)
+	if _, _, err := ReadHeader(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "bad frame magic") {
+		t.Errorf("ReadHeader of zeros = %v", err)
+	}
+}
+
+func TestCopyChunks_DropsOverlapAndRefusesGaps(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	var stream bytes.Buffer
+	cw := &ChunkWriter{W: &stream, Skip: 30000}
+	cw.Write(payload)
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The receiver holds more than the sender skipped.
+	var got bytes.Buffer
+	got.Write(payload[:40000])
+	r := bytes.NewReader(stream.Bytes())
+	n, err := CopyChunks(r, &got, 40000)
+	if err != nil || n != int64(len(payload)) || !bytes.Equal(got.Bytes(), payload) {
+		t.Fatalf("CopyChunks = %d, %v (%d bytes)", n, err, got.Len())
+	}
+	if _, err := ReadDigest(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// ... or less.
+	if n, err := CopyChunks(bytes.NewReader(stream.Bytes()), &got, 20000); err == nil || n != 20000 {
+		t.Errorf("CopyChunks past a gap = %d, %v", n, err)
+	}
+}
+
+func TestReply_ResumePoint(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := WriteReply(bw, Ack, 0, string(ResumePoint(4, 1<<40))); err != nil {
+		t.Fatal(err)
+	}
+	code, seq, msg, err := ReadReply(&buf)
+	if err != nil || code != Ack || seq != 0 {
+		t.Fatalf("ReadReply = 0x%02X %d, %v", code, seq, err)
+	}
+	if last, off, err := ParseResumePoint(msg); err != nil || last != 4 || off != 1<<40 {
+		t.Errorf("ParseResumePoint = %d, %d, %v", last, off, err)
+	}
+	if _, _, err := ParseResumePoint("short"); err == nil {
+		t.Error("a truncated resume point must be refused")
+	}
+}